@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/artyom/image-resize/resize"
+)
+
+// explodeAnimation resizes every frame of animated gif or png read from r
+// and saves them as separate numbered files inside par.Explode directory.
+// Format of files is taken from par.Format or par.Output extension, png is
+// used if neither is set.
+func explodeAnimation(r io.Reader, par params, opts resize.Options) error {
+	suffix := ".png"
+	switch {
+	case par.Format != "" && par.Format != "auto":
+		suffix = "." + opts.Format
+	case par.Output != "":
+		suffix = strings.ToLower(filepath.Ext(par.Output))
+	}
+	opts.Format = formatName(suffix)
+	if err := os.MkdirAll(par.Explode, 0777); err != nil {
+		return err
+	}
+	var n int
+	return resize.Frames(r, opts, func(img image.Image, _ time.Duration) error {
+		n++
+		buf := new(bytes.Buffer)
+		if err := resize.Encode(buf, img, opts); err != nil {
+			return err
+		}
+		name := filepath.Join(par.Explode, fmt.Sprintf("%04d%s", n, suffix))
+		if err := writeFile(name, buf.Bytes(), par.NoClobber); err != nil {
+			if err == errExists {
+				return nil
+			}
+			return err
+		}
+		if par.Verify {
+			return verifyOutput(name, &resize.Result{
+				Format: opts.Format,
+				Width:  img.Bounds().Dx(),
+				Height: img.Bounds().Dy(),
+			})
+		}
+		return nil
+	})
+}
+
+// saveFrames processes every page of tiff or frame of animated gif or png
+// read from r as separate image, saving them to files named after
+// par.Output with frame number appended, like name-0001.png
+func saveFrames(ctx context.Context, r io.Reader, par params, opts resize.Options) error {
+	if par.FrameSet != "all" {
+		return fmt.Errorf("unsupported frames value %q, only all is supported", par.FrameSet)
+	}
+	if par.Output == "" || par.Output == stdio || par.Frame != 0 {
+		return errors.New("frames requires output file and cannot be used with frame")
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, resize.MaxFileSize))
+	if err != nil {
+		return err
+	}
+	n, err := resize.FrameCount(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	ext := filepath.Ext(par.Output)
+	base := strings.TrimSuffix(par.Output, ext)
+	for i := 0; i < n; i++ {
+		opts.Frame, opts.FirstFrame = i, i == 0
+		buf := new(bytes.Buffer)
+		res, err := resize.ProcessContext(ctx, bytes.NewReader(data), buf, opts)
+		if err != nil {
+			return fmt.Errorf("frame %d: %w", i+1, err)
+		}
+		p := par
+		p.Output = fmt.Sprintf("%s-%04d%s", base, i+1, ext)
+		if err := saveOutput(p, buf.Bytes(), res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assembleAnimation reads still images matching par.Sequence glob pattern
+// (sorted by name) and images listed in par.frames, resizes them and saves
+// them as frames of animated gif or png to par.Output. Frames are resized to
+// the dimensions derived from the first one.
+func assembleAnimation(par params, opts resize.Options) error {
+	var names []string
+	if par.Sequence != "" {
+		var err error
+		if names, err = filepath.Glob(par.Sequence); err != nil {
+			return err
+		}
+		sort.Strings(names)
+	}
+	names = append(names, par.frames...)
+	if len(names) == 0 {
+		return errors.New("no frames to assemble")
+	}
+	if par.Delay < 0 {
+		return errors.New("delay cannot be negative")
+	}
+	if opts.Format == "auto" {
+		opts.Format = "gif"
+	}
+	if opts.Format != "gif" && opts.Format != "png" {
+		return errors.New("animation can only be saved as gif or png")
+	}
+	opts.Loop = &par.Loop
+	var width, height int
+	frames := make([]image.Image, 0, len(names))
+	delays := make([]time.Duration, 0, len(names))
+	for i, name := range names {
+		img, err := decodeFile(name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if i == 0 {
+			b := img.Bounds()
+			if width, height, err = opts.Dimensions(b.Dx(), b.Dy()); err != nil {
+				return err
+			}
+			if len(names)*width*height > resize.PixelLimit {
+				return errors.New("animation size exceeds limit")
+			}
+		}
+		if b := img.Bounds(); b.Dx() != width || b.Dy() != height {
+			if img, err = resize.ScaleFilter(img, width, height, opts.Filter); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		img = opts.Composite(img)
+		frames = append(frames, img)
+		delays = append(delays, par.Delay)
+	}
+	buf := new(bytes.Buffer)
+	if err := resize.EncodeAnimation(buf, frames, delays, opts); err != nil {
+		return err
+	}
+	res := &resize.Result{Format: opts.Format, Width: width, Height: height}
+	if opts.Format == "gif" {
+		res.Frames = len(frames)
+	}
+	if opts.Hash {
+		res.Hash = resize.DHash(frames[0])
+	}
+	res.Placeholder = resize.Placeholder(frames[0], opts.Placeholder)
+	return saveOutput(par, buf.Bytes(), res)
+}
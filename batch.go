@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// processDir processes every supported image found in par.Indir tree with
+// par.Workers concurrent workers, saving results to par.Outdir under the
+// same relative paths. Errors are reported per file and don't stop
+// processing of other files. Files are listed before processing starts, so
+// that progress can be reported. With par.Dedupe, byte-identical inputs are
+// processed once, see dedupeInputs.
+func processDir(par params, c *resultCache, st *runStats) error {
+	if par.Outdir == "" {
+		return errors.New("both input and output directories should be set")
+	}
+	switch par.Dedupe {
+	case "", "inputs", "outputs":
+	default:
+		return fmt.Errorf("unsupported dedupe value %q, should be inputs or outputs", par.Dedupe)
+	}
+	if par.Input != "" || par.Output != "" || len(par.Outputs) > 0 {
+		return errors.New("input and output files cannot be used with directories")
+	}
+	workers := par.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var rels []string
+	walkErr := filepath.Walk(par.Indir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && filepath.Clean(path) == filepath.Clean(par.Outdir) && par.Outdir != par.Indir {
+			return filepath.SkipDir // outdir is nested in indir
+		}
+		if !info.Mode().IsRegular() || !isImageFile(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(par.Indir, path)
+		if err != nil {
+			return err
+		}
+		rels = append(rels, rel)
+		return nil
+	})
+	var dups map[string][]string
+	var ndups int
+	if par.Dedupe != "" {
+		rels, dups = dedupeInputs(par.Indir, rels)
+		for _, d := range dups {
+			ndups += len(d)
+		}
+	}
+	outputs := make(map[string]string) // first output path by content hash
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var total, failed int
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range jobs {
+				var saved []string
+				p := par
+				p.saved = &saved
+				err := processDirFile(p, rel, c, st)
+				output := filepath.Join(par.Outdir, rel)
+				if len(saved) == 1 { // name differs with -to auto
+					output = saved[0]
+				}
+				if err == nil && par.Dedupe == "outputs" {
+					linkOutput(output, outputs, &mu, st)
+				}
+				errs := map[string]error{rel: err}
+				for _, dup := range dups[rel] {
+					if err != nil {
+						errs[dup] = processDirFile(par, dup, c, st)
+					} else {
+						errs[dup] = copyDuplicate(par, output, dup, c, st)
+					}
+				}
+				mu.Lock()
+				for rel, err := range errs {
+					total++
+					if err != nil {
+						failed++
+						printError(filepath.Join(par.Indir, rel), err, par.JSONErrors)
+					}
+					if par.Progress {
+						printProgress(total, len(rels)+ndups)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, rel := range rels {
+		jobs <- rel
+	}
+	close(jobs)
+	wg.Wait()
+	if par.Dedupe != "" && !par.Quiet {
+		fmt.Fprintf(os.Stderr, "dedupe: %d duplicate inputs, %d linked outputs, %d bytes saved\n",
+			st.Duplicates, st.LinkedOutputs, st.SavedBytes)
+	}
+	if walkErr != nil {
+		return walkErr
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, total)
+	}
+	return nil
+}
+
+// processDirFile processes file with rel path relative to par.Indir
+func processDirFile(par params, rel string, c *resultCache, st *runStats) error {
+	par.Input = filepath.Join(par.Indir, rel)
+	par.Output = filepath.Join(par.Outdir, rel)
+	if err := os.MkdirAll(filepath.Dir(par.Output), 0777); err != nil {
+		st.record(par, false, err)
+		return err
+	}
+	return processFile(par, c, st)
+}
+
+// dedupeInputs groups files with rel paths relative to indir by their
+// content, returning list of the first files of every group, in original
+// order, and map of other files of the group by the first one. Files that
+// cannot be read are kept in the list.
+func dedupeInputs(indir string, rels []string) ([]string, map[string][]string) {
+	first := make(map[string]string) // by content hash
+	dups := make(map[string][]string)
+	var uniq []string
+	for _, rel := range rels {
+		h, err := fileHash(filepath.Join(indir, rel))
+		if err != nil {
+			uniq = append(uniq, rel)
+			continue
+		}
+		if f, ok := first[h]; ok {
+			dups[f] = append(dups[f], rel)
+			continue
+		}
+		first[h] = rel
+		uniq = append(uniq, rel)
+	}
+	return uniq, dups
+}
+
+// copyDuplicate saves output of file with rel path dup as hard link (or
+// copy) of src, the output already made for identical file. If src is not
+// found or is of different format than dup output would be, dup is
+// processed as usual.
+func copyDuplicate(par params, src, dup string, c *resultCache, st *runStats) error {
+	dst := filepath.Join(par.Outdir, dup)
+	if par.Format == "auto" { // identical input gets the same format
+		dst = strings.TrimSuffix(dst, filepath.Ext(dst)) + filepath.Ext(src)
+	}
+	if fi, err := os.Stat(src); err != nil || !fi.Mode().IsRegular() ||
+		suffixFormat(strings.ToLower(filepath.Ext(src))) != suffixFormat(strings.ToLower(filepath.Ext(dst))) {
+		return processDirFile(par, dup, c, st)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+	par.Input, par.Output = filepath.Join(par.Indir, dup), dst
+	if err := linkFile(src, dst); err != nil {
+		st.record(par, false, err)
+		return err
+	}
+	st.record(par, true, nil)
+	st.recordDuplicate(linkedSize(src, dst))
+	return nil
+}
+
+// linkOutput replaces output file with hard link to identical file recorded
+// in outputs map guarded by mu, or records it there if there's none
+func linkOutput(output string, outputs map[string]string, mu *sync.Mutex, st *runStats) {
+	h, err := fileHash(output)
+	if err != nil {
+		return
+	}
+	mu.Lock()
+	first, ok := outputs[h]
+	if !ok {
+		outputs[h] = output
+	}
+	mu.Unlock()
+	if !ok || first == output {
+		return
+	}
+	if err := linkFile(first, output); err == nil {
+		st.recordLinked(linkedSize(first, output))
+	}
+}
+
+// linkedSize returns size of file src if dst is hard link to it, 0
+// otherwise
+func linkedSize(src, dst string) int64 {
+	s, err1 := os.Stat(src)
+	d, err2 := os.Stat(dst)
+	if err1 != nil || err2 != nil || !os.SameFile(s, d) {
+		return 0
+	}
+	return s.Size()
+}
+
+// printProgress prints number and percentage of processed files to stderr
+func printProgress(done, total int) {
+	fmt.Fprintf(os.Stderr, "progress: %d/%d (%d%%)\n", done, total, done*100/total)
+}
+
+// isImageFile reports whether file name has extension of supported image
+// format
+func isImageFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".tiff", ".tif", ".bmp", ".webp", ".avif", ".heic", ".heif", ".svg":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// resultCache maps hashes of input file content and transform parameters to
+// hashes of produced outputs, so that repeated runs can skip files that were
+// already processed with identical settings
+type resultCache struct {
+	name string
+
+	mu      sync.Mutex
+	entries map[string]string
+	dirty   bool
+	journal *os.File // entries are appended to it as they're stored
+}
+
+// journalEntry is a single line of resume journal
+type journalEntry struct {
+	Key    string `json:"key"`
+	Output string `json:"output"`
+}
+
+// openCache loads cache from named file, missing file is treated as an
+// empty cache
+func openCache(name string) (*resultCache, error) {
+	c := &resultCache{name: name, entries: make(map[string]string)}
+	b, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.entries); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// openJournal loads cache from named journal file, creating it if needed.
+// Unlike cache loaded with openCache, entries are appended to the journal
+// as they are stored, so that interrupted run can be resumed. Incomplete
+// last line left by an interrupted write is discarded.
+func openJournal(name string) (*resultCache, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	c := &resultCache{name: name, entries: make(map[string]string), journal: f}
+	var size int64
+	rd := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		var e journalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s:%d: %w", name, n, err)
+		}
+		c.entries[e.Key] = e.Output
+		size += int64(len(line))
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// key returns cache key for given params, reading input file, overlay and
+// watermark images and sequence frames to hash their content. Parameters
+// not affecting output, like number of workers or reporting settings, are
+// not part of the key, so that run can be resumed with them changed.
+func (c *resultCache) key(par params) (string, error) {
+	inputHash, err := fileHash(par.Input)
+	if err != nil {
+		return "", err
+	}
+	par.Input, par.Cache, par.Resume = "", "", ""
+	par.Workers, par.Progress, par.Stats, par.Report = 0, false, false, ""
+	par.Verbose, par.Quiet, par.JSONErrors = false, false, false
+	b, err := json.Marshal(par)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	io.WriteString(h, inputHash)
+	h.Write(b)
+	// unexported fields are skipped by json
+	fmt.Fprintf(h, "\nloopSet=%v frames=%q\n", par.loopSet, par.frames)
+	for _, name := range append([]string{par.Overlay, par.Watermark}, par.frames...) {
+		if name == "" {
+			continue
+		}
+		sum, err := fileHash(name)
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fresh reports whether output file exists and matches one recorded for the
+// key
+func (c *resultCache) fresh(key, output string) bool {
+	c.mu.Lock()
+	want, ok := c.entries[key]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	got, err := fileHash(output)
+	return err == nil && got == want
+}
+
+// store records hash of output file under the key
+func (c *resultCache) store(key, output string) error {
+	h, err := fileHash(output)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = h
+	if c.journal != nil {
+		b, err := json.Marshal(journalEntry{Key: key, Output: h})
+		if err != nil {
+			return err
+		}
+		_, err = c.journal.Write(append(b, '\n'))
+		return err
+	}
+	c.dirty = true
+	return nil
+}
+
+// save writes cache to its file if it was modified, or closes its journal
+func (c *resultCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.journal != nil {
+		return c.journal.Close()
+	}
+	if !c.dirty {
+		return nil
+	}
+	b, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	tf, err := ioutil.TempFile(filepath.Dir(c.name), ".image-resize-cache-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+	defer tf.Close()
+	if _, err := tf.Write(b); err != nil {
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tf.Name(), c.name); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+func fileHash(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
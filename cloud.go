@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements reading and writing of s3://bucket/key and
+// gs://bucket/object urls over S3 and Google Cloud Storage REST APIs.
+// Credentials are discovered the same way official SDKs do it:
+//
+// S3: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// environment variables, shared credentials file (AWS_PROFILE profile),
+// container credentials endpoint (ECS), EC2 instance metadata. Region is
+// taken from AWS_REGION or AWS_DEFAULT_REGION, AWS_ENDPOINT_URL sets
+// custom endpoint used with path-style requests.
+//
+// GCS: GOOGLE_APPLICATION_CREDENTIALS file, gcloud application default
+// credentials, GCE metadata server. STORAGE_EMULATOR_HOST makes requests
+// go to emulator without authentication.
+
+var cloudClient = &http.Client{Timeout: 5 * time.Minute}
+
+// isRemote reports whether name is s3:// or gs:// url
+func isRemote(name string) bool {
+	return strings.HasPrefix(name, "s3://") || strings.HasPrefix(name, "gs://")
+}
+
+// openRemote opens remote object for reading
+func openRemote(ctx context.Context, name string) (io.ReadCloser, error) {
+	req, err := remoteRequest(ctx, http.MethodGet, name, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, remoteError(name, resp)
+	}
+	return resp.Body, nil
+}
+
+// writeRemote uploads data to remote object with given content type
+func writeRemote(ctx context.Context, name string, data []byte, contentType string) error {
+	req, err := remoteRequest(ctx, http.MethodPut, name, data, contentType)
+	if err != nil {
+		return err
+	}
+	resp, err := cloudClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return remoteError(name, resp)
+	}
+	return nil
+}
+
+func remoteError(name string, resp *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if msg := strings.TrimSpace(string(b)); msg != "" {
+		return fmt.Errorf("%s: %s: %s", name, resp.Status, msg)
+	}
+	return fmt.Errorf("%s: %s", name, resp.Status)
+}
+
+// remoteRequest returns authenticated request to read (GET) or write (PUT)
+// remote object
+func remoteRequest(ctx context.Context, method, name string, data []byte, contentType string) (*http.Request, error) {
+	i := strings.Index(name, "://")
+	bucket, key := name[i+3:], ""
+	if j := strings.IndexByte(bucket, '/'); j >= 0 {
+		bucket, key = bucket[:j], bucket[j+1:]
+	}
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid url %q, should be like %s://bucket/key", name, name[:i])
+	}
+	if name[:i] == "s3" {
+		return s3Request(ctx, method, bucket, key, data, contentType)
+	}
+	return gcsRequest(ctx, method, bucket, key, data, contentType)
+}
+
+func s3Request(ctx context.Context, method, bucket, key string, data []byte, contentType string) (*http.Request, error) {
+	creds, err := awsCreds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	var u string
+	switch endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); {
+	case endpoint != "":
+		u = strings.TrimSuffix(endpoint, "/") + "/" + bucket + "/" + awsEscape(key)
+	case strings.Contains(bucket, "."): // virtual-hosted style breaks TLS
+		u = "https://s3." + region + ".amazonaws.com/" + bucket + "/" + awsEscape(key)
+	default:
+		u = "https://" + bucket + ".s3." + region + ".amazonaws.com/" + awsEscape(key)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	sum := sha256.Sum256(data)
+	creds.sign(req, hex.EncodeToString(sum[:]), region, time.Now())
+	return req, nil
+}
+
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+
+	Expiration time.Time // of temporary credentials, zero for static ones
+}
+
+// sign adds AWS signature version 4 to request for S3 service
+func (c *awsCredentials) sign(req *http.Request, payloadHash, region string, t time.Time) {
+	t = t.UTC()
+	date, stamp := t.Format("20060102"), t.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.Token)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k := strings.ToLower(k); k == "content-type" || k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonReq := strings.Join([]string{req.Method, path, req.URL.Query().Encode(),
+		canonHeaders.String(), signed, payloadHash}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	reqHash := sha256.Sum256([]byte(canonReq))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+	key := []byte("AWS4" + c.SecretAccessKey)
+	for _, s := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// awsEscape escapes object key for S3 url path, keeping slashes
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+var awsCache struct {
+	sync.Mutex
+	creds   *awsCredentials
+	expires time.Time // zero if creds don't expire
+}
+
+// awsCreds discovers AWS credentials, caching static ones for the process
+// lifetime and temporary ones of container or instance role until they
+// expire
+func awsCreds(ctx context.Context) (*awsCredentials, error) {
+	awsCache.Lock()
+	defer awsCache.Unlock()
+	if awsCache.creds != nil && (awsCache.expires.IsZero() || time.Now().Before(awsCache.expires)) {
+		return awsCache.creds, nil
+	}
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		awsCache.creds = &awsCredentials{AccessKeyID: id, SecretAccessKey: secret, Token: os.Getenv("AWS_SESSION_TOKEN")}
+		return awsCache.creds, nil
+	}
+	c, err := awsFileCreds()
+	if c == nil && err == nil {
+		c, err = awsContainerCreds(ctx)
+	}
+	if c == nil && err == nil {
+		c, err = awsInstanceCreds(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errors.New("no AWS credentials found")
+	}
+	awsCache.creds, awsCache.expires = c, time.Time{}
+	if !c.Expiration.IsZero() {
+		awsCache.expires = c.Expiration.Add(-time.Minute)
+	}
+	return c, nil
+}
+
+// awsFileCreds reads credentials of AWS_PROFILE (or default) profile from
+// shared credentials file, returning nil if there's no such file
+func awsFileCreds() (*awsCredentials, error) {
+	name := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if name == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		name = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	var c awsCredentials
+	var section string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if section != profile || i < 0 {
+			continue
+		}
+		switch v := strings.TrimSpace(line[i+1:]); strings.TrimSpace(line[:i]) {
+		case "aws_access_key_id":
+			c.AccessKeyID = v
+		case "aws_secret_access_key":
+			c.SecretAccessKey = v
+		case "aws_session_token":
+			c.Token = v
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return nil, fmt.Errorf("%s: no credentials for profile %q", name, profile)
+	}
+	return &c, nil
+}
+
+// awsContainerCreds fetches credentials from ECS container endpoint, if
+// it's configured
+func awsContainerCreds(ctx context.Context) (*awsCredentials, error) {
+	u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); u == "" && rel != "" {
+		u = "http://169.254.170.2" + rel
+	}
+	if u == "" {
+		return nil, nil
+	}
+	header := make(http.Header)
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		header.Set("Authorization", token)
+	}
+	var c awsCredentials
+	if err := getJSON(ctx, u, header, &c); err != nil {
+		return nil, fmt.Errorf("fetching container credentials: %v", err)
+	}
+	return &c, nil
+}
+
+// awsInstanceCreds fetches credentials of EC2 instance role using IMDSv2,
+// returning nil if metadata service is not available
+func awsInstanceCreds(ctx context.Context) (*awsCredentials, error) {
+	const base = "http://169.254.169.254/latest"
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPut, base+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "300")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil
+	}
+	token, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	req, err = http.NewRequest(http.MethodGet, base+"/meta-data/iam/security-credentials/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	if resp, err = http.DefaultClient.Do(req.WithContext(ctx)); err != nil {
+		return nil, err
+	}
+	role, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil // no role attached
+	}
+	var c awsCredentials
+	name := strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0])
+	if err := getJSON(ctx, base+"/meta-data/iam/security-credentials/"+name, header, &c); err != nil {
+		return nil, fmt.Errorf("fetching instance credentials: %v", err)
+	}
+	return &c, nil
+}
+
+func gcsRequest(ctx context.Context, method, bucket, key string, data []byte, contentType string) (*http.Request, error) {
+	base, token := "https://storage.googleapis.com", ""
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		base = host
+		if !strings.Contains(host, "://") {
+			base = "http://" + host
+		}
+	} else {
+		var err error
+		if token, err = gcsToken(ctx); err != nil {
+			return nil, err
+		}
+	}
+	var req *http.Request
+	var err error
+	if method == http.MethodGet {
+		u := base + "/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(key) + "?alt=media"
+		req, err = http.NewRequest(method, u, nil)
+	} else {
+		u := base + "/upload/storage/v1/b/" + url.PathEscape(bucket) + "/o?" +
+			url.Values{"uploadType": {"media"}, "name": {key}}.Encode()
+		req, err = http.NewRequest(http.MethodPost, u, bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req.WithContext(ctx), nil
+}
+
+var gcsCache struct {
+	sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// gcsToken returns OAuth2 access token for Google Cloud Storage from
+// application default credentials, caching it until it expires
+func gcsToken(ctx context.Context) (string, error) {
+	gcsCache.Lock()
+	defer gcsCache.Unlock()
+	if gcsCache.token != "" && time.Now().Before(gcsCache.expires) {
+		return gcsCache.token, nil
+	}
+	name := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if name == "" {
+		if dir, err := os.UserConfigDir(); err == nil {
+			if fn := filepath.Join(dir, "gcloud", "application_default_credentials.json"); fileExists(fn) {
+				name = fn
+			}
+		}
+		if home, err := os.UserHomeDir(); err == nil && name == "" {
+			if fn := filepath.Join(home, ".config", "gcloud", "application_default_credentials.json"); fileExists(fn) {
+				name = fn
+			}
+		}
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if name != "" {
+		form, tokenURL, err := gcsTokenRequest(name)
+		if err != nil {
+			return "", err
+		}
+		req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := cloudClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", remoteError("fetching GCS token", resp)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+			return "", err
+		}
+	} else {
+		host := os.Getenv("GCE_METADATA_HOST")
+		if host == "" {
+			host = "metadata.google.internal"
+		}
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if err := getJSON(ctx, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token",
+			http.Header{"Metadata-Flavor": {"Google"}}, &tok); err != nil {
+			return "", fmt.Errorf("no GCS credentials found: %v", err)
+		}
+	}
+	if tok.AccessToken == "" {
+		return "", errors.New("empty GCS access token")
+	}
+	gcsCache.token = tok.AccessToken
+	gcsCache.expires = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return tok.AccessToken, nil
+}
+
+// gcsTokenRequest returns token request form and token endpoint for
+// credentials file, which is either service account key or authorized user
+// credentials
+func gcsTokenRequest(name string) (url.Values, string, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, "", err
+	}
+	var f struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, "", fmt.Errorf("%s: %v", name, err)
+	}
+	tokenURI := f.TokenURI
+	if tokenURI == "" {
+		tokenURI = "https://oauth2.googleapis.com/token"
+	}
+	switch f.Type {
+	case "authorized_user":
+		return url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {f.ClientID},
+			"client_secret": {f.ClientSecret},
+			"refresh_token": {f.RefreshToken},
+		}, tokenURI, nil
+	case "service_account":
+		block, _ := pem.Decode([]byte(f.PrivateKey))
+		if block == nil {
+			return nil, "", fmt.Errorf("%s: invalid private key", name)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %v", name, err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, "", fmt.Errorf("%s: private key is not RSA", name)
+		}
+		now := time.Now().Unix()
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+		claims, _ := json.Marshal(map[string]interface{}{
+			"iss":   f.ClientEmail,
+			"scope": "https://www.googleapis.com/auth/devstorage.read_write",
+			"aud":   tokenURI,
+			"iat":   now,
+			"exp":   now + 3600,
+		})
+		enc := base64.RawURLEncoding
+		unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+		sum := sha256.Sum256([]byte(unsigned))
+		sig, err := rsa.SignPKCS1v15(nil, rsaKey, crypto.SHA256, sum[:])
+		if err != nil {
+			return nil, "", err
+		}
+		return url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+		}, tokenURI, nil
+	}
+	return nil, "", fmt.Errorf("%s: unsupported credentials type %q", name, f.Type)
+}
+
+// getJSON decodes JSON response to GET request to url into v
+func getJSON(ctx context.Context, u string, header http.Header, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+	resp, err := cloudClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
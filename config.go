@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultConfig returns path of the default config file
+func defaultConfig() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "image-resize", "config.toml")
+}
+
+// applyPreset sets flags of fs to values of named preset from config file,
+// skipping flags already set
+func applyPreset(fs *flag.FlagSet, config, name string) error {
+	if config == "" {
+		if config = defaultConfig(); config == "" {
+			return errors.New("cannot find config file location, set it explicitly")
+		}
+	}
+	f, err := os.Open(config)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	presets, err := parseConfig(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", config, err)
+	}
+	preset, ok := presets[name]
+	if !ok {
+		return fmt.Errorf("%s: preset %q not found", config, name)
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for key, val := range preset {
+		if key == "preset" || key == "config" || fs.Lookup(key) == nil {
+			return fmt.Errorf("%s: preset %q: unsupported option %q", config, name, key)
+		}
+		if set[key] {
+			continue
+		}
+		if err := fs.Set(key, val); err != nil {
+			return fmt.Errorf("%s: preset %q: option %q: %v", config, name, key, err)
+		}
+	}
+	return nil
+}
+
+// parseConfig parses presets from TOML subset: every preset is either a
+// table with its options, or an inline table, like:
+//
+//	thumb = {maxwidth = 200, q = 80, sharpen = "0.5"}
+//
+//	[hero]
+//	width = 1600
+//	progressive = true
+//
+// Option names are the same as command line flag names. Values are strings,
+// numbers or booleans. Result maps preset names to options and their values
+// in text form.
+func parseConfig(r io.Reader) (map[string]map[string]string, error) {
+	presets := make(map[string]map[string]string)
+	var table map[string]string
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		s := &configScanner{line: sc.Text()}
+		s.skipSpace()
+		if s.done() {
+			continue
+		}
+		if s.peek() == '[' {
+			s.pos++
+			name, err := s.key()
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			if err := s.expect(']'); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			if !s.done() {
+				return nil, fmt.Errorf("line %d: unexpected text after table name", n)
+			}
+			if _, ok := presets[name]; ok {
+				return nil, fmt.Errorf("line %d: duplicate preset %q", n, name)
+			}
+			table = make(map[string]string)
+			presets[name] = table
+			continue
+		}
+		key, err := s.key()
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if err := s.expect('='); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		if s.skipSpace(); s.peek() == '{' {
+			if table != nil {
+				return nil, fmt.Errorf("line %d: nested tables are not supported", n)
+			}
+			if _, ok := presets[key]; ok {
+				return nil, fmt.Errorf("line %d: duplicate preset %q", n, key)
+			}
+			s.pos++
+			inline := make(map[string]string)
+			if err := s.inlineTable(inline); err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			presets[key] = inline
+		} else {
+			if table == nil {
+				return nil, fmt.Errorf("line %d: option %q outside of preset", n, key)
+			}
+			val, err := s.value()
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			table[key] = val
+		}
+		if !s.done() {
+			return nil, fmt.Errorf("line %d: unexpected text after value", n)
+		}
+	}
+	return presets, sc.Err()
+}
+
+// configScanner tokenizes single line of config
+type configScanner struct {
+	line string
+	pos  int
+}
+
+// done reports whether only spaces and comment are left
+func (s *configScanner) done() bool {
+	s.skipSpace()
+	return s.pos == len(s.line) || s.line[s.pos] == '#'
+}
+
+func (s *configScanner) peek() byte {
+	if s.pos < len(s.line) {
+		return s.line[s.pos]
+	}
+	return 0
+}
+
+func (s *configScanner) skipSpace() {
+	for s.pos < len(s.line) && (s.line[s.pos] == ' ' || s.line[s.pos] == '\t') {
+		s.pos++
+	}
+}
+
+func (s *configScanner) expect(c byte) error {
+	if s.skipSpace(); s.peek() != c {
+		return fmt.Errorf("%q expected", c)
+	}
+	s.pos++
+	return nil
+}
+
+// key reads bare or quoted key
+func (s *configScanner) key() (string, error) {
+	if s.skipSpace(); s.peek() == '"' || s.peek() == '\'' {
+		return s.str()
+	}
+	start := s.pos
+	for s.pos < len(s.line) {
+		c := s.line[s.pos]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			break
+		}
+		s.pos++
+	}
+	if s.pos == start {
+		return "", errors.New("key expected")
+	}
+	return s.line[start:s.pos], nil
+}
+
+// value reads string, number or boolean value
+func (s *configScanner) value() (string, error) {
+	if s.skipSpace(); s.peek() == '"' || s.peek() == '\'' {
+		return s.str()
+	}
+	start := s.pos
+	for s.pos < len(s.line) && !strings.ContainsRune(" \t,}#", rune(s.line[s.pos])) {
+		s.pos++
+	}
+	v := s.line[start:s.pos]
+	if v == "" {
+		return "", errors.New("value expected")
+	}
+	if v != "true" && v != "false" {
+		if _, err := strconv.ParseFloat(strings.Replace(v, "_", "", -1), 64); err != nil {
+			return "", fmt.Errorf("invalid value %q", v)
+		}
+		v = strings.Replace(v, "_", "", -1)
+	}
+	return v, nil
+}
+
+// str reads basic (double quoted) or literal (single quoted) string
+func (s *configScanner) str() (string, error) {
+	quote := s.line[s.pos]
+	end := s.pos + 1
+	for ; end < len(s.line) && s.line[end] != quote; end++ {
+		if s.line[end] == '\\' && quote == '"' {
+			end++
+		}
+	}
+	if end >= len(s.line) {
+		return "", errors.New("unterminated string")
+	}
+	raw := s.line[s.pos : end+1]
+	s.pos = end + 1
+	if quote == '\'' {
+		return raw[1 : len(raw)-1], nil
+	}
+	v, err := strconv.Unquote(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid string %s", raw)
+	}
+	return v, nil
+}
+
+// inlineTable reads key = value pairs up to closing brace into m
+func (s *configScanner) inlineTable(m map[string]string) error {
+	if s.skipSpace(); s.peek() == '}' {
+		s.pos++
+		return nil
+	}
+	for {
+		key, err := s.key()
+		if err != nil {
+			return err
+		}
+		if err := s.expect('='); err != nil {
+			return err
+		}
+		if m[key], err = s.value(); err != nil {
+			return err
+		}
+		switch s.skipSpace(); s.peek() {
+		case ',':
+			s.pos++
+		case '}':
+			s.pos++
+			return nil
+		default:
+			return errors.New(`"," or "}" expected`)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/artyom/image-resize/resize"
+)
+
+// diffFiles renders heatmap of differences between par.Input and par.Diff
+// images and saves it to par.Output. If dimensions are specified, input is
+// resized first; the second image is always resized to match the first one.
+func diffFiles(par params) error {
+	opts, err := par.options()
+	if err != nil {
+		return err
+	}
+	a, err := decodeFile(par.Input)
+	if err != nil {
+		return err
+	}
+	b, err := decodeFile(par.Diff)
+	if err != nil {
+		return err
+	}
+	if par.Width > 0 || par.Height > 0 || par.MaxWidth > 0 || par.MaxHeight > 0 ||
+		par.MaxLong > 0 || par.MaxShort > 0 || par.Scale != "" {
+		width, height, err := opts.Dimensions(a.Bounds().Dx(), a.Bounds().Dy())
+		if err != nil {
+			return err
+		}
+		if a, err = resize.Scale(a, width, height); err != nil {
+			return err
+		}
+	}
+	if size := a.Bounds().Size(); b.Bounds().Size() != size {
+		if b, err = resize.Scale(b, size.X, size.Y); err != nil {
+			return err
+		}
+	}
+	return writeImage(par, opts, diffImages(a, b))
+}
+
+// diffImages renders differences between two images of the same size as a
+// heatmap over darkened grayscale copy of the first image: identical pixels
+// stay gray, differing ones are highlighted with colors ranging from dark red
+// for subtle changes to white for the most prominent ones.
+func diffImages(a, b image.Image) *image.RGBA {
+	r := a.Bounds()
+	na, nb := resize.ToNRGBA(a), resize.ToNRGBA(b)
+	out := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			i := y*na.Stride + x*4
+			j := y*nb.Stride + x*4
+			var d int
+			for k := 0; k < 4; k++ {
+				if v := abs(int(na.Pix[i+k]) - int(nb.Pix[j+k])); v > d {
+					d = v
+				}
+			}
+			gray := color.GrayModel.Convert(na.At(r.Min.X+x, r.Min.Y+y)).(color.Gray).Y / 4
+			if d == 0 {
+				out.SetRGBA(x, y, color.RGBA{gray, gray, gray, 0xff})
+				continue
+			}
+			// "hot" color map: black → red → yellow → white; small
+			// differences are boosted so they're still noticeable
+			t := 3 * (0.25 + 0.75*float64(d)/255)
+			out.SetRGBA(x, y, color.RGBA{heat(t), heat(t - 1), heat(t - 2), 0xff})
+		}
+	}
+	return out
+}
+
+func heat(v float64) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 1:
+		return 0xff
+	}
+	return uint8(v * 0xff)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/artyom/image-resize/resize"
+)
+
+// outputMeta describes saved output, see params.EmitMeta
+type outputMeta struct {
+	Output string `json:"output"`
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Frames int    `json:"frames,omitempty"`
+	Size   int    `json:"size"`
+	DHash  string `json:"dhash"`
+
+	SSIM float64 `json:"ssim,omitempty"`
+	PSNR float64 `json:"psnr,omitempty"`
+
+	Placeholder string `json:"placeholder,omitempty"`
+}
+
+// emitMeta reports output of given size described by res according to
+// par.EmitMeta: prints it as JSON line or saves it to sidecar file. Without
+// par.EmitMeta, quality metrics are printed to stderr if par.QualityMetrics
+// is set, and placeholder is printed where JSON line would be.
+func emitMeta(par params, size int, res *resize.Result) error {
+	if par.EmitMeta == "" {
+		if par.QualityMetrics && res.PSNR != 0 {
+			fmt.Fprintf(os.Stderr, "%s: SSIM %.4f, PSNR %.2f dB\n", par.Output, res.SSIM, res.PSNR)
+		}
+		if res.Placeholder != "" {
+			w := os.Stdout
+			if par.Output == stdio {
+				w = os.Stderr
+			}
+			fmt.Fprintf(w, "%s: %s\n", par.Output, res.Placeholder)
+		}
+		return nil
+	}
+	b, err := json.Marshal(outputMeta{
+		Output: par.Output,
+		Format: res.Format,
+		Width:  res.Width,
+		Height: res.Height,
+		Frames: res.Frames,
+		Size:   size,
+		DHash:  fmt.Sprintf("%016x", res.Hash),
+		SSIM:   res.SSIM,
+		PSNR:   math.Min(res.PSNR, 100),
+
+		Placeholder: res.Placeholder,
+	})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if par.EmitMeta == "print" {
+		var w io.Writer = os.Stdout
+		if par.Output == stdio {
+			w = os.Stderr
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	name := par.Output + ".json"
+	switch {
+	case par.Output == stdio:
+		return errors.New("sidecar metadata cannot be saved for stdout output")
+	case isRemote(name):
+		ctx, cancel := par.context()
+		defer cancel()
+		return writeRemote(ctx, name, b, "application/json")
+	}
+	return writeFile(name, b, false)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/artyom/image-resize/resize"
+)
+
+// exit codes for different classes of errors
+const (
+	exitError       = 1 // error of no specific class, like I/O error
+	exitUsage       = 2 // invalid flags or options
+	exitUnsupported = 3 // unsupported input format
+	exitTooLarge    = 4 // image dimensions exceed limits
+	exitCorrupt     = 5 // input cannot be decoded
+	exitTimeout     = 6 // processing took longer than -timeout
+)
+
+// errorClass returns name of err class and the matching exit code
+func errorClass(err error) (string, int) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout", exitTimeout
+	}
+	switch k := resize.KindOf(err); k {
+	case resize.KindInvalidOptions:
+		return k.String(), exitUsage
+	case resize.KindUnsupported:
+		return k.String(), exitUnsupported
+	case resize.KindTooLarge:
+		return k.String(), exitTooLarge
+	case resize.KindCorrupt:
+		return k.String(), exitCorrupt
+	}
+	return "other", exitError
+}
+
+// printError writes err related to named file (if not empty) to stderr,
+// as JSON object if asJSON is set
+func printError(name string, err error, asJSON bool) {
+	if !asJSON {
+		if name != "" {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			return
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	kind, code := errorClass(err)
+	json.NewEncoder(os.Stderr).Encode(struct {
+		File  string `json:"file,omitempty"`
+		Error string `json:"error"`
+		Kind  string `json:"kind"`
+		Code  int    `json:"code"`
+	}{name, err.Error(), kind, code})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/artyom/image-resize/resize"
+)
+
+// openInput opens local file, remote object or http(s) url for reading
+func (par params) openInput(ctx context.Context, name string) (io.ReadCloser, error) {
+	switch {
+	case isRemote(name):
+		return openRemote(ctx, name)
+	case isURL(name):
+		return fetchURL(ctx, &http.Client{Timeout: par.HTTPTimeout}, name, par.Headers.header())
+	}
+	return os.Open(name)
+}
+
+// isURL reports whether name is http:// or https:// url
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// fetchURL requests image from http or https url, sending extra headers.
+// Responses with non-image content type or larger than resize.MaxFileSize
+// are rejected before the whole body is read.
+func fetchURL(ctx context.Context, client *http.Client, rawurl string, header http.Header) (io.ReadCloser, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("only http and https urls are supported")
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s: %s", u, resp.Status)
+	}
+	if resp.ContentLength > resize.MaxFileSize {
+		resp.Body.Close()
+		return nil, &resize.Error{Kind: resize.KindTooLarge, Err: fmt.Errorf("fetching %s: size %d exceeds limit", u, resp.ContentLength)}
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		typ, _, err := mime.ParseMediaType(ct)
+		if err != nil || !strings.HasPrefix(typ, "image/") && typ != "application/octet-stream" {
+			resp.Body.Close()
+			return nil, fmt.Errorf("fetching %s: unexpected content type %q", u, ct)
+		}
+	}
+	return &sizeLimitReader{ReadCloser: resp.Body, n: resize.MaxFileSize, name: u.String()}, nil
+}
+
+// publicClient returns http client that only connects to public addresses,
+// refusing loopback, private and link-local ones, so that urls given by
+// server clients cannot reach internal services. Proxies set in
+// environment are not used for the same reason.
+func publicClient(timeout time.Duration) *http.Client {
+	d := &net.Dialer{Timeout: 30 * time.Second, Control: dialPublicOnly}
+	return &http.Client{Timeout: timeout, Transport: &http.Transport{
+		DialContext:         d.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}}
+}
+
+// dialPublicOnly is net.Dialer.Control function rejecting connections to
+// non-public addresses; it's called with already resolved address, so
+// host names resolving to internal addresses are rejected too
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("connecting to non-public address %s is not allowed", host)
+	}
+	return nil
+}
+
+// nonPublicNets are private, shared and reserved networks not covered by
+// net.IP methods
+var nonPublicNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12",
+		"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "240.0.0.0/4", "fc00::/7"} {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// isPublicIP reports whether ip is a global unicast address outside of
+// private networks
+func isPublicIP(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() { // loopback, link-local, multicast
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// sizeLimitReader returns an error once more than n bytes are read
+type sizeLimitReader struct {
+	io.ReadCloser
+	n    int64
+	name string
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.n+1 {
+		p = p[:r.n+1]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if r.n -= int64(n); r.n < 0 {
+		return n, &resize.Error{Kind: resize.KindTooLarge, Err: fmt.Errorf("fetching %s: size exceeds limit", r.name)}
+	}
+	return n, err
+}
+
+// headerList is a list of HTTP headers given with repeated -header flags
+type headerList []string
+
+func (l *headerList) String() string { return strings.Join(*l, ", ") }
+
+func (l *headerList) Set(s string) error {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 || strings.TrimSpace(s[:i]) == "" {
+		return fmt.Errorf("invalid header %q, should be Name: value", s)
+	}
+	*l = append(*l, s)
+	return nil
+}
+
+// header returns headers of l as http.Header
+func (l headerList) header() http.Header {
+	h := make(http.Header, len(l))
+	for _, s := range l {
+		i := strings.IndexByte(s, ':')
+		h.Add(strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]))
+	}
+	return h
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/artyom/image-resize/resize"
+)
+
+// generateImage creates solid color or gradient image of par.Width×par.Height
+// size according to par.Generate specification and saves it to par.Output.
+// If par.Placeholder is set, image is labeled with its dimensions or
+// par.Label text. Specification is one of:
+//
+//	COLOR
+//	linear:COLOR1,COLOR2[,ANGLE]
+//	radial:COLOR1,COLOR2
+//
+// Linear gradient angle is in degrees, 0 (default) goes from left to right,
+// 90 from top to bottom. Radial gradient goes from the center to the
+// farthest corner.
+func generateImage(par params, opts resize.Options) error {
+	if par.Width <= 0 || par.Height <= 0 {
+		return errors.New("both width and height should be set to generate image")
+	}
+	if par.Width*par.Height > resize.PixelLimit {
+		return errors.New("destination size exceeds limit")
+	}
+	spec := par.Generate
+	if spec == "" {
+		spec = "#ccc"
+	}
+	img, err := renderSpec(spec, par.Width, par.Height)
+	if err != nil {
+		return err
+	}
+	if par.Placeholder {
+		textColor, err := parseColor(par.TextColor)
+		if err != nil {
+			return err
+		}
+		text := par.Label
+		if text == "" {
+			text = fmt.Sprintf("%d×%d", par.Width, par.Height)
+		}
+		size, err := textSize(text, par.Width, par.Height)
+		if err != nil {
+			return err
+		}
+		center := image.Pt(par.Width/2, par.Height/2)
+		if err := drawText(img, text, center, size, textColor); err != nil {
+			return err
+		}
+	}
+	return writeImage(par, opts, opts.Composite(img))
+}
+
+func renderSpec(spec string, width, height int) (*image.NRGBA, error) {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	kind, args := "solid", spec
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, args = spec[:i], spec[i+1:]
+	}
+	fields := strings.Split(args, ",")
+	colors := make([]color.NRGBA, 0, 2)
+	for _, s := range fields {
+		if len(colors) == 2 {
+			break
+		}
+		c, err := parseColor(s)
+		if err != nil {
+			return nil, err
+		}
+		colors = append(colors, c)
+	}
+	switch kind {
+	case "solid":
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("invalid solid color specification %q", spec)
+		}
+		fillGradient(img, func(x, y int) float64 { return 0 }, colors[0], colors[0])
+	case "linear":
+		var angle float64
+		switch len(fields) {
+		case 2:
+		case 3:
+			var err error
+			if angle, err = strconv.ParseFloat(fields[2], 64); err != nil {
+				return nil, fmt.Errorf("invalid gradient angle %q", fields[2])
+			}
+		default:
+			return nil, fmt.Errorf("invalid linear gradient specification %q", spec)
+		}
+		sin, cos := math.Sincos(angle * math.Pi / 180)
+		// project every pixel onto gradient direction, normalizing by
+		// projections of canvas corners
+		w, h := float64(width-1), float64(height-1)
+		lo := math.Min(0, w*cos) + math.Min(0, h*sin)
+		hi := math.Max(0, w*cos) + math.Max(0, h*sin)
+		fillGradient(img, func(x, y int) float64 {
+			if hi == lo {
+				return 0
+			}
+			return (float64(x)*cos + float64(y)*sin - lo) / (hi - lo)
+		}, colors[0], colors[1])
+	case "radial":
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid radial gradient specification %q", spec)
+		}
+		cx, cy := float64(width-1)/2, float64(height-1)/2
+		r := math.Hypot(cx, cy)
+		fillGradient(img, func(x, y int) float64 {
+			if r == 0 {
+				return 0
+			}
+			return math.Hypot(float64(x)-cx, float64(y)-cy) / r
+		}, colors[0], colors[1])
+	default:
+		return nil, fmt.Errorf("unsupported image specification %q", spec)
+	}
+	return img, nil
+}
+
+// fillGradient sets every pixel of img to color interpolated between c1 and
+// c2 using position function returning values in 0-1 range
+func fillGradient(img *image.NRGBA, pos func(x, y int) float64, c1, c2 color.NRGBA) {
+	b := img.Bounds()
+	lerp := func(a, b uint8, t float64) uint8 {
+		return uint8(float64(a) + (float64(b)-float64(a))*t + 0.5)
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			t := math.Min(1, math.Max(0, pos(x, y)))
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: lerp(c1.R, c2.R, t),
+				G: lerp(c1.G, c2.G, t),
+				B: lerp(c1.B, c2.B, t),
+				A: lerp(c1.A, c2.A, t),
+			})
+		}
+	}
+}
+
+// parseColor parses color in #rgb, #rrggbb or #rrggbbaa hex notation, leading
+// # is optional. Few basic color names are also supported.
+func parseColor(s string) (color.NRGBA, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if c, ok := colorNames[s]; ok {
+		return c, nil
+	}
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+var colorNames = map[string]color.NRGBA{
+	"black":       {0, 0, 0, 0xff},
+	"white":       {0xff, 0xff, 0xff, 0xff},
+	"gray":        {0x80, 0x80, 0x80, 0xff},
+	"grey":        {0x80, 0x80, 0x80, 0xff},
+	"silver":      {0xc0, 0xc0, 0xc0, 0xff},
+	"red":         {0xff, 0, 0, 0xff},
+	"green":       {0, 0x80, 0, 0xff},
+	"lime":        {0, 0xff, 0, 0xff},
+	"blue":        {0, 0, 0xff, 0xff},
+	"navy":        {0, 0, 0x80, 0xff},
+	"yellow":      {0xff, 0xff, 0, 0xff},
+	"orange":      {0xff, 0xa5, 0, 0xff},
+	"purple":      {0x80, 0, 0x80, 0xff},
+	"magenta":     {0xff, 0, 0xff, 0xff},
+	"cyan":        {0, 0xff, 0xff, 0xff},
+	"transparent": {0, 0, 0, 0},
+}
@@ -1,12 +1,19 @@
 module github.com/artyom/image-resize
 
-go 1.13
+go 1.16
 
 require (
 	github.com/artyom/autoflags v1.1.1
 	github.com/bamiaux/rez v0.0.0-20170731184118-29f4463c688b
 	github.com/disintegration/gift v1.2.1
+	github.com/esimov/pigo v1.4.6
+	github.com/fsnotify/fsnotify v1.5.4
+	github.com/golang/protobuf v1.4.2
 	github.com/rwcarlsen/goexif v0.0.0-20180518182100-8d986c03457a
 	github.com/soniakeys/quant v1.0.0
-	golang.org/x/image v0.0.0-20180708004352-c73c2afc3b81
+	github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c
+	github.com/srwiley/rasterx v0.0.0-20210519020934-456a8d69b780
+	golang.org/x/image v0.0.0-20211028202545-6944b10bf410
+	google.golang.org/grpc v1.38.0
+	google.golang.org/protobuf v1.25.0
 )
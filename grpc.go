@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/artyom/image-resize/resize"
+	"github.com/artyom/image-resize/resizepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// serveGRPC runs gRPC server on par.GRPC address, implementing Resizer
+// service described in resizepb/resize.proto. Options set by par are used as
+// defaults that requests can override.
+func serveGRPC(par params) error {
+	opts, err := par.options()
+	if err != nil {
+		return err
+	}
+	if par.Format == "" {
+		opts.Format = "jpeg"
+	}
+	m, err := startMetrics(par)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", par.GRPC)
+	if err != nil {
+		return err
+	}
+	srv := grpc.NewServer(grpc.MaxRecvMsgSize(resize.MaxFileSize + 1<<20))
+	resizepb.RegisterResizerServer(srv, &resizer{opts: opts, par: par, metrics: m})
+	return srv.Serve(ln)
+}
+
+// resizer implements Resizer gRPC service
+type resizer struct {
+	resizepb.UnimplementedResizerServer
+
+	opts    resize.Options
+	par     params
+	metrics *serverMetrics
+
+	proc resize.Processor
+}
+
+// grpcChunkSize is the max. size of image data sent in a single message of
+// ResizeStream response
+const grpcChunkSize = 1 << 20
+
+// Resize implements Resize method
+func (s *resizer) Resize(ctx context.Context, req *resizepb.ResizeRequest) (*resizepb.ResizeResponse, error) {
+	return s.resize(ctx, req.Data, req.Options)
+}
+
+func (s *resizer) resize(ctx context.Context, data []byte, o *resizepb.TransformOptions) (*resizepb.ResizeResponse, error) {
+	opts := s.opts
+	if o != nil {
+		for _, v := range [...]struct {
+			val int32
+			dst *int
+		}{
+			{o.Width, &opts.Width},
+			{o.Height, &opts.Height},
+			{o.MaxWidth, &opts.MaxWidth},
+			{o.MaxHeight, &opts.MaxHeight},
+			{o.Quality, &opts.JpegQuality},
+		} {
+			if v.val < 0 {
+				err := errors.New("dimensions and quality cannot be negative")
+				s.metrics.fail(&resize.Error{Kind: resize.KindInvalidOptions, Err: err})
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			if v.val != 0 {
+				*v.dst = int(v.val)
+			}
+		}
+		switch f := strings.ToLower(o.Format); f {
+		case "":
+		case "jpg":
+			opts.Format = "jpeg"
+		default:
+			opts.Format = f
+		}
+		if o.Fit != "" {
+			opts.Fit = o.Fit
+		}
+		if o.Gravity != "" {
+			opts.Gravity = o.Gravity
+		}
+	}
+	if s.par.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.par.Timeout)
+		defer cancel()
+	}
+	buf := new(bytes.Buffer)
+	res, err := s.proc.Process(ctx, bytes.NewReader(data), buf, opts)
+	if err != nil {
+		s.metrics.fail(err)
+		return nil, grpcError(err)
+	}
+	s.metrics.observe(res, buf.Len())
+	return &resizepb.ResizeResponse{
+		Data:   buf.Bytes(),
+		Format: res.Format,
+		Width:  int32(res.Width),
+		Height: int32(res.Height),
+	}, nil
+}
+
+// grpcError converts processing error to gRPC status error
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+	switch resize.KindOf(err) {
+	case resize.KindInvalidOptions, resize.KindUnsupported, resize.KindCorrupt:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case resize.KindTooLarge:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// ResizeStream implements ResizeStream method: image is received as data of
+// request messages, options are taken from the first one; resulting image
+// is sent back in chunks, the first response message also describes it
+func (s *resizer) ResizeStream(stream resizepb.Resizer_ResizeStreamServer) error {
+	var data []byte
+	var opts *resizepb.TransformOptions
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if opts == nil {
+			opts = req.Options
+			if opts == nil {
+				opts = new(resizepb.TransformOptions)
+			}
+		}
+		if len(data)+len(req.Data) > resize.MaxFileSize {
+			return status.Error(codes.ResourceExhausted, "image size exceeds limit")
+		}
+		data = append(data, req.Data...)
+	}
+	res, err := s.resize(stream.Context(), data, opts)
+	if err != nil {
+		return err
+	}
+	out := res.Data
+	for first := true; first || len(out) > 0; first = false {
+		msg := new(resizepb.ResizeResponse)
+		if first {
+			msg.Format, msg.Width, msg.Height = res.Format, res.Width, res.Height
+		}
+		n := len(out)
+		if n > grpcChunkSize {
+			n = grpcChunkSize
+		}
+		msg.Data, out = out[:n], out[n:]
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,352 +3,961 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"image"
-	"image/gif"
 	"image/jpeg"
-	"image/png"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/artyom/autoflags"
-	"github.com/bamiaux/rez"
-	"github.com/disintegration/gift"
-	"github.com/rwcarlsen/goexif/exif"
-	"github.com/soniakeys/quant/mean"
-	"golang.org/x/image/bmp"
-	"golang.org/x/image/draw"
-	"golang.org/x/image/tiff"
+	"github.com/artyom/image-resize/resize"
 )
 
 func main() {
 	p := params{
 		JpegQuality: jpeg.DefaultQuality,
+		Delay:       100 * time.Millisecond,
+		Blend:       "over",
+		Opacity:     1,
+		WmGravity:   "southeast",
+		WmOpacity:   1,
+		TextColor:   "#666",
+		Workers:     runtime.NumCPU(),
+		HTTPTimeout: time.Minute,
+		SheetCols:   4,
+		SheetThumb:  200,
+		SheetPad:    10,
+		PyramidTile: 256,
 	}
 	autoflags.Define(&p)
 	flag.Parse()
-	if err := do(p); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	if p.Preset != "" {
+		if err := applyPreset(flag.CommandLine, p.Config, p.Preset); err != nil {
+			printError("", err, p.JSONErrors)
+			os.Exit(exitUsage)
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "loop" {
+			p.loopSet = true
+		}
+	})
+	p.frames = flag.Args()
+	if err := run(p); err != nil {
+		printError("", err, p.JSONErrors)
+		_, code := errorClass(err)
+		os.Exit(code)
 	}
 }
 
 type params struct {
-	Width     int    `flag:"width,width to enforce"`
-	Height    int    `flag:"height,height to enforce"`
-	MaxWidth  int    `flag:"maxwidth,max. allowed width"`
-	MaxHeight int    `flag:"maxheight,max. allowed height"`
-	Input     string `flag:"input,input file"`
-	Output    string `flag:"output,output file"`
-	Square    bool   `flag:"square,crop image to square by smaller side before processing"`
-	NoFill    bool   `flag:"nofill,do not draw transparent inputs over white for non-png outputs"`
-
-	JpegQuality int `flag:"q,jpeg quality (1-100)"`
+	Width     int        `flag:"width,width to enforce"`
+	Height    int        `flag:"height,height to enforce"`
+	MaxWidth  int        `flag:"maxwidth,max. allowed width"`
+	MaxHeight int        `flag:"maxheight,max. allowed height"`
+	MaxLong   int        `flag:"maxlong,max. allowed size of the longer side, whether it's width or height"`
+	MaxShort  int        `flag:"maxshort,max. allowed size of the shorter side, whether it's width or height"`
+	Scale     string     `flag:"scale,size relative to source as percentage (50%) or factor (0.25), instead of absolute dimensions"`
+	Geometry  string     `flag:"geometry,ImageMagick-style size: WxH (fit inside), WxH! (exact), WxH> (only shrink larger), WxH^ (cover), W, xH, N%"`
+	Resize    string     `flag:"resize,same as geometry, for compatibility with ImageMagick convert"`
+	Ops       string     `flag:"ops,comma separated pipeline of operations applied in order instead of dimension flags, like crop=square,resize=maxw:800,sharpen=0.6,rotate=90; operations are crop=square|WxH, resize=KEY:VALUE[:...] with w, h, maxw, maxh, maxlong, maxshort, scale and fit keys, sharpen=amount[:radius:threshold], rotate=90|180|270, flip=h|v, grayscale"`
+	Extent    string     `flag:"extent,ImageMagick-style WxH canvas size, only supported when equal to resize dimensions: crops WxH^ result according to gravity or pads WxH result with background"`
+	Input     string     `flag:"input,input file, http(s) url or s3://bucket/key, gs://bucket/key url, - reads from stdin"`
+	Output    string     `flag:"output,output file or s3://bucket/key, gs://bucket/key url, - writes to stdout"`
+	Outputs   outputList `flag:"out,additional output as WIDTH[xHEIGHT]:FILE, can be repeated; input is decoded once for all outputs"`
+	Format    string     `flag:"format,output format: jpeg, png, gif, tiff, bmp, webp; by default derived from output file name"`
+	To        string     `flag:"to,output format like format, but it's an error if output file extension is of a different format, unless force is set; auto picks format per image: jpeg for photos, png (or registered webp) for images with transparency or few colors, animations keep their format, and output extension is changed to match"`
+	Force     bool       `flag:"force,allow output file extension to differ from format set with to"`
+	Square    bool       `flag:"square,crop image to square by smaller side before processing"`
+	Trim      bool       `flag:"trim,crop off input borders of the same color as its top-left pixel, or transparent ones, before processing"`
+	TrimFuzz  float64    `flag:"trim-fuzz,max. difference of trimmed border colors from the top-left pixel color in percents (0-100)"`
+	Fit       string     `flag:"fit,how to fit image when both width and height are set: fill (stretch), cover (scale and crop), contain (scale and pad), inside (scale only), outside (scale to cover without cropping)"`
+	Pad       bool       `flag:"pad,scale image to fit inside width×height box and pad it to the box size with background color, same as -fit contain"`
+	Gravity   string     `flag:"gravity,part of image to keep when cropping: center, north, south, east, west, northeast, northwest, southeast, southwest, x,y focal point, edges (most detailed region), attention (detailed, saturated and skin colored region) or face (detected faces, center if none)"`
+	Rotate    int        `flag:"rotate,rotate output clockwise by 90, 180 or 270 degrees, after EXIF based orientation"`
+	Flip      string     `flag:"flip,mirror output horizontally (h) or vertically (v), after rotation"`
+	NoFill    bool       `flag:"nofill,do not draw transparent inputs over background for non-png outputs, same as -background none"`
+	SRGB      bool       `flag:"srgb,convert colors of images with embedded ICC profile to sRGB instead of keeping the profile"`
+	KeepEXIF  bool       `flag:"keep-exif,copy EXIF metadata of jpeg, png and webp inputs to output, by default it's dropped"`
+	Strip     bool       `flag:"strip,remove all metadata from output, including ICC profile"`
+	StripGPS  bool       `flag:"strip-gps,remove GPS location from EXIF metadata kept with keep-exif"`
+	DPI       float64    `flag:"dpi,physical density to write to jpeg, png and tiff output in dots per inch; by default density of source is kept"`
+
+	Background  string `flag:"background,color transparent inputs are drawn over for non-png outputs, as #rrggbb[aa] or name; none disables it"`
+	Sharpen     string `flag:"sharpen,unsharp mask to apply after resizing as amount[,radius,threshold], like 0.8 or 1,1.5,0.02"`
+	Filter      string `flag:"filter,resampling filter: lanczos3, lanczos2, bicubic, bilinear, box, nearest; lanczos1 to lanczos8 set number of lanczos taps, fewer are faster"`
+	JpegQuality int    `flag:"q,jpeg quality (1-100)"`
+	Quality     int    `flag:"quality,same as q, for compatibility with ImageMagick convert"`
+	Progressive bool   `flag:"progressive,write progressive jpeg"`
+	MaxBytes    string `flag:"max-bytes,max. output size like 200k or 1.5m: jpeg quality is lowered and, if that's not enough, image is scaled down until it fits"`
+	Subsample   string `flag:"subsample,jpeg chroma subsampling: 444, 422 or 420 (default); chroma of jpeg inputs is also scaled with it"`
+	Optimize    bool   `flag:"optimize,use optimized Huffman tables for jpeg output and save png output as grayscale or palette image when lossless; drops EXIF data"`
+	Interlace   bool   `flag:"interlace,write interlaced (Adam7) png or interlaced gif output, so it can be displayed progressively"`
+	GifColors   int    `flag:"gif-colors,gif palette size (2-256), by default 256 or source palette size"`
+	Colors      int    `flag:"colors,write png output as indexed image with palette of this size (2-256)"`
+	Loop        int    `flag:"loop,animated gif loop count (0 loops forever, -1 plays once), by default source value is kept"`
+	FPS         int    `flag:"fps,max. frame rate of animated output, frames above it are dropped"`
+	DropFrames  int    `flag:"drop-frames,keep only every Nth frame of animated output"`
+
+	PngCompression  string `flag:"png-compression,png compression: best (default, slow), default, speed or none"`
+	TiffCompression string `flag:"tiff-compression,tiff compression: deflate (default), lzw or none"`
+
+	Grayscale  bool    `flag:"grayscale,convert output to grayscale"`
+	Sepia      float64 `flag:"sepia,sepia tone strength in percents (0-100)"`
+	Brightness float64 `flag:"brightness,output brightness change in percents (-100..100)"`
+	Contrast   float64 `flag:"contrast,output contrast change in percents (-100..100)"`
+	Saturation float64 `flag:"saturation,output saturation change in percents (-100..500)"`
+
+	GrayOutput bool `flag:"grayscale-output,save jpeg, png and tiff output as single channel grayscale image, smaller than the one made with grayscale"`
+
+	Explode string `flag:"explode,directory to save every frame of animated gif or png input as separate numbered file"`
+
+	Frame    int    `flag:"frame,page of multi-page tiff or frame of animated gif or png input to use, starting from 1"`
+	FrameSet string `flag:"frames,set to all to save every page of tiff or frame of gif or png input as separate output file, numbered like name-0001.png"`
+
+	FirstFrame bool `flag:"first-frame,use only the first frame of animated input even if output could be animated, without warning"`
+
+	Sequence string        `flag:"sequence,glob pattern of still images to assemble into animated gif or png; frames can also be given as arguments"`
+	Delay    time.Duration `flag:"delay,frame delay of assembled animation"`
+
+	Sheet       string `flag:"sheet,directory or glob pattern of images to compose contact sheet of, saved as output; images can also be given as arguments"`
+	SheetCols   int    `flag:"sheet-cols,number of contact sheet columns"`
+	SheetThumb  int    `flag:"sheet-thumb,size of contact sheet cells in pixels, images are scaled to fit them"`
+	SheetPad    int    `flag:"sheet-pad,padding between contact sheet cells in pixels"`
+	SheetLabels bool   `flag:"sheet-labels,label contact sheet images with their file names"`
+
+	Slice string `flag:"slice,cut output into COLSxROWS grid of tiles saved as separate files, numbered row by row like name-0001.png"`
+	Tile  string `flag:"tile,cut output into WxH pixel tiles (smaller at right and bottom edges) saved as separate files, numbered like with slice"`
+
+	Pyramid     string `flag:"pyramid,save output with its halved resolution levels: levels saves them as name-0.jpg (full size), name-1.jpg and so on until they fit pyramid-tile; dzi saves Deep Zoom Image descriptor as output (name.dzi) and tiles of all levels in name_files directory"`
+	PyramidTile int    `flag:"pyramid-tile,size of the smallest pyramid level and of dzi tiles (including 1 pixel overlap)"`
+
+	At string `flag:"at,position of video input frame to use, like 00:00:03 (requires ffmpeg)"`
+
+	Timeout time.Duration `flag:"timeout,max. time to process single image, like 30s"`
+	Threads int           `flag:"threads,max. number of threads used to scale single image, by default all CPUs are used; 1 disables parallel scaling"`
+	LowMem  bool          `flag:"lowmem,decode and scale baseline jpeg inputs row by row to reduce memory use, at the cost of speed"`
+
+	Deterministic bool `flag:"deterministic,make outputs depend only on input and their own options, so that they are byte-identical however they are produced: jpeg inputs are decoded at full size, svg ones at their own size, and outputs set with out are not scaled from each other"`
+
+	ExifThumb bool `flag:"use-exif-thumb,scale jpeg inputs from thumbnail embedded in EXIF data if it's at least as large as the output, instead of decoding the full image"`
+
+	HTTPTimeout time.Duration `flag:"http-timeout,max. time to download http(s) input or server url parameter"`
+	Headers     headerList    `flag:"header,HTTP header to send when downloading http(s) input as 'Name: value', can be repeated"`
+
+	NoClobber bool `flag:"no-clobber,do not overwrite existing output files, skipping them; outputs are always written to temporary file renamed on success"`
+	Inplace   bool `flag:"inplace,replace input file (or files in indir) with the result"`
+	Preserve  bool `flag:"preserve,copy input file modification time and permission bits to output"`
+
+	SkipSmaller bool `flag:"skip-smaller,hard link (or copy) input files already within output dimensions and of output format to output instead of processing them"`
+	NewerThan   bool `flag:"newer-than,skip input files with existing output that is not older than input, like make does"`
+
+	Verify bool `flag:"verify,re-decode written output to check it's complete and of expected format and dimensions"`
+
+	EmitMeta string `flag:"emit-meta,report output name, format, dimensions, size and perceptual hash (dHash) as JSON: print writes it to stdout (stderr if output is stdout), sidecar saves it next to output with .json suffix appended"`
+
+	QualityMetrics bool `flag:"quality-metrics,decode output after encoding and report its SSIM and PSNR against the image it was encoded from to stderr, or with emit-meta if set, capping PSNR of lossless output at 100"`
+
+	PlaceholderHash string `flag:"placeholder-hash,compute compact placeholder of output for progressive loading: blurhash or thumbhash (base64 encoded); it's printed to stdout (stderr if output is stdout), or reported with emit-meta if set"`
+
+	Diff string `flag:"diff,save heatmap of differences between input and this file as output"`
+
+	Overlay      string  `flag:"overlay,image to composite over resized output"`
+	OverlayPos   string  `flag:"overlay-pos,overlay top-left corner position on output as x,y"`
+	OverlayScale float64 `flag:"overlay-scale,overlay scale factor"`
+	Blend        string  `flag:"blend,overlay blend mode: over, multiply, screen, overlay"`
+	Opacity      float64 `flag:"opacity,overlay opacity (0-1)"`
+
+	Watermark string  `flag:"watermark,image to composite over resized output as watermark"`
+	WmGravity string  `flag:"wm-gravity,watermark placement: center, north, south, east, west, northeast, northwest, southeast, southwest"`
+	WmMargin  int     `flag:"wm-margin,watermark distance from output edges in pixels"`
+	WmScale   float64 `flag:"wm-scale,watermark width relative to output width, like 0.2; by default watermark is used as is"`
+	WmOpacity float64 `flag:"wm-opacity,watermark opacity (0-1)"`
+
+	Generate    string `flag:"generate,generate width×height image instead of reading input: COLOR, linear:COLOR1,COLOR2[,ANGLE] or radial:COLOR1,COLOR2"`
+	Placeholder bool   `flag:"placeholder,generate width×height placeholder image labeled with its dimensions"`
+	Label       string `flag:"label,custom placeholder label text"`
+	TextColor   string `flag:"text-color,placeholder and contact sheet label color"`
+
+	Probe        bool `flag:"probe,print input format, dimensions, orientation, alpha presence, output dimensions and estimated memory use as JSON to stdout without processing the image"`
+	DumpMetadata bool `flag:"dump-metadata,print input EXIF, XMP and IPTC metadata as JSON to stdout; only metadata is printed if output is not set"`
+
+	Cache string `flag:"cache,file to record input and parameters hashes in, to skip work on repeated runs with the same input and settings"`
+
+	Resume string `flag:"resume,journal file to record processed files in like cache does, but as each one is done, so that interrupted run can be resumed"`
+
+	Stats  bool   `flag:"stats,print run statistics to stderr"`
+	Report string `flag:"report,file to save run statistics to as JSON"`
+
+	Verbose  bool `flag:"v,log time spent on decoding, scaling and encoding and input and output sizes to stderr"`
+	Quiet    bool `flag:"quiet,do not print warnings, like failures to decode EXIF data, to stderr"`
+	Progress bool `flag:"progress,print progress percentage to stderr in indir and manifest modes"`
+
+	JSONErrors bool `flag:"json-errors,print errors to stderr as JSON objects with message, kind and exit code; exit codes are 2 for invalid options, 3 for unsupported input format, 4 for too large images, 5 for corrupt input, 6 for timeout, 1 for other errors"`
+
+	Indir   string `flag:"indir,directory to process all supported images in, recursively"`
+	Watch   string `flag:"watch,directory to monitor for new and changed images, which are processed like in indir mode once they stay unchanged for a second"`
+	Outdir  string `flag:"outdir,directory to save images processed in indir or watch mode to, preserving directory structure"`
+	Workers int    `flag:"workers,number of images to process concurrently in indir and watch modes"`
+	Dedupe  string `flag:"dedupe,in indir mode, process byte-identical inputs once and hard link (or copy) the result for duplicates: inputs; outputs also replaces identical outputs of different inputs with hard links"`
+
+	Manifest string `flag:"manifest,JSON file with list of jobs to run, like [{\"input\":\"a.jpg\",\"outputs\":[{\"output\":\"b.webp\",\"width\":800}]}]; outputs can also set height, maxwidth, maxheight, format, quality, square, fit and gravity; results are printed as JSON lines"`
+
+	Preset string `flag:"preset,name of preset from config file to take options from; explicitly set flags override preset values"`
+	Config string `flag:"config,config file with presets (default is image-resize/config.toml in user config directory)"`
+
+	Listen string `flag:"listen,address to serve HTTP requests on, resizing images uploaded or given by url query parameter; w, h, maxw, maxh, q, fmt query parameters override flags"`
+	GRPC   string `flag:"grpc,address to serve gRPC Resizer service on, see resizepb/resize.proto; request options override flags"`
+
+	Sign       string `flag:"sign,print server request path with query, like /?w=100&url=..., with sig parameter added; HTTP server requires signed requests if IMAGE_RESIZE_KEY environment variable sets the secret key"`
+	AllowSizes string `flag:"allow-sizes,comma separated list of width×height pairs (0 for unset) HTTP server requests can set w and h or maxw and maxh to, like 100x100,800x0"`
+
+	ServerCache     string `flag:"server-cache,directory to cache HTTP server responses in, requires server-cache-size"`
+	ServerCacheSize int    `flag:"server-cache-size,max. size in megabytes of HTTP server responses cached in memory, and in server-cache directory if set"`
+	CacheControl    string `flag:"cache-control,Cache-Control header of HTTP server responses, like public, max-age=86400"`
+
+	Metrics string `flag:"metrics,address to serve Prometheus metrics on at /metrics path in listen and grpc modes"`
+	Pprof   bool   `flag:"pprof,also serve runtime profiling data at /debug/pprof/ on metrics address"`
+
+	loopSet bool     // whether Loop was explicitly set
+	frames  []string // still images to assemble into animation
+
+	saved *[]string // local files written by saveOutput, collected if not nil
 }
 
-func do(par params) error {
-	if par.JpegQuality < 1 || par.JpegQuality > 100 {
-		par.JpegQuality = jpeg.DefaultQuality
+// run processes the job described by par, taking care of cache and
+// statistics
+func run(par params) error {
+	if err := par.setCompat(); err != nil {
+		return &resize.Error{Kind: resize.KindInvalidOptions, Err: err}
 	}
-	tr, err := newTransform(par.Width, par.Height, par.MaxWidth, par.MaxHeight)
-	if err != nil {
-		return err
+	if err := par.setGeometry(); err != nil {
+		return &resize.Error{Kind: resize.KindInvalidOptions, Err: err}
 	}
-	f, err := os.Open(par.Input)
-	if err != nil {
+	if err := par.setTo(); err != nil {
+		return &resize.Error{Kind: resize.KindInvalidOptions, Err: err}
+	}
+	if par.Sign != "" {
+		return printSigned(par.Sign)
+	}
+	if par.Listen != "" {
+		return serve(par)
+	}
+	if par.GRPC != "" {
+		return serveGRPC(par)
+	}
+	if par.Inplace {
+		if err := par.setInplace(); err != nil {
+			return err
+		}
+	}
+	var c *resultCache
+	switch {
+	case par.Cache != "" && par.Resume != "":
+		return &resize.Error{Kind: resize.KindInvalidOptions, Err: errors.New("cache and resume cannot be used together")}
+	case par.Cache != "":
+		var err error
+		if c, err = openCache(par.Cache); err != nil {
+			return err
+		}
+	case par.Resume != "":
+		var err error
+		if c, err = openJournal(par.Resume); err != nil {
+			return err
+		}
+	}
+	st := newRunStats()
+	var err error
+	switch {
+	case par.Manifest != "":
+		err = processManifest(par, st)
+	case par.Watch != "":
+		err = watchDir(par, c, st)
+	case par.Indir != "":
+		err = processDir(par, c, st)
+	default:
+		err = processFile(par, c, st)
+	}
+	if c != nil {
+		if err := c.save(); err != nil {
+			return err
+		}
+	}
+	if err := st.report(par); err != nil {
 		return err
 	}
-	defer f.Close()
+	return err
+}
 
-	headBuf := new(bytes.Buffer)
-	teeReader := io.TeeReader(f, headBuf)
-	cfg, kind, err := image.DecodeConfig(teeReader)
-	if err != nil {
-		return err
+// processFile calls do, skipping processing if output was already produced
+// from the same input with the same parameters according to the cache, which
+// can be nil, or if output exists and par.NoClobber is set, or according to
+// par.SkipSmaller and par.NewerThan. Outcome is recorded to st.
+func processFile(par params, c *resultCache, st *runStats) error {
+	if par.saved == nil {
+		par.saved = new([]string)
+	}
+	if par.NoClobber && par.Output != "" && par.Output != stdio && !isRemote(par.Output) && len(par.Outputs) == 0 {
+		if _, err := os.Stat(par.Output); err == nil {
+			st.record(par, true, nil)
+			return nil
+		}
 	}
-	if cfg.Width*cfg.Height > pixelLimit {
-		return fmt.Errorf("image dimensions %d×%d exceeds limit", cfg.Width, cfg.Height)
+	if (par.SkipSmaller || par.NewerThan) && par.Output != "" && par.Output != stdio && !isRemote(par.Output) &&
+		par.Input != "" && par.Input != stdio && !isRemote(par.Input) && !isURL(par.Input) && par.Input != par.Output &&
+		len(par.Outputs) == 0 && par.Explode == "" && par.FrameSet == "" && par.Slice == "" && par.Tile == "" && par.Pyramid == "" && par.Format != "auto" && !isVideo(par.Input) {
+		skip, err := skipFile(par)
+		if err != nil {
+			st.record(par, false, err)
+			return err
+		}
+		if skip {
+			st.record(par, true, nil)
+			return nil
+		}
 	}
-	width, height, err := tr.newDimensions(cfg.Width, cfg.Height)
-	if err != nil {
+	if c == nil || len(par.Outputs) > 0 || par.Input == par.Output || par.Input == "" || par.Input == stdio || par.Output == "" || par.Output == stdio || isRemote(par.Input) || isURL(par.Input) || isRemote(par.Output) || par.Explode != "" || par.FrameSet != "" || par.Slice != "" || par.Tile != "" || par.Pyramid != "" || par.Format == "auto" || isVideo(par.Input) {
+		err := do(par)
+		st.record(par, false, err)
 		return err
 	}
-
-	imageDataReader := io.LimitReader(io.MultiReader(headBuf, f), maxFileSize)
-	exifChan := make(chan exifData, 1)
-	if kind == "jpeg" {
-		prd, pwr := io.Pipe()
-		defer pwr.Close()
-		imageDataReader = io.TeeReader(imageDataReader, pwr)
-		go func() {
-			defer func() {
-				if p := recover(); p != nil {
-					fmt.Fprintln(os.Stderr, "exif decode failed")
-				}
-				io.Copy(ioutil.Discard, prd)
-			}()
-			data, err := exif.Decode(prd)
-			exifChan <- exifData{data, err}
-		}()
-	}
-
-	img, _, err := image.Decode(imageDataReader)
+	key, err := c.key(par)
 	if err != nil {
+		st.record(par, false, err)
 		return err
 	}
+	if c.fresh(key, par.Output) {
+		st.record(par, true, nil)
+		return nil
+	}
+	if err = do(par); err == nil {
+		err = c.store(key, par.Output)
+	}
+	st.record(par, false, err)
+	return err
+}
 
-	var rotatefunc func(image.Image) image.Image
-	var swapWH bool
-	if kind == "jpeg" {
-		select {
-		case ed := <-exifChan:
-			rotatefunc, swapWH = useExifOrientation(ed)
-		default:
-			fmt.Fprintln(os.Stderr, "exif decode failed/stuck")
+func do(par params) error {
+	if par.Diff != "" {
+		return diffFiles(par)
+	}
+	opts, err := par.options()
+	if err != nil {
+		return &resize.Error{Kind: resize.KindInvalidOptions, Err: err}
+	}
+	if par.Generate != "" || par.Placeholder {
+		return generateImage(par, opts)
+	}
+	if par.Probe {
+		return probeImage(par, opts)
+	}
+	if par.DumpMetadata {
+		if err := dumpMetadata(os.Stdout, par.Input); err != nil {
+			return err
+		}
+		if par.Output == "" {
+			return nil
 		}
 	}
-	if swapWH {
-		par.Width, par.Height = par.Height, par.Width
-		par.MaxWidth, par.MaxHeight = par.MaxHeight, par.MaxWidth
-		tr, err = newTransform(par.Width, par.Height, par.MaxWidth, par.MaxHeight)
+	if par.Sheet != "" {
+		return makeSheet(par, opts)
+	}
+	if par.Sequence != "" || len(par.frames) > 0 {
+		return assembleAnimation(par, opts)
+	}
+	ctx, cancel := par.context()
+	defer cancel()
+	var f io.Reader
+	if par.At != "" || isVideo(par.Input) {
+		frame, err := videoFrame(ctx, par.Input, par.At)
 		if err != nil {
 			return err
 		}
-		width, height, err = tr.newDimensions(cfg.Width, cfg.Height)
+		f = bytes.NewReader(frame)
+	} else if par.Input == stdio {
+		f = os.Stdin
+	} else {
+		file, err := par.openInput(ctx, par.Input)
 		if err != nil {
 			return err
 		}
+		defer file.Close()
+		f = file
+	}
+	if par.Explode != "" {
+		return explodeAnimation(f, par, opts)
+	}
+	if par.FrameSet != "" {
+		return saveFrames(ctx, f, par, opts)
+	}
+	if par.Slice != "" || par.Tile != "" {
+		return sliceImage(ctx, f, par, opts)
+	}
+	if par.Pyramid != "" {
+		return savePyramid(ctx, f, par, opts)
+	}
+	if len(par.Outputs) > 0 {
+		return saveOutputs(f, par)
 	}
-	if par.Square {
-		type subImager interface {
-			SubImage(r image.Rectangle) image.Image
+	buf := new(bytes.Buffer)
+	res, err := resize.ProcessContext(ctx, f, buf, opts)
+	if err != nil {
+		return err
+	}
+	return saveOutput(par, buf.Bytes(), res)
+}
+
+// saveOutput writes data to par.Output file, or to stdout if it is "-",
+// verifies it if par.Verify is set and reports it if par.EmitMeta is set.
+// With auto format, par.Output extension is replaced to match format of
+// data.
+func saveOutput(par params, data []byte, want *resize.Result) error {
+	if par.Format == "auto" && par.Output != stdio {
+		if ext := filepath.Ext(par.Output); suffixFormat(strings.ToLower(ext)) != want.Format {
+			par.Output = strings.TrimSuffix(par.Output, ext) + formatSuffix(want.Format)
 		}
-		si, ok := img.(subImager)
-		if !ok {
-			return errors.New("cannot crop image")
+	}
+	if par.Output == stdio {
+		if par.Verify {
+			if err := verifyImage("stdout", bytes.NewReader(data), want); err != nil {
+				return err
+			}
 		}
-		minSide := cfg.Width
-		if cfg.Height < minSide {
-			minSide = cfg.Height
+		if _, err := os.Stdout.Write(data); err != nil {
+			return err
 		}
-		x0, y0 := (cfg.Width-minSide)/2, (cfg.Height-minSide)/2
-		img = si.SubImage(image.Rect(x0, y0, x0+minSide, y0+minSide))
-		width, height, err = tr.newDimensions(minSide, minSide)
-		if err != nil {
+		return emitMeta(par, len(data), want)
+	}
+	if isRemote(par.Output) {
+		if par.NoClobber {
+			return errors.New("no-clobber is not supported for remote outputs")
+		}
+		ctx, cancel := par.context()
+		defer cancel()
+		if err := writeRemote(ctx, par.Output, data, "image/"+want.Format); err != nil {
+			return err
+		}
+		if par.Verify {
+			if err := verifyImage(par.Output, bytes.NewReader(data), want); err != nil {
+				return err
+			}
+		}
+		return emitMeta(par, len(data), want)
+	}
+	var src os.FileInfo // input attributes to copy, taken before it's replaced
+	if par.Preserve && par.Input != "" && par.Input != stdio && !isRemote(par.Input) && !isURL(par.Input) {
+		var err error
+		if src, err = os.Stat(par.Input); err != nil {
+			return err
+		}
+	}
+	if err := writeFile(par.Output, data, par.NoClobber); err != nil {
+		if err == errExists {
+			if par.Quiet {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "%s already exists, not overwritten\n", par.Output)
+			return nil
+		}
+		return err
+	}
+	if par.saved != nil {
+		*par.saved = append(*par.saved, par.Output)
+	}
+	if src != nil {
+		if err := copyAttrs(par.Output, src); err != nil {
+			return err
+		}
+	}
+	if par.Verify {
+		if err := verifyOutput(par.Output, want); err != nil {
 			return err
 		}
 	}
-	outSuffix := strings.ToLower(filepath.Ext(par.Output))
-	var outImg image.Image
-	if (cfg.Width <= width && cfg.Height <= height) && (tr.MaxWidth > 0 || tr.MaxHeight > 0) {
-		// noupscale case
-		outImg = img
-		goto saveOutput
+	return emitMeta(par, len(data), want)
+}
+
+// context returns context limiting processing time to par.Timeout, if set
+func (par params) context() (context.Context, context.CancelFunc) {
+	if par.Timeout > 0 {
+		return context.WithTimeout(context.Background(), par.Timeout)
 	}
-	switch img.(type) {
-	case *image.YCbCr, *image.RGBA, *image.NRGBA, *image.Gray:
-		outImg, err = resize(img, width, height, rez.NewLanczosFilter(3))
+	return context.WithCancel(context.Background())
+}
+
+// setInplace makes par write results over its input file or files in input
+// directory
+func (par *params) setInplace() error {
+	switch {
+	case par.Output != "" || par.Outdir != "" || len(par.Outputs) > 0 || par.Explode != "" || par.Manifest != "":
+		return errors.New("inplace cannot be used with output files or directories")
+	case par.Indir != "":
+		par.Outdir = par.Indir
+	case par.Input == "" || par.Input == stdio || isURL(par.Input) || par.At != "" || isVideo(par.Input):
+		return errors.New("inplace requires input image file")
 	default:
-		outImg, err = resizeFallback(img, width, height)
+		par.Output = par.Input
+	}
+	return nil
+}
+
+// copyAttrs sets modification time and permission bits of dst file to the
+// ones from fi
+func copyAttrs(dst string, fi os.FileInfo) error {
+	if err := os.Chmod(dst, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+var errExists = errors.New("file already exists")
+
+// writeFile writes data to temporary file in the same directory as name and
+// renames it to name on success, so readers never see partially written
+// file. If noClobber is set and name already exists, it is left intact and
+// errExists is returned. Mode of replaced file is preserved.
+func writeFile(name string, data []byte, noClobber bool) error {
+	mode := os.FileMode(0644)
+	switch fi, err := os.Stat(name); {
+	case err == nil && noClobber:
+		return errExists
+	case err == nil:
+		mode = fi.Mode().Perm()
+	case !os.IsNotExist(err):
+		return err
 	}
+	tf, err := ioutil.TempFile(filepath.Dir(name), ".image-resize-")
 	if err != nil {
 		return err
 	}
-saveOutput:
-	if op, ok := outImg.(opaquer); ok && !par.NoFill && !op.Opaque() && outSuffix != ".png" {
-		newOut := image.NewRGBA(outImg.Bounds())
-		draw.Copy(newOut, image.Point{}, image.White, newOut.Bounds(), draw.Src, nil)
-		draw.Copy(newOut, image.Point{}, outImg, newOut.Bounds(), draw.Over, nil)
-		outImg = newOut
+	defer os.Remove(tf.Name())
+	defer tf.Close()
+	if _, err := tf.Write(data); err != nil {
+		return err
 	}
-	if rotatefunc != nil {
-		outImg = rotatefunc(outImg)
+	if err := tf.Chmod(mode); err != nil {
+		return err
 	}
-	of, err := os.Create(par.Output)
-	if err != nil {
+	if err := tf.Close(); err != nil {
 		return err
 	}
-	defer of.Close()
-	switch outSuffix {
-	case ".gif":
-		gifOpts := &gif.Options{NumColors: 256, Quantizer: mean.Quantizer(256)}
-		if pImg, ok := img.(*image.Paletted); ok {
-			gifOpts.NumColors = len(pImg.Palette)
-			gifOpts.Quantizer = mean.Quantizer(gifOpts.NumColors)
+	return os.Rename(tf.Name(), name)
+}
+
+// options returns resize.Options matching par, output format is derived from
+// par.Output name unless set explicitly
+func (par params) options() (resize.Options, error) {
+	opts := resize.Options{
+		Width:       par.Width,
+		Height:      par.Height,
+		MaxWidth:    par.MaxWidth,
+		MaxHeight:   par.MaxHeight,
+		MaxLong:     par.MaxLong,
+		MaxShort:    par.MaxShort,
+		Square:      par.Square,
+		Fit:         par.Fit,
+		Gravity:     par.Gravity,
+		Threads:     par.Threads,
+		LowMemory:   par.LowMem,
+		Rotate:      par.Rotate,
+		Flip:        par.Flip,
+		NoFill:      par.NoFill,
+		SRGB:        par.SRGB,
+		KeepEXIF:    par.KeepEXIF,
+		Strip:       par.Strip,
+		StripGPS:    par.StripGPS,
+		Format:      strings.ToLower(par.Format),
+		Filter:      par.Filter,
+		JpegQuality: par.JpegQuality,
+		Progressive: par.Progressive,
+		Subsample:   par.Subsample,
+		GifColors:   par.GifColors,
+		PngColors:   par.Colors,
+		FPS:         par.FPS,
+		DropFrames:  par.DropFrames,
+
+		PngCompression:  par.PngCompression,
+		TiffCompression: par.TiffCompression,
+
+		Warnf: func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format+"\n", args...)
+		},
+		UseEXIFThumb: par.ExifThumb,
+		Grayscale:    par.Grayscale,
+		Sepia:        par.Sepia,
+		Brightness:   par.Brightness,
+		Contrast:     par.Contrast,
+		Saturation:   par.Saturation,
+		GrayOutput:   par.GrayOutput,
+		DPI:          par.DPI,
+		Optimize:     par.Optimize,
+		Trim:         par.Trim,
+		TrimFuzz:     par.TrimFuzz,
+		Interlace:    par.Interlace,
+		Metrics:      par.QualityMetrics,
+		Placeholder:  par.PlaceholderHash,
+	}
+	opts.Deterministic = par.Deterministic
+	if par.Quiet {
+		opts.Warnf = nil
+	}
+	if par.Verbose {
+		name := par.Input
+		opts.Debugf = func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, "%s: "+format+"\n", append([]interface{}{name}, args...)...)
 		}
-		err = gif.Encode(of, outImg, gifOpts)
-	case ".png":
-		enc := png.Encoder{CompressionLevel: png.BestCompression}
-		err = enc.Encode(of, outImg)
-	case ".tiff", ".tif":
-		err = tiff.Encode(of, outImg,
-			&tiff.Options{Compression: tiff.Deflate, Predictor: true})
-	case ".bmp":
-		err = bmp.Encode(of, outImg)
+	}
+	switch opts.Format {
+	case "":
+		opts.Format = formatName(strings.ToLower(filepath.Ext(par.Output)))
+	case "jpg":
+		opts.Format = "jpeg"
+	}
+	if par.loopSet {
+		opts.Loop = &par.Loop
+	}
+	switch par.EmitMeta {
+	case "":
+	case "print", "sidecar":
+		opts.Hash = true
 	default:
-		err = jpeg.Encode(of, outImg, &jpeg.Options{Quality: par.JpegQuality})
+		return opts, fmt.Errorf("unsupported emit-meta value %q, should be print or sidecar", par.EmitMeta)
 	}
-	if err != nil {
-		return err
+	switch {
+	case par.Frame < 0:
+		return opts, errors.New("frame should be positive")
+	case par.Frame > 0:
+		opts.Frame = par.Frame - 1
+	}
+	opts.FirstFrame = par.FirstFrame || par.Frame == 1
+	var err error
+	if opts.MaxBytes, err = parseBytes(par.MaxBytes); err != nil {
+		return opts, err
+	}
+	switch par.Background {
+	case "":
+	case "none":
+		opts.NoFill = true
+	default:
+		if opts.Background, err = parseColor(par.Background); err != nil {
+			return opts, err
+		}
+	}
+	if opts.Scale, err = parseScale(par.Scale); err != nil {
+		return opts, err
+	}
+	if par.Pad {
+		if par.Fit != "" && par.Fit != "contain" {
+			return opts, fmt.Errorf("pad cannot be used with %s fit", par.Fit)
+		}
+		if par.Width <= 0 || par.Height <= 0 {
+			return opts, errors.New("pad requires both width and height")
+		}
+		opts.Fit = "contain"
+	}
+	if opts.Sharpen, err = parseSharpen(par.Sharpen); err != nil {
+		return opts, err
+	}
+	if par.Ops != "" {
+		if opts.Ops, err = resize.ParseOps(par.Ops); err != nil {
+			return opts, err
+		}
+	}
+	if opts.Overlay, err = loadOverlay(par); err != nil {
+		return opts, err
 	}
-	return of.Close()
+	opts.Watermark, err = loadWatermark(par)
+	return opts, err
 }
 
-type transform struct {
-	Width     int
-	Height    int
-	MaxWidth  int
-	MaxHeight int
+// parseScale parses scale given as percentage (50%) or factor (0.5),
+// returning 0 if s is empty
+func parseScale(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	num, mult := s, 1.0
+	if strings.HasSuffix(s, "%") {
+		num, mult = s[:len(s)-1], 0.01
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v <= 0 || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid scale %q", s)
+	}
+	return v * mult, nil
 }
 
-func (tr transform) newDimensions(origWidth, origHeight int) (width, height int, err error) {
-	if origWidth == 0 || origHeight == 0 {
-		return 0, 0, errors.New("invalid source dimensions")
+// setGeometry sets dimensions of par from par.Geometry given in
+// ImageMagick-like form: WxH scales image to fit inside the box keeping
+// aspect ratio, WxH! scales it to exact size, WxH> only shrinks images larger
+// than the box, WxH^ scales it to cover the box, W or xH set just one side,
+// and N% scales image by N percent.
+func (par *params) setGeometry() error {
+	g := par.Geometry
+	if g == "" {
+		return nil
+	}
+	if par.Width != 0 || par.Height != 0 || par.MaxWidth != 0 || par.MaxHeight != 0 ||
+		par.MaxLong != 0 || par.MaxShort != 0 || par.Scale != "" {
+		return errors.New("geometry cannot be used with width, height, maxwidth, maxheight, maxlong, maxshort or scale")
+	}
+	invalid := fmt.Errorf("invalid geometry %q", g)
+	var mod byte
+	if n := len(g); strings.IndexByte("%!<>^@", g[n-1]) >= 0 {
+		g, mod = g[:n-1], g[n-1]
 	}
 	var w, h int
-	switch {
-	case tr.MaxWidth > 0 || tr.MaxHeight > 0:
-		w, h = tr.MaxWidth, tr.MaxHeight
-		// if only one max dimension specified, calculate another using
-		// original aspect ratio
-		if w == 0 {
-			w = origWidth * h / origHeight
-		}
-		if h == 0 {
-			h = origHeight * w / origWidth
-		}
-		if origWidth <= w && origHeight <= h {
-			return origWidth, origHeight, nil // image already fit
-		}
-		if tr.MaxWidth > 0 && tr.MaxHeight > 0 {
-			// maxwidth and maxheight form free aspect ratio, need
-			// to adjust w and h to match origin aspect ratio, while
-			// keeping dimensions inside max bounds
-			if float64(origWidth)/float64(origHeight) > float64(w)/float64(h) {
-				h = origHeight * w / origWidth
-			} else {
-				w = origWidth * h / origHeight
-			}
+	size := strings.SplitN(g, "x", 2)
+	var err error
+	if size[0] != "" {
+		if w, err = strconv.Atoi(size[0]); err != nil || w <= 0 {
+			return invalid
+		}
+	}
+	if len(size) == 2 {
+		if h, err = strconv.Atoi(size[1]); err != nil || h <= 0 {
+			return invalid
 		}
-	case tr.Width > 0 || tr.Height > 0:
-		// if both width and height specified, free aspect ratio is
-		// applied; if only one is set, original aspect ratio is kept
-		w, h = tr.Width, tr.Height
-		if w == 0 {
-			w = origWidth * h / origHeight
+	}
+	if w == 0 && h == 0 {
+		return invalid
+	}
+	switch mod {
+	case 0:
+		par.Width, par.Height = w, h
+		if par.Fit == "" && w != 0 && h != 0 {
+			par.Fit = "inside"
 		}
-		if h == 0 {
-			h = origHeight * w / origWidth
+	case '!':
+		par.Width, par.Height = w, h
+	case '>':
+		par.MaxWidth, par.MaxHeight = w, h
+	case '%':
+		if w == 0 || h != 0 && h != w {
+			return fmt.Errorf("geometry %q: only uniform percentage scale is supported", par.Geometry)
+		}
+		par.Scale = size[0] + "%"
+	case '^':
+		par.Width, par.Height = w, h
+		if par.Fit == "" && w != 0 && h != 0 {
+			par.Fit = "outside"
 		}
 	default:
-		return 0, 0, fmt.Errorf("invalid transform %v", tr)
-	}
-	if w*h > pixelLimit || w >= 1<<16 || h >= 1<<16 {
-		return 0, 0, errors.New("destination size exceeds limit")
+		return fmt.Errorf("geometry %q: %q modifier is not supported", par.Geometry, mod)
 	}
-	return w, h, nil
+	return nil
 }
 
-func newTransform(width, height, maxWidth, maxHeight int) (transform, error) {
-	tr := transform{
-		Width:     width,
-		Height:    height,
-		MaxWidth:  maxWidth,
-		MaxHeight: maxHeight,
+// setCompat maps ImageMagick convert options onto native ones: resize to
+// geometry, quality to q and extent to fit, so that convert invocations can
+// be translated flag by flag. Gravity names are made lower case, as convert
+// accepts them capitalized, like Center.
+func (par *params) setCompat() error {
+	if par.Quality != 0 {
+		par.JpegQuality = par.Quality
+	}
+	par.Gravity = strings.ToLower(par.Gravity)
+	if par.Resize != "" {
+		if par.Geometry != "" {
+			return errors.New("resize and geometry cannot be used together")
+		}
+		par.Geometry = par.Resize
 	}
-	if tr.Width == 0 && tr.Height == 0 && tr.MaxWidth == 0 && tr.MaxHeight == 0 {
-		return transform{}, errors.New("no valid dimensions specified")
+	if par.Extent == "" {
+		return nil
 	}
-	if tr.Width*tr.Height > pixelLimit || tr.MaxWidth > pixelLimit || tr.MaxHeight > pixelLimit {
-		return transform{}, errors.New("destination size exceeds limit")
+	if par.Geometry == "" || par.Fit != "" || par.Pad {
+		return errors.New("extent requires resize and cannot be used with fit or pad")
 	}
-	return tr, nil
+	g := par.Geometry
+	switch {
+	case strings.TrimSuffix(g, "^") == par.Extent:
+		par.Fit = "cover"
+	case strings.TrimSuffix(g, "!") == par.Extent:
+	case g == par.Extent:
+		par.Fit = "contain"
+	default:
+		return fmt.Errorf("extent %q is only supported with resize of the same dimensions", par.Extent)
+	}
+	if !strings.Contains(par.Extent, "x") || strings.HasPrefix(par.Extent, "x") || strings.HasSuffix(par.Extent, "x") {
+		return fmt.Errorf("extent %q should be given as WxH", par.Extent)
+	}
+	return nil
 }
 
-func resize(inImg image.Image, width, height int, algo rez.Filter) (image.Image, error) {
-	var outImg image.Image
-	rect := image.Rect(0, 0, width, height)
-	switch inImg.(type) {
-	case *image.Gray:
-		outImg = image.NewGray(rect)
-	case *image.RGBA:
-		outImg = image.NewRGBA(rect)
-	case *image.NRGBA:
-		outImg = image.NewNRGBA(rect)
-	default:
-		outImg = image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+// setTo sets par.Format to par.To, failing if it conflicts with par.Format or
+// with extensions of output files, unless par.Force is set
+func (par *params) setTo() error {
+	if par.To == "" {
+		return nil
+	}
+	to := strings.ToLower(par.To)
+	if to == "jpg" {
+		to = "jpeg"
+	}
+	if to == "auto" {
+		if par.Format != "" {
+			return fmt.Errorf("to %q conflicts with format %q", par.To, par.Format)
+		}
+		par.Format = to
+		return nil
 	}
-	if err := rez.Convert(outImg, inImg, algo); err != nil {
-		return nil, err
+	if suffixFormat("."+to) != to && !resize.IsRegistered(to) {
+		return fmt.Errorf("unsupported output format %q", par.To)
+	}
+	if f := strings.ToLower(par.Format); f != "" && f != to && !(f == "jpg" && to == "jpeg") {
+		return fmt.Errorf("to %q conflicts with format %q", par.To, par.Format)
+	}
+	names := []string{par.Output}
+	for _, o := range par.Outputs {
+		names = append(names, o.name)
 	}
-	return outImg, nil
+	for _, name := range names {
+		if name == stdio || par.Force {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(name))
+		if f := suffixFormat(ext); f != "" && f != to {
+			return fmt.Errorf("%s extension is for %s, not %s format, use force to write it anyway", name, f, to)
+		}
+	}
+	par.Format = to
+	return nil
 }
 
-func resizeFallback(inImg image.Image, width, height int) (image.Image, error) {
-	outImg := image.NewRGBA(image.Rect(0, 0, width, height))
-	draw.CatmullRom.Scale(outImg, outImg.Bounds(), inImg, inImg.Bounds(), draw.Src, nil)
-	return outImg, nil
+// parseBytes parses size in bytes with optional k or m suffix (KiB, MiB),
+// returning 0 if s is empty
+func parseBytes(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	num, mult := s, 1.0
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		num, mult = s[:len(s)-1], 1<<10
+	case "m":
+		num, mult = s[:len(s)-1], 1<<20
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v*mult < 1 || v*mult > 1<<31-1 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int(v * mult), nil
 }
 
-const (
-	pixelLimit  = 50 * 1000000
-	maxFileSize = 50 << 20
-)
+// parseSharpen parses amount[,radius,threshold] string, returning nil if s
+// is empty
+func parseSharpen(s string) (*resize.Sharpen, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var vals [3]float64
+	fields := strings.Split(s, ",")
+	if len(fields) > len(vals) {
+		return nil, fmt.Errorf("invalid sharpen value %q, should be amount[,radius,threshold]", s)
+	}
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sharpen value %q, should be amount[,radius,threshold]", s)
+		}
+		vals[i] = v
+	}
+	return &resize.Sharpen{Amount: vals[0], Radius: vals[1], Threshold: vals[2]}, nil
+}
 
-type opaquer interface {
-	Opaque() bool
+// stdio is a file name standing for stdin or stdout
+const stdio = "-"
+
+// formatName returns name of image format that is used to save files with
+// given name suffix
+func formatName(suffix string) string {
+	if name := suffixFormat(suffix); name != "" {
+		return name
+	}
+	return "jpeg"
 }
 
-type exifData struct {
-	exif *exif.Exif
-	err  error
+// suffixFormat returns name of image format of files with given name suffix,
+// or empty string if suffix is unknown
+func suffixFormat(suffix string) string {
+	if name := strings.TrimPrefix(suffix, "."); name != "" && resize.IsRegistered(name) {
+		return name
+	}
+	switch suffix {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".gif":
+		return "gif"
+	case ".png":
+		return "png"
+	case ".tiff", ".tif":
+		return "tiff"
+	case ".bmp":
+		return "bmp"
+	case ".webp":
+		return "webp"
+	}
+	return ""
 }
 
-func useExifOrientation(ed exifData) (rotatefunc func(image.Image) image.Image, swapWH bool) {
-	if ed.err != nil || ed.exif == nil {
-		return
-	}
-	o, err := ed.exif.Get(exif.Orientation)
-	if err != nil || o == nil || len(o.Val) != 2 {
-		return
-	}
-	for _, x := range o.Val {
-		switch x {
-		case 3: // 180º
-			return rotate180, false
-		case 6: // 90ºCCW
-			return rotate90ccw, true
-		case 8: // 90ºCW
-			return rotate90cw, true
-		case 4: // vertical flip
-			return flipVertical, true
-		case 2: // horizontal flip
-			return flipHorizontal, true
-		}
-	}
-	return
+// formatSuffix returns file name suffix for image format
+func formatSuffix(format string) string {
+	if format == "jpeg" {
+		return ".jpg"
+	}
+	return "." + format
 }
 
-func flipHorizontal(src image.Image) image.Image { return rotate(src, gift.FlipHorizontal()) }
-func flipVertical(src image.Image) image.Image   { return rotate(src, gift.FlipVertical()) }
-func rotate90ccw(src image.Image) image.Image    { return rotate(src, gift.Rotate270()) }
-func rotate90cw(src image.Image) image.Image     { return rotate(src, gift.Rotate90()) }
-func rotate180(src image.Image) image.Image      { return rotate(src, gift.Rotate180()) }
-
-func rotate(src image.Image, filter gift.Filter) image.Image {
-	g := gift.New(filter)
-	var dst draw.Image
-	switch src.(type) {
-	case *image.Gray:
-		dst = image.NewGray(g.Bounds(src.Bounds()))
-	default:
-		dst = image.NewRGBA(g.Bounds(src.Bounds()))
+// writeImage encodes img according to opts and saves it to par.Output
+func writeImage(par params, opts resize.Options, img image.Image) error {
+	if opts.Format == "auto" {
+		opts.Format = resize.AutoFormat(img)
+	}
+	buf := new(bytes.Buffer)
+	if err := resize.Encode(buf, img, opts); err != nil {
+		return err
+	}
+	res := &resize.Result{
+		Format: opts.Format,
+		Width:  img.Bounds().Dx(),
+		Height: img.Bounds().Dy(),
+	}
+	if opts.Hash {
+		res.Hash = resize.DHash(img)
+	}
+	res.Placeholder = resize.Placeholder(img, opts.Placeholder)
+	return saveOutput(par, buf.Bytes(), res)
+}
+
+// decodeFile decodes image from named file, checking that image fits
+// pixelLimit before fully decoding it
+func decodeFile(name string) (image.Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > resize.PixelLimit {
+		return nil, fmt.Errorf("image dimensions %d×%d exceeds limit", cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
 	}
-	g.Draw(dst, src)
-	return dst
+	img, _, err := image.Decode(io.LimitReader(f, resize.MaxFileSize))
+	return img, err
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/artyom/image-resize/resize"
+)
+
+// manifestJob is a single job of -manifest file: input file and outputs to
+// produce from it
+type manifestJob struct {
+	Input   string           `json:"input"`
+	Outputs []manifestOutput `json:"outputs"`
+}
+
+// manifestOutput describes single output of manifest job. Settings not set
+// here are taken from command line flags.
+type manifestOutput struct {
+	Output    string `json:"output"`
+	Format    string `json:"format,omitempty"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	MaxWidth  int    `json:"maxwidth,omitempty"`
+	MaxHeight int    `json:"maxheight,omitempty"`
+	Quality   int    `json:"quality,omitempty"`
+	Square    bool   `json:"square,omitempty"`
+	Fit       string `json:"fit,omitempty"`
+	Gravity   string `json:"gravity,omitempty"`
+}
+
+// manifestResult is the outcome of manifest job, printed as a JSON line to
+// stdout
+type manifestResult struct {
+	Input   string                 `json:"input"`
+	Outputs []manifestOutputResult `json:"outputs,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+type manifestOutputResult struct {
+	Output string `json:"output"`
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Frames int    `json:"frames,omitempty"`
+	Size   int    `json:"size"`
+}
+
+// processManifest runs jobs listed in par.Manifest JSON file, printing
+// results of each job as JSON line to stdout. Failure of one job doesn't
+// stop processing of others.
+func processManifest(par params, st *runStats) error {
+	if par.Input != "" || par.Output != "" || par.Indir != "" || len(par.Outputs) > 0 {
+		return errors.New("input and output files or directories cannot be used with manifest")
+	}
+	data, err := ioutil.ReadFile(par.Manifest)
+	if err != nil {
+		return err
+	}
+	var jobs []manifestJob
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return fmt.Errorf("reading manifest: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	var failed int
+	for i, job := range jobs {
+		p := par
+		p.saved = new([]string)
+		res, err := runManifestJob(p, job)
+		if err != nil {
+			failed++
+			res.Error = err.Error()
+		}
+		p.Input = job.Input
+		st.record(p, false, err)
+		if err := enc.Encode(res); err != nil {
+			return err
+		}
+		if par.Progress {
+			printProgress(i+1, len(jobs))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d jobs failed", failed, len(jobs))
+	}
+	return nil
+}
+
+// runManifestJob decodes job input once and saves it to all job outputs
+func runManifestJob(par params, job manifestJob) (*manifestResult, error) {
+	res := &manifestResult{Input: job.Input}
+	if job.Input == "" || len(job.Outputs) == 0 {
+		return res, errors.New("job should have input and at least one output")
+	}
+	pars := make([]params, len(job.Outputs))
+	targets := make([]resize.Target, len(job.Outputs))
+	for i, o := range job.Outputs {
+		if o.Output == "" {
+			return res, errors.New("output file name is not set")
+		}
+		p := par
+		p.Input, p.Output = job.Input, o.Output
+		p.Width, p.Height, p.MaxWidth, p.MaxHeight = o.Width, o.Height, o.MaxWidth, o.MaxHeight
+		p.Scale = ""
+		p.MaxLong, p.MaxShort = 0, 0
+		if o.Format != "" {
+			p.Format = o.Format
+		}
+		if o.Quality != 0 {
+			p.JpegQuality = o.Quality
+		}
+		if o.Square {
+			p.Square = true
+		}
+		if o.Fit != "" {
+			p.Fit = o.Fit
+		}
+		if o.Gravity != "" {
+			p.Gravity = o.Gravity
+		}
+		opts, err := p.options()
+		if err != nil {
+			return res, fmt.Errorf("%s: %v", o.Output, err)
+		}
+		pars[i] = p
+		targets[i] = resize.Target{W: new(bytes.Buffer), Opts: opts}
+	}
+	ctx, cancel := par.context()
+	defer cancel()
+	f, err := par.openInput(ctx, job.Input)
+	if err != nil {
+		return res, err
+	}
+	defer f.Close()
+	results, err := resize.ProcessMultiContext(ctx, f, targets)
+	if err != nil {
+		return res, err
+	}
+	for i, p := range pars {
+		data := targets[i].W.(*bytes.Buffer).Bytes()
+		if err := saveOutput(p, data, results[i]); err != nil {
+			return res, fmt.Errorf("%s: %v", p.Output, err)
+		}
+		res.Outputs = append(res.Outputs, manifestOutputResult{
+			Output: p.Output,
+			Format: results[i].Format,
+			Width:  results[i].Width,
+			Height: results[i].Height,
+			Frames: results[i].Frames,
+			Size:   len(data),
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"unicode/utf8"
+
+	"github.com/artyom/image-resize/resize"
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// imageMetadata is a structured representation of image metadata
+type imageMetadata struct {
+	Format string                     `json:"format"`
+	Width  int                        `json:"width"`
+	Height int                        `json:"height"`
+	Exif   map[string]json.RawMessage `json:"exif,omitempty"`
+	XMP    string                     `json:"xmp,omitempty"`
+	IPTC   map[string][]string        `json:"iptc,omitempty"`
+}
+
+// probeImage prints information about par.Input image and the output it
+// would be transformed to as JSON to stdout, without decoding the image
+func probeImage(par params, opts resize.Options) error {
+	var r io.Reader = os.Stdin
+	if par.Input != stdio {
+		f, err := par.openInput(context.Background(), par.Input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	info, err := resize.Probe(r, opts)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
+// dumpMetadata writes EXIF, XMP and IPTC metadata of named image file as
+// JSON object to w
+func dumpMetadata(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cfg, kind, err := image.DecodeConfig(f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	md := &imageMetadata{Format: kind, Width: cfg.Width, Height: cfg.Height}
+	var exifData []byte
+	switch kind {
+	case "jpeg":
+		exifData, err = md.readJpeg(bufio.NewReader(io.LimitReader(f, resize.MaxFileSize)))
+	case "png":
+		exifData, err = md.readPng(bufio.NewReader(io.LimitReader(f, resize.MaxFileSize)))
+	case "tiff":
+		var x *exif.Exif
+		if x, err = exif.Decode(io.LimitReader(f, resize.MaxFileSize)); err == nil || x != nil {
+			err = md.setExif(x)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if exifData != nil {
+		if x, err := exif.Decode(bytes.NewReader(exifData)); err == nil || x != nil {
+			if err := md.setExif(x); err != nil {
+				return err
+			}
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(md)
+}
+
+func (md *imageMetadata) setExif(x *exif.Exif) error {
+	md.Exif = make(map[string]json.RawMessage)
+	return x.Walk(exifWalker(func(name exif.FieldName, tag *tiff.Tag) error {
+		val, err := tag.MarshalJSON()
+		if err != nil || !json.Valid(val) {
+			// tiff package doesn't properly escape some strings
+			if val, err = json.Marshal(tag.String()); err != nil {
+				return err
+			}
+		}
+		md.Exif[string(name)] = val
+		return nil
+	}))
+}
+
+type exifWalker func(name exif.FieldName, tag *tiff.Tag) error
+
+func (fn exifWalker) Walk(name exif.FieldName, tag *tiff.Tag) error { return fn(name, tag) }
+
+// readJpeg reads jpeg segments up to the start of scan, filling XMP and IPTC
+// metadata. It returns raw EXIF data in a form suitable for exif.Decode.
+func (md *imageMetadata) readJpeg(r *bufio.Reader) (exifData []byte, err error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+		return nil, err
+	}
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return exifData, err
+		}
+		for hdr[1] == 0xff { // fill bytes
+			hdr[1], hdr[2], hdr[3] = hdr[2], hdr[3], 0
+			if hdr[3], err = r.ReadByte(); err != nil {
+				return exifData, err
+			}
+		}
+		marker := hdr[1]
+		if hdr[0] != 0xff || marker == 0xda || marker == 0xd9 { // SOS, EOI
+			return exifData, nil
+		}
+		size := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if size < 0 {
+			return exifData, fmt.Errorf("invalid jpeg segment size")
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return exifData, err
+		}
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(data, []byte("Exif\x00\x00")):
+			exifData = data
+		case marker == 0xe1 && bytes.HasPrefix(data, []byte(xmpJpegHeader)):
+			md.XMP = string(data[len(xmpJpegHeader):])
+		case marker == 0xed && bytes.HasPrefix(data, []byte(photoshopHeader)):
+			md.readPhotoshop(data[len(photoshopHeader):])
+		}
+	}
+}
+
+// readPng reads png chunks up to the first IDAT one, filling XMP metadata.
+// It returns raw EXIF data in a form suitable for exif.Decode.
+func (md *imageMetadata) readPng(r *bufio.Reader) (exifData []byte, err error) {
+	if _, err := r.Discard(8); err != nil { // png signature
+		return nil, err
+	}
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return exifData, err
+		}
+		size, typ := binary.BigEndian.Uint32(hdr[:4]), string(hdr[4:])
+		if typ == "IDAT" || typ == "IEND" {
+			return exifData, nil
+		}
+		if size > resize.MaxFileSize {
+			return exifData, fmt.Errorf("invalid png chunk size")
+		}
+		data := make([]byte, size+4) // chunk data + crc
+		if _, err := io.ReadFull(r, data); err != nil {
+			return exifData, err
+		}
+		data = data[:size]
+		switch typ {
+		case "eXIf":
+			exifData = data
+		case "iTXt":
+			// keyword, null separator, compression flag, compression
+			// method, language tag, null separator, translated keyword,
+			// null separator, text
+			if !bytes.HasPrefix(data, []byte(xmpPngKeyword+"\x00\x00")) {
+				continue
+			}
+			fields := bytes.SplitN(data[len(xmpPngKeyword)+3:], []byte{0}, 3)
+			if len(fields) == 3 {
+				md.XMP = string(fields[2])
+			}
+		}
+	}
+}
+
+// readPhotoshop parses Photoshop image resource blocks stored in jpeg APP13
+// segment, extracting IPTC records from them
+func (md *imageMetadata) readPhotoshop(b []byte) {
+	for len(b) >= 12 && string(b[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(b[4:])
+		nameLen := int(b[6])
+		off := 7 + nameLen
+		if off%2 != 0 { // name is padded to even size
+			off++
+		}
+		if len(b) < off+4 {
+			return
+		}
+		size := int(binary.BigEndian.Uint32(b[off:]))
+		off += 4
+		if size < 0 || len(b) < off+size {
+			return
+		}
+		if id == 0x0404 { // IPTC-NAA record
+			md.readIPTC(b[off : off+size])
+		}
+		if size%2 != 0 {
+			size++
+		}
+		if off+size > len(b) {
+			return
+		}
+		b = b[off+size:]
+	}
+}
+
+// readIPTC parses IPTC IIM datasets
+func (md *imageMetadata) readIPTC(b []byte) {
+	for len(b) >= 5 && b[0] == 0x1c {
+		record, dataset := b[1], b[2]
+		size := int(binary.BigEndian.Uint16(b[3:]))
+		if size&0x8000 != 0 || len(b) < 5+size { // extended datasets are not supported
+			return
+		}
+		val := b[5 : 5+size]
+		b = b[5+size:]
+		if record != 2 || !utf8.Valid(val) {
+			continue
+		}
+		name, ok := iptcNames[dataset]
+		if !ok {
+			name = fmt.Sprintf("2:%d", dataset)
+		}
+		if md.IPTC == nil {
+			md.IPTC = make(map[string][]string)
+		}
+		md.IPTC[name] = append(md.IPTC[name], string(val))
+	}
+}
+
+var iptcNames = map[byte]string{
+	5:   "ObjectName",
+	7:   "EditStatus",
+	10:  "Urgency",
+	15:  "Category",
+	20:  "SupplementalCategories",
+	25:  "Keywords",
+	40:  "SpecialInstructions",
+	55:  "DateCreated",
+	60:  "TimeCreated",
+	65:  "OriginatingProgram",
+	80:  "By-line",
+	85:  "By-lineTitle",
+	90:  "City",
+	92:  "Sub-location",
+	95:  "Province-State",
+	100: "Country-PrimaryLocationCode",
+	101: "Country-PrimaryLocationName",
+	103: "OriginalTransmissionReference",
+	105: "Headline",
+	110: "Credit",
+	115: "Source",
+	116: "CopyrightNotice",
+	118: "Contact",
+	120: "Caption-Abstract",
+	122: "Writer-Editor",
+}
+
+const (
+	xmpJpegHeader   = "http://ns.adobe.com/xap/1.0/\x00"
+	xmpPngKeyword   = "XML:com.adobe.xmp"
+	photoshopHeader = "Photoshop 3.0\x00"
+)
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/artyom/image-resize/resize"
+)
+
+// latencyBuckets are upper bounds of latency histogram buckets, in seconds
+var latencyBuckets = [...]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// serverMetrics accumulates statistics of images processed in server modes
+// and exposes them in Prometheus text format. Methods of nil *serverMetrics
+// do nothing.
+type serverMetrics struct {
+	mu        sync.Mutex
+	processed map[string]int64 // by output format
+	errors    map[string]int64 // by error class
+	bytesIn   int64
+	bytesOut  int64
+	latency   map[[2]string]*histogram // by stage and format
+}
+
+type histogram struct {
+	counts [len(latencyBuckets)]int64 // non-cumulative
+	count  int64
+	sum    float64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	if i := sort.SearchFloat64s(latencyBuckets[:], v); i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// startMetrics serves metrics on par.Metrics address, along with pprof
+// handlers if par.Pprof is set. It returns nil if par.Metrics is empty.
+func startMetrics(par params) (*serverMetrics, error) {
+	if par.Metrics == "" {
+		if par.Pprof {
+			return nil, &resize.Error{Kind: resize.KindInvalidOptions, Err: errors.New("-pprof requires -metrics")}
+		}
+		return nil, nil
+	}
+	m := &serverMetrics{
+		processed: make(map[string]int64),
+		errors:    make(map[string]int64),
+		latency:   make(map[[2]string]*histogram),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	if par.Pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	ln, err := net.Listen("tcp", par.Metrics)
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(ln, mux)
+	return m, nil
+}
+
+// observe registers successfully processed image, written as size bytes
+func (m *serverMetrics) observe(res *resize.Result, size int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.processed[res.Format]++
+	m.bytesIn += res.BytesRead
+	m.bytesOut += int64(size)
+	for _, v := range [...]struct {
+		stage, format string
+		d             time.Duration
+	}{
+		{"decode", res.Source, res.DecodeTime},
+		{"resize", res.Format, res.ScaleTime},
+		{"encode", res.Format, res.EncodeTime},
+	} {
+		if v.d == 0 {
+			continue
+		}
+		key := [2]string{v.stage, v.format}
+		h := m.latency[key]
+		if h == nil {
+			h = new(histogram)
+			m.latency[key] = h
+		}
+		h.observe(v.d)
+	}
+}
+
+// fail registers failed request
+func (m *serverMetrics) fail(err error) {
+	if m == nil {
+		return
+	}
+	kind, _ := errorClass(err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[kind]++
+}
+
+func (m *serverMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeCounters(w, "imageresize_processed_total", "Images processed, by output format.", "format", m.processed)
+	writeCounters(w, "imageresize_errors_total", "Failed requests, by error class.", "class", m.errors)
+	fmt.Fprintf(w, "# HELP imageresize_input_bytes_total Bytes of input images read.\n"+
+		"# TYPE imageresize_input_bytes_total counter\nimageresize_input_bytes_total %d\n", m.bytesIn)
+	fmt.Fprintf(w, "# HELP imageresize_output_bytes_total Bytes of output images written.\n"+
+		"# TYPE imageresize_output_bytes_total counter\nimageresize_output_bytes_total %d\n", m.bytesOut)
+
+	const name = "imageresize_stage_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Duration of decode, resize and encode stages, by stage and image format.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	keys := make([][2]string, 0, len(m.latency))
+	for k := range m.latency {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		h := m.latency[k]
+		labels := fmt.Sprintf("stage=%q,format=%q", k[0], k[1])
+		var n int64
+		for i, le := range latencyBuckets {
+			n += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, le, n)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+// writeCounters writes counter metric with one label in Prometheus text
+// format
+func writeCounters(w io.Writer, name, help, label string, vals map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, vals[k])
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/artyom/image-resize/resize"
+)
+
+// outputList is a list of outputs given with repeated -out flags
+type outputList []outputSpec
+
+// outputSpec describes single output as WIDTH[xHEIGHT]:FILE
+type outputSpec struct {
+	width, height int
+	name          string
+}
+
+func (l *outputList) String() string {
+	var parts []string
+	for _, o := range *l {
+		parts = append(parts, o.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *outputList) Set(s string) error {
+	i := strings.IndexByte(s, ':')
+	if i < 0 || i == len(s)-1 {
+		return fmt.Errorf("invalid output %q, should be WIDTH[xHEIGHT]:FILE", s)
+	}
+	var o outputSpec
+	o.name = s[i+1:]
+	size := strings.SplitN(s[:i], "x", 2)
+	var err error
+	if size[0] != "" {
+		if o.width, err = strconv.Atoi(size[0]); err != nil || o.width < 0 {
+			return fmt.Errorf("invalid output width in %q", s)
+		}
+	}
+	if len(size) == 2 {
+		if o.height, err = strconv.Atoi(size[1]); err != nil || o.height < 0 {
+			return fmt.Errorf("invalid output height in %q", s)
+		}
+	}
+	if o.width == 0 && o.height == 0 {
+		return fmt.Errorf("output %q should have width or height set", s)
+	}
+	*l = append(*l, o)
+	return nil
+}
+
+func (o outputSpec) String() string {
+	if o.height == 0 {
+		return fmt.Sprintf("%d:%s", o.width, o.name)
+	}
+	return fmt.Sprintf("%dx%d:%s", o.width, o.height, o.name)
+}
+
+// saveOutputs decodes image read from r once and saves it to par.Output, if
+// set, and to every output of par.Outputs
+func saveOutputs(r io.Reader, par params) error {
+	var pars []params
+	if par.Output != "" {
+		pars = append(pars, par)
+	}
+	for _, o := range par.Outputs {
+		p := par
+		p.Output, p.Width, p.Height = o.name, o.width, o.height
+		p.MaxWidth, p.MaxHeight, p.Scale = 0, 0, ""
+		p.MaxLong, p.MaxShort = 0, 0
+		pars = append(pars, p)
+	}
+	targets := make([]resize.Target, len(pars))
+	for i, p := range pars {
+		opts, err := p.options()
+		if err != nil {
+			return err
+		}
+		targets[i] = resize.Target{W: new(bytes.Buffer), Opts: opts}
+	}
+	ctx, cancel := par.context()
+	defer cancel()
+	res, err := resize.ProcessMultiContext(ctx, r, targets)
+	if err != nil {
+		return err
+	}
+	for i, p := range pars {
+		if err := saveOutput(p, targets[i].W.(*bytes.Buffer).Bytes(), res[i]); err != nil {
+			return fmt.Errorf("%s: %v", p.Output, err)
+		}
+	}
+	return nil
+}
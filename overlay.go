@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/artyom/image-resize/resize"
+)
+
+// loadOverlay decodes overlay image configured by par. It returns nil
+// overlay if par.Overlay is not set.
+func loadOverlay(par params) (*resize.Overlay, error) {
+	if par.Overlay == "" {
+		return nil, nil
+	}
+	var pos image.Point
+	if par.OverlayPos != "" {
+		if _, err := fmt.Sscanf(par.OverlayPos, "%d,%d", &pos.X, &pos.Y); err != nil {
+			return nil, fmt.Errorf("invalid overlay position %q, should be in x,y form", par.OverlayPos)
+		}
+	}
+	img, err := decodeFile(par.Overlay)
+	if err != nil {
+		return nil, err
+	}
+	if par.OverlayScale < 0 {
+		return nil, errors.New("overlay scale cannot be negative")
+	}
+	if s := par.OverlayScale; s > 0 && s != 1 {
+		b := img.Bounds()
+		w, h := int(float64(b.Dx())*s+0.5), int(float64(b.Dy())*s+0.5)
+		if w < 1 || h < 1 || w*h > resize.PixelLimit {
+			return nil, errors.New("invalid overlay scale")
+		}
+		if img, err = resize.Scale(img, w, h); err != nil {
+			return nil, err
+		}
+	}
+	return resize.NewOverlay(img, pos, par.Blend, par.Opacity)
+}
+
+// loadWatermark decodes watermark image configured by par. It returns nil
+// watermark if par.Watermark is not set.
+func loadWatermark(par params) (*resize.Overlay, error) {
+	if par.Watermark == "" {
+		return nil, nil
+	}
+	img, err := decodeFile(par.Watermark)
+	if err != nil {
+		return nil, err
+	}
+	return resize.NewWatermark(img, par.WmGravity, par.WmMargin, par.WmScale, par.WmOpacity)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/artyom/image-resize/resize"
+	"golang.org/x/image/draw"
+)
+
+// dziOverlap is the number of pixels Deep Zoom tiles overlap their
+// neighbours by
+const dziOverlap = 1
+
+// savePyramid resizes image read from r and saves it along with versions
+// of it halved in resolution, each scaled from the previous one. With
+// par.Pyramid set to levels they are saved to files named after par.Output
+// with level number appended, like name-0.jpg for full size, name-1.jpg for
+// half size and so on, until image fits par.PyramidTile square. With dzi,
+// par.Output is Deep Zoom Image descriptor and levels down to 1×1 pixel are
+// cut into par.PyramidTile sized tiles saved in name_files directory.
+func savePyramid(ctx context.Context, r io.Reader, par params, opts resize.Options) error {
+	if par.Pyramid != "levels" && par.Pyramid != "dzi" {
+		return fmt.Errorf("unsupported pyramid value %q, should be levels or dzi", par.Pyramid)
+	}
+	if par.Output == "" || par.Output == stdio {
+		return errors.New("pyramid requires output file")
+	}
+	if par.PyramidTile <= 2*dziOverlap {
+		return errors.New("pyramid tile size is too small")
+	}
+	img, err := processedImage(ctx, r, opts)
+	if err != nil {
+		return err
+	}
+	if opts.Format == "auto" {
+		opts.Format = resize.AutoFormat(img)
+	}
+	opts.Width, opts.Height, opts.MaxWidth, opts.MaxHeight = 0, 0, 0, 0
+	opts.MaxLong, opts.MaxShort = 0, 0
+	levels := []image.Image{img}
+	for {
+		b := img.Bounds()
+		if b.Dx() == 1 && b.Dy() == 1 ||
+			par.Pyramid == "levels" && b.Dx() <= par.PyramidTile && b.Dy() <= par.PyramidTile {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if img, err = halve(img, opts.Filter); err != nil {
+			return err
+		}
+		levels = append(levels, img)
+	}
+	ext := filepath.Ext(par.Output)
+	base := strings.TrimSuffix(par.Output, ext)
+	if par.Pyramid == "levels" {
+		for i, img := range levels {
+			p := par
+			p.Output = fmt.Sprintf("%s-%d%s", base, i, ext)
+			if err := writeImage(p, opts, img); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tileExt := opts.Format
+	if tileExt == "jpeg" {
+		tileExt = "jpg"
+	}
+	size := par.PyramidTile - 2*dziOverlap
+	for i, img := range levels {
+		level := len(levels) - 1 - i
+		dir := filepath.Join(base+"_files", fmt.Sprint(level))
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+		b := img.Bounds()
+		for row := 0; row*size < b.Dy(); row++ {
+			for col := 0; col*size < b.Dx(); col++ {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				rect := image.Rect(col*size, row*size, (col+1)*size, (row+1)*size).
+					Inset(-dziOverlap).Add(b.Min).Intersect(b)
+				p := par
+				p.Output = filepath.Join(dir, fmt.Sprintf("%d_%d.%s", col, row, tileExt))
+				if err := writeImage(p, opts, img.(resize.SubImager).SubImage(rect)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	b := levels[0].Bounds()
+	descriptor := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format=%q Overlap="%d" TileSize="%d">
+  <Size Width="%d" Height="%d"/>
+</Image>
+`, tileExt, dziOverlap, size, b.Dx(), b.Dy())
+	if err := writeFile(par.Output, []byte(descriptor), par.NoClobber); err != nil && err != errExists {
+		return err
+	}
+	return nil
+}
+
+// halve returns img scaled to half of its size, rounded up
+func halve(img image.Image, filter string) (image.Image, error) {
+	b := img.Bounds()
+	w, h := (b.Dx()+1)/2, (b.Dy()+1)/2
+	if w >= 2 && h >= 2 {
+		return resize.ScaleFilter(img, w, h, filter)
+	}
+	// too small for resize.ScaleFilter
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst, nil
+}
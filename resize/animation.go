@@ -0,0 +1,405 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/soniakeys/quant/mean"
+	"golang.org/x/image/draw"
+)
+
+// animation is a decoded animated gif or png
+type animation struct {
+	bounds   image.Rectangle // canvas
+	frames   []image.Image   // positioned on canvas
+	delays   []time.Duration
+	disposal []byte    // gif disposal method of each frame
+	blend    []draw.Op // how each frame is drawn over canvas, draw.Over if nil
+	loop     int       // loop count like gif.GIF.LoopCount
+}
+
+// gifAnimation returns animation of g frames
+func gifAnimation(g *gif.GIF) *animation {
+	a := &animation{
+		bounds:   image.Rect(0, 0, g.Config.Width, g.Config.Height),
+		frames:   make([]image.Image, len(g.Image)),
+		delays:   make([]time.Duration, len(g.Image)),
+		disposal: make([]byte, len(g.Image)),
+		loop:     g.LoopCount,
+	}
+	for i, img := range g.Image {
+		a.frames[i] = img
+		if i < len(g.Delay) {
+			a.delays[i] = time.Duration(g.Delay[i]) * 10 * time.Millisecond
+		}
+		if i < len(g.Disposal) {
+			a.disposal[i] = g.Disposal[i]
+		}
+	}
+	return a
+}
+
+// drawFrame draws frame i over canvas
+func (a *animation) drawFrame(canvas *image.RGBA, i int) {
+	op := draw.Over
+	if a.blend != nil {
+		op = a.blend[i]
+	}
+	frame := a.frames[i]
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, op)
+}
+
+// resizeAnimation resizes every frame of animation and writes result as an
+// animated gif to w.
+func resizeAnimation(ctx context.Context, w io.Writer, a *animation, opts Options, tr transform) (*Result, error) {
+	numColors := 256
+	if opts.GifColors > 0 {
+		numColors = opts.GifColors
+	}
+	out := &gif.GIF{LoopCount: a.loop}
+	if opts.Loop != nil {
+		out.LoopCount = *opts.Loop
+	}
+	var prev *image.NRGBA // previous frame
+	var hash uint64
+	var placeholder string
+	err := animationFrames(ctx, a, opts, tr, func(img image.Image, delay time.Duration) error {
+		cur := ToNRGBA(img)
+		if prev == nil {
+			if opts.Hash {
+				hash = DHash(cur)
+			}
+			placeholder = Placeholder(cur, opts.Placeholder)
+		}
+		b := cur.Bounds()
+		rect := b
+		if prev != nil {
+			var clear bool
+			switch rect, clear = changedRect(prev, cur); {
+			case clear:
+				// some pixels become transparent, previous frame
+				// should be cleared before drawing this one
+				last := len(out.Image) - 1
+				out.Image[last] = quantize(prev, numColors)
+				out.Disposal[last] = gif.DisposalBackground
+				rect = b
+			case rect.Empty():
+				rect = image.Rectangle{b.Min, b.Min.Add(image.Pt(1, 1))}
+			}
+		}
+		prev = cur
+		// only changed part of frame is saved, leaving the rest of
+		// previous frame visible
+		frame := quantize(cur.SubImage(rect), numColors)
+		frame.Rect = frame.Rect.Add(rect.Min.Sub(b.Min))
+		out.Image = append(out.Image, frame)
+		out.Delay = append(out.Delay, int(delay/(10*time.Millisecond)))
+		out.Disposal = append(out.Disposal, gif.DisposalNone)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	out.Config = image.Config{
+		Width:  out.Image[0].Bounds().Dx(),
+		Height: out.Image[0].Bounds().Dy(),
+	}
+	encode := gif.EncodeAll
+	if opts.Interlace {
+		encode = encodeGIFInterlaced
+	}
+	if err := encode(w, out); err != nil {
+		return nil, err
+	}
+	return &Result{
+		Format:      "gif",
+		Width:       out.Config.Width,
+		Height:      out.Config.Height,
+		Frames:      len(out.Image),
+		Hash:        hash,
+		Placeholder: placeholder,
+	}, nil
+}
+
+// resizeAPNG resizes every frame of animation and writes result as an
+// animated png to w.
+func resizeAPNG(ctx context.Context, w io.Writer, a *animation, opts Options, tr transform) (*Result, error) {
+	loop := a.loop
+	if opts.Loop != nil {
+		loop = *opts.Loop
+	}
+	var frames []image.Image
+	var delays []time.Duration
+	err := animationFrames(ctx, a, opts, tr, func(img image.Image, delay time.Duration) error {
+		frames = append(frames, img)
+		delays = append(delays, delay)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opts.Interlace {
+		opts.warnf("animated png cannot be interlaced")
+	}
+	if err := encodeAPNG(w, frames, delays, apngPlays(loop), pngCompression[opts.PngCompression]); err != nil {
+		return nil, err
+	}
+	res := &Result{
+		Format: "png",
+		Width:  frames[0].Bounds().Dx(),
+		Height: frames[0].Bounds().Dy(),
+		Frames: len(frames),
+	}
+	if opts.Hash {
+		res.Hash = DHash(frames[0])
+	}
+	res.Placeholder = Placeholder(frames[0], opts.Placeholder)
+	return res, nil
+}
+
+// Frames decodes animated gif or png from r, resizes its frames according
+// to opts and calls fn on every resulting frame along with its display
+// duration. Every frame passed to fn covers the whole animation canvas.
+func Frames(r io.Reader, opts Options, fn func(img image.Image, delay time.Duration) error) error {
+	if err := opts.normalize(); err != nil {
+		return err
+	}
+	tr, err := opts.transform()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxFileSize))
+	if err != nil {
+		return err
+	}
+	a, err := decodeAPNG(data)
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		_, kind, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return decodeError(err)
+		}
+		if kind != "gif" {
+			return errorf(KindUnsupported, "input is not an animated gif or png")
+		}
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return decodeError(err)
+		}
+		a = gifAnimation(g)
+	}
+	return animationFrames(context.Background(), a, opts, tr, fn)
+}
+
+// EncodeAnimation writes frames as animated gif or png (depending on
+// opts.Format, gif for auto) to w. All frames must have the same dimensions.
+// Each frame is shown for the corresponding delay.
+func EncodeAnimation(w io.Writer, frames []image.Image, delays []time.Duration, opts Options) error {
+	if err := opts.normalize(); err != nil {
+		return err
+	}
+	if opts.Format == "auto" {
+		opts.Format = "gif"
+	}
+	if len(frames) == 0 || len(frames) != len(delays) {
+		return errorf(KindInvalidOptions, "invalid number of frames or delays")
+	}
+	var loop int
+	if opts.Loop != nil {
+		loop = *opts.Loop
+	}
+	switch opts.Format {
+	case "png":
+		if opts.Interlace {
+			opts.warnf("animated png cannot be interlaced")
+		}
+		return encodeAPNG(w, frames, delays, apngPlays(loop), pngCompression[opts.PngCompression])
+	case "gif":
+		numColors := 256
+		if opts.GifColors > 0 {
+			numColors = opts.GifColors
+		}
+		b := frames[0].Bounds()
+		g := &gif.GIF{
+			LoopCount: loop,
+			Config:    image.Config{Width: b.Dx(), Height: b.Dy()},
+		}
+		for i, img := range frames {
+			if img.Bounds().Size() != b.Size() {
+				return errorf(KindInvalidOptions, "animation frames are of different sizes")
+			}
+			g.Image = append(g.Image, quantize(img, numColors))
+			g.Delay = append(g.Delay, int(delays[i]/(10*time.Millisecond)))
+		}
+		if opts.Interlace {
+			return encodeGIFInterlaced(w, g)
+		}
+		return gif.EncodeAll(w, g)
+	}
+	return errorf(KindInvalidOptions, "animation can only be saved as gif or png")
+}
+
+// animationFrames composes frames of animation over each other honoring
+// their disposal methods, resizes them and calls fn on each resulting frame,
+// so every frame passed to fn covers the whole canvas. Frames dropped because
+// of opts.FPS or opts.DropFrames settings extend delay of the previous kept
+// frame, so overall animation duration is preserved.
+func animationFrames(ctx context.Context, a *animation, opts Options, tr transform, fn func(img image.Image, delay time.Duration) error) error {
+	bounds := a.bounds
+	if bounds.Empty() || len(a.frames) == 0 {
+		return errorf(KindCorrupt, "invalid animation dimensions")
+	}
+	orientfunc, swapWH := opts.orient()
+	adjustfunc := opts.adjust()
+	if swapWH {
+		opts.Width, opts.Height = opts.Height, opts.Width
+		opts.MaxWidth, opts.MaxHeight = opts.MaxHeight, opts.MaxWidth
+		var err error
+		if tr, err = opts.transform(); err != nil {
+			return err
+		}
+	}
+	area := bounds // part of canvas left after trimming
+	if opts.Trim {
+		area = animationTrimRect(a, opts.TrimFuzz)
+	}
+	crop := area
+	if opts.Square {
+		crop = squareRect(area)
+	}
+	// crop is positioned according to gravity on the first frame
+	cw, ch := tr.coverSize(crop.Dx(), crop.Dy())
+	crop = image.Rect(0, 0, cw, ch).Add(area.Min)
+	width, height, err := tr.newDimensions(crop.Dx(), crop.Dy())
+	if err != nil {
+		return err
+	}
+	noUpscale := (crop.Dx() <= width && crop.Dy() <= height) && tr.limitsOnly()
+	var minDelay time.Duration // min. delay between kept frames
+	if opts.FPS > 0 {
+		minDelay = time.Duration(100/opts.FPS) * 10 * time.Millisecond
+	}
+	canvas := image.NewRGBA(bounds)
+	var prev *image.RGBA
+	var pending image.Image   // last kept frame, not yet passed to fn
+	var elapsed time.Duration // time since last kept frame was shown
+	for i, frame := range a.frames {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		disposal := a.disposal[i]
+		if disposal == gif.DisposalPrevious {
+			prev = cloneRGBA(canvas)
+		}
+		a.drawFrame(canvas, i)
+		if i == 0 && (opts.Square || tr.Fit == "cover") {
+			img := canvas.SubImage(area)
+			if opts.Square {
+				img = canvas.SubImage(squareCrop(img, subGravity(opts.Gravity, bounds, area, 0), 0))
+			}
+			crop = cropRect(img, cw, ch, subGravity(opts.Gravity, bounds, img.Bounds(), 0), 0)
+		}
+		keep := i == 0 || elapsed >= minDelay
+		if opts.DropFrames > 1 && i%opts.DropFrames != 0 {
+			keep = false
+		}
+		if keep {
+			if pending != nil {
+				if err := fn(pending, elapsed); err != nil {
+					return err
+				}
+			}
+			if noUpscale {
+				pending = cloneRGBA(canvas).SubImage(crop)
+			} else if pending, err = scaleThreads(canvas.SubImage(crop), width, height, opts.Filter, opts.Threads); err != nil {
+				return err
+			}
+			if opts.Sharpen != nil {
+				pending = opts.Sharpen.apply(pending)
+			}
+			if adjustfunc != nil {
+				pending = adjustfunc(pending)
+			}
+			if tr.Fit == "contain" {
+				pending = padImage(pending, tr.Width, tr.Height, opts.Background)
+			}
+			if orientfunc != nil {
+				pending = orientfunc(pending)
+			}
+			pending = opts.Composite(pending)
+			elapsed = 0
+		}
+		elapsed += a.delays[i]
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = prev
+		}
+	}
+	return fn(pending, elapsed)
+}
+
+// changedRect returns bounding rectangle of pixels that differ between two
+// frames with the same bounds. If some pixel that is visible in prev is
+// transparent in cur, clear is true.
+func changedRect(prev, cur *image.NRGBA) (rect image.Rectangle, clear bool) {
+	b := cur.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := prev.Pix[prev.PixOffset(x, y):]
+			c := cur.Pix[cur.PixOffset(x, y):]
+			switch {
+			case c[3] == 0 && p[3] != 0:
+				return b, true
+			case c[3] == 0 || c[0] == p[0] && c[1] == p[1] && c[2] == p[2] && c[3] == p[3]:
+				continue
+			}
+			rect = rect.Union(image.Rect(x, y, x+1, y+1))
+		}
+	}
+	return rect, false
+}
+
+// quantize converts img to paletted image of at most numColors colors with
+// bounds starting at (0,0). If img is not opaque, one of palette colors is
+// reserved for transparency.
+func quantize(img image.Image, numColors int) *image.Paletted {
+	b := img.Bounds()
+	var pal color.Palette
+	if op, ok := img.(opaquer); ok && !op.Opaque() {
+		pal = mean.Quantizer(numColors-1).Quantize(make(color.Palette, 0, numColors-1), img)
+		pal = append(pal, color.Transparent)
+	} else {
+		pal = mean.Quantizer(numColors).Quantize(make(color.Palette, 0, numColors), img)
+	}
+	dst := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), pal)
+	draw.FloydSteinberg.Draw(dst, dst.Bounds(), img, b.Min)
+	return dst
+}
+
+func cloneRGBA(src *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(src.Rect)
+	copy(dst.Pix, src.Pix)
+	return dst
+}
+
+// apngPlays converts gif style loop count (0 loops forever, -1 plays once)
+// to apng number of plays (0 plays forever)
+func apngPlays(loop int) int {
+	switch {
+	case loop < 0:
+		return 1
+	case loop > 0:
+		return loop + 1
+	}
+	return 0
+}
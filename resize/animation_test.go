@@ -0,0 +1,71 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestEncodeAnimationPNGPlays(t *testing.T) {
+	var frames []image.Image
+	for _, c := range []color.Gray{{0}, {255}} {
+		img := image.NewGray(image.Rect(0, 0, 4, 4))
+		for i := range img.Pix {
+			img.Pix[i] = c.Y
+		}
+		frames = append(frames, img)
+	}
+	delays := []time.Duration{100 * time.Millisecond, 100 * time.Millisecond}
+	for _, tc := range []struct{ loop, plays int }{{-1, 1}, {0, 0}, {1, 2}, {3, 4}} {
+		loop := tc.loop
+		buf := new(bytes.Buffer)
+		if err := EncodeAnimation(buf, frames, delays, Options{Format: "png", Loop: &loop}); err != nil {
+			t.Fatalf("loop %d: %v", tc.loop, err)
+		}
+		i := bytes.Index(buf.Bytes(), []byte("acTL"))
+		if i < 0 {
+			t.Fatalf("loop %d: no acTL chunk", tc.loop)
+		}
+		if plays := int(binary.BigEndian.Uint32(buf.Bytes()[i+8:])); plays != tc.plays {
+			t.Errorf("loop %d: got %d plays, want %d", tc.loop, plays, tc.plays)
+		}
+	}
+}
+
+func TestFramesPNG(t *testing.T) {
+	var frames []image.Image
+	for _, y := range []uint8{0, 128, 255} {
+		img := image.NewGray(image.Rect(0, 0, 8, 8))
+		for i := range img.Pix {
+			img.Pix[i] = y
+		}
+		frames = append(frames, img)
+	}
+	delays := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}
+	buf := new(bytes.Buffer)
+	if err := EncodeAnimation(buf, frames, delays, Options{Format: "png"}); err != nil {
+		t.Fatal(err)
+	}
+	var got []time.Duration
+	err := Frames(buf, Options{Width: 4}, func(img image.Image, delay time.Duration) error {
+		if size := img.Bounds().Size(); size != image.Pt(4, 4) {
+			t.Errorf("frame %d: got %v size, want 4×4", len(got)+1, size)
+		}
+		got = append(got, delay)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(delays) {
+		t.Fatalf("got %d frames, want %d", len(got), len(delays))
+	}
+	for i := range got {
+		if got[i] != delays[i] {
+			t.Errorf("frame %d: got %v delay, want %v", i+1, got[i], delays[i])
+		}
+	}
+}
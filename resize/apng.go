@@ -0,0 +1,225 @@
+package resize
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// encodeAPNG writes frames as an animated png to w. All frames must have the
+// same dimensions. Each frame is shown for the corresponding delay, plays is
+// the number of times animation should play, 0 means infinite looping.
+func encodeAPNG(w io.Writer, frames []image.Image, delays []time.Duration, plays int, level png.CompressionLevel) error {
+	if len(frames) == 0 || len(frames) != len(delays) {
+		return errors.New("invalid number of frames or delays")
+	}
+	size := frames[0].Bounds().Size()
+	alpha := false
+	for _, img := range frames {
+		if img.Bounds().Size() != size {
+			return errors.New("animation frames are of different sizes")
+		}
+		if op, ok := img.(opaquer); !ok || !op.Opaque() {
+			alpha = true
+		}
+	}
+	pw := &pngWriter{w: w}
+	colorType := byte(2) // truecolor
+	if alpha {
+		colorType = 6 // truecolor with alpha
+	}
+	pw.writeHeader(size.X, size.Y, colorType, false)
+	var buf []byte
+	buf = appendUint32(buf[:0], uint32(len(frames)))
+	buf = appendUint32(buf, uint32(plays))
+	pw.writeChunk("acTL", buf)
+	for i, img := range frames {
+		num, den := delays[i]/time.Millisecond, time.Duration(1000)
+		if num > 0xffff {
+			num, den = delays[i]/(10*time.Millisecond), 100
+		}
+		if num > 0xffff {
+			num = 0xffff
+		}
+		buf = appendUint32(buf[:0], pw.seq)
+		pw.seq++
+		buf = appendUint32(buf, uint32(size.X))
+		buf = appendUint32(buf, uint32(size.Y))
+		buf = appendUint32(buf, 0) // x offset
+		buf = appendUint32(buf, 0) // y offset
+		buf = append(buf, byte(num>>8), byte(num), byte(den>>8), byte(den))
+		buf = append(buf, 0, 0) // APNG_DISPOSE_OP_NONE, APNG_BLEND_OP_SOURCE
+		pw.writeChunk("fcTL", buf)
+		data, err := compressedScanlines(img, alpha, level)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			pw.writeChunk("IDAT", data)
+			continue
+		}
+		buf = appendUint32(buf[:0], pw.seq)
+		pw.seq++
+		pw.writeChunk("fdAT", append(buf, data...))
+	}
+	pw.writeChunk("IEND", nil)
+	return pw.err
+}
+
+// pngWriter writes png chunks to underlying writer, recording the first
+// encountered error
+type pngWriter struct {
+	w   io.Writer
+	seq uint32 // sequence number of the next fcTL/fdAT chunk
+	err error
+}
+
+// writeHeader writes png signature and IHDR chunk of an image of given color
+// type with 8 bits per channel, interlaced with Adam7 method if interlaced is
+// true
+func (pw *pngWriter) writeHeader(width, height int, colorType byte, interlaced bool) {
+	if _, err := io.WriteString(pw.w, pngSignature); err != nil {
+		pw.err = err
+		return
+	}
+	buf := appendUint32(nil, uint32(width))
+	buf = appendUint32(buf, uint32(height))
+	var interlace byte
+	if interlaced {
+		interlace = 1
+	}
+	buf = append(buf, 8, colorType, 0, 0, interlace)
+	pw.writeChunk("IHDR", buf)
+}
+
+func (pw *pngWriter) writeChunk(typ string, data []byte) {
+	if pw.err != nil {
+		return
+	}
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr, uint32(len(data)))
+	copy(hdr[4:], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(data)
+	for _, b := range [][]byte{hdr, data, appendUint32(nil, crc.Sum32())} {
+		if _, err := pw.w.Write(b); err != nil {
+			pw.err = err
+			return
+		}
+	}
+}
+
+// compressedScanlines returns zlib-compressed 8 bit per channel RGB or RGBA
+// scanlines of img, each prefixed with adaptively selected filter type, ready
+// to be stored inside IDAT or fdAT chunks.
+func compressedScanlines(img image.Image, alpha bool, level png.CompressionLevel) ([]byte, error) {
+	b := img.Bounds()
+	src, ok := img.(*image.NRGBA)
+	if !ok {
+		src = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+	bpp := 3
+	if alpha {
+		bpp = 4
+	}
+	buf := new(bytes.Buffer)
+	zw, err := zlib.NewWriterLevel(buf, zlibLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	prev := make([]byte, b.Dx()*bpp)
+	cur := make([]byte, b.Dx()*bpp)
+	filtered := make([]byte, 1+b.Dx()*bpp)
+	best := make([]byte, 1+b.Dx()*bpp)
+	for y := 0; y < b.Dy(); y++ {
+		row := src.Pix[y*src.Stride : y*src.Stride+b.Dx()*4]
+		for x := 0; x < b.Dx(); x++ {
+			copy(cur[x*bpp:x*bpp+bpp], row[x*4:x*4+bpp])
+		}
+		bestSum := -1
+		for ft := byte(0); ft < 5; ft++ {
+			if sum := filterRow(filtered, cur, prev, bpp, ft); bestSum < 0 || sum < bestSum {
+				bestSum = sum
+				best, filtered = filtered, best
+			}
+		}
+		if _, err := zw.Write(best); err != nil {
+			return nil, err
+		}
+		prev, cur = cur, prev
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// filterRow applies png filter of type ft to cur row, writing filter type
+// followed by filtered bytes to dst. prev is the previous unfiltered row.
+// Returns sum of absolute values of filtered bytes, used as heuristic to
+// pick the best filter.
+func filterRow(dst, cur, prev []byte, bpp int, ft byte) (sum int) {
+	dst[0] = ft
+	for i := range cur {
+		var a, b, c byte
+		if i >= bpp {
+			a, c = cur[i-bpp], prev[i-bpp]
+		}
+		b = prev[i]
+		var v byte
+		switch ft {
+		case 0:
+			v = cur[i]
+		case 1:
+			v = cur[i] - a
+		case 2:
+			v = cur[i] - b
+		case 3:
+			v = cur[i] - byte((int(a)+int(b))/2)
+		case 4:
+			v = cur[i] - paeth(a, b, c)
+		}
+		dst[i+1] = v
+		if v < 128 {
+			sum += int(v)
+		} else {
+			sum += 256 - int(v)
+		}
+	}
+	return sum
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
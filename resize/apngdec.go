@@ -0,0 +1,152 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"time"
+)
+
+// apngFrames returns number of frames of animated png, or 0 if data is not
+// an animated png
+func apngFrames(data []byte) int {
+	var n int
+	pngChunks(data, func(typ string, p []byte) bool {
+		if typ == "acTL" && len(p) == 8 {
+			n = int(binary.BigEndian.Uint32(p))
+			return false
+		}
+		return true
+	})
+	return n
+}
+
+// decodeAPNG decodes all frames of animated png. It returns nil if data is
+// not an animated png. Default image not being part of animation is
+// skipped.
+func decodeAPNG(data []byte) (*animation, error) {
+	if apngFrames(data) == 0 {
+		return nil, nil
+	}
+	var (
+		a      = new(animation)
+		ihdr   []byte
+		common bytes.Buffer // ancillary chunks preceding image data
+		fctl   []byte       // fcTL payload of the current frame
+		parts  [][]byte     // image data of the current frame
+		idat   bool         // IDAT chunks were seen
+	)
+	flush := func() error {
+		if fctl == nil {
+			return nil
+		}
+		defer func() { fctl, parts = nil, nil }()
+		be := binary.BigEndian
+		w, h := int(be.Uint32(fctl[4:])), int(be.Uint32(fctl[8:]))
+		x, y := int(be.Uint32(fctl[12:])), int(be.Uint32(fctl[16:]))
+		r := image.Rect(x, y, x+w, y+h)
+		if w <= 0 || h <= 0 || x < 0 || y < 0 || !r.In(a.bounds) || len(parts) == 0 {
+			return errorf(KindCorrupt, "invalid animated png frame")
+		}
+		buf := bytes.NewBufferString(pngSignature)
+		pw := &pngWriter{w: buf}
+		hdr := append([]byte(nil), ihdr...)
+		be.PutUint32(hdr, uint32(w))
+		be.PutUint32(hdr[4:], uint32(h))
+		pw.writeChunk("IHDR", hdr)
+		buf.Write(common.Bytes())
+		pw.writeChunk("IDAT", bytes.Join(parts, nil))
+		pw.writeChunk("IEND", nil)
+		img, err := png.Decode(buf)
+		if err != nil {
+			return decodeError(err)
+		}
+		frame := image.NewNRGBA(r)
+		draw.Draw(frame, r, img, image.Point{}, draw.Src)
+		num, den := time.Duration(be.Uint16(fctl[20:])), time.Duration(be.Uint16(fctl[22:]))
+		if den == 0 {
+			den = 100
+		}
+		disposal := byte(gif.DisposalNone)
+		switch fctl[24] {
+		case 1:
+			disposal = gif.DisposalBackground
+		case 2:
+			disposal = gif.DisposalPrevious
+			if len(a.frames) == 0 {
+				disposal = gif.DisposalBackground
+			}
+		}
+		op := draw.Src
+		if fctl[25] == 1 {
+			op = draw.Over
+		}
+		a.frames = append(a.frames, frame)
+		a.delays = append(a.delays, num*time.Second/den)
+		a.disposal = append(a.disposal, disposal)
+		a.blend = append(a.blend, op)
+		return nil
+	}
+	for i := 8; i+12 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+		if n < 0 || i+12+n > len(data) {
+			return nil, errorf(KindCorrupt, "truncated png chunk")
+		}
+		chunk, p := data[i:i+12+n], data[i+8:i+8+n]
+		i += 12 + n
+		switch typ {
+		case "IHDR":
+			if len(p) != 13 {
+				return nil, errorf(KindCorrupt, "invalid png header")
+			}
+			ihdr = p
+			a.bounds = image.Rect(0, 0, int(binary.BigEndian.Uint32(p)), int(binary.BigEndian.Uint32(p[4:])))
+		case "acTL":
+			if len(p) != 8 {
+				return nil, errorf(KindCorrupt, "invalid animated png control chunk")
+			}
+			switch plays := int(binary.BigEndian.Uint32(p[4:])); plays {
+			case 0:
+			case 1:
+				a.loop = -1
+			default:
+				a.loop = plays - 1
+			}
+		case "fcTL":
+			if len(p) != 26 {
+				return nil, errorf(KindCorrupt, "invalid animated png frame control chunk")
+			}
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			fctl = p
+		case "IDAT":
+			idat = true
+			if fctl != nil {
+				parts = append(parts, p)
+			}
+		case "fdAT":
+			if len(p) < 4 {
+				return nil, errorf(KindCorrupt, "invalid animated png frame data chunk")
+			}
+			parts = append(parts, p[4:])
+		case "IEND":
+			i = len(data)
+		default:
+			if !idat && ihdr != nil {
+				common.Write(chunk)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if len(a.frames) == 0 {
+		return nil, errorf(KindCorrupt, "animated png has no frames")
+	}
+	return a, nil
+}
@@ -0,0 +1,50 @@
+package resize
+
+import (
+	"image"
+	"image/color"
+)
+
+// AutoFormat returns output format suiting img, which is what "auto"
+// Options.Format resolves to for still images: png for images with
+// transparency or at most 256 colors, or webp if webp encoder was
+// registered with RegisterFormat, and jpeg for others, like photos.
+func AutoFormat(img image.Image) string {
+	if op, ok := img.(opaquer); ok && !op.Opaque() || hasFewColors(img, 256) {
+		if IsRegistered("webp") {
+			return "webp"
+		}
+		return "png"
+	}
+	return "jpeg"
+}
+
+// autoFormat is like AutoFormat, but animated source keeps its format if
+// opts allow animated output, and jpeg one is not inspected
+func (src *source) autoFormat(opts Options) string {
+	switch {
+	case src.anim != nil && len(opts.Ops) == 0 && !opts.FirstFrame:
+		return src.kind
+	case src.kind == "jpeg":
+		return "jpeg"
+	}
+	return AutoFormat(src.img)
+}
+
+// hasFewColors reports whether img has at most n distinct colors
+func hasFewColors(img image.Image, n int) bool {
+	if p, ok := img.(*image.Paletted); ok && len(p.Palette) <= n {
+		return true
+	}
+	b := img.Bounds()
+	seen := make(map[color.NRGBA]struct{}, n+1)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			seen[color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)] = struct{}{}
+			if len(seen) > n {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+//go:build avif
+// +build avif
+
+package resize
+
+// #cgo pkg-config: libavif
+// #include <stdlib.h>
+// #include <avif/avif.h>
+import "C"
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"unsafe"
+)
+
+// This file implements AVIF decoder using libavif, it's only built with avif
+// build tag.
+
+func init() {
+	image.RegisterFormat("avif", "????ftypavif", decodeAVIF, decodeAVIFConfig)
+	image.RegisterFormat("avif", "????ftypavis", decodeAVIF, decodeAVIFConfig)
+}
+
+// avifSource is libavif decoder which parsed image data held in C memory
+type avifSource struct {
+	dec  *C.avifDecoder
+	data unsafe.Pointer
+}
+
+// newAVIFSource reads image from r and parses it with libavif decoder.
+// Caller should call close once done.
+func newAVIFSource(r io.Reader) (*avifSource, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxFileSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("avif: empty input")
+	}
+	dec := C.avifDecoderCreate()
+	if dec == nil {
+		return nil, errors.New("avif: cannot create decoder")
+	}
+	src := &avifSource{dec: dec, data: C.CBytes(data)}
+	res := C.avifDecoderSetIOMemory(dec, (*C.uint8_t)(src.data), C.size_t(len(data)))
+	if res == C.AVIF_RESULT_OK {
+		res = C.avifDecoderParse(dec)
+	}
+	if res != C.AVIF_RESULT_OK {
+		src.close()
+		return nil, avifError(res)
+	}
+	return src, nil
+}
+
+func (src *avifSource) close() {
+	C.avifDecoderDestroy(src.dec)
+	C.free(src.data)
+}
+
+func decodeAVIFConfig(r io.Reader) (image.Config, error) {
+	src, err := newAVIFSource(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer src.close()
+	return image.Config{
+		ColorModel: color.NRGBAModel,
+		Width:      int(src.dec.image.width),
+		Height:     int(src.dec.image.height),
+	}, nil
+}
+
+func decodeAVIF(r io.Reader) (image.Image, error) {
+	src, err := newAVIFSource(r)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	dec := src.dec
+	if res := C.avifDecoderNextImage(dec); res != C.AVIF_RESULT_OK {
+		return nil, avifError(res)
+	}
+	if int(dec.image.width)*int(dec.image.height) > PixelLimit {
+		return nil, errors.New("avif: image is too large")
+	}
+	var rgb C.avifRGBImage
+	C.avifRGBImageSetDefaults(&rgb, dec.image)
+	rgb.format = C.AVIF_RGB_FORMAT_RGBA
+	rgb.depth = 8
+	C.avifRGBImageAllocatePixels(&rgb)
+	defer C.avifRGBImageFreePixels(&rgb)
+	if res := C.avifImageYUVToRGB(dec.image, &rgb); res != C.AVIF_RESULT_OK {
+		return nil, avifError(res)
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, int(rgb.width), int(rgb.height)))
+	pix := C.GoBytes(unsafe.Pointer(rgb.pixels), C.int(int(rgb.rowBytes)*img.Rect.Dy()))
+	for y := 0; y < img.Rect.Dy(); y++ {
+		copy(img.Pix[y*img.Stride:(y+1)*img.Stride], pix[y*int(rgb.rowBytes):])
+	}
+	return img, nil
+}
+
+func avifError(res C.avifResult) error {
+	return errors.New("avif: " + C.GoString(C.avifResultToString(res)))
+}
@@ -0,0 +1,26 @@
+//go:build !avif
+// +build !avif
+
+package resize
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// Without avif build tag AVIF images are recognized, but decoding them
+// reports that support is not built in.
+
+func init() {
+	image.RegisterFormat("avif", "????ftypavif", decodeAVIF, decodeAVIFConfig)
+	image.RegisterFormat("avif", "????ftypavis", decodeAVIF, decodeAVIFConfig)
+}
+
+var errNoAVIF = &Error{
+	Kind: KindUnsupported,
+	Err:  errors.New("avif support is not built in, rebuild with avif build tag and libavif installed"),
+}
+
+func decodeAVIF(io.Reader) (image.Image, error)        { return nil, errNoAVIF }
+func decodeAVIFConfig(io.Reader) (image.Config, error) { return image.Config{}, errNoAVIF }
@@ -0,0 +1,143 @@
+package resize
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// Overlay is an image composited over the output image
+type Overlay struct {
+	img     *image.NRGBA
+	pos     image.Point // top-left corner of overlay on the output image
+	blend   blendFunc
+	opacity float64
+
+	// placement of watermark, see NewWatermark
+	watermark bool
+	gravity   string
+	margin    int
+	scale     float64
+}
+
+// NewOverlay returns Overlay placing img with its top-left corner at pos
+// point of the output image. Supported blend modes are over (used if empty),
+// multiply, screen and overlay. Opacity should be in 0-1 range.
+func NewOverlay(img image.Image, pos image.Point, blend string, opacity float64) (*Overlay, error) {
+	if opacity < 0 || opacity > 1 {
+		return nil, errors.New("opacity should be in 0-1 range")
+	}
+	if blend == "" {
+		blend = "over"
+	}
+	fn, ok := blendModes[blend]
+	if !ok {
+		return nil, fmt.Errorf("unsupported blend mode %q", blend)
+	}
+	return &Overlay{img: ToNRGBA(img), pos: pos, blend: fn, opacity: opacity}, nil
+}
+
+// NewWatermark returns Overlay placing img on the output image according to
+// gravity (one of center, north, south, east, west, northeast, northwest,
+// southeast, southwest), at least margin pixels away from its edges. If
+// scale is positive, img is scaled to be of this fraction of output width.
+func NewWatermark(img image.Image, gravity string, margin int, scale, opacity float64) (*Overlay, error) {
+	if _, ok := gravityPoints[gravity]; !ok {
+		return nil, fmt.Errorf("unsupported watermark gravity %q", gravity)
+	}
+	if margin < 0 || scale < 0 {
+		return nil, errors.New("watermark margin and scale cannot be negative")
+	}
+	ov, err := NewOverlay(img, image.Point{}, "over", opacity)
+	if err != nil {
+		return nil, err
+	}
+	ov.watermark, ov.gravity, ov.margin, ov.scale = true, gravity, margin, scale
+	return ov, nil
+}
+
+// place returns watermark image and its position on the output image of
+// given size
+func (ov *Overlay) place(width, height int) (*image.NRGBA, image.Point) {
+	src := ov.img
+	if ov.scale > 0 {
+		b := src.Bounds()
+		w := int(float64(width)*ov.scale + .5)
+		h := int(float64(w)*float64(b.Dy())/float64(b.Dx()) + .5)
+		if w > 0 && h > 0 && (w != b.Dx() || h != b.Dy()) {
+			if img, err := Scale(src, w, h); err == nil {
+				src = ToNRGBA(img)
+			}
+		}
+	}
+	p := gravityPoints[ov.gravity]
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	return src, image.Pt(
+		ov.margin+int(p[0]*float64(width-2*ov.margin-w)+.5),
+		ov.margin+int(p[1]*float64(height-2*ov.margin-h)+.5))
+}
+
+// blendFunc mixes backdrop and source color channel values, both in 0-1
+// range
+type blendFunc func(cb, cs float64) float64
+
+var blendModes = map[string]blendFunc{
+	"over":     func(cb, cs float64) float64 { return cs },
+	"multiply": func(cb, cs float64) float64 { return cb * cs },
+	"screen":   func(cb, cs float64) float64 { return cb + cs - cb*cs },
+	"overlay": func(cb, cs float64) float64 {
+		if cb <= 0.5 {
+			return 2 * cb * cs
+		}
+		return 1 - 2*(1-cb)*(1-cs)
+	},
+}
+
+// DrawOn returns a copy of img with overlay composited over it. Returned
+// image bounds start at (0,0).
+func (ov *Overlay) DrawOn(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	src, pos := ov.img, ov.pos
+	if ov.watermark {
+		src, pos = ov.place(b.Dx(), b.Dy())
+	}
+	r := src.Bounds().Sub(src.Bounds().Min).Add(pos).Intersect(dst.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			s := src.Pix[src.PixOffset(src.Rect.Min.X+x-pos.X, src.Rect.Min.Y+y-pos.Y):]
+			d := dst.Pix[dst.PixOffset(x, y):]
+			as := float64(s[3]) / 255 * ov.opacity
+			if as == 0 {
+				continue
+			}
+			ab := float64(d[3]) / 255
+			ao := as + ab*(1-as)
+			for i := 0; i < 3; i++ {
+				cs, cb := float64(s[i])/255, float64(d[i])/255
+				// W3C compositing: blend result is used only where
+				// backdrop is present, then source-over is applied
+				cm := (1-ab)*cs + ab*ov.blend(cb, cs)
+				co := (as*cm + (1-as)*ab*cb) / ao
+				d[i] = uint8(math.Min(255, math.Max(0, co*255+0.5)))
+			}
+			d[3] = uint8(ao*255 + 0.5)
+		}
+	}
+	return dst
+}
+
+// ToNRGBA returns img as *image.NRGBA with the same bounds, converting it
+// if necessary
+func ToNRGBA(img image.Image) *image.NRGBA {
+	if n, ok := img.(*image.NRGBA); ok {
+		return n
+	}
+	n := image.NewNRGBA(img.Bounds())
+	draw.Draw(n, n.Bounds(), img, img.Bounds().Min, draw.Src)
+	return n
+}
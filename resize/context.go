@@ -0,0 +1,59 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// ctxReader is an io.Reader failing with ctx error once ctx is done, so that
+// decoding of slowly arriving or huge inputs can be aborted. Errors of r
+// other than io.EOF are wrapped into readError.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := cr.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = readError{err}
+	}
+	return n, err
+}
+
+// countReader counts bytes read from r
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// countWriter counts bytes written to w
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// memInput is input fully available in memory, like memory-mapped file, so
+// that it can be decoded without copying
+type memInput struct {
+	*bytes.Reader
+	data []byte
+}
+
+func newMemInput(data []byte) memInput { return memInput{bytes.NewReader(data), data} }
@@ -0,0 +1,244 @@
+package resize
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// gravityPoints maps gravity names to points (in 0-1 range) of displayed
+// image that crop should keep as close to its center as possible
+var gravityPoints = map[string][2]float64{
+	"":          {.5, .5},
+	"center":    {.5, .5},
+	"north":     {.5, 0},
+	"south":     {.5, 1},
+	"east":      {1, .5},
+	"west":      {0, .5},
+	"northeast": {1, 0},
+	"northwest": {0, 0},
+	"southeast": {1, 1},
+	"southwest": {0, 1},
+}
+
+// validGravity checks that gravity is either one of known names or x,y
+// focal point
+func validGravity(gravity string) error {
+	if _, ok := gravityPoints[gravity]; ok || gravity == "attention" || gravity == "edges" || gravity == "face" {
+		return nil
+	}
+	if _, _, err := focalPoint(gravity); err != nil {
+		return fmt.Errorf("invalid gravity %q", gravity)
+	}
+	return nil
+}
+
+// focalPoint parses "x,y" string
+func focalPoint(s string) (x, y int, err error) {
+	i := strings.IndexByte(s, ',')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid point %q", s)
+	}
+	if x, err = strconv.Atoi(s[:i]); err != nil {
+		return 0, 0, err
+	}
+	if y, err = strconv.Atoi(s[i+1:]); err != nil {
+		return 0, 0, err
+	}
+	if x < 0 || y < 0 {
+		return 0, 0, fmt.Errorf("invalid point %q", s)
+	}
+	return x, y, nil
+}
+
+// cropRect returns rectangle of w×h size inside img bounds, positioned
+// according to gravity. Directions and focal point are relative to the
+// image as displayed, orientation is EXIF orientation of img.
+func cropRect(img image.Image, w, h int, gravity string, orientation int) image.Rectangle {
+	b := img.Bounds()
+	if w >= b.Dx() && h >= b.Dy() {
+		return b
+	}
+	var fx, fy float64
+	switch gravity {
+	case "attention", "edges":
+		return attentionRect(img, w, h, gravity == "attention")
+	case "face":
+		if r, ok := faceRect(img, w, h, orientation); ok {
+			return r
+		}
+		fx, fy = .5, .5
+	default:
+		p, ok := gravityPoints[gravity]
+		if !ok {
+			x, y, _ := focalPoint(gravity)
+			dw, dh := b.Dx(), b.Dy()
+			if orientation >= 5 {
+				dw, dh = dh, dw
+			}
+			p = [2]float64{float64(x) / float64(dw), float64(y) / float64(dh)}
+		}
+		fx, fy = storedPoint(orientation, p[0], p[1])
+	}
+	x0 := clampInt(int(math.Round(fx*float64(b.Dx())))-w/2, 0, b.Dx()-w)
+	y0 := clampInt(int(math.Round(fy*float64(b.Dy())))-h/2, 0, b.Dy()-h)
+	return image.Rect(b.Min.X+x0, b.Min.Y+y0, b.Min.X+x0+w, b.Min.Y+y0+h)
+}
+
+// subGravity converts x,y focal point given in pixels of displayed image
+// with stored bounds full to pixels of its part with stored bounds r, so
+// that crops of already cropped image keep the same point. Other gravity
+// values are returned as is.
+func subGravity(gravity string, full, r image.Rectangle, orientation int) string {
+	x, y, err := focalPoint(gravity)
+	if err != nil || r == full || r.Empty() {
+		return gravity
+	}
+	dw, dh := full.Dx(), full.Dy()
+	rw, rh := r.Dx(), r.Dy()
+	if orientation >= 5 {
+		dw, dh = dh, dw
+		rw, rh = rh, rw
+	}
+	sx, sy := storedPoint(orientation, float64(x)/float64(dw), float64(y)/float64(dh))
+	sx = (sx*float64(full.Dx()) + float64(full.Min.X-r.Min.X)) / float64(r.Dx())
+	sy = (sy*float64(full.Dy()) + float64(full.Min.Y-r.Min.Y)) / float64(r.Dy())
+	// storedPoint is its own inverse except for 90° rotations
+	inverse := orientation
+	switch orientation {
+	case 6:
+		inverse = 8
+	case 8:
+		inverse = 6
+	}
+	px, py := storedPoint(inverse, sx, sy)
+	return fmt.Sprintf("%d,%d", clampInt(int(math.Round(px*float64(rw))), 0, rw),
+		clampInt(int(math.Round(py*float64(rh))), 0, rh))
+}
+
+// squareCrop returns the largest square inside img bounds positioned
+// according to gravity
+func squareCrop(img image.Image, gravity string, orientation int) image.Rectangle {
+	side := squareRect(img.Bounds()).Dx()
+	return cropRect(img, side, side, gravity, orientation)
+}
+
+// storedPoint maps point in 0-1 coordinates of displayed image to
+// coordinates of image stored with given EXIF orientation
+func storedPoint(orientation int, x, y float64) (float64, float64) {
+	switch orientation {
+	case 2:
+		return 1 - x, y
+	case 3:
+		return 1 - x, 1 - y
+	case 4:
+		return x, 1 - y
+	case 5:
+		return y, x
+	case 6:
+		return y, 1 - x
+	case 7:
+		return 1 - y, 1 - x
+	case 8:
+		return 1 - y, x
+	}
+	return x, y
+}
+
+// attentionSize is the size of downscaled image copy used to find its most
+// interesting region
+const attentionSize = 128
+
+// attentionRect returns w×h rectangle inside img bounds covering the region
+// with the highest density of edges. If saliency is true, edges in saturated
+// and skin colored areas are given more weight.
+func attentionRect(img image.Image, w, h int, saliency bool) image.Rectangle {
+	b := img.Bounds()
+	scale := float64(attentionSize) / float64(b.Dx())
+	if s := float64(attentionSize) / float64(b.Dy()); s < scale {
+		scale = s
+	}
+	if scale > 1 {
+		scale = 1
+	}
+	sw, sh := int(float64(b.Dx())*scale+.5), int(float64(b.Dy())*scale+.5)
+	if sw < 1 {
+		sw = 1
+	}
+	if sh < 1 {
+		sh = 1
+	}
+	small := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, b, draw.Src, nil)
+
+	luma := make([]float64, sw*sh)
+	for i := range luma {
+		p := small.Pix[4*i:]
+		luma[i] = .299*float64(p[0]) + .587*float64(p[1]) + .114*float64(p[2])
+	}
+	at := func(x, y int) float64 {
+		return luma[clampInt(y, 0, sh-1)*sw+clampInt(x, 0, sw-1)]
+	}
+	// summed area table of energy, with extra zero row and column
+	sat := make([]float64, (sw+1)*(sh+1))
+	for y := 0; y < sh; y++ {
+		var row float64
+		for x := 0; x < sw; x++ {
+			e := math.Abs(at(x+1, y)-at(x-1, y)) + math.Abs(at(x, y+1)-at(x, y-1))
+			if saliency {
+				e *= 1 + salience(small.RGBAAt(x, y))
+			}
+			row += e
+			sat[(y+1)*(sw+1)+x+1] = sat[y*(sw+1)+x+1] + row
+		}
+	}
+	cw := clampInt(int(float64(w)*scale+.5), 1, sw)
+	ch := clampInt(int(float64(h)*scale+.5), 1, sh)
+	bestX, bestY, best := (sw-cw)/2, (sh-ch)/2, -1.0
+	for y := 0; y <= sh-ch; y++ {
+		for x := 0; x <= sw-cw; x++ {
+			sum := sat[(y+ch)*(sw+1)+x+cw] - sat[y*(sw+1)+x+cw] -
+				sat[(y+ch)*(sw+1)+x] + sat[y*(sw+1)+x]
+			if sum > best {
+				bestX, bestY, best = x, y, sum
+			}
+		}
+	}
+	// map center of the best region back to original image
+	cx := (float64(bestX) + float64(cw)/2) / scale
+	cy := (float64(bestY) + float64(ch)/2) / scale
+	x0 := clampInt(int(cx+.5)-w/2, 0, b.Dx()-w)
+	y0 := clampInt(int(cy+.5)-h/2, 0, b.Dy()-h)
+	return image.Rect(b.Min.X+x0, b.Min.Y+y0, b.Min.X+x0+w, b.Min.Y+y0+h)
+}
+
+// salience returns 0-2 value estimating how likely color belongs to the
+// subject of image: saturated colors and skin tones score higher
+func salience(c color.RGBA) float64 {
+	r, g, b := float64(c.R), float64(c.G), float64(c.B)
+	max, min := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	var s float64
+	if max > 0 {
+		s = (max - min) / max
+	}
+	// rough skin tone detection rule in RGB space
+	if r > 95 && g > 40 && b > 20 && r > g && r > b && r-min > 15 && math.Abs(r-g) > 15 {
+		s++
+	}
+	return s
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,65 @@
+package resize
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestSubGravity(t *testing.T) {
+	full := image.Rect(0, 0, 200, 100)
+	for _, tc := range []struct {
+		gravity     string
+		r           image.Rectangle
+		orientation int
+		want        string
+	}{
+		{"north", image.Rect(50, 0, 150, 100), 0, "north"},
+		{"120,40", full, 0, "120,40"},
+		{"120,40", image.Rect(50, 0, 150, 100), 0, "70,40"},
+		{"120,40", image.Rect(50, 10, 150, 90), 0, "70,30"},
+		{"10,40", image.Rect(50, 0, 150, 100), 0, "0,40"},
+		// stored 200×100 image is displayed as 100×200 one
+		{"40,120", image.Rect(0, 50, 200, 100), 6, "40,120"},
+		{"40,120", image.Rect(50, 0, 150, 100), 6, "40,70"},
+		{"40,120", image.Rect(50, 0, 150, 100), 8, "40,70"},
+	} {
+		if got := subGravity(tc.gravity, full, tc.r, tc.orientation); got != tc.want {
+			t.Errorf("subGravity(%q, %v, %v, %d) = %q, want %q", tc.gravity, full, tc.r, tc.orientation, got, tc.want)
+		}
+	}
+}
+
+func TestSquareCoverFocalPoint(t *testing.T) {
+	// red channel of each pixel is its x coordinate
+	src := image.NewRGBA(image.Rect(0, 0, 256, 128))
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 256; x++ {
+			src.Set(x, y, color.RGBA{uint8(x), 0, 0, 255})
+		}
+	}
+	in := new(bytes.Buffer)
+	if err := png.Encode(in, src); err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	opts := Options{Width: 32, Height: 64, Fit: "cover", Square: true, Gravity: "150,64", Format: "png"}
+	if err := Resize(in, out, opts); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.Bounds().Size(); got != image.Pt(32, 64) {
+		t.Fatalf("got %v image, want 32×64", got)
+	}
+	// square crop spans x=86…214, cover crop inside it must be centered
+	// at x=150 of the source
+	r, _, _, _ := img.At(16, 32).RGBA()
+	if got := int(r >> 8); got < 148 || got > 152 {
+		t.Errorf("center of result comes from x=%d of source, want 150", got)
+	}
+}
@@ -0,0 +1,143 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// imageDensity returns physical density in dots per inch stored in raw image
+// data of given kind, or 0 if it's unknown
+func imageDensity(kind string, data []byte) float64 {
+	switch kind {
+	case "jpeg":
+		var dpi float64
+		jpegSegments(data, func(marker byte, p []byte) bool {
+			if marker != 0xe0 || !bytes.HasPrefix(p, []byte("JFIF\x00")) || len(p) < 12 {
+				return true
+			}
+			switch d := float64(binary.BigEndian.Uint16(p[8:])); p[7] {
+			case 1:
+				dpi = d
+			case 2:
+				dpi = d * 2.54
+			}
+			return false
+		})
+		if dpi == 0 {
+			dpi = tiffDensity(exifBlock(kind, data))
+		}
+		return dpi
+	case "png":
+		var dpi float64
+		pngChunks(data, func(typ string, p []byte) bool {
+			if typ != "pHYs" || len(p) != 9 {
+				return true
+			}
+			if p[8] == 1 { // pixels per meter
+				dpi = float64(binary.BigEndian.Uint32(p)) * 0.0254
+			}
+			return false
+		})
+		return dpi
+	case "tiff":
+		return tiffDensity(data)
+	case "webp":
+		return tiffDensity(exifBlock(kind, data))
+	}
+	return 0
+}
+
+// tiffEntries calls fn for every entry of the first IFD of TIFF structure,
+// passing byte order and entry offset
+func tiffEntries(data []byte, fn func(bo binary.ByteOrder, e int)) {
+	bo := tiffByteOrder(data)
+	if bo == nil {
+		return
+	}
+	off := int(bo.Uint32(data[4:]))
+	if off < 8 || off+2 > len(data) {
+		return
+	}
+	for i, n := 0, int(bo.Uint16(data[off:])); i < n; i++ {
+		e := off + 2 + i*12
+		if e+12 > len(data) {
+			return
+		}
+		fn(bo, e)
+	}
+}
+
+// tiffDensity returns horizontal density in dots per inch stored in TIFF
+// structure (TIFF file or EXIF data), or 0 if it's unknown
+func tiffDensity(data []byte) float64 {
+	var res float64
+	unit := 2 // inch
+	tiffEntries(data, func(bo binary.ByteOrder, e int) {
+		switch tag, typ := bo.Uint16(data[e:]), bo.Uint16(data[e+2:]); {
+		case tag == 0x011a && typ == 5: // XResolution, RATIONAL
+			if off := int(bo.Uint32(data[e+8:])); off >= 8 && off+8 <= len(data) {
+				if den := bo.Uint32(data[off+4:]); den != 0 {
+					res = float64(bo.Uint32(data[off:])) / float64(den)
+				}
+			}
+		case tag == 0x0128 && typ == 3: // ResolutionUnit, SHORT
+			unit = int(bo.Uint16(data[e+8:]))
+		}
+	})
+	switch unit {
+	case 2:
+		return res
+	case 3:
+		return res * 2.54
+	}
+	return 0
+}
+
+// setDensity returns encoded image of given format with physical density
+// set to dpi dots per inch. Only jpeg, png and tiff are supported.
+func setDensity(format string, data []byte, dpi float64) ([]byte, error) {
+	switch format {
+	case "jpeg":
+		if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+			return nil, errors.New("invalid jpeg data")
+		}
+		d := uint16(math.Round(dpi))
+		if data[2] == 0xff && data[3] == 0xe0 && bytes.HasPrefix(data[6:], []byte("JFIF\x00")) && len(data) >= 18 {
+			out := append([]byte(nil), data...)
+			out[13] = 1 // dots per inch
+			binary.BigEndian.PutUint16(out[14:], d)
+			binary.BigEndian.PutUint16(out[16:], d)
+			return out, nil
+		}
+		seg := []byte{0xff, 0xe0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 1, 1, byte(d >> 8), byte(d), byte(d >> 8), byte(d), 0, 0}
+		out := make([]byte, 0, len(data)+len(seg))
+		out = append(out, data[:2]...)
+		out = append(out, seg...)
+		return append(out, data[2:]...), nil
+	case "png":
+		ppm := uint32(math.Round(dpi / 0.0254))
+		p := make([]byte, 9)
+		binary.BigEndian.PutUint32(p, ppm)
+		binary.BigEndian.PutUint32(p[4:], ppm)
+		p[8] = 1 // meter
+		return insertPNGChunk(data, "pHYs", p)
+	case "tiff":
+		out := append([]byte(nil), data...)
+		num := uint32(math.Round(dpi * 100))
+		tiffEntries(out, func(bo binary.ByteOrder, e int) {
+			switch tag, typ := bo.Uint16(out[e:]), bo.Uint16(out[e+2:]); {
+			case (tag == 0x011a || tag == 0x011b) && typ == 5: // X/YResolution
+				if off := int(bo.Uint32(out[e+8:])); off >= 8 && off+8 <= len(out) {
+					bo.PutUint32(out[off:], num)
+					bo.PutUint32(out[off+4:], 100)
+				}
+			case tag == 0x0128 && typ == 3:
+				bo.PutUint16(out[e+8:], 2) // inch
+			}
+		})
+		return out, nil
+	}
+	return nil, errors.New("density cannot be saved in " + format + " format")
+}
@@ -0,0 +1,78 @@
+package resize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// ErrorKind is a class of errors returned by this package
+type ErrorKind int
+
+const (
+	KindOther          ErrorKind = iota // error of no specific class, like I/O error
+	KindUnsupported                     // input format is not supported
+	KindTooLarge                        // source or destination dimensions exceed limits
+	KindCorrupt                         // input cannot be decoded
+	KindInvalidOptions                  // options are invalid
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindUnsupported:
+		return "unsupported"
+	case KindTooLarge:
+		return "too-large"
+	case KindCorrupt:
+		return "corrupt"
+	case KindInvalidOptions:
+		return "invalid-options"
+	}
+	return "other"
+}
+
+// Error is an error of a known class
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+func (e *Error) Unwrap() error { return e.Err }
+
+// KindOf returns class of err, KindOther if it's not an *Error
+func KindOf(err error) ErrorKind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return KindOther
+}
+
+func errorf(kind ErrorKind, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// readError is an error returned by underlying reader of ctxReader, it
+// tells input read failures from decoding ones
+type readError struct{ err error }
+
+func (e readError) Error() string { return e.err.Error() }
+func (e readError) Unwrap() error { return e.err }
+
+// decodeError classifies error returned by image decoder: unknown format
+// errors become KindUnsupported, others KindCorrupt. Errors reading input
+// and context errors are returned as is.
+func decodeError(err error) error {
+	var re readError
+	var e *Error
+	switch {
+	case err == nil, errors.As(err, &re), errors.As(err, &e),
+		err == context.Canceled, err == context.DeadlineExceeded:
+		return err
+	case err == image.ErrFormat:
+		return &Error{Kind: KindUnsupported, Err: err}
+	}
+	return &Error{Kind: KindCorrupt, Err: err}
+}
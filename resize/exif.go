@@ -0,0 +1,217 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var exifJPEGHeader = []byte("Exif\x00\x00")
+
+// maxJPEGExif is the max. size of EXIF data fitting into single jpeg APP1
+// segment
+const maxJPEGExif = 65535 - 2 - 6
+
+// exifBlock extracts raw EXIF data (TIFF structure) from raw image data of
+// given kind, returning nil if there's none
+func exifBlock(kind string, data []byte) []byte {
+	var out []byte
+	switch kind {
+	case "jpeg":
+		jpegSegments(data, func(marker byte, p []byte) bool {
+			if marker == 0xe1 && bytes.HasPrefix(p, exifJPEGHeader) {
+				out = p[len(exifJPEGHeader):]
+				return false
+			}
+			return true
+		})
+	case "png":
+		pngChunks(data, func(typ string, p []byte) bool {
+			if typ == "eXIf" {
+				out = p
+				return false
+			}
+			return true
+		})
+	case "webp":
+		out = bytes.TrimPrefix(riffChunk(data, "EXIF"), exifJPEGHeader)
+	}
+	if len(out) < 8 {
+		return nil
+	}
+	return out
+}
+
+// resetOrientation returns copy of EXIF data with orientation tag set to 1
+// (normal), if it's present in the first IFD
+func resetOrientation(data []byte) []byte {
+	var bo binary.ByteOrder
+	switch string(data[:4]) {
+	case "II*\x00":
+		bo = binary.LittleEndian
+	case "MM\x00*":
+		bo = binary.BigEndian
+	default:
+		return data
+	}
+	off := int(bo.Uint32(data[4:]))
+	if off < 8 || off+2 > len(data) {
+		return data
+	}
+	n := int(bo.Uint16(data[off:]))
+	for i := 0; i < n; i++ {
+		e := off + 2 + i*12
+		if e+12 > len(data) {
+			break
+		}
+		// orientation tag of SHORT type with single value stored inline
+		if bo.Uint16(data[e:]) == 0x0112 && bo.Uint16(data[e+2:]) == 3 && bo.Uint32(data[e+4:]) == 1 {
+			out := append([]byte(nil), data...)
+			bo.PutUint16(out[e+8:], 1)
+			return out
+		}
+	}
+	return data
+}
+
+// tiffOrientation returns value of orientation tag from the first IFD of
+// TIFF structure, which is either TIFF image or EXIF data, or 0 if there's
+// none
+func tiffOrientation(data []byte) int {
+	bo := tiffByteOrder(data)
+	if bo == nil {
+		return 0
+	}
+	off := int(bo.Uint32(data[4:]))
+	if off < 8 || off+2 > len(data) {
+		return 0
+	}
+	n := int(bo.Uint16(data[off:]))
+	for i := 0; i < n; i++ {
+		e := off + 2 + i*12
+		if e+12 > len(data) {
+			break
+		}
+		if bo.Uint16(data[e:]) == 0x0112 && bo.Uint16(data[e+2:]) == 3 && bo.Uint32(data[e+4:]) == 1 {
+			if o := int(bo.Uint16(data[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// tiffTypeSizes maps TIFF field types to their value sizes
+var tiffTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// stripGPS returns copy of EXIF data with GPS IFD pointer removed from the
+// first IFD and GPS IFD itself, along with values it references, zeroed
+func stripGPS(data []byte) []byte {
+	var bo binary.ByteOrder
+	switch string(data[:4]) {
+	case "II*\x00":
+		bo = binary.LittleEndian
+	case "MM\x00*":
+		bo = binary.BigEndian
+	default:
+		return data
+	}
+	off := int(bo.Uint32(data[4:]))
+	if off < 8 || off+2 > len(data) {
+		return data
+	}
+	n := int(bo.Uint16(data[off:]))
+	end := off + 2 + n*12 + 4 // past the next IFD offset
+	if end > len(data) {
+		return data
+	}
+	for i := 0; i < n; i++ {
+		e := off + 2 + i*12
+		if bo.Uint16(data[e:]) != 0x8825 {
+			continue
+		}
+		out := append([]byte(nil), data...)
+		if gps := int(bo.Uint32(data[e+8:])); gps >= 8 && gps+2 <= len(out) {
+			m := int(bo.Uint16(out[gps:]))
+			for j := 0; j < m && gps+2+j*12+12 <= len(out); j++ {
+				g := gps + 2 + j*12
+				size := tiffTypeSizes[bo.Uint16(out[g+2:])] * int(bo.Uint32(out[g+4:]))
+				if v := int(bo.Uint32(out[g+8:])); size > 4 && v >= 8 && v+size <= len(out) {
+					zero(out[v : v+size])
+				}
+			}
+			zero(out[gps+2 : minInt(gps+2+m*12, len(out))])
+			bo.PutUint16(out[gps:], 0)
+		}
+		// drop the entry, moving the following ones and next IFD offset
+		copy(out[e:end-12], out[e+12:end])
+		zero(out[end-12 : end])
+		bo.PutUint16(out[off:], uint16(n-1))
+		return out
+	}
+	return data
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// jpegExifSegment returns jpeg APP1 segment holding EXIF data
+func jpegExifSegment(data []byte) ([]byte, error) {
+	if len(data) > maxJPEGExif {
+		return nil, errors.New("EXIF data is too large")
+	}
+	seg := []byte{0xff, 0xe1}
+	seg = appendUint16(seg, uint16(2+len(exifJPEGHeader)+len(data)))
+	seg = append(seg, exifJPEGHeader...)
+	return append(seg, data...), nil
+}
+
+// exifThumbnail returns jpeg thumbnail referenced from the second IFD of
+// EXIF data, or nil if there's none
+func exifThumbnail(data []byte) []byte {
+	var bo binary.ByteOrder
+	switch {
+	case len(data) < 8:
+		return nil
+	case string(data[:4]) == "II*\x00":
+		bo = binary.LittleEndian
+	case string(data[:4]) == "MM\x00*":
+		bo = binary.BigEndian
+	default:
+		return nil
+	}
+	off := int(bo.Uint32(data[4:]))
+	if off < 8 || off+2 > len(data) {
+		return nil
+	}
+	next := off + 2 + int(bo.Uint16(data[off:]))*12
+	if next+4 > len(data) {
+		return nil
+	}
+	if off = int(bo.Uint32(data[next:])); off < 8 || off+2 > len(data) {
+		return nil
+	}
+	var start, size int
+	for i, n := 0, int(bo.Uint16(data[off:])); i < n; i++ {
+		e := off + 2 + i*12
+		if e+12 > len(data) {
+			break
+		}
+		// JPEGInterchangeFormat and JPEGInterchangeFormatLength tags of
+		// LONG type
+		switch tag := bo.Uint16(data[e:]); {
+		case tag == 0x0201 && bo.Uint16(data[e+2:]) == 4:
+			start = int(bo.Uint32(data[e+8:]))
+		case tag == 0x0202 && bo.Uint16(data[e+2:]) == 4:
+			size = int(bo.Uint32(data[e+8:]))
+		}
+	}
+	if start < 8 || size < 4 || start+size > len(data) || data[start] != 0xff || data[start+1] != 0xd8 {
+		return nil
+	}
+	return data[start : start+size]
+}
@@ -0,0 +1,76 @@
+package resize
+
+import (
+	_ "embed" // for face detection cascade
+	"image"
+	"math"
+	"sync"
+
+	pigo "github.com/esimov/pigo/core"
+	"golang.org/x/image/draw"
+)
+
+// faceCascade is the face detection cascade from github.com/esimov/pigo
+// (MIT license), see NOTICE for its origin
+//
+//go:embed facefinder
+var faceCascade []byte
+
+var faceClassifier struct {
+	once sync.Once
+	p    *pigo.Pigo
+	err  error
+}
+
+const (
+	faceSize    = 480 // max. side of downscaled image copy faces are detected on
+	faceQuality = 5   // min. detection score
+)
+
+// faceRect returns w×h rectangle inside img bounds centered on the area
+// covering all detected faces. Faces are looked for in the image as
+// displayed, according to its EXIF orientation. If no faces are found, ok
+// is false.
+func faceRect(img image.Image, w, h, orientation int) (r image.Rectangle, ok bool) {
+	faceClassifier.once.Do(func() {
+		faceClassifier.p, faceClassifier.err = pigo.NewPigo().Unpack(faceCascade)
+	})
+	if faceClassifier.err != nil {
+		return r, false
+	}
+	b := img.Bounds()
+	scale := math.Min(math.Min(faceSize/float64(b.Dx()), faceSize/float64(b.Dy())), 1)
+	sw, sh := int(float64(b.Dx())*scale+.5), int(float64(b.Dy())*scale+.5)
+	if sw < 1 || sh < 1 {
+		return r, false
+	}
+	var small image.Image = image.NewGray(image.Rect(0, 0, sw, sh))
+	draw.ApproxBiLinear.Scale(small.(*image.Gray), small.Bounds(), img, b, draw.Src, nil)
+	if rotatefunc, _ := useExifOrientation(orientation); rotatefunc != nil {
+		small = rotatefunc(small)
+	}
+	gray := image.NewGray(image.Rect(0, 0, small.Bounds().Dx(), small.Bounds().Dy()))
+	draw.Draw(gray, gray.Bounds(), small, small.Bounds().Min, draw.Src)
+	dw, dh := gray.Rect.Dx(), gray.Rect.Dy()
+	dets := faceClassifier.p.RunCascade(pigo.CascadeParams{
+		MinSize:     20,
+		MaxSize:     int(math.Max(float64(dw), float64(dh))),
+		ShiftFactor: .1,
+		ScaleFactor: 1.1,
+		ImageParams: pigo.ImageParams{Pixels: gray.Pix, Rows: dh, Cols: dw, Dim: gray.Stride},
+	}, 0)
+	var area image.Rectangle
+	for _, d := range faceClassifier.p.ClusterDetections(dets, .2) {
+		if d.Q >= faceQuality {
+			area = area.Union(image.Rect(d.Col-d.Scale/2, d.Row-d.Scale/2, d.Col+d.Scale/2, d.Row+d.Scale/2))
+		}
+	}
+	if area.Empty() {
+		return r, false
+	}
+	fx, fy := storedPoint(orientation,
+		float64(area.Min.X+area.Max.X)/2/float64(dw), float64(area.Min.Y+area.Max.Y)/2/float64(dh))
+	x0 := clampInt(int(math.Round(fx*float64(b.Dx())))-w/2, 0, b.Dx()-w)
+	y0 := clampInt(int(math.Round(fy*float64(b.Dy())))-h/2, 0, b.Dy()-h)
+	return image.Rect(b.Min.X+x0, b.Min.Y+y0, b.Min.X+x0+w, b.Min.Y+y0+h), true
+}
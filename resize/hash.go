@@ -0,0 +1,26 @@
+package resize
+
+import (
+	"image"
+
+	"github.com/disintegration/gift"
+)
+
+// DHash returns 64-bit difference hash of img: image is scaled down to 9×8
+// grayscale one and every bit of hash tells whether pixel is brighter than
+// its right neighbor. Hashes of similar images differ in few bits.
+func DHash(img image.Image) uint64 {
+	g := gift.New(gift.Resize(9, 8, gift.BoxResampling), gift.Grayscale())
+	small := image.NewGray(g.Bounds(img.Bounds()))
+	g.Draw(small, img)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
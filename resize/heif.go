@@ -0,0 +1,118 @@
+//go:build heif
+// +build heif
+
+package resize
+
+// #cgo pkg-config: libheif
+// #include <stdlib.h>
+// #include <libheif/heif.h>
+import "C"
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"unsafe"
+)
+
+// This file implements HEIF (HEIC) decoder using libheif, it's only built
+// with heif build tag. Rotation and mirroring stored in the container are
+// applied by libheif while decoding.
+
+func init() {
+	for _, brand := range []string{"heic", "heix", "hevc", "hevx", "mif1", "msf1"} {
+		image.RegisterFormat("heic", "????ftyp"+brand, decodeHEIF, decodeHEIFConfig)
+	}
+}
+
+// heifSource is libheif context holding primary image handle of image
+// data held in C memory
+type heifSource struct {
+	ctx    *C.struct_heif_context
+	handle *C.struct_heif_image_handle
+	data   unsafe.Pointer
+}
+
+// newHEIFSource reads image from r and parses it with libheif. Caller should
+// call close once done.
+func newHEIFSource(r io.Reader) (*heifSource, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxFileSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("heif: empty input")
+	}
+	ctx := C.heif_context_alloc()
+	if ctx == nil {
+		return nil, errors.New("heif: cannot create context")
+	}
+	src := &heifSource{ctx: ctx, data: C.CBytes(data)}
+	herr := C.heif_context_read_from_memory_without_copy(ctx, src.data, C.size_t(len(data)), nil)
+	if herr.code == C.heif_error_Ok {
+		herr = C.heif_context_get_primary_image_handle(ctx, &src.handle)
+	}
+	if herr.code != C.heif_error_Ok {
+		src.close()
+		return nil, heifError(herr)
+	}
+	return src, nil
+}
+
+func (src *heifSource) close() {
+	if src.handle != nil {
+		C.heif_image_handle_release(src.handle)
+	}
+	C.heif_context_free(src.ctx)
+	C.free(src.data)
+}
+
+func decodeHEIFConfig(r io.Reader) (image.Config, error) {
+	src, err := newHEIFSource(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer src.close()
+	return image.Config{
+		ColorModel: color.NRGBAModel,
+		Width:      int(C.heif_image_handle_get_width(src.handle)),
+		Height:     int(C.heif_image_handle_get_height(src.handle)),
+	}, nil
+}
+
+func decodeHEIF(r io.Reader) (image.Image, error) {
+	src, err := newHEIFSource(r)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+	w, h := int(C.heif_image_handle_get_width(src.handle)), int(C.heif_image_handle_get_height(src.handle))
+	if w*h > PixelLimit {
+		return nil, errors.New("heif: image is too large")
+	}
+	var himg *C.struct_heif_image
+	herr := C.heif_decode_image(src.handle, &himg, C.heif_colorspace_RGB, C.heif_chroma_interleaved_RGBA, nil)
+	if herr.code != C.heif_error_Ok {
+		return nil, heifError(herr)
+	}
+	defer C.heif_image_release(himg)
+	var stride C.int
+	plane := C.heif_image_get_plane_readonly(himg, C.heif_channel_interleaved, &stride)
+	if plane == nil {
+		return nil, errors.New("heif: cannot get image data")
+	}
+	w = int(C.heif_image_get_width(himg, C.heif_channel_interleaved))
+	h = int(C.heif_image_get_height(himg, C.heif_channel_interleaved))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	pix := C.GoBytes(unsafe.Pointer(plane), C.int(int(stride)*h))
+	for y := 0; y < h; y++ {
+		copy(img.Pix[y*img.Stride:(y+1)*img.Stride], pix[y*int(stride):])
+	}
+	return img, nil
+}
+
+func heifError(herr C.struct_heif_error) error {
+	return errors.New("heif: " + C.GoString(herr.message))
+}
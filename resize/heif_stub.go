@@ -0,0 +1,27 @@
+//go:build !heif
+// +build !heif
+
+package resize
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// Without heif build tag HEIF images are recognized, but decoding them
+// reports that support is not built in.
+
+func init() {
+	for _, brand := range []string{"heic", "heix", "hevc", "hevx", "mif1", "msf1"} {
+		image.RegisterFormat("heic", "????ftyp"+brand, decodeHEIF, decodeHEIFConfig)
+	}
+}
+
+var errNoHEIF = &Error{
+	Kind: KindUnsupported,
+	Err:  errors.New("heic support is not built in, rebuild with heif build tag and libheif installed"),
+}
+
+func decodeHEIF(io.Reader) (image.Image, error)        { return nil, errNoHEIF }
+func decodeHEIFConfig(io.Reader) (image.Config, error) { return image.Config{}, errNoHEIF }
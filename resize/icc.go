@@ -0,0 +1,481 @@
+package resize
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// maxICCSize limits size of ICC profile accepted from input
+const maxICCSize = 4 << 20
+
+// iccProfile extracts ICC profile from raw image data of given kind,
+// returning nil if there's none
+func iccProfile(kind string, data []byte) []byte {
+	switch kind {
+	case "jpeg":
+		return jpegICC(data)
+	case "png":
+		return pngICC(data)
+	case "tiff":
+		t, err := tiff.Decode(bytes.NewReader(data))
+		if err != nil || len(t.Dirs) == 0 {
+			return nil
+		}
+		for _, tag := range t.Dirs[0].Tags {
+			if tag.Id == 0x8773 {
+				return tag.Val
+			}
+		}
+	case "webp":
+		return riffChunk(data, "ICCP")
+	}
+	return nil
+}
+
+// jpegSegments calls fn for every marker segment before image data of
+// jpeg file, stopping if fn returns false
+func jpegSegments(data []byte, fn func(marker byte, payload []byte) bool) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return
+		}
+		marker := data[i+1]
+		if marker == 0xff { // fill byte
+			i++
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 { // SOS, EOI
+			return
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return
+		}
+		if !fn(marker, data[i+4:i+2+n]) {
+			return
+		}
+		i += 2 + n
+	}
+}
+
+var iccJPEGHeader = []byte("ICC_PROFILE\x00")
+
+// jpegICC returns ICC profile assembled from jpeg APP2 segments
+func jpegICC(data []byte) []byte {
+	var chunks [][]byte
+	jpegSegments(data, func(marker byte, p []byte) bool {
+		if marker != 0xe2 || !bytes.HasPrefix(p, iccJPEGHeader) || len(p) < 14 {
+			return true
+		}
+		seq, count := int(p[12]), int(p[13])
+		if seq < 1 || seq > count {
+			return true
+		}
+		if chunks == nil {
+			chunks = make([][]byte, count)
+		}
+		if seq <= len(chunks) {
+			chunks[seq-1] = p[14:]
+		}
+		return true
+	})
+	var out []byte
+	for _, c := range chunks {
+		if c == nil {
+			return nil
+		}
+		out = append(out, c...)
+	}
+	return out
+}
+
+// pngChunks calls fn for every png chunk before image data, stopping if fn
+// returns false
+func pngChunks(data []byte, fn func(typ string, payload []byte) bool) {
+	if len(data) < 8 || string(data[:8]) != pngSignature {
+		return
+	}
+	for i := 8; i+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		typ := string(data[i+4 : i+8])
+		if typ == "IDAT" || n < 0 || i+12+n > len(data) {
+			return
+		}
+		if !fn(typ, data[i+8:i+8+n]) {
+			return
+		}
+		i += 12 + n
+	}
+}
+
+// pngICC returns ICC profile stored in png iCCP chunk
+func pngICC(data []byte) []byte {
+	var out []byte
+	pngChunks(data, func(typ string, p []byte) bool {
+		if typ != "iCCP" {
+			return true
+		}
+		i := bytes.IndexByte(p, 0)
+		if i < 0 || i+2 > len(p) || p[i+1] != 0 {
+			return false
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(p[i+2:]))
+		if err != nil {
+			return false
+		}
+		out, _ = ioutil.ReadAll(io.LimitReader(zr, maxICCSize))
+		return false
+	})
+	return out
+}
+
+// riffChunk returns payload of the first chunk of given type in webp file
+func riffChunk(data []byte, typ string) []byte {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil
+	}
+	for i := 12; i+8 <= len(data); {
+		n := int(binary.LittleEndian.Uint32(data[i+4:]))
+		if n < 0 || i+8+n > len(data) {
+			return nil
+		}
+		if string(data[i:i+4]) == typ {
+			return data[i+8 : i+8+n]
+		}
+		i += 8 + n + n&1
+	}
+	return nil
+}
+
+// embedMetadata returns encoded image of given format with ICC profile and
+// EXIF data added, either of which can be empty. Only jpeg, png and webp
+// are supported.
+func embedMetadata(format string, data, icc, exif []byte) ([]byte, error) {
+	switch format {
+	case "jpeg":
+		var segs []byte
+		if len(exif) > 0 {
+			seg, err := jpegExifSegment(exif)
+			if err != nil {
+				return nil, err
+			}
+			segs = append(segs, seg...)
+		}
+		const maxChunk = 65535 - 2 - 14
+		count := (len(icc) + maxChunk - 1) / maxChunk
+		if count > 255 {
+			return nil, errors.New("ICC profile is too large")
+		}
+		for i := 0; i < count; i++ {
+			chunk := icc[i*maxChunk:]
+			if len(chunk) > maxChunk {
+				chunk = chunk[:maxChunk]
+			}
+			segs = append(segs, 0xff, 0xe2)
+			segs = appendUint16(segs, uint16(2+14+len(chunk)))
+			segs = append(segs, iccJPEGHeader...)
+			segs = append(segs, byte(i+1), byte(count))
+			segs = append(segs, chunk...)
+		}
+		return insertJPEGSegments(data, segs)
+	case "png":
+		var err error
+		if len(exif) > 0 {
+			if data, err = insertPNGChunk(data, "eXIf", exif); err != nil {
+				return nil, err
+			}
+		}
+		if len(icc) > 0 {
+			buf := new(bytes.Buffer)
+			buf.WriteString("icc\x00\x00")
+			zw, _ := zlib.NewWriterLevel(buf, zlib.BestCompression)
+			zw.Write(icc)
+			zw.Close()
+			data, err = insertPNGChunk(data, "iCCP", buf.Bytes())
+		}
+		return data, err
+	case "webp":
+		return extendWebP(data, icc, exif)
+	}
+	return nil, errors.New("metadata cannot be saved in " + format + " format")
+}
+
+// insertJPEGSegments inserts raw segments data into jpeg right after SOI
+// and JFIF APP0 marker, if any
+func insertJPEGSegments(data, segs []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errors.New("invalid jpeg data")
+	}
+	pos := 2
+	if data[2] == 0xff && data[3] == 0xe0 && len(data) > 6 {
+		pos += 2 + int(binary.BigEndian.Uint16(data[4:]))
+	}
+	out := make([]byte, 0, len(data)+len(segs))
+	out = append(out, data[:pos]...)
+	out = append(out, segs...)
+	return append(out, data[pos:]...), nil
+}
+
+// insertPNGChunk inserts chunk into png right after IHDR chunk
+func insertPNGChunk(data []byte, typ string, payload []byte) ([]byte, error) {
+	const ihdrEnd = 8 + 8 + 13 + 4
+	if len(data) < ihdrEnd || string(data[:8]) != pngSignature {
+		return nil, errors.New("invalid png data")
+	}
+	out := make([]byte, 0, len(data)+len(payload)+12)
+	out = append(out, data[:ihdrEnd]...)
+	out = appendUint32(out, uint32(len(payload)))
+	start := len(out)
+	out = append(out, typ...)
+	out = append(out, payload...)
+	out = appendUint32(out, crc32.ChecksumIEEE(out[start:]))
+	return append(out, data[ihdrEnd:]...), nil
+}
+
+// extendWebP converts simple lossless webp file into extended format and
+// adds ICCP and EXIF chunks if icc and exif are not empty
+func extendWebP(data, icc, exif []byte) ([]byte, error) {
+	vp8l := riffChunk(data, "VP8L")
+	if len(vp8l) < 5 || vp8l[0] != 0x2f {
+		return nil, errors.New("invalid webp data")
+	}
+	hdr := binary.LittleEndian.Uint32(vp8l[1:])
+	width, height := hdr&0x3fff+1, (hdr>>14)&0x3fff+1
+	var flags byte
+	if len(icc) > 0 {
+		flags |= 0x20
+	}
+	if len(exif) > 0 {
+		flags |= 0x08
+	}
+	if hdr>>28&1 == 1 {
+		flags |= 0x10 // alpha
+	}
+	body := []byte("WEBP")
+	body = appendRIFFChunk(body, "VP8X", []byte{flags, 0, 0, 0,
+		byte(width - 1), byte((width - 1) >> 8), byte((width - 1) >> 16),
+		byte(height - 1), byte((height - 1) >> 8), byte((height - 1) >> 16)})
+	if len(icc) > 0 {
+		body = appendRIFFChunk(body, "ICCP", icc)
+	}
+	body = appendRIFFChunk(body, "VP8L", vp8l)
+	if len(exif) > 0 {
+		body = appendRIFFChunk(body, "EXIF", exif)
+	}
+	out := []byte("RIFF")
+	out = append(out, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(body)))
+	return append(out, body...), nil
+}
+
+func appendRIFFChunk(b []byte, typ string, payload []byte) []byte {
+	b = append(b, typ...)
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(payload)))
+	b = append(b, payload...)
+	if len(payload)&1 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func appendUint16(b []byte, v uint16) []byte { return append(b, byte(v>>8), byte(v)) }
+
+// iccTransform converts pixels of RGB matrix/TRC based ICC profile to sRGB
+type iccTransform struct {
+	trc [3][256]float64 // linearization tables
+	m   [3][3]float64   // linear RGB to linear sRGB
+}
+
+// newICCTransform parses RGB matrix/TRC ICC profile (like Display P3 or
+// Adobe RGB) and returns transform converting its pixels to sRGB
+func newICCTransform(icc []byte) (*iccTransform, error) {
+	if len(icc) < 132 || string(icc[16:20]) != "RGB " || string(icc[36:40]) != "acsp" {
+		return nil, errors.New("unsupported ICC profile")
+	}
+	tags := make(map[string][]byte)
+	n := int(binary.BigEndian.Uint32(icc[128:]))
+	for i := 0; i < n && 132+12*i+12 <= len(icc); i++ {
+		e := icc[132+12*i:]
+		off, size := binary.BigEndian.Uint32(e[4:]), binary.BigEndian.Uint32(e[8:])
+		if uint64(off)+uint64(size) > uint64(len(icc)) {
+			return nil, errors.New("invalid ICC profile")
+		}
+		tags[string(e[:4])] = icc[off : off+size]
+	}
+	t := new(iccTransform)
+	var toXYZ [3][3]float64
+	for c, name := range [...]string{"r", "g", "b"} {
+		xyz := tags[name+"XYZ"]
+		if len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, errors.New("ICC profile is not matrix based")
+		}
+		for i := 0; i < 3; i++ {
+			toXYZ[i][c] = s15Fixed16(xyz[8+4*i:])
+		}
+		curve, err := parseTRC(tags[name+"TRC"])
+		if err != nil {
+			return nil, err
+		}
+		for i := range t.trc[c] {
+			t.trc[c][i] = curve(float64(i) / 255)
+		}
+	}
+	t.m = mulMatrix(xyzD50ToSRGB, toXYZ)
+	return t, nil
+}
+
+func s15Fixed16(b []byte) float64 { return float64(int32(binary.BigEndian.Uint32(b))) / 65536 }
+
+// parseTRC returns tone reproduction curve function from ICC curv or para
+// tag data
+func parseTRC(b []byte) (func(float64) float64, error) {
+	if len(b) < 12 {
+		return nil, errors.New("ICC profile has no tone curves")
+	}
+	switch string(b[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(b[8:]))
+		switch {
+		case n == 0:
+			return func(x float64) float64 { return x }, nil
+		case n == 1 && len(b) >= 14:
+			g := float64(binary.BigEndian.Uint16(b[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, g) }, nil
+		case len(b) >= 12+2*n:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(b[12+2*i:])) / 65535
+			}
+			return func(x float64) float64 {
+				pos := x * float64(n-1)
+				i := int(pos)
+				if i >= n-1 {
+					return table[n-1]
+				}
+				f := pos - float64(i)
+				return table[i]*(1-f) + table[i+1]*f
+			}, nil
+		}
+	case "para":
+		typ := binary.BigEndian.Uint16(b[8:])
+		nParams := [...]int{1, 3, 4, 5, 7}
+		if int(typ) >= len(nParams) || len(b) < 12+4*nParams[typ] {
+			break
+		}
+		var p [7]float64
+		for i := 0; i < nParams[typ]; i++ {
+			p[i] = s15Fixed16(b[12+4*i:])
+		}
+		g, a, bb, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		pow := func(x float64) float64 {
+			if x <= 0 {
+				return 0
+			}
+			return math.Pow(x, g)
+		}
+		switch typ {
+		case 0:
+			return pow, nil
+		case 1:
+			return func(x float64) float64 { return pow(a*x + bb) }, nil
+		case 2:
+			return func(x float64) float64 { return pow(a*x+bb) + c }, nil
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return pow(a*x + bb)
+				}
+				return c * x
+			}, nil
+		case 4:
+			return func(x float64) float64 {
+				if x >= d {
+					return pow(a*x+bb) + e
+				}
+				return c*x + f
+			}, nil
+		}
+	}
+	return nil, errors.New("unsupported ICC tone curve")
+}
+
+// xyzD50ToSRGB converts D50 adapted XYZ (ICC profile connection space) to
+// linear sRGB
+var xyzD50ToSRGB = invertMatrix([3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+})
+
+func mulMatrix(a, b [3][3]float64) [3][3]float64 {
+	var out [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				out[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return out
+}
+
+func invertMatrix(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	var out [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			a, b := m[(j+1)%3], m[(j+2)%3]
+			out[i][j] = (a[(i+1)%3]*b[(i+2)%3] - a[(i+2)%3]*b[(i+1)%3]) / det
+		}
+	}
+	return out
+}
+
+// srgbEncode maps linear values quantized to 12 bits to sRGB encoded ones
+var srgbEncode = func() (t [4096]uint8) {
+	for i := range t {
+		v := float64(i) / 4095
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		t[i] = uint8(math.Round(v * 255))
+	}
+	return t
+}()
+
+// apply returns copy of img with pixels converted to sRGB
+func (t *iccTransform) apply(img image.Image) *image.NRGBA {
+	src := ToNRGBA(img)
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		si, di := src.PixOffset(b.Min.X, y), dst.PixOffset(b.Min.X, y)
+		for x := b.Min.X; x < b.Max.X; x, si, di = x+1, si+4, di+4 {
+			s := src.Pix[si : si+4]
+			r, g, bl := t.trc[0][s[0]], t.trc[1][s[1]], t.trc[2][s[2]]
+			for c := 0; c < 3; c++ {
+				v := t.m[c][0]*r + t.m[c][1]*g + t.m[c][2]*bl
+				dst.Pix[di+c] = srgbEncode[clampInt(int(v*4095+.5), 0, 4095)]
+			}
+			dst.Pix[di+3] = s[3]
+		}
+	}
+	return dst
+}
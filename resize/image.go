@@ -0,0 +1,47 @@
+package resize
+
+import (
+	"context"
+	"image"
+	"image/draw"
+)
+
+// Image transforms already decoded img according to opts the same way
+// Process does, but returns the result instead of encoding it. Background
+// is only filled if opts.Format is set to a format without transparency
+// support, options related to decoding and encoding are ignored. As there
+// is no EXIF data, img is taken as is, use Orient to apply orientation
+// known from elsewhere.
+func Image(img image.Image, opts Options) (image.Image, error) {
+	if opts.Format == "" {
+		opts.NoFill = true
+	}
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+	tr, err := opts.transform()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := img.(SubImager); !ok {
+		dst := image.NewNRGBA(img.Bounds())
+		draw.Draw(dst, dst.Bounds(), img, dst.Bounds().Min, draw.Src)
+		img = dst
+	}
+	b := img.Bounds()
+	src := &source{
+		cfg: image.Config{ColorModel: img.ColorModel(), Width: b.Dx(), Height: b.Dy()},
+		img: img,
+	}
+	img, _, err = src.process(context.Background(), opts, tr)
+	return img, err
+}
+
+// Orient returns img transformed according to EXIF orientation value (1-8),
+// for images with orientation known from other sources than EXIF data
+func Orient(img image.Image, orientation int) image.Image {
+	if rotatefunc, _ := useExifOrientation(orientation); rotatefunc != nil {
+		return rotatefunc(img)
+	}
+	return img
+}
@@ -0,0 +1,190 @@
+package resize
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+)
+
+// adam7 holds x and y offsets and steps of Adam7 interlacing passes
+var adam7 = [7][4]int{
+	{0, 0, 8, 8},
+	{4, 0, 8, 8},
+	{0, 4, 4, 8},
+	{2, 0, 4, 4},
+	{0, 2, 2, 4},
+	{1, 0, 2, 2},
+	{0, 1, 1, 2},
+}
+
+// encodePNGInterlaced writes img to w as Adam7 interlaced png. Paletted and
+// gray images are stored as such, others as 8 bit per channel truecolor
+// images, with alpha channel if img is not opaque.
+func encodePNGInterlaced(w io.Writer, img image.Image, level png.CompressionLevel) error {
+	b := img.Bounds()
+	var colorType byte
+	var bpp int
+	var pixel func(dst []byte, x, y int)
+	switch m := img.(type) {
+	case *image.Paletted:
+		if len(m.Palette) == 0 || len(m.Palette) > 256 {
+			return encodePNGInterlaced(w, ToNRGBA(img), level)
+		}
+		colorType, bpp = 3, 1
+		pixel = func(dst []byte, x, y int) { dst[0] = m.ColorIndexAt(x, y) }
+	case *image.Gray:
+		colorType, bpp = 0, 1
+		pixel = func(dst []byte, x, y int) { dst[0] = m.GrayAt(x, y).Y }
+	default:
+		colorType, bpp = 2, 3
+		if op, ok := img.(opaquer); !ok || !op.Opaque() {
+			colorType, bpp = 6, 4
+		}
+		src := ToNRGBA(img)
+		pixel = func(dst []byte, x, y int) { copy(dst, src.Pix[src.PixOffset(x, y):][:bpp]) }
+	}
+	pw := &pngWriter{w: w}
+	pw.writeHeader(b.Dx(), b.Dy(), colorType, true)
+	if m, ok := img.(*image.Paletted); ok && colorType == 3 {
+		plte := make([]byte, 0, 3*len(m.Palette))
+		trns := make([]byte, 0, len(m.Palette))
+		for _, c := range m.Palette {
+			n := color.NRGBAModel.Convert(c).(color.NRGBA)
+			plte = append(plte, n.R, n.G, n.B)
+			trns = append(trns, n.A)
+		}
+		for len(trns) > 0 && trns[len(trns)-1] == 0xff {
+			trns = trns[:len(trns)-1]
+		}
+		pw.writeChunk("PLTE", plte)
+		if len(trns) > 0 {
+			pw.writeChunk("tRNS", trns)
+		}
+	}
+	buf := new(bytes.Buffer)
+	zw, err := zlib.NewWriterLevel(buf, zlibLevel(level))
+	if err != nil {
+		return err
+	}
+	filters := byte(5)
+	if colorType == 3 {
+		filters = 1 // filtering rarely helps palette images
+	}
+	for _, p := range adam7 {
+		width := (b.Dx() - p[0] + p[2] - 1) / p[2]
+		height := (b.Dy() - p[1] + p[3] - 1) / p[3]
+		if width <= 0 || height <= 0 {
+			continue
+		}
+		prev := make([]byte, width*bpp)
+		cur := make([]byte, width*bpp)
+		filtered := make([]byte, 1+width*bpp)
+		best := make([]byte, 1+width*bpp)
+		for y := b.Min.Y + p[1]; y < b.Max.Y; y += p[3] {
+			for i, x := 0, b.Min.X+p[0]; x < b.Max.X; i, x = i+1, x+p[2] {
+				pixel(cur[i*bpp:], x, y)
+			}
+			bestSum := -1
+			for ft := byte(0); ft < filters; ft++ {
+				if sum := filterRow(filtered, cur, prev, bpp, ft); bestSum < 0 || sum < bestSum {
+					bestSum = sum
+					best, filtered = filtered, best
+				}
+			}
+			if _, err := zw.Write(best); err != nil {
+				return err
+			}
+			prev, cur = cur, prev
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	pw.writeChunk("IDAT", buf.Bytes())
+	pw.writeChunk("IEND", nil)
+	return pw.err
+}
+
+// encodeGIFInterlaced writes g to w like gif.EncodeAll, but with all frames
+// interlaced
+func encodeGIFInterlaced(w io.Writer, g *gif.GIF) error {
+	out := *g
+	out.Image = make([]*image.Paletted, len(g.Image))
+	for i, img := range g.Image {
+		out.Image[i] = gifInterlaceRows(img)
+	}
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, &out); err != nil {
+		return err
+	}
+	data, err := setGIFInterlaced(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// gifInterlaceRows returns copy of img with its rows reordered the way they
+// are stored in interlaced gif: every 8th row starting from 0, every 8th
+// starting from 4, every 4th starting from 2, then every other row
+func gifInterlaceRows(img *image.Paletted) *image.Paletted {
+	b := img.Bounds()
+	out := image.NewPaletted(b, img.Palette)
+	row := b.Min.Y
+	for _, p := range [][2]int{{0, 8}, {4, 8}, {2, 4}, {1, 2}} {
+		for y := b.Min.Y + p[0]; y < b.Max.Y; y += p[1] {
+			copy(out.Pix[out.PixOffset(b.Min.X, row):out.PixOffset(b.Min.X, row)+b.Dx()],
+				img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Min.X, y)+b.Dx()])
+			row++
+		}
+	}
+	return out
+}
+
+// setGIFInterlaced sets interlace flag of every image descriptor of gif
+// data, which must already store rows in interlaced order
+func setGIFInterlaced(data []byte) ([]byte, error) {
+	errCorrupt := errors.New("malformed gif structure")
+	if len(data) < 13 {
+		return nil, errCorrupt
+	}
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&7 + 1)
+	}
+	// skipBlocks returns position after data sub-blocks starting at i
+	skipBlocks := func(i int) int {
+		for i < len(data) && data[i] != 0 {
+			i += 1 + int(data[i])
+		}
+		return i + 1
+	}
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension
+			pos = skipBlocks(pos + 2)
+		case 0x2c: // image descriptor
+			if pos+11 > len(data) {
+				return nil, errCorrupt
+			}
+			flags := data[pos+9]
+			data[pos+9] |= 0x40
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&7 + 1)
+			}
+			pos = skipBlocks(pos + 1) // LZW minimum code size goes first
+		case 0x3b: // trailer
+			return data, nil
+		default:
+			return nil, errCorrupt
+		}
+	}
+	return nil, errCorrupt
+}
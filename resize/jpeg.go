@@ -0,0 +1,535 @@
+package resize
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// This file implements jpeg encoder supporting progressive mode, chroma
+// subsampling choice and optimized Huffman tables, which image/jpeg lacks.
+// It uses the same quantization and default Huffman tables as image/jpeg
+// (section K of the spec).
+//
+// Progressive images are written with spectral selection only: DC of all
+// components first, then low frequency AC of luma, AC of chroma, and the
+// rest of luma AC.
+
+// jpegUnzig maps zig-zag order index to natural order one
+var jpegUnzig = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// jpegQuant are unscaled luminance and chrominance quantization tables in
+// zig-zag order
+var jpegQuant = [2][64]byte{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14, 13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37, 29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68, 87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113, 121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26, 26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// jpegHuffSpec is the Huffman table specification: number of codes of each
+// length 1-16 and symbols
+type jpegHuffSpec struct {
+	count  [16]byte
+	values []byte
+}
+
+// jpegHuffSpecs are luminance DC, luminance AC, chrominance DC and
+// chrominance AC tables
+var jpegHuffSpecs = [4]jpegHuffSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12, 0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08, 0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21, 0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91, 0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34, 0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// jpegHuffCodes are jpegHuffSpecs compiled to symbol to code maps
+var jpegHuffCodes = compileHuffSpecs(jpegHuffSpecs)
+
+// compileHuffSpecs returns symbol to code maps of Huffman tables; code
+// length is kept in the upper 8 bits
+func compileHuffSpecs(specs [4]jpegHuffSpec) (out [4][256]uint32) {
+	for i, s := range specs {
+		code, k := uint32(0), 0
+		for n, cnt := range s.count {
+			for j := byte(0); j < cnt; j++ {
+				out[i][s.values[k]] = uint32(n+1)<<24 | code
+				code++
+				k++
+			}
+			code <<= 1
+		}
+	}
+	return out
+}
+
+// optimalHuffSpec returns Huffman table specification optimal for symbols
+// of given frequencies, built as described in section K.2 of the spec. It
+// returns false if no symbols are used.
+func optimalHuffSpec(freq *[256]int) (jpegHuffSpec, bool) {
+	var f [257]int
+	copy(f[:], freq[:])
+	f[256] = 1 // reserved symbol, so that no code consists of all 1 bits
+	var size [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+	for {
+		v1, v2 := -1, -1
+		for i, n := range f {
+			switch {
+			case n == 0:
+			case v1 < 0 || n <= f[v1]:
+				v1, v2 = i, v1
+			case v2 < 0 || n <= f[v2]:
+				v2 = i
+			}
+		}
+		if v2 < 0 {
+			break
+		}
+		f[v1] += f[v2]
+		f[v2] = 0
+		for size[v1]++; others[v1] >= 0; size[v1]++ {
+			v1 = others[v1]
+		}
+		others[v1] = v2
+		for size[v2]++; others[v2] >= 0; size[v2]++ {
+			v2 = others[v2]
+		}
+	}
+	var bits [33]int
+	for _, n := range size {
+		if n > 0 {
+			bits[n]++
+		}
+	}
+	// limit code lengths to 16 bits
+	for i := 32; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+	// drop the reserved symbol, which has the longest code
+	i := 16
+	for i > 0 && bits[i] == 0 {
+		i--
+	}
+	if i == 0 {
+		return jpegHuffSpec{}, false
+	}
+	bits[i]--
+	var spec jpegHuffSpec
+	for n := 1; n <= 16; n++ {
+		spec.count[n-1] = byte(bits[n])
+	}
+	for n := 1; n <= 32; n++ {
+		for sym := 0; sym < 256; sym++ {
+			if size[sym] == n {
+				spec.values = append(spec.values, byte(sym))
+			}
+		}
+	}
+	return spec, len(spec.values) > 0
+}
+
+// jpegCos holds DCT basis function values: jpegCos[u][x] = C(u)/2 *
+// cos((2x+1)uπ/16)
+var jpegCos = func() (t [8][8]float64) {
+	for u := range t {
+		c := .5
+		if u == 0 {
+			c = .5 / math.Sqrt2
+		}
+		for x := range t[u] {
+			t[u][x] = c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return t
+}()
+
+// jpegSubsampling maps subsampling names to luma sampling factors
+var jpegSubsampling = map[string][2]int{
+	"444": {1, 1},
+	"422": {2, 1},
+	"420": {2, 2},
+}
+
+// jpegComponent holds quantized DCT coefficients of a single image
+// component in zig-zag order
+type jpegComponent struct {
+	id     int
+	h, v   int // sampling factors
+	bw, bh int // number of blocks covering the component, MCU padded
+	cw, ch int // number of blocks covering the component, unpadded
+	table  int // quantization and Huffman tables index
+	blocks [][64]int32
+}
+
+// encodeJPEG writes img to w as jpeg of given quality with subsampling
+// being one of 444, 422 or 420 (the default). If progressive is true,
+// progressive jpeg is written. If optimize is true, Huffman tables optimal
+// for the image are used instead of the default ones.
+func encodeJPEG(w io.Writer, img image.Image, quality int, subsample string, progressive, optimize bool) error {
+	b := img.Bounds()
+	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
+		return errors.New("jpeg: image is too large to encode")
+	}
+	if subsample == "" {
+		subsample = "420"
+	}
+	hmax, vmax := jpegSubsampling[subsample][0], jpegSubsampling[subsample][1]
+	if hmax == 0 {
+		return errors.New("jpeg: unsupported subsampling " + subsample)
+	}
+	var quant [2][64]int32
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	for i := range quant {
+		for j, q := range jpegQuant[i] {
+			quant[i][j] = int32(clampInt((int(q)*scale+50)/100, 1, 255))
+		}
+	}
+
+	var planes [][]uint8 // full resolution Y, Cb, Cr
+	width, height := b.Dx(), b.Dy()
+	if g, ok := img.(*image.Gray); ok {
+		hmax, vmax = 1, 1
+		plane := make([]uint8, width*height)
+		for y := 0; y < height; y++ {
+			copy(plane[y*width:], g.Pix[g.PixOffset(b.Min.X, b.Min.Y+y):][:width])
+		}
+		planes = [][]uint8{plane}
+	} else {
+		planes = [][]uint8{make([]uint8, width*height), make([]uint8, width*height), make([]uint8, width*height)}
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				r, g, bb, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				i := y*width + x
+				planes[0][i], planes[1][i], planes[2][i] = color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bb>>8))
+			}
+		}
+	}
+	mcusX := (width + 8*hmax - 1) / (8 * hmax)
+	mcusY := (height + 8*vmax - 1) / (8 * vmax)
+	comps := make([]*jpegComponent, len(planes))
+	for i, plane := range planes {
+		c := &jpegComponent{id: i + 1, h: 1, v: 1}
+		if i == 0 {
+			c.h, c.v = hmax, vmax
+		} else {
+			c.table = 1
+		}
+		c.bw, c.bh = mcusX*c.h, mcusY*c.v
+		c.cw = ((width*c.h+hmax-1)/hmax + 7) / 8
+		c.ch = ((height*c.v+vmax-1)/vmax + 7) / 8
+		c.blocks = make([][64]int32, c.bw*c.bh)
+		sx, sy := hmax/c.h, vmax/c.v // pixels per sample
+		var px [64]float64
+		for by := 0; by < c.bh; by++ {
+			for bx := 0; bx < c.bw; bx++ {
+				for j := 0; j < 8; j++ {
+					for k := 0; k < 8; k++ {
+						var sum int
+						for dy := 0; dy < sy; dy++ {
+							y := clampInt(((by*8+j)*sy + dy), 0, height-1)
+							for dx := 0; dx < sx; dx++ {
+								sum += int(plane[y*width+clampInt((bx*8+k)*sx+dx, 0, width-1)])
+							}
+						}
+						px[j*8+k] = float64(sum)/float64(sx*sy) - 128
+					}
+				}
+				c.blocks[by*c.bw+bx] = jpegDCT(&px, &quant[c.table])
+			}
+		}
+		comps[i] = c
+	}
+
+	scans := func(e *jpegWriter) {
+		if !progressive {
+			e.writeScan(comps, 0, 63)
+			return
+		}
+		e.writeScan(comps, 0, 0)
+		e.writeScan(comps[:1], 1, 5)
+		for _, c := range comps[1:] {
+			e.writeScan([]*jpegComponent{c}, 1, 63)
+		}
+		e.writeScan(comps[:1], 6, 63)
+	}
+	specs := jpegHuffSpecs
+	if optimize {
+		// dry run to collect symbol frequencies
+		dry := &jpegWriter{w: bufio.NewWriter(ioutil.Discard), freq: new([4][256]int)}
+		scans(dry)
+		for i := range specs {
+			if s, ok := optimalHuffSpec(&dry.freq[i]); ok {
+				specs[i] = s
+			}
+		}
+	}
+	codes := compileHuffSpecs(specs)
+
+	e := &jpegWriter{w: bufio.NewWriter(w), codes: &codes}
+	e.write([]byte{0xff, 0xd8})
+	// quantization tables
+	tables := 1
+	if len(comps) > 1 {
+		tables = 2
+	}
+	e.marker(0xdb, 65*tables)
+	for i := 0; i < tables; i++ {
+		e.writeByte(byte(i))
+		for _, q := range quant[i] {
+			e.writeByte(byte(q))
+		}
+	}
+	// frame header
+	sof := byte(0xc0)
+	if progressive {
+		sof = 0xc2
+	}
+	e.marker(sof, 6+3*len(comps))
+	e.write([]byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), byte(len(comps))})
+	for _, c := range comps {
+		e.write([]byte{byte(c.id), byte(c.h<<4 | c.v), byte(c.table)})
+	}
+	// Huffman tables
+	n := 0
+	for _, s := range specs[:2*tables] {
+		n += 17 + len(s.values)
+	}
+	e.marker(0xc4, n)
+	for i, s := range specs[:2*tables] {
+		e.writeByte(byte(i%2<<4 | i/2))
+		e.write(s.count[:])
+		e.write(s.values)
+	}
+	scans(e)
+	e.write([]byte{0xff, 0xd9})
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// jpegDCT returns quantized DCT coefficients of 8×8 block of level shifted
+// samples, in zig-zag order
+func jpegDCT(px *[64]float64, quant *[64]int32) (out [64]int32) {
+	var tmp [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			var s float64
+			for x := 0; x < 8; x++ {
+				s += jpegCos[u][x] * px[y*8+x]
+			}
+			tmp[y*8+u] = s
+		}
+	}
+	for zig, nat := range jpegUnzig {
+		u, v := nat%8, nat/8
+		var s float64
+		for y := 0; y < 8; y++ {
+			s += jpegCos[v][y] * tmp[y*8+u]
+		}
+		out[zig] = int32(math.Round(s / float64(quant[zig])))
+	}
+	return out
+}
+
+// jpegWriter writes jpeg markers and entropy coded data
+type jpegWriter struct {
+	w     *bufio.Writer
+	err   error
+	bits  uint32
+	nBits uint
+	codes *[4][256]uint32 // Huffman codes, see compileHuffSpecs
+	freq  *[4][256]int    // if set, Huffman symbols are only counted
+}
+
+func (e *jpegWriter) write(p []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(p)
+	}
+}
+
+func (e *jpegWriter) writeByte(b byte) {
+	if e.err == nil {
+		e.err = e.w.WriteByte(b)
+	}
+}
+
+// marker writes marker segment header for payload of n bytes
+func (e *jpegWriter) marker(marker byte, n int) {
+	e.write([]byte{0xff, marker, byte((n + 2) >> 8), byte(n + 2)})
+}
+
+// emit writes n lowest bits of v to entropy coded data
+func (e *jpegWriter) emit(v uint32, n uint) {
+	e.bits = e.bits<<n | v&(1<<n-1)
+	e.nBits += n
+	for e.nBits >= 8 {
+		b := byte(e.bits >> (e.nBits - 8))
+		e.writeByte(b)
+		if b == 0xff {
+			e.writeByte(0)
+		}
+		e.nBits -= 8
+	}
+}
+
+func (e *jpegWriter) emitHuff(table int, sym byte) {
+	if e.freq != nil {
+		e.freq[table][sym]++
+		return
+	}
+	c := e.codes[table][sym]
+	e.emit(c&(1<<24-1), uint(c>>24))
+}
+
+// emitValue writes Huffman coded run/size symbol followed by value bits
+func (e *jpegWriter) emitValue(table int, run int, v int32) {
+	a := v
+	if a < 0 {
+		a, v = -a, v-1
+	}
+	var size uint
+	for a > 0 {
+		size++
+		a >>= 1
+	}
+	e.emitHuff(table, byte(run<<4)|byte(size))
+	if size > 0 {
+		e.emit(uint32(v), size)
+	}
+}
+
+// writeScan writes scan header and data of coefficients ss-se of given
+// components
+func (e *jpegWriter) writeScan(comps []*jpegComponent, ss, se int) {
+	e.marker(0xda, 4+2*len(comps))
+	e.writeByte(byte(len(comps)))
+	for _, c := range comps {
+		e.write([]byte{byte(c.id), byte(c.table<<4 | c.table)})
+	}
+	e.write([]byte{byte(ss), byte(se), 0})
+	prevDC := make([]int32, len(comps))
+	block := func(i int, c *jpegComponent, bx, by int) {
+		blk := &c.blocks[by*c.bw+bx]
+		if ss == 0 {
+			e.emitValue(2*c.table, 0, blk[0]-prevDC[i])
+			prevDC[i] = blk[0]
+		}
+		run := 0
+		k := ss
+		if k == 0 {
+			k = 1
+		}
+		for ; k <= se; k++ {
+			if blk[k] == 0 {
+				run++
+				continue
+			}
+			for ; run > 15; run -= 16 {
+				e.emitHuff(2*c.table+1, 0xf0)
+			}
+			e.emitValue(2*c.table+1, run, blk[k])
+			run = 0
+		}
+		if run > 0 {
+			e.emitHuff(2*c.table+1, 0x00)
+		}
+	}
+	if len(comps) == 1 {
+		// non-interleaved scan covers only blocks inside the component
+		c := comps[0]
+		for by := 0; by < c.ch; by++ {
+			for bx := 0; bx < c.cw; bx++ {
+				block(0, c, bx, by)
+			}
+		}
+	} else {
+		for my := 0; my < comps[0].bh/comps[0].v; my++ {
+			for mx := 0; mx < comps[0].bw/comps[0].h; mx++ {
+				for i, c := range comps {
+					for y := 0; y < c.v; y++ {
+						for x := 0; x < c.h; x++ {
+							block(i, c, mx*c.h+x, my*c.v+y)
+						}
+					}
+				}
+			}
+		}
+	}
+	if e.nBits > 0 { // pad the last byte with 1s
+		e.emit(1<<(8-e.nBits)-1, 8-e.nBits)
+	}
+}
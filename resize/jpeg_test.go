@@ -0,0 +1,85 @@
+package resize
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// testImage returns w×h image with smooth gradients and some detail
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(255 * x / w), uint8(255 * y / h), uint8(128 + 64*((x/4+y/4)%2)), 255})
+		}
+	}
+	return img
+}
+
+func TestEncodeJPEG(t *testing.T) {
+	const quality = 90
+	for _, size := range []image.Point{{1, 1}, {1, 9}, {9, 1}, {7, 3}, {16, 16}, {33, 17}, {200, 150}} {
+		img := testImage(size.X, size.Y)
+		buf := new(bytes.Buffer)
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			t.Fatal(err)
+		}
+		base, err := jpeg.Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, basePSNR := compareImages(img, base)
+		for _, subsample := range []string{"444", "422", "420"} {
+			for _, progressive := range []bool{false, true} {
+				for _, optimize := range []bool{false, true} {
+					name := fmt.Sprintf("%dx%d/%s/progressive=%v/optimize=%v", size.X, size.Y, subsample, progressive, optimize)
+					t.Run(name, func(t *testing.T) {
+						buf := new(bytes.Buffer)
+						if err := encodeJPEG(buf, img, quality, subsample, progressive, optimize); err != nil {
+							t.Fatal(err)
+						}
+						out, err := jpeg.Decode(buf)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if out.Bounds() != img.Bounds() {
+							t.Fatalf("got %v bounds, want %v", out.Bounds(), img.Bounds())
+						}
+						// chroma subsampling differs from the one of
+						// image/jpeg encoder, so some slack is allowed
+						if _, psnr := compareImages(img, out); psnr < basePSNR-1 {
+							t.Errorf("PSNR %.2f dB, image/jpeg encoder gets %.2f dB", psnr, basePSNR)
+						}
+					})
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeJPEGGray(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 7, 3))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 12)
+	}
+	for _, progressive := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		if err := encodeJPEG(buf, img, 90, "", progressive, true); err != nil {
+			t.Fatal(err)
+		}
+		out, err := jpeg.Decode(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := out.(*image.Gray); !ok {
+			t.Errorf("progressive=%v: decoded %T, want *image.Gray", progressive, out)
+		}
+		if _, psnr := compareImages(img, out); psnr < 35 {
+			t.Errorf("progressive=%v: PSNR %.2f dB is too low", progressive, psnr)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+package resize
+
+import (
+	"errors"
+	"image/color"
+	"io"
+	"math"
+)
+
+// This file implements decoder of baseline jpegs producing image row by row,
+// so that the whole decoded image never has to be kept in memory. Only
+// sequential Huffman coded 8-bit jpegs with all components in a single scan
+// are supported, other ones should be decoded with image/jpeg.
+
+// errJPEGUnsupported is returned for jpegs band decoder cannot handle
+var errJPEGUnsupported = errors.New("jpeg: unsupported by band decoder")
+
+var errJPEGFormat = errors.New("jpeg: invalid format")
+
+// jpegHuffTable is a Huffman table prepared for decoding
+type jpegHuffTable struct {
+	lut     [1 << jpegLUTBits]uint16 // 9 bit code prefix to length<<8 | value, 0 if code is longer
+	maxCode [17]int32                // max. code of given length, -1 if none
+	valPtr  [17]int32                // index of the first value of codes of given length
+	values  []byte
+}
+
+const jpegLUTBits = 9
+
+func newJPEGHuffTable(count [16]byte, values []byte) *jpegHuffTable {
+	t := &jpegHuffTable{values: values}
+	code, k := int32(0), int32(0)
+	for n := 1; n <= 16; n++ {
+		t.valPtr[n] = k - code
+		t.maxCode[n] = -1
+		for i := 0; i < int(count[n-1]); i++ {
+			if n <= jpegLUTBits {
+				shift := uint(jpegLUTBits - n)
+				for j := 0; j < 1<<shift; j++ {
+					t.lut[int(code)<<shift|j] = uint16(n)<<8 | uint16(values[k])
+				}
+			}
+			t.maxCode[n] = code
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return t
+}
+
+// jpegDecComponent describes single image component of decoded jpeg
+type jpegDecComponent struct {
+	id     byte
+	h, v   int // sampling factors
+	tq     int // quantization table index
+	dc, ac *jpegHuffTable
+	pred   int32  // DC predictor
+	plane  []byte // samples of the current MCU row
+	stride int
+}
+
+// jpegDecoder decodes baseline jpeg held in data
+type jpegDecoder struct {
+	data          []byte
+	width, height int
+	comps         []*jpegDecComponent
+	hmax, vmax    int
+	restart       int // restart interval in MCUs, 0 if not used
+	quant         [4][64]int32
+
+	off    int    // offset of the next entropy coded byte
+	bits   uint64 // bit buffer, MSB aligned
+	nbits  uint
+	marker bool // whether marker was reached in entropy coded data
+	short  bool // whether data ended before marker, i.e. it's truncated
+}
+
+// newJPEGDecoder parses jpeg headers up to the first scan
+func newJPEGDecoder(data []byte) (*jpegDecoder, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errJPEGFormat
+	}
+	d := &jpegDecoder{data: data}
+	var huff [2][4]*jpegHuffTable
+	var adobeRGB bool
+	for off := 2; ; {
+		for off < len(data) && data[off] == 0xff && off+1 < len(data) && data[off+1] == 0xff {
+			off++ // fill bytes
+		}
+		if off+4 > len(data) || data[off] != 0xff {
+			return nil, errJPEGFormat
+		}
+		marker := data[off+1]
+		n := int(data[off+2])<<8 | int(data[off+3])
+		if n < 2 || off+2+n > len(data) {
+			return nil, errJPEGFormat
+		}
+		p := data[off+4 : off+2+n]
+		off += 2 + n
+		switch marker {
+		case 0xc0, 0xc1: // baseline and extended sequential, Huffman coded
+			if len(p) < 6 || p[0] != 8 {
+				return nil, errJPEGUnsupported
+			}
+			d.height = int(p[1])<<8 | int(p[2])
+			d.width = int(p[3])<<8 | int(p[4])
+			nc := int(p[5])
+			if d.width == 0 || d.height == 0 || (nc != 1 && nc != 3) || len(p) < 6+3*nc {
+				return nil, errJPEGUnsupported
+			}
+			d.hmax, d.vmax = 1, 1
+			for i := 0; i < nc; i++ {
+				c := &jpegDecComponent{id: p[6+3*i], h: int(p[7+3*i] >> 4), v: int(p[7+3*i] & 15), tq: int(p[8+3*i] & 3)}
+				if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 {
+					return nil, errJPEGFormat
+				}
+				if nc == 1 {
+					c.h, c.v = 1, 1 // single component scans are not interleaved
+				}
+				if c.h > d.hmax {
+					d.hmax = c.h
+				}
+				if c.v > d.vmax {
+					d.vmax = c.v
+				}
+				d.comps = append(d.comps, c)
+			}
+			if nc == 3 && d.comps[0].id == 'R' && d.comps[1].id == 'G' && d.comps[2].id == 'B' {
+				return nil, errJPEGUnsupported
+			}
+		case 0xc2, 0xc3, 0xc5, 0xc6, 0xc7, 0xc9, 0xca, 0xcb, 0xcd, 0xce, 0xcf:
+			return nil, errJPEGUnsupported
+		case 0xc4: // DHT
+			for len(p) > 0 {
+				if len(p) < 17 || p[0]>>4 > 1 || p[0]&15 > 3 {
+					return nil, errJPEGFormat
+				}
+				var count [16]byte
+				copy(count[:], p[1:17])
+				total := 0
+				for _, c := range count {
+					total += int(c)
+				}
+				if total > 256 || len(p) < 17+total {
+					return nil, errJPEGFormat
+				}
+				huff[p[0]>>4][p[0]&15] = newJPEGHuffTable(count, p[17:17+total])
+				p = p[17+total:]
+			}
+		case 0xdb: // DQT
+			for len(p) > 0 {
+				pq, tq := p[0]>>4, p[0]&15
+				if tq > 3 || pq > 1 || len(p) < 1+64*(1+int(pq)) {
+					return nil, errJPEGFormat
+				}
+				for i := 0; i < 64; i++ {
+					if pq == 0 {
+						d.quant[tq][i] = int32(p[1+i])
+					} else {
+						d.quant[tq][i] = int32(p[1+2*i])<<8 | int32(p[2+2*i])
+					}
+				}
+				p = p[1+64*(1+int(pq)):]
+			}
+		case 0xdd: // DRI
+			if len(p) < 2 {
+				return nil, errJPEGFormat
+			}
+			d.restart = int(p[0])<<8 | int(p[1])
+		case 0xee: // APP14, Adobe transform flag
+			if len(p) >= 12 && string(p[:5]) == "Adobe" && p[11] == 0 {
+				adobeRGB = true
+			}
+		case 0xda: // SOS
+			if d.comps == nil {
+				return nil, errJPEGFormat
+			}
+			if adobeRGB && len(d.comps) == 3 {
+				return nil, errJPEGUnsupported
+			}
+			if len(p) < 1 || int(p[0]) != len(d.comps) || len(p) < 4+2*len(d.comps) {
+				return nil, errJPEGUnsupported
+			}
+			for i, c := range d.comps {
+				if p[1+2*i] != c.id {
+					return nil, errJPEGUnsupported
+				}
+				td, ta := p[2+2*i]>>4, p[2+2*i]&15
+				if td > 3 || ta > 3 || huff[0][td] == nil || huff[1][ta] == nil {
+					return nil, errJPEGFormat
+				}
+				c.dc, c.ac = huff[0][td], huff[1][ta]
+			}
+			if s := p[1+2*len(d.comps):]; s[0] != 0 || s[1] != 63 || s[2] != 0 {
+				return nil, errJPEGUnsupported
+			}
+			d.off = off
+			return d, nil
+		}
+	}
+}
+
+// scaledSize returns image dimensions when decoded at 1/scale size
+func (d *jpegDecoder) scaledSize(scale int) (width, height int) {
+	return (d.width + scale - 1) / scale, (d.height + scale - 1) / scale
+}
+
+// decodeRows decodes image at 1/scale size, scale being 1, 2, 4 or 8,
+// calling fn for every row of pixels in top to bottom order. Row holds 1
+// (gray) or 3 (RGB) bytes per pixel, depending on the number of components;
+// it is only valid until fn returns. Scaling is done by inverse DCT of only
+// low frequency coefficients, which is much faster than decoding image at
+// full size.
+func (d *jpegDecoder) decodeRows(scale int, fn func(y int, row []byte) error) error {
+	bs := 8 / scale // block size
+	if bs*scale != 8 || bs < 1 {
+		return errors.New("jpeg: invalid scale")
+	}
+	mcuW, mcuH := 8*d.hmax, 8*d.vmax
+	mxx, myy := (d.width+mcuW-1)/mcuW, (d.height+mcuH-1)/mcuH
+	for _, c := range d.comps {
+		c.stride = mxx * c.h * bs
+		c.plane = make([]byte, c.stride*c.v*bs)
+	}
+	width, height := d.scaledSize(scale)
+	row := make([]byte, width*len(d.comps))
+	var coef [64]int32
+	var mcus int
+	for my := 0; my < myy; my++ {
+		for mx := 0; mx < mxx; mx++ {
+			if d.restart > 0 && mcus > 0 && mcus%d.restart == 0 {
+				if err := d.nextRestart(); err != nil {
+					return err
+				}
+			}
+			mcus++
+			for _, c := range d.comps {
+				q := &d.quant[c.tq]
+				for by := 0; by < c.v; by++ {
+					for bx := 0; bx < c.h; bx++ {
+						last, err := d.decodeBlock(c, q, &coef)
+						if err != nil {
+							return err
+						}
+						off := by*bs*c.stride + (mx*c.h+bx)*bs
+						jpegIDCT(&coef, last, bs, c.plane[off:], c.stride)
+					}
+				}
+			}
+		}
+		if d.short {
+			return io.ErrUnexpectedEOF
+		}
+		for y := 0; y < mcuH/scale && my*mcuH/scale+y < height; y++ {
+			d.convertRow(row, y)
+			if err := fn(my*mcuH/scale+y, row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// convertRow fills dst with pixels of row y of the current MCU row
+func (d *jpegDecoder) convertRow(dst []byte, y int) {
+	width := len(dst) / len(d.comps)
+	if len(d.comps) == 1 {
+		c := d.comps[0]
+		copy(dst, c.plane[y*c.stride:])
+		return
+	}
+	cy, cb, cr := d.comps[0], d.comps[1], d.comps[2]
+	ly := cy.plane[y*cy.v/d.vmax*cy.stride:]
+	lb := cb.plane[y*cb.v/d.vmax*cb.stride:]
+	lr := cr.plane[y*cr.v/d.vmax*cr.stride:]
+	for x := 0; x < width; x++ {
+		r, g, b := color.YCbCrToRGB(ly[x*cy.h/d.hmax], lb[x*cb.h/d.hmax], lr[x*cr.h/d.hmax])
+		dst[3*x], dst[3*x+1], dst[3*x+2] = r, g, b
+	}
+}
+
+// decodeBlock decodes single block of component c into coef, dequantized
+// and in natural order. It returns index of the last row holding non-zero
+// coefficients.
+func (d *jpegDecoder) decodeBlock(c *jpegDecComponent, q *[64]int32, coef *[64]int32) (last int, err error) {
+	*coef = [64]int32{}
+	s, err := d.decodeHuff(c.dc)
+	if err != nil {
+		return 0, err
+	}
+	if s > 16 {
+		return 0, errJPEGFormat
+	}
+	c.pred += d.receive(s)
+	coef[0] = c.pred * q[0]
+	for k := 1; k < 64; k++ {
+		rs, err := d.decodeHuff(c.ac)
+		if err != nil {
+			return 0, err
+		}
+		r, s := int(rs>>4), rs&15
+		if s == 0 {
+			if r != 15 {
+				break // end of block
+			}
+			k += 15
+			continue
+		}
+		if k += r; k > 63 {
+			return 0, errJPEGFormat
+		}
+		i := jpegUnzig[k]
+		coef[i] = d.receive(s) * q[k]
+		if i>>3 > last {
+			last = i >> 3
+		}
+	}
+	return last, nil
+}
+
+// fill makes bit buffer hold at least 57 bits, padding data with zeros
+// once marker or the end of data is reached
+func (d *jpegDecoder) fill() {
+	for d.nbits <= 56 {
+		var b byte
+		if !d.marker && d.off >= len(d.data) {
+			d.short = true
+		}
+		if !d.marker && d.off < len(d.data) {
+			b = d.data[d.off]
+			switch {
+			case b != 0xff:
+				d.off++
+			case d.off+1 < len(d.data) && d.data[d.off+1] == 0:
+				d.off += 2
+			default:
+				d.marker, b = true, 0
+			}
+		}
+		d.bits |= uint64(b) << (56 - d.nbits)
+		d.nbits += 8
+	}
+}
+
+func (d *jpegDecoder) decodeHuff(t *jpegHuffTable) (byte, error) {
+	if d.nbits < 16 {
+		d.fill()
+	}
+	if v := t.lut[d.bits>>(64-jpegLUTBits)]; v != 0 {
+		n := uint(v >> 8)
+		d.bits <<= n
+		d.nbits -= n
+		return byte(v), nil
+	}
+	for n := uint(jpegLUTBits + 1); n <= 16; n++ {
+		code := int32(d.bits >> (64 - n))
+		if code <= t.maxCode[n] {
+			d.bits <<= n
+			d.nbits -= n
+			if i := int(t.valPtr[n] + code); i < len(t.values) {
+				return t.values[i], nil
+			}
+			break
+		}
+	}
+	return 0, errJPEGFormat
+}
+
+// receive reads s bits and returns them as signed value
+func (d *jpegDecoder) receive(s byte) int32 {
+	if s == 0 {
+		return 0
+	}
+	if d.nbits < uint(s) {
+		d.fill()
+	}
+	v := int32(d.bits >> (64 - uint(s)))
+	d.bits <<= s
+	d.nbits -= uint(s)
+	if v < 1<<(s-1) {
+		v += -1<<s + 1
+	}
+	return v
+}
+
+// nextRestart skips RSTn marker and resets decoder state
+func (d *jpegDecoder) nextRestart() error {
+	d.bits, d.nbits, d.marker = 0, 0, false
+	for d.off+1 < len(d.data) && d.data[d.off] == 0xff && d.data[d.off+1] == 0xff {
+		d.off++
+	}
+	if d.off+1 >= len(d.data) || d.data[d.off] != 0xff || d.data[d.off+1] < 0xd0 || d.data[d.off+1] > 0xd7 {
+		return errJPEGFormat
+	}
+	d.off += 2
+	for _, c := range d.comps {
+		c.pred = 0
+	}
+	return nil
+}
+
+// jpegIDCT writes inverse DCT of coef to n×n block of dst with given
+// stride, n being 1, 2, 4 or 8. If n is less than 8, only n×n low frequency
+// coefficients are used, giving block downscaled by 8/n. Last is the index
+// of the last coefficient row with non-zero values.
+func jpegIDCT(coef *[64]int32, last, n int, dst []byte, stride int) {
+	if last >= n {
+		last = n - 1
+	}
+	if n == 1 || last == 0 && coef[1]|coef[2]|coef[3]|coef[4]|coef[5]|coef[6]|coef[7] == 0 {
+		v := clampByte(float64(coef[0])/8 + 128)
+		for y := 0; y < n; y++ {
+			row := dst[y*stride : y*stride+n]
+			for x := range row {
+				row[x] = v
+			}
+		}
+		return
+	}
+	cos := jpegScaledCos[n]
+	var tmp [64]float64
+	for v := 0; v <= last; v++ {
+		c := coef[v*8 : v*8+n]
+		for x := 0; x < n; x++ {
+			var sum float64
+			for u, f := range c {
+				if f != 0 {
+					sum += cos[u][x] * float64(f)
+				}
+			}
+			tmp[v*8+x] = sum
+		}
+	}
+	for y := 0; y < n; y++ {
+		row := dst[y*stride : y*stride+n]
+		for x := range row {
+			sum := 128.0
+			for v := 0; v <= last; v++ {
+				sum += cos[v][y] * tmp[v*8+x]
+			}
+			row[x] = clampByte(sum)
+		}
+	}
+}
+
+// jpegScaledCos holds DCT basis function values sampled at the centers of
+// n×n grid cells covering the block: jpegScaledCos[n][u][x] = C(u)/2 *
+// cos((2x+1)uπ/2n)
+var jpegScaledCos = func() (t [9][8][8]float64) {
+	for _, n := range []int{2, 4, 8} {
+		for u := 0; u < n; u++ {
+			c := .5
+			if u == 0 {
+				c = .5 / math.Sqrt2
+			}
+			for x := 0; x < n; x++ {
+				t[n][u][x] = c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/float64(2*n))
+			}
+		}
+	}
+	return t
+}()
+
+func clampByte(v float64) byte {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	}
+	return byte(v + .5)
+}
@@ -0,0 +1,261 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+
+	"github.com/bamiaux/rez"
+)
+
+// jpegStream is a placeholder for jpeg image that is decoded only when
+// scaled, row by row, to keep memory use low. It only reports bounds and
+// should not be read pixel by pixel.
+type jpegStream struct {
+	data  []byte
+	rect  image.Rectangle // region of image to use
+	model color.Model
+}
+
+// newJPEGStream returns jpegStream for data if it can be decoded with band
+// decoder
+func newJPEGStream(data []byte) (*jpegStream, error) {
+	d, err := newJPEGDecoder(data)
+	if err != nil {
+		return nil, err
+	}
+	model := color.YCbCrModel
+	if len(d.comps) == 1 {
+		model = color.GrayModel
+	}
+	return &jpegStream{data: data, rect: image.Rect(0, 0, d.width, d.height), model: model}, nil
+}
+
+func (js *jpegStream) ColorModel() color.Model { return js.model }
+func (js *jpegStream) Bounds() image.Rectangle { return js.rect }
+func (js *jpegStream) At(x, y int) color.Color { return color.Black }
+func (js *jpegStream) Opaque() bool            { return true }
+
+func (js *jpegStream) SubImage(r image.Rectangle) image.Image {
+	out := *js
+	out.rect = r.Intersect(js.rect)
+	return &out
+}
+
+// decode fully decodes image, for cases where all of its pixels are needed
+func (js *jpegStream) decode() (image.Image, error) {
+	img, err := jpeg.Decode(bytes.NewReader(js.data))
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	return img.(SubImager).SubImage(js.rect), nil
+}
+
+// scale decodes image and scales it to width×height with named filter,
+// keeping in memory only source rows needed for the next output row. Image
+// is decoded at reduced size if it's still at least as large as the output.
+func (js *jpegStream) scale(ctx context.Context, width, height int, filter string) (image.Image, error) {
+	d, err := newJPEGDecoder(js.data)
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	n := len(d.comps)
+	f := filters[filter]
+	shrink := 1
+	if f != nil {
+		shrink = jpegShrink(js.rect.Dx(), js.rect.Dy(), width, height)
+	}
+	sw, sh := d.scaledSize(shrink)
+	rect := image.Rect(js.rect.Min.X/shrink, js.rect.Min.Y/shrink,
+		(js.rect.Max.X+shrink-1)/shrink, (js.rect.Max.Y+shrink-1)/shrink).Intersect(image.Rect(0, 0, sw, sh))
+	xs := filterSpans(rect.Dx(), width, f)
+	ys := filterSpans(rect.Dy(), height, f)
+	// window is the number of source rows to keep: output row is produced
+	// once the last row it or any previous output row needs is decoded
+	var window, end int
+	for _, s := range ys {
+		if e := s.start + len(s.w); e > end {
+			end = e
+		}
+		if end-s.start > window {
+			window = end - s.start
+		}
+	}
+	ring := make([][]float32, window)
+	for i := range ring {
+		ring[i] = make([]float32, width*n)
+	}
+	var out image.Image
+	var pix []byte
+	var outStride int
+	if n == 1 {
+		img := image.NewGray(image.Rect(0, 0, width, height))
+		out, pix, outStride = img, img.Pix, img.Stride
+	} else {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		out, pix, outStride = img, img.Pix, img.Stride
+	}
+	var next int // next output row
+	err = d.decodeRows(shrink, func(y int, row []byte) error {
+		y -= rect.Min.Y
+		if y < 0 || y >= rect.Dy() || next >= height {
+			return nil
+		}
+		if y%64 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		row = row[rect.Min.X*n:]
+		hrow := ring[y%window]
+		for x, s := range xs {
+			for c := 0; c < n; c++ {
+				var sum float32
+				for j, w := range s.w {
+					sum += w * float32(row[(s.start+j)*n+c])
+				}
+				hrow[x*n+c] = sum
+			}
+		}
+		for ; next < height && ys[next].start+len(ys[next].w)-1 <= y; next++ {
+			s := ys[next]
+			dst := pix[next*outStride:]
+			for x := 0; x < width; x++ {
+				for c := 0; c < n; c++ {
+					var sum float32
+					for j, w := range s.w {
+						sum += w * ring[(s.start+j)%window][x*n+c]
+					}
+					v := clampByte(float64(sum))
+					if n == 1 {
+						dst[x] = v
+						continue
+					}
+					dst[4*x+c] = v
+				}
+				if n == 3 {
+					dst[4*x+3] = 0xff
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	return out, nil
+}
+
+// jpegShrink returns the largest factor jpeg decoder supports (1, 2, 4 or
+// 8) that w×h image can be shrunk by while still being at least as large as
+// width×height
+func jpegShrink(w, h, width, height int) int {
+	for s := 8; s > 1; s /= 2 {
+		if w/s >= width && h/s >= height {
+			return s
+		}
+	}
+	return 1
+}
+
+// decodeJPEGShrunk decodes jpeg at 1/shrink size into image allocated with
+// bufs
+func decodeJPEGShrunk(data []byte, shrink int, bufs *buffers) (image.Image, error) {
+	d, err := newJPEGDecoder(data)
+	if err != nil {
+		return nil, err
+	}
+	w, h := d.scaledSize(shrink)
+	if len(d.comps) == 1 {
+		img := bufs.gray(image.Rect(0, 0, w, h))
+		err = d.decodeRows(shrink, func(y int, row []byte) error {
+			copy(img.Pix[y*img.Stride:], row)
+			return nil
+		})
+		return img, err
+	}
+	img := bufs.rgba(image.Rect(0, 0, w, h))
+	err = d.decodeRows(shrink, func(y int, row []byte) error {
+		dst := img.Pix[y*img.Stride:]
+		for x := 0; x < w; x++ {
+			dst[4*x], dst[4*x+1], dst[4*x+2], dst[4*x+3] = row[3*x], row[3*x+1], row[3*x+2], 0xff
+		}
+		return nil
+	})
+	return img, err
+}
+
+// filterSpan holds weights of source samples contributing to a single
+// destination sample, starting at index start
+type filterSpan struct {
+	start int
+	w     []float32
+}
+
+// filterSpans returns filter weights for scaling srcLen samples to dstLen
+// ones. Nil filter means nearest neighbor.
+func filterSpans(srcLen, dstLen int, f rez.Filter) []filterSpan {
+	scale := float64(srcLen) / float64(dstLen)
+	fscale := math.Max(scale, 1)
+	out := make([]filterSpan, dstLen)
+	for i := range out {
+		center := (float64(i) + .5) * scale
+		if f == nil {
+			out[i] = filterSpan{clampInt(int(center), 0, srcLen-1), []float32{1}}
+			continue
+		}
+		support := float64(f.Taps()) * fscale
+		lo := clampInt(int(math.Floor(center-support)), 0, srcLen-1)
+		hi := clampInt(int(math.Ceil(center+support)), lo+1, srcLen)
+		w := make([]float64, hi-lo)
+		var sum float64
+		for j := range w {
+			w[j] = f.Get(math.Abs(float64(lo+j)+.5-center) / fscale)
+			sum += w[j]
+		}
+		if sum == 0 {
+			out[i] = filterSpan{clampInt(int(center), 0, srcLen-1), []float32{1}}
+			continue
+		}
+		// drop zero weights at span ends
+		for len(w) > 1 && w[0] == 0 {
+			w, lo = w[1:], lo+1
+		}
+		for len(w) > 1 && w[len(w)-1] == 0 {
+			w = w[:len(w)-1]
+		}
+		span := filterSpan{start: lo, w: make([]float32, len(w))}
+		for j, v := range w {
+			span.w[j] = float32(v / sum)
+		}
+		out[i] = span
+	}
+	return out
+}
+
+// decodeEXIFThumb decodes thumbnail embedded in EXIF data of jpeg image
+// with cfg configuration, if its shorter side is at least maxSide and it
+// has the same aspect ratio as the image; otherwise it returns nil
+func decodeEXIFThumb(data []byte, cfg image.Config, maxSide int) image.Image {
+	thumb := exifThumbnail(exifBlock("jpeg", data))
+	if thumb == nil {
+		return nil
+	}
+	tc, err := jpeg.DecodeConfig(bytes.NewReader(thumb))
+	if err != nil || tc.Width < maxSide || tc.Height < maxSide {
+		return nil
+	}
+	// thumbnails are often padded to fixed aspect ratio, such ones are
+	// not usable
+	if d := tc.Width*cfg.Height - tc.Height*cfg.Width; d > cfg.Width*tc.Height/100 || -d > cfg.Width*tc.Height/100 {
+		return nil
+	}
+	img, err := jpeg.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		return nil
+	}
+	return img
+}
@@ -0,0 +1,35 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package resize
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// mapFile maps the rest of regular file f, from its current offset, into
+// memory read-only and advances the offset to the end of file. It returns
+// nil data if f cannot be mapped, like if it's a pipe, empty or larger than
+// MaxFileSize, leaving offset as is. Function unmap releases the mapping,
+// data must not be used after it's called.
+func mapFile(f *os.File) (data []byte, unmap func()) {
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() == 0 || fi.Size() > MaxFileSize {
+		return nil, nil
+	}
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil || off >= fi.Size() {
+		return nil, nil
+	}
+	m, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		syscall.Munmap(m)
+		return nil, nil
+	}
+	return m[off:], func() { syscall.Munmap(m) }
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package resize
+
+import "os"
+
+// mapFile is a stub for platforms where files are not memory-mapped, it
+// always returns nil data
+func mapFile(f *os.File) (data []byte, unmap func()) { return nil, nil }
@@ -0,0 +1,246 @@
+package resize
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// Op is a single operation of Options.Ops pipeline
+type Op struct {
+	Name string // crop, resize, sharpen, rotate, flip or grayscale
+	Arg  string // operation argument, see ParseOps
+}
+
+func (op Op) String() string {
+	if op.Arg == "" {
+		return op.Name
+	}
+	return op.Name + "=" + op.Arg
+}
+
+// ParseOps parses comma separated list of operations applied in order, like
+// "crop=square,resize=maxw:800,sharpen=0.6,rotate=90". Operations are:
+//
+//	crop=square            crop to square by smaller side
+//	crop=WxH               crop to W×H, positioned according to gravity
+//	resize=KEY:VALUE[:...] scale with w, h, maxw, maxh, maxlong, maxshort,
+//	                       scale (factor) and fit keys, meaning the same
+//	                       as Options fields
+//	sharpen=A[:R[:T]]      unsharp mask of amount, radius and threshold
+//	rotate=90|180|270      rotate clockwise
+//	flip=h|v               mirror horizontally or vertically
+//	grayscale              convert to grayscale
+func ParseOps(s string) ([]Op, error) {
+	var ops []Op
+	for _, f := range strings.Split(s, ",") {
+		op := Op{Name: strings.TrimSpace(f)}
+		if i := strings.IndexByte(op.Name, '='); i >= 0 {
+			op.Name, op.Arg = op.Name[:i], op.Name[i+1:]
+		}
+		if _, err := op.compile(Options{}); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// compile returns function applying op to image, using filter, threads and
+// gravity settings of opts
+func (op Op) compile(opts Options) (func(image.Image) (image.Image, error), error) {
+	invalid := errorf(KindInvalidOptions, "invalid operation %q", op)
+	switch op.Name {
+	case "crop":
+		if op.Arg == "square" {
+			return func(img image.Image) (image.Image, error) {
+				img = croppable(img)
+				return img.(SubImager).SubImage(squareCrop(img, opts.Gravity, 0)), nil
+			}, nil
+		}
+		var w, h int
+		if n, err := fmt.Sscanf(op.Arg, "%dx%d", &w, &h); err != nil || n != 2 || w <= 0 || h <= 0 {
+			return nil, invalid
+		}
+		return func(img image.Image) (image.Image, error) {
+			img = croppable(img)
+			b := img.Bounds()
+			return img.(SubImager).SubImage(cropRect(img, minInt(w, b.Dx()), minInt(h, b.Dy()), opts.Gravity, 0)), nil
+		}, nil
+	case "resize":
+		var tr transform
+		kv := strings.Split(op.Arg, ":")
+		if len(kv)%2 != 0 {
+			return nil, invalid
+		}
+		for i := 0; i < len(kv); i += 2 {
+			var err error
+			switch kv[i] {
+			case "w":
+				tr.Width, err = strconv.Atoi(kv[i+1])
+			case "h":
+				tr.Height, err = strconv.Atoi(kv[i+1])
+			case "maxw":
+				tr.MaxWidth, err = strconv.Atoi(kv[i+1])
+			case "maxh":
+				tr.MaxHeight, err = strconv.Atoi(kv[i+1])
+			case "maxlong":
+				tr.MaxLong, err = strconv.Atoi(kv[i+1])
+			case "maxshort":
+				tr.MaxShort, err = strconv.Atoi(kv[i+1])
+			case "scale":
+				tr.Scale, err = strconv.ParseFloat(kv[i+1], 64)
+			case "fit":
+				tr.Fit = kv[i+1]
+			default:
+				return nil, invalid
+			}
+			if err != nil {
+				return nil, invalid
+			}
+		}
+		o := Options{Width: tr.Width, Height: tr.Height, MaxWidth: tr.MaxWidth, MaxHeight: tr.MaxHeight,
+			MaxLong: tr.MaxLong, MaxShort: tr.MaxShort, Scale: tr.Scale, Fit: tr.Fit, Filter: opts.Filter}
+		if err := o.normalize(); err != nil {
+			return nil, err
+		}
+		if tr.Width < 0 || tr.Height < 0 || tr.MaxWidth < 0 || tr.MaxHeight < 0 {
+			return nil, invalid
+		}
+		tr, err := o.transform()
+		if err != nil {
+			return nil, err
+		}
+		return func(img image.Image) (image.Image, error) {
+			if tr.Fit == "cover" {
+				img = croppable(img)
+				b := img.Bounds()
+				cw, ch := tr.coverSize(b.Dx(), b.Dy())
+				img = img.(SubImager).SubImage(cropRect(img, cw, ch, opts.Gravity, 0))
+			}
+			b := img.Bounds()
+			width, height, err := tr.newDimensions(b.Dx(), b.Dy())
+			if err != nil {
+				return nil, err
+			}
+			if width != b.Dx() || height != b.Dy() {
+				if img, err = scaleThreads(img, width, height, opts.Filter, opts.Threads); err != nil {
+					return nil, err
+				}
+			}
+			if tr.Fit == "contain" {
+				img = padImage(img, tr.Width, tr.Height, opts.Background)
+			}
+			return img, nil
+		}, nil
+	case "sharpen":
+		var vals [3]float64
+		fields := strings.Split(op.Arg, ":")
+		if len(fields) > len(vals) {
+			return nil, invalid
+		}
+		for i, f := range fields {
+			var err error
+			if vals[i], err = strconv.ParseFloat(f, 64); err != nil {
+				return nil, invalid
+			}
+		}
+		s := &Sharpen{Amount: vals[0], Radius: vals[1], Threshold: vals[2]}
+		if err := (&Options{Sharpen: s}).normalize(); err != nil {
+			return nil, err
+		}
+		return func(img image.Image) (image.Image, error) { return s.apply(img), nil }, nil
+	case "rotate", "flip":
+		var o Options
+		if op.Name == "rotate" {
+			var err error
+			if o.Rotate, err = strconv.Atoi(op.Arg); err != nil || o.Rotate == 0 {
+				return nil, invalid
+			}
+		} else if o.Flip = op.Arg; o.Flip == "" {
+			return nil, invalid
+		}
+		if err := o.normalize(); err != nil {
+			return nil, err
+		}
+		orientfunc, _ := o.orient()
+		return func(img image.Image) (image.Image, error) { return orientfunc(img), nil }, nil
+	case "grayscale":
+		if op.Arg != "" {
+			return nil, invalid
+		}
+		adjustfunc := Options{Grayscale: true}.adjust()
+		return func(img image.Image) (image.Image, error) { return adjustfunc(img), nil }, nil
+	}
+	return nil, errorf(KindInvalidOptions, "unsupported operation %q", op.Name)
+}
+
+// processOps is like process, but transforms source image with opts.Ops
+// pipeline. Image is rotated according to its EXIF orientation first, so
+// that operations refer to the image as displayed.
+func (src *source) processOps(ctx context.Context, opts Options) (image.Image, Options, error) {
+	funcs := make([]func(image.Image) (image.Image, error), len(opts.Ops))
+	for i, op := range opts.Ops {
+		var err error
+		if funcs[i], err = op.compile(opts); err != nil {
+			return nil, opts, err
+		}
+	}
+	toSRGB := src.metadata(&opts)
+	img := src.img
+	if js, ok := img.(*jpegStream); ok {
+		var err error
+		if img, err = js.decode(); err != nil {
+			return nil, opts, err
+		}
+	}
+	if rotatefunc, _ := useExifOrientation(src.orientation); rotatefunc != nil {
+		img = rotatefunc(img)
+		if len(opts.exif) > 0 {
+			opts.exif = resetOrientation(opts.exif)
+		}
+	}
+	for i, fn := range funcs {
+		if err := ctx.Err(); err != nil {
+			return nil, opts, err
+		}
+		var err error
+		if img, err = fn(img); err != nil {
+			return nil, opts, fmt.Errorf("%v: %w", opts.Ops[i], err)
+		}
+	}
+	if toSRGB != nil {
+		img = toSRGB.apply(img)
+	}
+	if adjustfunc := opts.adjust(); adjustfunc != nil {
+		img = adjustfunc(img)
+	}
+	if !opts.NoFill && !keepsAlpha(opts.Format) {
+		img = fillBackground(img, opts.Background, opts.bufs)
+	}
+	return opts.Composite(img), opts, nil
+}
+
+// croppable returns img if it supports SubImage method, otherwise its copy
+func croppable(img image.Image) image.Image {
+	if _, ok := img.(SubImager); ok {
+		return img
+	}
+	return ToNRGBA(img)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,134 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"io/ioutil"
+)
+
+// FrameCount returns number of pages of tiff image or frames of animated gif
+// or png read from r, or 1 for other images
+func FrameCount(r io.Reader) (int, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxFileSize))
+	if err != nil {
+		return 0, err
+	}
+	_, kind, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, decodeError(err)
+	}
+	switch kind {
+	case "tiff":
+		return len(tiffPages(data)), nil
+	case "gif":
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return 0, decodeError(err)
+		}
+		return len(g.Image), nil
+	case "png":
+		a, err := decodeAPNG(data)
+		if err != nil {
+			return 0, err
+		}
+		if a != nil {
+			return len(a.frames), nil
+		}
+	}
+	return 1, nil
+}
+
+// selectPage reads the whole r and, if it's a tiff image, returns reader of
+// the same image with its page n made the first one. Other images are
+// returned as is.
+func selectPage(r io.Reader, n int) (io.Reader, error) {
+	var data []byte
+	if m, ok := r.(memInput); ok {
+		data = m.data
+	} else {
+		var err error
+		if data, err = ioutil.ReadAll(io.LimitReader(r, MaxFileSize)); err != nil {
+			return nil, err
+		}
+	}
+	pages := tiffPages(data)
+	if len(pages) == 0 {
+		return newMemInput(data), nil
+	}
+	if n >= len(pages) {
+		return nil, errorf(KindInvalidOptions, "image has no page %d, it only has %d", n+1, len(pages))
+	}
+	// IFD offsets are absolute, so it's enough to point header to the
+	// selected IFD
+	data = append([]byte(nil), data...)
+	tiffByteOrder(data).PutUint32(data[4:], uint32(pages[n]))
+	return newMemInput(data), nil
+}
+
+// tiffByteOrder returns byte order of TIFF structure, or nil if data is not
+// TIFF
+func tiffByteOrder(data []byte) binary.ByteOrder {
+	switch {
+	case len(data) < 8:
+		return nil
+	case string(data[:4]) == "II*\x00":
+		return binary.LittleEndian
+	case string(data[:4]) == "MM\x00*":
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// tiffPages returns offsets of all IFDs (pages) of TIFF structure
+func tiffPages(data []byte) []int {
+	bo := tiffByteOrder(data)
+	if bo == nil {
+		return nil
+	}
+	var pages []int
+	seen := make(map[int]bool)
+	for off := int(bo.Uint32(data[4:])); off >= 8 && off+2 <= len(data) && !seen[off]; {
+		seen[off] = true
+		next := off + 2 + int(bo.Uint16(data[off:]))*12
+		if next+4 > len(data) {
+			break
+		}
+		pages = append(pages, off)
+		off = int(bo.Uint32(data[next:]))
+	}
+	return pages
+}
+
+// animationFrame returns frame n of animation composed over previous frames
+// according to their disposal methods
+func animationFrame(a *animation, n int) (image.Image, error) {
+	if n >= len(a.frames) {
+		return nil, errorf(KindInvalidOptions, "image has no frame %d, it only has %d", n+1, len(a.frames))
+	}
+	if a.bounds.Empty() {
+		return nil, errorf(KindCorrupt, "invalid animation dimensions")
+	}
+	canvas := image.NewRGBA(a.bounds)
+	for i, frame := range a.frames[:n+1] {
+		disposal := a.disposal[i]
+		var prev *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			prev = cloneRGBA(canvas)
+		}
+		a.drawFrame(canvas, i)
+		if i == n {
+			break
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = prev
+		}
+	}
+	return canvas, nil
+}
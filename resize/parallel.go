@@ -0,0 +1,120 @@
+package resize
+
+import (
+	"image"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bamiaux/rez"
+	"golang.org/x/image/draw"
+)
+
+// parallelChunk is the number of destination rows scaled by a worker at once
+const parallelChunk = 32
+
+// convert is like rez.Convert, but limits the number of goroutines used to
+// threads, if positive, and reuses converters kept by bufs
+func convert(output, input image.Image, filter rez.Filter, threads int, bufs *buffers) error {
+	cfg, err := rez.PrepareConversion(output, input)
+	if err != nil {
+		return err
+	}
+	cfg.Threads = threads
+	c, err := bufs.converter(*cfg, filter)
+	if err != nil {
+		return err
+	}
+	return c.Convert(output, input)
+}
+
+// resampleParallel scales img to width×height using filter f, splitting
+// destination into chunks of rows scaled concurrently by up to threads
+// goroutines (GOMAXPROCS if threads is not positive). Image is scaled in
+// premultiplied RGBA space.
+func resampleParallel(img image.Image, width, height int, f rez.Filter, threads int) *image.RGBA {
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(img.Bounds())
+		draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+	sb := src.Bounds()
+	xs := filterSpans(sb.Dx(), width, f)
+	ys := filterSpans(sb.Dy(), height, f)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if threads <= 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+	chunks := (height + parallelChunk - 1) / parallelChunk
+	if threads > chunks {
+		threads = chunks
+	}
+	var next int32 // next chunk to process
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var tmp []float32 // horizontally scaled source rows of chunk
+			for {
+				c := int(atomic.AddInt32(&next, 1)) - 1
+				if c >= chunks {
+					return
+				}
+				y0, y1 := c*parallelChunk, (c+1)*parallelChunk
+				if y1 > height {
+					y1 = height
+				}
+				r0, r1 := ys[y0].start, 0 // source rows chunk needs
+				for _, s := range ys[y0:y1] {
+					if s.start < r0 {
+						r0 = s.start
+					}
+					if e := s.start + len(s.w); e > r1 {
+						r1 = e
+					}
+				}
+				if n := (r1 - r0) * width * 4; cap(tmp) < n {
+					tmp = make([]float32, n)
+				}
+				for r := r0; r < r1; r++ {
+					row := src.Pix[r*src.Stride:]
+					out := tmp[(r-r0)*width*4:]
+					for x, s := range xs {
+						var sr, sg, sb, sa float32
+						for j, w := range s.w {
+							p := row[(s.start+j)*4:]
+							sr += w * float32(p[0])
+							sg += w * float32(p[1])
+							sb += w * float32(p[2])
+							sa += w * float32(p[3])
+						}
+						out[4*x], out[4*x+1], out[4*x+2], out[4*x+3] = sr, sg, sb, sa
+					}
+				}
+				for y := y0; y < y1; y++ {
+					s := ys[y]
+					out := dst.Pix[y*dst.Stride:]
+					for i := 0; i < width*4; i++ {
+						var sum float32
+						for j, w := range s.w {
+							sum += w * tmp[(s.start+j-r0)*width*4+i]
+						}
+						out[i] = clampByte(float64(sum))
+					}
+					// keep color values premultiplied after overshoots
+					for x := 0; x < width; x++ {
+						p := out[4*x : 4*x+4]
+						for i := 0; i < 3; i++ {
+							if p[i] > p[3] {
+								p[i] = p[3]
+							}
+						}
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return dst
+}
@@ -0,0 +1,248 @@
+package resize
+
+import (
+	"encoding/base64"
+	"image"
+	"math"
+
+	"github.com/disintegration/gift"
+)
+
+// Placeholder returns compact placeholder of img of given kind: BlurHash
+// string for "blurhash", base64 encoded ThumbHash for "thumbhash". It
+// returns empty string for other kinds.
+func Placeholder(img image.Image, kind string) string {
+	switch kind {
+	case "blurhash":
+		return BlurHash(img)
+	case "thumbhash":
+		return base64.StdEncoding.EncodeToString(ThumbHash(img))
+	}
+	return ""
+}
+
+// placeholderSize is the max. side of downscaled image copy placeholders are
+// computed from
+const placeholderSize = 100
+
+// placeholderSource returns img scaled down to fit placeholderSize square
+func placeholderSource(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > placeholderSize || h > placeholderSize {
+		if w >= h {
+			w, h = placeholderSize, maxInt(1, int(math.Round(float64(h)*placeholderSize/float64(w))))
+		} else {
+			w, h = maxInt(1, int(math.Round(float64(w)*placeholderSize/float64(h)))), placeholderSize
+		}
+	}
+	g := gift.New(gift.Resize(w, h, gift.BoxResampling))
+	dst := image.NewNRGBA(g.Bounds(b))
+	g.Draw(dst, img)
+	return dst
+}
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// BlurHash returns BlurHash string of img (see https://blurha.sh) made of 4
+// horizontal and 3 vertical components for landscape images, 3 and 4 for
+// portrait ones. Transparency is ignored.
+func BlurHash(img image.Image) string {
+	src := placeholderSource(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	nx, ny := 4, 3
+	if h > w {
+		nx, ny = 3, 4
+	}
+	linear := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := src.Pix[y*src.Stride+4*x:]
+			linear[y*w+x] = [3]float64{srgbToLinear(p[0]), srgbToLinear(p[1]), srgbToLinear(p[2])}
+		}
+	}
+	factors := make([][3]float64, 0, nx*ny)
+	for j := 0; j < ny; j++ {
+		for i := 0; i < nx; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				fy := math.Cos(math.Pi * float64(j) * float64(y) / float64(h))
+				for x := 0; x < w; x++ {
+					basis := fy * math.Cos(math.Pi*float64(i)*float64(x)/float64(w))
+					for c := range f {
+						f[c] += basis * linear[y*w+x][c]
+					}
+				}
+			}
+			for c := range f {
+				f[c] *= norm / float64(w*h)
+			}
+			factors = append(factors, f)
+		}
+	}
+	buf := make([]byte, 0, 6+2*len(factors))
+	buf = appendBase83(buf, (nx-1)+(ny-1)*9, 1)
+	maxValue := 1.0
+	if ac := factors[1:]; len(ac) > 0 {
+		var actualMax float64
+		for _, f := range ac {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-.5))))
+		maxValue = float64(quantised+1) / 166
+		buf = appendBase83(buf, quantised, 1)
+	} else {
+		buf = appendBase83(buf, 0, 1)
+	}
+	dc := factors[0]
+	buf = appendBase83(buf, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range factors[1:] {
+		var v int
+		for _, c := range f {
+			q := math.Copysign(math.Sqrt(math.Abs(c/maxValue)), c)
+			v = v*19 + int(math.Max(0, math.Min(18, math.Floor(q*9+9.5))))
+		}
+		buf = appendBase83(buf, v, 2)
+	}
+	return string(buf)
+}
+
+func appendBase83(b []byte, v, length int) []byte {
+	for i := length - 1; i >= 0; i-- {
+		d := v
+		for j := 0; j < i; j++ {
+			d /= 83
+		}
+		b = append(b, base83[d%83])
+	}
+	return b
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= .04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= .0031308 {
+		return int(v*12.92*255 + .5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-.055)*255 + .5)
+}
+
+// ThumbHash returns ThumbHash of img (see https://evanw.github.io/thumbhash/),
+// which unlike BlurHash keeps transparency and aspect ratio of the image
+func ThumbHash(img image.Image) []byte {
+	src := placeholderSource(img)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	n := w * h
+	var avgR, avgG, avgB, avgA float64
+	for i := 0; i < n; i++ {
+		p := src.Pix[(i/w)*src.Stride+4*(i%w):]
+		alpha := float64(p[3]) / 255
+		avgR += alpha / 255 * float64(p[0])
+		avgG += alpha / 255 * float64(p[1])
+		avgB += alpha / 255 * float64(p[2])
+		avgA += alpha
+	}
+	if avgA > 0 {
+		avgR, avgG, avgB = avgR/avgA, avgG/avgA, avgB/avgA
+	}
+	hasAlpha := avgA < float64(n)
+	lLimit := 7.0
+	if hasAlpha {
+		lLimit = 5 // fewer luminance bits if there's alpha
+	}
+	side := float64(maxInt(w, h))
+	lx := maxInt(1, int(jsRound(lLimit*float64(w)/side)))
+	ly := maxInt(1, int(jsRound(lLimit*float64(h)/side)))
+	// luminance, yellow-blue, red-green and alpha channels of the image
+	// composited over its average color
+	l, p, q, a := make([]float64, n), make([]float64, n), make([]float64, n), make([]float64, n)
+	for i := 0; i < n; i++ {
+		px := src.Pix[(i/w)*src.Stride+4*(i%w):]
+		alpha := float64(px[3]) / 255
+		r := avgR*(1-alpha) + alpha/255*float64(px[0])
+		g := avgG*(1-alpha) + alpha/255*float64(px[1])
+		b := avgB*(1-alpha) + alpha/255*float64(px[2])
+		l[i] = (r + g + b) / 3
+		p[i] = (r+g)/2 - b
+		q[i] = r - g
+		a[i] = alpha
+	}
+	encode := func(channel []float64, nx, ny int) (dc float64, ac []float64, scale float64) {
+		fx := make([]float64, w)
+		for cy := 0; cy < ny; cy++ {
+			for cx := 0; cx*ny < nx*(ny-cy); cx++ {
+				for x := range fx {
+					fx[x] = math.Cos(math.Pi / float64(w) * float64(cx) * (float64(x) + .5))
+				}
+				var f float64
+				for y := 0; y < h; y++ {
+					fy := math.Cos(math.Pi / float64(h) * float64(cy) * (float64(y) + .5))
+					for x := 0; x < w; x++ {
+						f += channel[x+y*w] * fx[x] * fy
+					}
+				}
+				f /= float64(n)
+				if cx > 0 || cy > 0 {
+					ac = append(ac, f)
+					scale = math.Max(scale, math.Abs(f))
+				} else {
+					dc = f
+				}
+			}
+		}
+		if scale > 0 {
+			for i := range ac {
+				ac[i] = .5 + .5/scale*ac[i]
+			}
+		}
+		return dc, ac, scale
+	}
+	lDC, lAC, lScale := encode(l, maxInt(3, lx), maxInt(3, ly))
+	pDC, pAC, pScale := encode(p, 3, 3)
+	qDC, qAC, qScale := encode(q, 3, 3)
+	isLandscape := w > h
+	header24 := int(jsRound(63*lDC)) | int(jsRound(31.5+31.5*pDC))<<6 |
+		int(jsRound(31.5+31.5*qDC))<<12 | int(jsRound(31*lScale))<<18
+	if hasAlpha {
+		header24 |= 1 << 23
+	}
+	header16 := lx
+	if isLandscape {
+		header16 = ly | 1<<15
+	}
+	header16 |= int(jsRound(63*pScale))<<3 | int(jsRound(63*qScale))<<9
+	hash := []byte{byte(header24), byte(header24 >> 8), byte(header24 >> 16), byte(header16), byte(header16 >> 8)}
+	acs := [][]float64{lAC, pAC, qAC}
+	if hasAlpha {
+		aDC, aAC, aScale := encode(a, 5, 5)
+		hash = append(hash, byte(int(jsRound(15*aDC))|int(jsRound(15*aScale))<<4))
+		acs = append(acs, aAC)
+	}
+	start, i := len(hash), 0
+	for _, ac := range acs {
+		for _, f := range ac {
+			if start+i/2 == len(hash) {
+				hash = append(hash, 0)
+			}
+			hash[start+i/2] |= byte(int(jsRound(15*f)) << ((i & 1) * 4))
+			i++
+		}
+	}
+	return hash
+}
+
+// jsRound rounds x like JavaScript Math.round does, half up
+func jsRound(x float64) float64 { return math.Floor(x + .5) }
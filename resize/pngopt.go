@@ -0,0 +1,110 @@
+package resize
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// pngCompression maps Options.PngCompression values to png compression
+// levels
+var pngCompression = map[string]png.CompressionLevel{
+	"":        png.BestCompression,
+	"best":    png.BestCompression,
+	"default": png.DefaultCompression,
+	"speed":   png.BestSpeed,
+	"none":    png.NoCompression,
+}
+
+// zlibLevel returns zlib compression level matching png one
+func zlibLevel(level png.CompressionLevel) int {
+	switch level {
+	case png.BestCompression:
+		return zlib.BestCompression
+	case png.BestSpeed:
+		return zlib.BestSpeed
+	case png.NoCompression:
+		return zlib.NoCompression
+	}
+	return zlib.DefaultCompression
+}
+
+// encodePNGOptimized writes img to w as png, trying to store it as
+// grayscale or palette image if that's lossless, and keeping the smallest of
+// encodings. Output is interlaced if interlaced is true.
+func encodePNGOptimized(w io.Writer, img image.Image, interlaced bool, level png.CompressionLevel) error {
+	enc := png.Encoder{CompressionLevel: level}
+	var best []byte
+	for _, m := range []image.Image{img, reducePNGColors(img)} {
+		if m == nil {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		encode := enc.Encode
+		if interlaced {
+			encode = func(w io.Writer, m image.Image) error { return encodePNGInterlaced(w, m, level) }
+		}
+		if err := encode(buf, m); err != nil {
+			return err
+		}
+		if best == nil || buf.Len() < len(best) {
+			best = buf.Bytes()
+		}
+	}
+	_, err := w.Write(best)
+	return err
+}
+
+// reducePNGColors returns img converted to grayscale image if all its
+// pixels are opaque gray, or to palette image if it has at most 256 colors.
+// It returns nil if neither conversion is lossless, or img already is of
+// such type or has 16 bits per channel.
+func reducePNGColors(img image.Image) image.Image {
+	switch img.(type) {
+	case *image.Gray, *image.Paletted, *image.Gray16, *image.RGBA64, *image.NRGBA64:
+		return nil
+	}
+	b := img.Bounds()
+	gray, paletted := true, true
+	index := make(map[color.NRGBA]uint8)
+	var palette color.Palette
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if gray && (c.A != 0xff || c.R != c.G || c.G != c.B) {
+				gray = false
+			}
+			if _, ok := index[c]; paletted && !ok {
+				if len(palette) == 256 {
+					paletted = false
+				} else {
+					index[c] = uint8(len(palette))
+					palette = append(palette, c)
+				}
+			}
+			if !gray && !paletted {
+				return nil
+			}
+		}
+	}
+	if gray {
+		out := image.NewGray(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				out.SetGray(x, y, color.Gray{color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA).R})
+			}
+		}
+		return out
+	}
+	out := image.NewPaletted(b, palette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			out.SetColorIndex(x, y, index[c])
+		}
+	}
+	return out
+}
@@ -0,0 +1,173 @@
+package resize
+
+import (
+	"context"
+	"image"
+	"io"
+	"math/bits"
+	"sync"
+
+	"github.com/bamiaux/rez"
+)
+
+// Processor transforms images like ProcessContext and ProcessMultiContext
+// do, but reuses pixel buffers of intermediate images between calls, which
+// reduces allocations and garbage collection work of servers processing
+// many images. Processor is safe for concurrent use, its zero value is
+// ready to use.
+type Processor struct {
+	pool bufferPool
+}
+
+// Process is like ProcessContext.
+func (p *Processor) Process(ctx context.Context, r io.Reader, w io.Writer, opts Options) (*Result, error) {
+	res, err := p.ProcessMulti(ctx, r, []Target{{W: w, Opts: opts}})
+	if err != nil {
+		return nil, err
+	}
+	return res[0], nil
+}
+
+// ProcessMulti is like ProcessMultiContext.
+func (p *Processor) ProcessMulti(ctx context.Context, r io.Reader, targets []Target) ([]*Result, error) {
+	bufs := &buffers{pool: &p.pool}
+	defer bufs.release()
+	tt := make([]Target, len(targets))
+	for i, t := range targets {
+		t.Opts.bufs = bufs
+		tt[i] = t
+	}
+	return ProcessMultiContext(ctx, r, tt)
+}
+
+// bufferPool holds byte slices grouped into classes by their capacity,
+// which is always a power of two, and rez converters, which keep their
+// own buffers and filter coefficients
+type bufferPool struct {
+	classes [48]sync.Pool // of *[]byte
+
+	mu         sync.Mutex
+	converters map[converterKey]*sync.Pool // of rez.Converter
+}
+
+type converterKey struct {
+	cfg    rez.ConverterConfig
+	filter rez.Filter
+}
+
+// maxConverterKeys limits the number of distinct conversions converters
+// are pooled for
+const maxConverterKeys = 256
+
+// buffers tracks pixel buffers taken from pool while processing a single
+// input, so that they are returned once all its outputs are written. Nil
+// *buffers allocates new slices every time.
+type buffers struct {
+	pool       *bufferPool
+	used       [][]byte
+	converters []pooledConverter
+}
+
+type pooledConverter struct {
+	p *sync.Pool
+	c rez.Converter
+}
+
+// get returns slice of n bytes with arbitrary content
+func (b *buffers) get(n int) []byte {
+	c := bits.Len(uint(n - 1))
+	if b == nil || n <= 0 || c >= len(b.pool.classes) {
+		return make([]byte, n)
+	}
+	var p []byte
+	if v, ok := b.pool.classes[c].Get().(*[]byte); ok {
+		p = (*v)[:n]
+	} else {
+		p = make([]byte, n, 1<<c)
+	}
+	b.used = append(b.used, p)
+	return p
+}
+
+// converter returns converter for given configuration and filter
+func (b *buffers) converter(cfg rez.ConverterConfig, filter rez.Filter) (rez.Converter, error) {
+	if b == nil {
+		return rez.NewConverter(&cfg, filter)
+	}
+	key := converterKey{cfg, filter}
+	b.pool.mu.Lock()
+	p := b.pool.converters[key]
+	if p == nil && len(b.pool.converters) < maxConverterKeys {
+		if b.pool.converters == nil {
+			b.pool.converters = make(map[converterKey]*sync.Pool)
+		}
+		p = new(sync.Pool)
+		b.pool.converters[key] = p
+	}
+	b.pool.mu.Unlock()
+	if p == nil {
+		return rez.NewConverter(&cfg, filter)
+	}
+	c, ok := p.Get().(rez.Converter)
+	if !ok {
+		var err error
+		if c, err = rez.NewConverter(&cfg, filter); err != nil {
+			return nil, err
+		}
+	}
+	b.converters = append(b.converters, pooledConverter{p, c})
+	return c, nil
+}
+
+// release returns all slices and converters taken from the pool
+func (b *buffers) release() {
+	for _, p := range b.used {
+		p := p[:0]
+		b.pool.classes[bits.Len(uint(cap(p)-1))].Put(&p)
+	}
+	for _, pc := range b.converters {
+		pc.p.Put(pc.c)
+	}
+	b.used, b.converters = nil, nil
+}
+
+func (b *buffers) rgba(r image.Rectangle) *image.RGBA {
+	return &image.RGBA{Pix: b.get(4 * r.Dx() * r.Dy()), Stride: 4 * r.Dx(), Rect: r}
+}
+
+func (b *buffers) nrgba(r image.Rectangle) *image.NRGBA {
+	return &image.NRGBA{Pix: b.get(4 * r.Dx() * r.Dy()), Stride: 4 * r.Dx(), Rect: r}
+}
+
+func (b *buffers) gray(r image.Rectangle) *image.Gray {
+	return &image.Gray{Pix: b.get(r.Dx() * r.Dy()), Stride: r.Dx(), Rect: r}
+}
+
+// ycbcr returns image like image.NewYCbCr with chroma subsampling named
+// like jpegSubsampling keys, 4:2:0 if subsample is empty; r must start at
+// the origin
+func (b *buffers) ycbcr(r image.Rectangle, subsample string) *image.YCbCr {
+	ratio := image.YCbCrSubsampleRatio420
+	switch subsample {
+	case "444":
+		ratio = image.YCbCrSubsampleRatio444
+	case "422":
+		ratio = image.YCbCrSubsampleRatio422
+	}
+	f, ok := jpegSubsampling[subsample]
+	if !ok {
+		f = jpegSubsampling["420"]
+	}
+	w, h := r.Dx(), r.Dy()
+	cw, ch := (w+f[0]-1)/f[0], (h+f[1]-1)/f[1]
+	p := b.get(w*h + 2*cw*ch)
+	return &image.YCbCr{
+		Y:              p[: w*h : w*h],
+		Cb:             p[w*h : w*h+cw*ch : w*h+cw*ch],
+		Cr:             p[w*h+cw*ch:],
+		YStride:        w,
+		CStride:        cw,
+		SubsampleRatio: ratio,
+		Rect:           r,
+	}
+}
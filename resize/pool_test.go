@@ -0,0 +1,87 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"sync"
+	"testing"
+)
+
+// testJPEG returns w×h jpeg with a color gradient
+func testJPEG(tb testing.TB, w, h int) []byte {
+	tb.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func BenchmarkProcess(b *testing.B) {
+	data := testJPEG(b, 640, 480)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Process(bytes.NewReader(data), io.Discard, Options{Width: 300}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProcessor(b *testing.B) {
+	data := testJPEG(b, 640, 480)
+	var p Processor
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Process(context.Background(), bytes.NewReader(data), io.Discard, Options{Width: 300}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestProcessorConcurrent(t *testing.T) {
+	data := testJPEG(t, 640, 480)
+	want := new(bytes.Buffer)
+	if _, err := Process(bytes.NewReader(data), want, Options{Width: 300}); err != nil {
+		t.Fatal(err)
+	}
+	var p Processor
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				buf := new(bytes.Buffer)
+				res, err := p.Process(context.Background(), bytes.NewReader(data), buf, Options{Width: 300})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if res.Width != 300 || res.Height != 225 {
+					t.Errorf("got %d×%d result, want 300×225", res.Width, res.Height)
+				}
+				if !bytes.Equal(buf.Bytes(), want.Bytes()) {
+					t.Error("output differs from Process one")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,119 @@
+package resize
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Info describes image and the output it would be transformed to
+type Info struct {
+	Format      string `json:"format"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Orientation int    `json:"orientation,omitempty"` // EXIF orientation
+	Alpha       bool   `json:"alpha"`                 // whether color model supports transparency
+
+	// OutputWidth and OutputHeight are dimensions of the output, they're
+	// only set if options have any dimensions set
+	OutputWidth  int `json:"outputWidth,omitempty"`
+	OutputHeight int `json:"outputHeight,omitempty"`
+
+	// Memory is a rough estimate of memory needed to hold decoded source
+	// and the output in bytes
+	Memory int64 `json:"estimatedMemory"`
+}
+
+// Probe reads image configuration and metadata from r, without decoding
+// the whole image, and reports dimensions it would be transformed to
+// according to opts.
+func Probe(r io.Reader, opts Options) (*Info, error) {
+	headBuf := new(bytes.Buffer)
+	cfg, kind, err := image.DecodeConfig(io.TeeReader(r, headBuf))
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	info := &Info{Format: kind, Width: cfg.Width, Height: cfg.Height}
+	switch kind {
+	case "jpeg":
+		x, err := exif.Decode(io.LimitReader(io.MultiReader(headBuf, r), MaxFileSize))
+		info.Orientation = exifOrientation(exifData{x, err})
+	case "tiff", "png", "webp":
+		data, err := ioutil.ReadAll(io.LimitReader(io.MultiReader(headBuf, r), MaxFileSize))
+		if err != nil {
+			return nil, err
+		}
+		if kind == "tiff" {
+			info.Orientation = tiffOrientation(data)
+		} else {
+			info.Orientation = tiffOrientation(exifBlock(kind, data))
+		}
+	}
+	bpp := 4
+	switch m := cfg.ColorModel.(type) {
+	case color.Palette:
+		bpp = 1
+		for _, c := range m {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				info.Alpha = true
+				break
+			}
+		}
+	default:
+		switch m {
+		case color.GrayModel:
+			bpp = 1
+		case color.Gray16Model:
+			bpp = 2
+		case color.YCbCrModel:
+			bpp = 3
+		case color.RGBA64Model, color.NRGBA64Model:
+			bpp = 8
+			info.Alpha = true
+		case color.RGBAModel, color.NRGBAModel, color.AlphaModel:
+			info.Alpha = true
+		}
+	}
+	info.Memory = int64(cfg.Width) * int64(cfg.Height) * int64(bpp)
+	if opts.Width == 0 && opts.Height == 0 && opts.MaxWidth == 0 && opts.MaxHeight == 0 &&
+		opts.MaxLong == 0 && opts.MaxShort == 0 && opts.Scale == 0 {
+		return info, nil
+	}
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+	_, swapWH := useExifOrientation(info.Orientation)
+	if _, swapRotated := opts.orient(); swapRotated {
+		swapWH = !swapWH
+	}
+	if swapWH {
+		opts.Width, opts.Height = opts.Height, opts.Width
+		opts.MaxWidth, opts.MaxHeight = opts.MaxHeight, opts.MaxWidth
+	}
+	tr, err := opts.transform()
+	if err != nil {
+		return nil, err
+	}
+	w, h := cfg.Width, cfg.Height
+	if opts.Square {
+		side := squareRect(image.Rect(0, 0, w, h)).Dx()
+		w, h = side, side
+	}
+	w, h = tr.coverSize(w, h)
+	if w, h, err = tr.newDimensions(w, h); err != nil {
+		return nil, err
+	}
+	if tr.Fit == "contain" {
+		w, h = tr.Width, tr.Height
+	}
+	if swapWH {
+		w, h = h, w
+	}
+	info.OutputWidth, info.OutputHeight = w, h
+	info.Memory += int64(w) * int64(h) * 4
+	return info, nil
+}
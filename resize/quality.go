@@ -0,0 +1,69 @@
+package resize
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// ssimWindow is the side of square windows SSIM is computed over, they
+// overlap by half
+const ssimWindow = 8
+
+// compareImages returns structural similarity index (SSIM) of luma and peak
+// signal-to-noise ratio (PSNR) in decibels of RGB channels of img relative
+// to ref, which must be of the same size. PSNR of identical images is +Inf.
+func compareImages(ref, img image.Image) (ssim, psnr float64) {
+	a, b := toRGBA(ref), toRGBA(img)
+	w, h := a.Rect.Dx(), a.Rect.Dy()
+	ya, yb := make([]float64, w*h), make([]float64, w*h)
+	var sum float64
+	for y := 0; y < h; y++ {
+		pa, pb := a.Pix[y*a.Stride:], b.Pix[y*b.Stride:]
+		for x := 0; x < w; x++ {
+			i := 4 * x
+			for c := 0; c < 3; c++ {
+				d := float64(pa[i+c]) - float64(pb[i+c])
+				sum += d * d
+			}
+			ya[y*w+x] = .299*float64(pa[i]) + .587*float64(pa[i+1]) + .114*float64(pa[i+2])
+			yb[y*w+x] = .299*float64(pb[i]) + .587*float64(pb[i+1]) + .114*float64(pb[i+2])
+		}
+	}
+	psnr = math.Inf(1)
+	if mse := sum / float64(3*w*h); mse > 0 {
+		psnr = 10 * math.Log10(255*255/mse)
+	}
+	const c1, c2 = (.01 * 255) * (.01 * 255), (.03 * 255) * (.03 * 255)
+	ww, wh := minInt(ssimWindow, w), minInt(ssimWindow, h)
+	var n int
+	for y0 := 0; y0+wh <= h; y0 += (wh + 1) / 2 {
+		for x0 := 0; x0+ww <= w; x0 += (ww + 1) / 2 {
+			var sa, sb, saa, sbb, sab float64
+			for y := y0; y < y0+wh; y++ {
+				for x := x0; x < x0+ww; x++ {
+					va, vb := ya[y*w+x], yb[y*w+x]
+					sa, sb = sa+va, sb+vb
+					saa, sbb, sab = saa+va*va, sbb+vb*vb, sab+va*vb
+				}
+			}
+			k := float64(ww * wh)
+			ma, mb := sa/k, sb/k
+			va, vb, cov := saa/k-ma*ma, sbb/k-mb*mb, sab/k-ma*mb
+			ssim += (2*ma*mb + c1) * (2*cov + c2) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+			n++
+		}
+	}
+	return ssim / float64(n), psnr
+}
+
+// toRGBA returns img as *image.RGBA with bounds starting at the origin
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	if m, ok := img.(*image.RGBA); ok && b.Min == (image.Point{}) {
+		return m
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, img, b.Min, draw.Src)
+	return dst
+}
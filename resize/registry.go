@@ -0,0 +1,104 @@
+package resize
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// DecodeFunc decodes image of custom format from r
+type DecodeFunc func(r io.Reader) (image.Image, error)
+
+// EncodeFunc writes img to w in custom format. Options are the ones image
+// is processed with, already validated.
+type EncodeFunc func(w io.Writer, img image.Image, opts Options) error
+
+type customFormat struct {
+	name   string
+	decode DecodeFunc
+	encode EncodeFunc
+}
+
+var registry struct {
+	sync.RWMutex
+	formats []customFormat
+}
+
+// RegisterFormat registers custom format with given name, which is also the
+// file extension (without dot) the command derives output format from.
+// Either of decode and encode can be nil.
+//
+// If encode is set, name becomes a valid Options.Format value; it is
+// consulted before built-in encoders, so that they can be replaced, like
+// "webp" encoder with a lossy one. If decode is set, it is tried on inputs
+// not recognized by registered image package decoders, in the order formats
+// were registered. As format of such inputs cannot be detected from their
+// header, they are read into memory and fully decoded before dimensions are
+// checked against PixelLimit.
+func RegisterFormat(name string, decode DecodeFunc, encode EncodeFunc) {
+	registry.Lock()
+	defer registry.Unlock()
+	for i, f := range registry.formats {
+		if f.name == name {
+			registry.formats[i] = customFormat{name, decode, encode}
+			return
+		}
+	}
+	registry.formats = append(registry.formats, customFormat{name, decode, encode})
+}
+
+// IsRegistered reports whether encoder of named format was registered with
+// RegisterFormat
+func IsRegistered(name string) bool { return customEncoder(name) != nil }
+
+// customEncoder returns encoder registered for named format, or nil
+func customEncoder(name string) EncodeFunc {
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, f := range registry.formats {
+		if f.name == name {
+			return f.encode
+		}
+	}
+	return nil
+}
+
+// customDecoders returns registered formats having decoders
+func customDecoders() []customFormat {
+	registry.RLock()
+	defer registry.RUnlock()
+	var out []customFormat
+	for _, f := range registry.formats {
+		if f.decode != nil {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// decodeCustom decodes image read from r with one of registered custom
+// decoders, calling check the same way as decodeSource does
+func decodeCustom(r io.Reader, formats []customFormat, check func(image.Config) (int, error)) (*source, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range formats {
+		img, err := f.decode(bytes.NewReader(data))
+		if err != nil {
+			continue
+		}
+		b := img.Bounds()
+		cfg := image.Config{ColorModel: img.ColorModel(), Width: b.Dx(), Height: b.Dy()}
+		if cfg.Width*cfg.Height > PixelLimit {
+			return nil, errorf(KindTooLarge, "image dimensions %d×%d exceeds limit", cfg.Width, cfg.Height)
+		}
+		if _, err := check(cfg); err != nil {
+			return nil, err
+		}
+		return &source{cfg: cfg, kind: f.name, img: img}, nil
+	}
+	return nil, decodeError(image.ErrFormat)
+}
@@ -0,0 +1,1630 @@
+// Package resize implements decoding, resizing (re-scaling) and encoding of
+// images of different formats.
+package resize
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bamiaux/rez"
+	"github.com/disintegration/gift"
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/soniakeys/quant/mean"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+)
+
+// Options describe how image should be transformed and encoded. At least one
+// of Width, Height, MaxWidth, MaxHeight, MaxLong, MaxShort or Scale should
+// be set.
+type Options struct {
+	Width     int  // width to enforce
+	Height    int  // height to enforce
+	MaxWidth  int  // max. allowed width
+	MaxHeight int  // max. allowed height
+	MaxLong   int  // max. allowed size of the longer side
+	MaxShort  int  // max. allowed size of the shorter side
+	Square    bool // crop image to square by smaller side before processing
+	NoFill    bool // do not draw transparent inputs over background for non-png outputs
+
+	// Scale, if positive, sets output size relative to source size, like
+	// 0.5 for half size. It cannot be used with other dimensions.
+	Scale float64
+
+	// Background is the color non-opaque images are drawn over for
+	// formats without transparency support, white if nil. It also fills
+	// padding added with contain fit, which is transparent if nil.
+	Background color.Color
+
+	// Fit sets how image is fit into Width×Height box when both are set:
+	// fill (default) stretches it ignoring aspect ratio, cover scales it to
+	// cover the box cropping the overflow according to Gravity, contain
+	// scales it to fit inside the box and pads it to box size, inside
+	// scales it to fit inside the box, outside scales it to cover the box
+	// without cropping
+	Fit string
+
+	// Gravity sets which part of image is kept when cropping: center
+	// (default), north, south, east, west, northeast, northwest,
+	// southeast, southwest, "x,y" focal point in source image pixels,
+	// edges to keep the region with most details, attention to do the
+	// same favoring saturated and skin colored regions, or face to center
+	// on detected faces, falling back to center if there are none
+	Gravity string
+
+	// Filter is the resampling filter: lanczos3 (default), lanczos2,
+	// bicubic, bilinear, box or nearest. Lanczos filter with 1 to 8 taps
+	// can be set as lanczos1 to lanczos8, fewer taps are faster and less
+	// sharp.
+	Filter string
+
+	// Rotate turns output clockwise by 90, 180 or 270 degrees, Flip
+	// mirrors it horizontally ("h") or vertically ("v"). Both are applied
+	// after resizing and EXIF based orientation; Width and Height refer to
+	// the final image.
+	Rotate int
+	Flip   string
+
+	// Format is the output format: jpeg, png, gif, tiff, bmp, webp or one
+	// registered with RegisterFormat; jpeg is used if empty. With auto,
+	// animations keep their format and still images are saved in one
+	// AutoFormat picks for them, reported as Result.Format.
+	Format      string
+	JpegQuality int  // jpeg quality (1-100)
+	Progressive bool // write progressive jpeg
+
+	// MaxBytes, if positive, limits output size: jpeg quality is lowered
+	// and, if that's not enough, image is scaled down until it fits
+	MaxBytes int
+
+	// Subsample sets jpeg chroma subsampling: 444, 422 or 420 (default).
+	// Chroma of jpeg inputs is scaled with the same subsampling, so 444
+	// keeps more color detail and 420 is faster.
+	Subsample string
+
+	// Optimize makes jpeg output use Huffman tables optimized for the
+	// image, and png output be saved as grayscale or palette image if
+	// that's lossless and smaller. EXIF data is not kept in such outputs.
+	Optimize bool
+
+	// Interlace makes png output be interlaced with Adam7 method and gif
+	// output be interlaced, so that it can be displayed progressively
+	Interlace bool
+
+	GifColors int // gif palette size (2-256), by default 256 or source palette size
+	PngColors int // png palette size (2-256), truecolor png is written if zero
+
+	// PngCompression trades png encoding time for size: best (default),
+	// default, speed or none. TiffCompression is deflate (default), lzw or
+	// none.
+	PngCompression  string
+	TiffCompression string
+
+	// Loop overrides loop count of animated gif or png output: 0 loops forever,
+	// -1 plays once. If nil, source value is kept.
+	Loop       *int
+	FPS        int // max. frame rate of animated output
+	DropFrames int // keep only every Nth frame of animated output
+
+	Sharpen   *Sharpen // unsharp mask to apply to resized output
+	Overlay   *Overlay // image to composite over resized output
+	Watermark *Overlay // image to composite over output after Overlay
+
+	// Grayscale and Sepia tone resized output, Sepia sets tone strength in
+	// percents (0-100). Brightness, Contrast (-100..100) and Saturation
+	// (-100..500) change output colors by given percentage.
+	Grayscale  bool
+	Sepia      float64
+	Brightness float64
+	Contrast   float64
+	Saturation float64
+
+	// GrayOutput makes jpeg, png and tiff output be saved as single channel
+	// grayscale image, which is smaller than toned RGB one. Transparent
+	// pixels are drawn over Background, ICC profile is dropped.
+	GrayOutput bool
+
+	// SRGB makes pixels of images with ICC profile be converted to sRGB
+	// color space, instead of saving the profile in output. Only RGB
+	// matrix based profiles are supported.
+	SRGB bool
+
+	// KeepEXIF makes EXIF data of jpeg, png and webp inputs be copied to
+	// output of the same formats, with orientation reset to normal if
+	// image was rotated according to it. By default EXIF is dropped.
+	KeepEXIF bool
+	// Strip drops all metadata from output, including ICC profile.
+	// Cannot be used with KeepEXIF.
+	Strip bool
+	// StripGPS removes GPS location from EXIF data kept with KeepEXIF
+	StripGPS bool
+
+	// DPI sets physical density written to jpeg, png and tiff output, in
+	// dots per inch. If zero, density of source image is kept.
+	DPI float64
+
+	// Hash makes Result.Hash be set to DHash of the output image
+	Hash bool
+
+	// Placeholder makes Result.Placeholder be set to placeholder of the
+	// output image of this kind: blurhash or thumbhash, see Placeholder
+	Placeholder string
+
+	// Metrics makes still output be decoded after encoding and compared
+	// with the image it was encoded from, setting Result.SSIM and PSNR
+	Metrics bool
+
+	// Trim makes borders of the same color as the top-left pixel of source
+	// image, or transparent ones, be cropped off before resizing. Pixels
+	// differing from it by at most TrimFuzz percents per channel are
+	// treated as border.
+	Trim     bool
+	TrimFuzz float64
+
+	// Ops, if set, is the pipeline of operations source image is
+	// transformed with in order, instead of the fixed order of cropping,
+	// scaling and rotation, see ParseOps. It is applied after EXIF based
+	// orientation and cannot be used with dimensions, Scale, Fit, Square,
+	// Trim, Rotate, Flip or Sharpen. Animated inputs are processed as
+	// still images.
+	Ops []Op
+
+	// Threads limits the number of goroutines scaling single image,
+	// GOMAXPROCS is used if it's not positive; 1 disables parallel scaling
+	Threads int
+
+	// LowMemory makes baseline jpeg inputs be decoded and scaled row by
+	// row, never keeping the whole decoded image in memory, at the cost of
+	// slower processing. Other inputs are processed as usual.
+	LowMemory bool
+
+	// Frame selects page of multi-page tiff or frame of animated gif or png
+	// to use as source, counting from zero. Animated input is then processed
+	// as a still image.
+	Frame int
+
+	// FirstFrame makes animated gif or png inputs be processed as still
+	// images of their first frame even if output format could keep the
+	// animation. Otherwise losing animation of png input is reported with
+	// a warning.
+	FirstFrame bool
+
+	// UseEXIFThumb makes jpeg inputs be scaled from the thumbnail embedded
+	// in their EXIF data instead of the full image, if the thumbnail is at
+	// least as large as the output and has the same aspect ratio
+	UseEXIFThumb bool
+
+	// Deterministic makes output depend only on the input and its own
+	// options: jpeg inputs are always decoded at full size, svg ones are
+	// rasterized at their own size, and, with ProcessMulti, output is never
+	// scaled from larger ones. As encoders don't embed timestamps and
+	// quantize colors in stable order, output is then byte-identical
+	// however it's produced, at the cost of speed.
+	Deterministic bool
+
+	icc     []byte  // ICC profile to embed in output
+	exif    []byte  // EXIF data to embed in output
+	density float64 // source density in dots per inch, used if DPI is zero
+
+	bufs *buffers // pixel buffers, set by Processor
+
+	// Warnf, if set, is called to report non-fatal issues, like failure
+	// to decode EXIF data
+	Warnf func(format string, args ...interface{})
+
+	// Debugf, if set, is called to report details of processing stages,
+	// like time spent on decoding, scaling and encoding and sizes of input
+	// and output
+	Debugf func(format string, args ...interface{})
+}
+
+// Sharpen describes unsharp mask filter
+type Sharpen struct {
+	Amount    float64 // how much edges are darkened and lightened, typically 0.5-1.5
+	Radius    float64 // sigma of gaussian blur used to find edges, 1 if zero
+	Threshold float64 // min. brightness change (0-1) to sharpen
+}
+
+// apply returns sharpened copy of img
+func (s *Sharpen) apply(img image.Image) image.Image {
+	radius := s.Radius
+	if radius == 0 {
+		radius = 1
+	}
+	g := gift.New(gift.UnsharpMask(float32(radius), float32(s.Amount), float32(s.Threshold)))
+	dst := image.NewNRGBA(g.Bounds(img.Bounds()))
+	g.Draw(dst, img)
+	return dst
+}
+
+// Result describes the written image
+type Result struct {
+	Format string
+	Width  int
+	Height int
+	Frames int // number of frames of animated output, 0 for still images
+
+	// Hash is DHash of the output image, or of the first frame of
+	// animation, only set if Options.Hash is set
+	Hash uint64
+
+	// Placeholder is compact placeholder of the output image, or of the
+	// first frame of animation, only set if Options.Placeholder is set
+	Placeholder string
+
+	// SSIM (structural similarity of luma, 1 for identical images) and
+	// PSNR (peak signal-to-noise ratio of RGB channels in decibels, +Inf
+	// for identical images) measure encoding loss of the output. Only set
+	// if Options.Metrics is set.
+	SSIM, PSNR float64
+
+	Source    string // input format
+	BytesRead int64  // size of input
+
+	// Durations of processing stages. Input is decoded once for all
+	// ProcessMulti targets, so every result reports the same DecodeTime.
+	// Animations are scaled and encoded frame by frame, which is all
+	// accounted as EncodeTime.
+	DecodeTime, ScaleTime, EncodeTime time.Duration
+}
+
+// Resize reads image from r, transforms it according to opts and writes the
+// result to w.
+func Resize(r io.Reader, w io.Writer, opts Options) error {
+	_, err := Process(r, w, opts)
+	return err
+}
+
+// Process is like Resize, but also reports properties of the written image.
+func Process(r io.Reader, w io.Writer, opts Options) (*Result, error) {
+	return ProcessContext(context.Background(), r, w, opts)
+}
+
+// ProcessContext is like Process, but stops with ctx error once ctx is done.
+// Context is checked while reading input, between processing stages and
+// between frames of animations.
+func ProcessContext(ctx context.Context, r io.Reader, w io.Writer, opts Options) (*Result, error) {
+	res, err := ProcessMultiContext(ctx, r, []Target{{W: w, Opts: opts}})
+	if err != nil {
+		return nil, err
+	}
+	return res[0], nil
+}
+
+// Target is one of the outputs of ProcessMulti
+type Target struct {
+	W    io.Writer
+	Opts Options
+}
+
+// ProcessMulti reads image from r once and writes it to every target,
+// transformed according to target options. Results are returned in the
+// same order as targets. Larger outputs are produced first, so that smaller
+// ones can be scaled down from them instead of the source image.
+func ProcessMulti(r io.Reader, targets []Target) ([]*Result, error) {
+	return ProcessMultiContext(context.Background(), r, targets)
+}
+
+// ProcessMultiContext is like ProcessMulti, but stops with ctx error once
+// ctx is done, see ProcessContext.
+func ProcessMultiContext(ctx context.Context, r io.Reader, targets []Target) ([]*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no targets")
+	}
+	type job struct {
+		idx           int
+		opts          Options
+		tr            transform
+		width, height int
+	}
+	jobs := make([]job, len(targets))
+	animated := make(map[string]bool) // formats of outputs that keep animation
+	for i, t := range targets {
+		if err := t.Opts.normalize(); err != nil {
+			return nil, err
+		}
+		tr, err := t.Opts.transform()
+		if err != nil {
+			return nil, err
+		}
+		jobs[i] = job{idx: i, opts: t.Opts, tr: tr}
+		if len(t.Opts.Ops) == 0 && !t.Opts.FirstFrame {
+			animated[t.Opts.Format] = true
+			if t.Opts.Format == "auto" {
+				animated["gif"], animated["png"] = true, true
+			}
+		}
+	}
+	start := time.Now()
+	cr := &countReader{r: r}
+	var input io.Reader = ctxReader{ctx, cr}
+	if f, ok := r.(*os.File); ok {
+		if data, unmap := mapFile(f); data != nil {
+			defer unmap()
+			cr.n, input = int64(len(data)), newMemInput(data)
+		}
+	}
+	src, err := decodeSource(input, targets[0].Opts, animated, func(cfg image.Config) (int, error) {
+		var maxSide int
+		for i := range jobs {
+			if len(jobs[i].opts.Ops) > 0 {
+				// output size is not known until pipeline is run
+				maxSide = -1
+				continue
+			}
+			w, h, err := jobs[i].tr.newDimensions(cfg.Width, cfg.Height)
+			if err != nil {
+				return 0, err
+			}
+			jobs[i].width, jobs[i].height = w, h
+			if jobs[i].opts.Filter == "nearest" || jobs[i].opts.Deterministic {
+				maxSide = -1
+			}
+			if h > w {
+				w = h
+			}
+			if maxSide >= 0 && w > maxSide {
+				maxSide = w
+			}
+		}
+		return maxSide, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	decodeTime := time.Since(start)
+	targets[0].Opts.debugf("decode: %s %dx%d, %d bytes read, %v", src.kind,
+		src.cfg.Width, src.cfg.Height, cr.n, decodeTime.Round(time.Millisecond))
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].width*jobs[i].height > jobs[j].width*jobs[j].height
+	})
+	out := make([]*Result, len(targets))
+	for _, j := range jobs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if out[j.idx], err = src.render(ctx, targets[j.idx].W, j.opts, j.tr); err != nil {
+			return nil, err
+		}
+		out[j.idx].Source, out[j.idx].BytesRead, out[j.idx].DecodeTime = src.kind, cr.n, decodeTime
+	}
+	return out, nil
+}
+
+// source is decoded input image
+type source struct {
+	cfg         image.Config
+	kind        string
+	img         image.Image
+	anim        *animation // animated input, only decoded as such for output of the same format
+	raw         []byte     // input copy for formats metadata can be extracted from
+	orientation int        // EXIF orientation
+	animatedPNG bool       // input is png with several frames
+
+	// scaled is the last image scaled from the whole img, smaller outputs
+	// can be scaled from it
+	scaled image.Image
+}
+
+// decodeSource reads and decodes image from r. If animated has input
+// format, all frames of animated gif or png are decoded. Function check is
+// called with image configuration before decoding, to fail early on
+// unsupported inputs; it returns the largest side of outputs, so that jpeg
+// inputs can be decoded at reduced size, or a negative value if they should
+// be decoded at full size. Decoded image may be smaller than cfg
+// dimensions. If r is memInput, its data is decoded without copying and
+// kept as source raw data.
+func decodeSource(r io.Reader, opts Options, animated map[string]bool, check func(image.Config) (int, error)) (*source, error) {
+	if opts.Frame > 0 {
+		var err error
+		if r, err = selectPage(r, opts.Frame); err != nil {
+			return nil, err
+		}
+	}
+	var data []byte // whole input, if it's already in memory
+	if m, ok := r.(memInput); ok {
+		data = m.data
+	}
+	headBuf := new(bytes.Buffer)
+	// input returns reader of the whole input from its start
+	input := func() io.Reader {
+		if data != nil {
+			return bytes.NewReader(data)
+		}
+		return io.LimitReader(io.MultiReader(headBuf, r), MaxFileSize)
+	}
+	configReader := io.TeeReader(r, headBuf)
+	if data != nil {
+		configReader = bytes.NewReader(data)
+	}
+	cfg, kind, err := image.DecodeConfig(configReader)
+	if err == image.ErrFormat {
+		if formats := customDecoders(); len(formats) > 0 {
+			return decodeCustom(input(), formats, check)
+		}
+	}
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	if cfg.Width*cfg.Height > PixelLimit {
+		return nil, errorf(KindTooLarge, "image dimensions %d×%d exceeds limit", cfg.Width, cfg.Height)
+	}
+	if opts.Frame > 0 && kind != "tiff" && kind != "gif" && kind != "png" {
+		return nil, errorf(KindInvalidOptions, "%s image has no frame %d", kind, opts.Frame+1)
+	}
+	maxSide, err := check(cfg)
+	if err != nil {
+		return nil, err
+	}
+	// output may be cropped or rotated, so its sides are compared with the
+	// shorter side of source
+	side := cfg.Width
+	if cfg.Height < side {
+		side = cfg.Height
+	}
+	shrink := 1
+	if maxSide > 0 {
+		shrink = jpegShrink(side, side, maxSide, maxSide)
+	}
+	useThumb := kind == "jpeg" && opts.UseEXIFThumb && maxSide > 0
+	src := &source{cfg: cfg, kind: kind}
+
+	imageDataReader := input()
+	var raw *bytes.Buffer // input copy to extract metadata from
+	switch kind {
+	case "jpeg", "png", "tiff", "webp":
+		if data != nil {
+			src.raw = data
+			break
+		}
+		raw = new(bytes.Buffer)
+		imageDataReader = io.TeeReader(imageDataReader, raw)
+	}
+	exifChan := make(chan exifData, 1)
+	if kind == "jpeg" && data != nil {
+		exifChan <- decodeEXIF(data)
+	} else if kind == "jpeg" {
+		prd, pwr := io.Pipe()
+		defer pwr.Close()
+		imageDataReader = io.TeeReader(imageDataReader, pwr)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					opts.warnf("exif decode failed")
+				}
+				io.Copy(ioutil.Discard, prd)
+			}()
+			data, err := exif.Decode(prd)
+			exifChan <- exifData{data, err}
+		}()
+	}
+
+	if kind == "jpeg" && (opts.LowMemory || shrink > 1 || useThumb) {
+		if raw != nil {
+			if _, err := io.Copy(ioutil.Discard, imageDataReader); err != nil {
+				return nil, err
+			}
+			src.raw = raw.Bytes()
+		}
+		if useThumb {
+			src.img = decodeEXIFThumb(src.raw, cfg, maxSide)
+		}
+		switch {
+		case src.img != nil:
+		case opts.LowMemory:
+			src.img, err = newJPEGStream(src.raw)
+		case shrink > 1:
+			src.img, err = decodeJPEGShrunk(src.raw, shrink, opts.bufs)
+		}
+		if src.img == nil || err != nil {
+			if src.img, err = jpeg.Decode(bytes.NewReader(src.raw)); err != nil {
+				return nil, decodeError(err)
+			}
+		}
+	} else if kind == "gif" && opts.Frame > 0 {
+		g, err := gif.DecodeAll(imageDataReader)
+		if err != nil {
+			return nil, decodeError(err)
+		}
+		if src.img, err = animationFrame(gifAnimation(g), opts.Frame); err != nil {
+			return nil, err
+		}
+	} else if kind == "gif" && animated[kind] {
+		g, err := gif.DecodeAll(imageDataReader)
+		if err != nil {
+			return nil, decodeError(err)
+		}
+		if len(g.Image) > 1 {
+			src.anim = gifAnimation(g)
+		}
+		src.img = g.Image[0]
+	} else if kind == "svg" {
+		if src.img, err = decodeSVGSized(imageDataReader, maxSide); err != nil {
+			return nil, decodeError(err)
+		}
+	} else if src.img, _, err = image.Decode(imageDataReader); err != nil {
+		return nil, decodeError(err)
+	}
+	if raw != nil {
+		src.raw = raw.Bytes()
+	}
+	if n := apngFrames(src.raw); kind == "png" && n > 0 {
+		src.animatedPNG = n > 1
+		if opts.Frame > 0 || animated[kind] {
+			a, err := decodeAPNG(src.raw)
+			if err != nil {
+				return nil, err
+			}
+			if opts.Frame > 0 {
+				if src.img, err = animationFrame(a, opts.Frame); err != nil {
+					return nil, err
+				}
+			} else if len(a.frames) > 1 {
+				src.anim = a
+			}
+		}
+	} else if kind == "png" && opts.Frame > 0 {
+		return nil, errorf(KindInvalidOptions, "%s image has no frame %d", kind, opts.Frame+1)
+	}
+	switch kind {
+	case "jpeg":
+		select {
+		case ed := <-exifChan:
+			src.orientation = exifOrientation(ed)
+		default:
+			opts.warnf("exif decode failed/stuck")
+		}
+	case "tiff":
+		src.orientation = tiffOrientation(src.raw)
+	case "png", "webp":
+		src.orientation = tiffOrientation(exifBlock(kind, src.raw))
+	}
+	return src, nil
+}
+
+// render transforms source image according to opts and tr and writes it
+// to w
+func (src *source) render(ctx context.Context, w io.Writer, opts Options, tr transform) (*Result, error) {
+	start := time.Now()
+	if opts.Format == "auto" {
+		opts.Format = src.autoFormat(opts)
+	}
+	if src.anim != nil && opts.Format == src.kind && len(opts.Ops) == 0 && !opts.FirstFrame {
+		resize := resizeAnimation
+		if src.kind == "png" {
+			resize = resizeAPNG
+		}
+		res, err := resize(ctx, w, src.anim, opts, tr)
+		if err != nil {
+			return nil, err
+		}
+		res.EncodeTime = time.Since(start)
+		if opts.Metrics {
+			opts.warnf("metrics are not computed for animated output")
+		}
+		return res, nil
+	}
+	if src.animatedPNG && opts.Frame == 0 && !opts.FirstFrame {
+		opts.warnf("only the first frame of animated png input is used")
+	}
+	outImg, opts, err := src.process(ctx, opts, tr)
+	if err != nil {
+		return nil, err
+	}
+	scaleTime := time.Since(start)
+	if pImg, ok := src.img.(*image.Paletted); ok && opts.GifColors == 0 {
+		opts.GifColors = len(pImg.Palette)
+	}
+	start = time.Now()
+	var encoded *bytes.Buffer
+	if opts.Metrics {
+		encoded = new(bytes.Buffer)
+		w = io.MultiWriter(w, encoded)
+	}
+	cw := &countWriter{w: w}
+	if opts.MaxBytes > 0 {
+		outImg, err = encodeMaxBytes(ctx, cw, outImg, opts)
+	} else {
+		err = Encode(cw, outImg, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	encodeTime := time.Since(start)
+	opts.debugf("encode: %s, %d bytes written, %v", opts.Format, cw.n, encodeTime.Round(time.Millisecond))
+	res := &Result{
+		Format:     opts.Format,
+		Width:      outImg.Bounds().Dx(),
+		Height:     outImg.Bounds().Dy(),
+		ScaleTime:  scaleTime,
+		EncodeTime: encodeTime,
+	}
+	if opts.Hash {
+		res.Hash = DHash(outImg)
+	}
+	res.Placeholder = Placeholder(outImg, opts.Placeholder)
+	if encoded != nil {
+		if img, _, err := image.Decode(encoded); err != nil {
+			opts.warnf("metrics: cannot decode %s output: %v", opts.Format, err)
+		} else if img.Bounds().Size() != outImg.Bounds().Size() {
+			opts.warnf("metrics: decoded %s output is of unexpected size", opts.Format)
+		} else {
+			res.SSIM, res.PSNR = compareImages(outImg, img)
+		}
+	}
+	return res, nil
+}
+
+// process transforms source image according to opts and tr, returning the
+// result along with opts updated with source metadata to encode it with
+func (src *source) process(ctx context.Context, opts Options, tr transform) (image.Image, Options, error) {
+	if len(opts.Ops) > 0 {
+		return src.processOps(ctx, opts)
+	}
+	cfg, img := src.cfg, src.img
+	width, height, err := tr.newDimensions(cfg.Width, cfg.Height)
+	if err != nil {
+		return nil, opts, err
+	}
+	toSRGB := src.metadata(&opts)
+
+	full := img.Bounds() // focal point is relative to the whole image
+	if b := img.Bounds(); b.Dx() != cfg.Width || b.Dy() != cfg.Height {
+		if x, y, err := focalPoint(opts.Gravity); err == nil {
+			// focal point is given in source image pixels, but image
+			// was decoded at reduced size
+			opts.Gravity = fmt.Sprintf("%d,%d", x*b.Dx()/cfg.Width, y*b.Dy()/cfg.Height)
+		}
+	}
+	var trimmed bool
+	if opts.Trim {
+		if js, ok := img.(*jpegStream); ok {
+			if img, err = js.decode(); err != nil {
+				return nil, opts, err
+			}
+		}
+		b := img.Bounds()
+		if r := trimRect(img, opts.TrimFuzz); r != b {
+			if _, ok := img.(SubImager); !ok {
+				return nil, opts, errors.New("cannot crop image")
+			}
+			img, trimmed = img.(SubImager).SubImage(r), true
+			// dimensions are derived from trimmed area size in
+			// source pixels, as image may be decoded at reduced size
+			cfg.Width = clampInt(r.Dx()*cfg.Width/b.Dx(), 1, cfg.Width)
+			cfg.Height = clampInt(r.Dy()*cfg.Height/b.Dy(), 1, cfg.Height)
+			if width, height, err = tr.newDimensions(cfg.Width, cfg.Height); err != nil {
+				return nil, opts, err
+			}
+		}
+	}
+	orientation := src.orientation
+	rotatefunc, swapWH := useExifOrientation(orientation)
+	orientfunc, swapRotated := opts.orient()
+	if swapWH != swapRotated {
+		opts.Width, opts.Height = opts.Height, opts.Width
+		opts.MaxWidth, opts.MaxHeight = opts.MaxHeight, opts.MaxWidth
+		if tr, err = opts.transform(); err != nil {
+			return nil, opts, err
+		}
+		width, height, err = tr.newDimensions(cfg.Width, cfg.Height)
+		if err != nil {
+			return nil, opts, err
+		}
+	}
+	if js, ok := img.(*jpegStream); ok && (opts.Gravity == "attention" || opts.Gravity == "edges" || opts.Gravity == "face") {
+		if img, err = js.decode(); err != nil {
+			return nil, opts, err
+		}
+	}
+	if b := img.Bounds(); tr.Scale > 0 && b.Dx() != cfg.Width {
+		// scale is relative to source size, but image was decoded at
+		// reduced size
+		tr.Scale *= float64(cfg.Width) / float64(b.Dx())
+	}
+	cropped := opts.Square || tr.Fit == "cover"
+	if cropped {
+		if _, ok := img.(SubImager); !ok {
+			return nil, opts, errors.New("cannot crop image")
+		}
+		if opts.Square {
+			gravity := subGravity(opts.Gravity, full, img.Bounds(), orientation)
+			img = img.(SubImager).SubImage(squareCrop(img, gravity, orientation))
+		}
+		b := img.Bounds()
+		if cw, ch := tr.coverSize(b.Dx(), b.Dy()); cw != b.Dx() || ch != b.Dy() {
+			gravity := subGravity(opts.Gravity, full, b, orientation)
+			img = img.(SubImager).SubImage(cropRect(img, cw, ch, gravity, orientation))
+		}
+		width, height, err = tr.newDimensions(img.Bounds().Dx(), img.Bounds().Dy())
+		if err != nil {
+			return nil, opts, err
+		}
+	}
+	var outImg image.Image
+	var start time.Time
+	if (cfg.Width <= width && cfg.Height <= height) && tr.limitsOnly() {
+		// noupscale case
+		outImg = img
+		if js, ok := img.(*jpegStream); ok {
+			if outImg, err = js.decode(); err != nil {
+				return nil, opts, err
+			}
+		}
+		if sb := src.img.Bounds(); sb.Dx() > src.cfg.Width {
+			// vector source was rasterized larger than its own size
+			b := outImg.Bounds()
+			w := int(math.Max(math.Round(float64(b.Dx()*src.cfg.Width)/float64(sb.Dx())), 1))
+			h := int(math.Max(math.Round(float64(b.Dy()*src.cfg.Height)/float64(sb.Dy())), 1))
+			if outImg, err = scaleThreads(outImg, w, h, opts.Filter, opts.Threads); err != nil {
+				return nil, opts, err
+			}
+		}
+		goto saveOutput
+	}
+	if !cropped && !trimmed && src.scaled != nil && !opts.Deterministic {
+		if b := src.scaled.Bounds(); b.Dx() >= width && b.Dy() >= height {
+			img = src.scaled
+		}
+	}
+	start = time.Now()
+	if js, ok := img.(*jpegStream); ok {
+		outImg, err = js.scale(ctx, width, height, opts.Filter)
+	} else {
+		outImg, err = scaleBuffers(img, width, height, opts.Filter, opts.Threads, opts.Subsample, opts.bufs)
+	}
+	if err != nil {
+		return nil, opts, err
+	}
+	opts.debugf("resize: %dx%d, %v", width, height, time.Since(start).Round(time.Millisecond))
+	if err := ctx.Err(); err != nil {
+		return nil, opts, err
+	}
+	if !cropped && !trimmed {
+		src.scaled = outImg
+	}
+saveOutput:
+	if opts.Sharpen != nil {
+		outImg = opts.Sharpen.apply(outImg)
+	}
+	if toSRGB != nil {
+		outImg = toSRGB.apply(outImg)
+	}
+	if adjustfunc := opts.adjust(); adjustfunc != nil {
+		outImg = adjustfunc(outImg)
+	}
+	if tr.Fit == "contain" {
+		outImg = padImage(outImg, tr.Width, tr.Height, opts.Background)
+	}
+	if !opts.NoFill && !keepsAlpha(opts.Format) {
+		outImg = fillBackground(outImg, opts.Background, opts.bufs)
+	}
+	if rotatefunc != nil {
+		outImg = rotatefunc(outImg)
+		if len(opts.exif) > 0 {
+			opts.exif = resetOrientation(opts.exif)
+		}
+	}
+	if orientfunc != nil {
+		outImg = orientfunc(outImg)
+	}
+	return opts.Composite(outImg), opts, nil
+}
+
+// metadata sets opts fields holding source metadata to embed in output. It
+// returns transform converting image colors to sRGB if that's requested
+// with opts.SRGB and source has ICC profile, or nil.
+func (src *source) metadata(opts *Options) *iccTransform {
+	if src.raw == nil {
+		return nil
+	}
+	if opts.KeepEXIF {
+		opts.exif = exifBlock(src.kind, src.raw)
+		if opts.StripGPS && len(opts.exif) > 0 {
+			opts.exif = stripGPS(opts.exif)
+		}
+	}
+	opts.density = imageDensity(src.kind, src.raw)
+	if opts.Strip {
+		return nil
+	}
+	icc := iccProfile(src.kind, src.raw)
+	if len(icc) == 0 || len(icc) > maxICCSize {
+		return nil
+	}
+	opts.icc = icc
+	if !opts.SRGB {
+		return nil
+	}
+	toSRGB, err := newICCTransform(icc)
+	if err != nil {
+		opts.warnf("cannot convert to sRGB, keeping ICC profile: %v", err)
+		return nil
+	}
+	opts.icc = nil
+	return toSRGB
+}
+
+// Dimensions returns dimensions image of given size would be resized to
+// according to opts. Orientation and cropping are not taken into account.
+func (opts Options) Dimensions(width, height int) (int, int, error) {
+	tr, err := opts.transform()
+	if err != nil {
+		return 0, 0, err
+	}
+	return tr.newDimensions(width, height)
+}
+
+// normalize validates options and fills defaults
+func (opts *Options) normalize() error {
+	if opts.Format == "" {
+		opts.Format = "jpeg"
+	}
+	switch opts.Format {
+	case "jpeg", "png", "gif", "tiff", "bmp", "webp", "auto":
+	default:
+		if !IsRegistered(opts.Format) {
+			return errorf(KindInvalidOptions, "unsupported output format %q", opts.Format)
+		}
+	}
+	if opts.JpegQuality < 1 || opts.JpegQuality > 100 {
+		opts.JpegQuality = jpeg.DefaultQuality
+	}
+	if s := opts.Sharpen; s != nil && (s.Amount < 0 || s.Radius < 0 || s.Threshold < 0 || s.Threshold > 1) {
+		return errorf(KindInvalidOptions, "invalid sharpen parameters")
+	}
+	if _, ok := filters[opts.Filter]; !ok {
+		return errorf(KindInvalidOptions, "unsupported filter %q", opts.Filter)
+	}
+	if _, ok := jpegSubsampling[opts.Subsample]; !ok && opts.Subsample != "" {
+		return errorf(KindInvalidOptions, "unsupported subsampling %q", opts.Subsample)
+	}
+	if opts.FPS < 0 || opts.DropFrames < 0 {
+		return errorf(KindInvalidOptions, "fps and drop-frames cannot be negative")
+	}
+	switch opts.Placeholder {
+	case "", "blurhash", "thumbhash":
+	default:
+		return errorf(KindInvalidOptions, "unsupported placeholder %q", opts.Placeholder)
+	}
+	if opts.GifColors != 0 && (opts.GifColors < 2 || opts.GifColors > 256) {
+		return errorf(KindInvalidOptions, "gif colors should be in 2-256 range")
+	}
+	if opts.PngColors != 0 && (opts.PngColors < 2 || opts.PngColors > 256) {
+		return errorf(KindInvalidOptions, "png colors should be in 2-256 range")
+	}
+	if _, ok := pngCompression[opts.PngCompression]; !ok {
+		return errorf(KindInvalidOptions, "unsupported png compression %q", opts.PngCompression)
+	}
+	if opts.TiffCompression == "ccitt" {
+		return errorf(KindInvalidOptions, "ccitt tiff compression is only supported for reading")
+	}
+	if _, ok := tiffCompression[opts.TiffCompression]; !ok {
+		return errorf(KindInvalidOptions, "unsupported tiff compression %q", opts.TiffCompression)
+	}
+	switch opts.Fit {
+	case "", "fill", "cover", "contain", "inside", "outside":
+	default:
+		return errorf(KindInvalidOptions, "unsupported fit %q", opts.Fit)
+	}
+	switch opts.Rotate {
+	case 0, 90, 180, 270:
+	default:
+		return errorf(KindInvalidOptions, "unsupported rotation angle %d", opts.Rotate)
+	}
+	switch opts.Flip {
+	case "", "h", "v":
+	default:
+		return errorf(KindInvalidOptions, "unsupported flip %q", opts.Flip)
+	}
+	if opts.Sepia < 0 || opts.Sepia > 100 || opts.Brightness < -100 || opts.Brightness > 100 ||
+		opts.Contrast < -100 || opts.Contrast > 100 || opts.Saturation < -100 || opts.Saturation > 500 {
+		return errorf(KindInvalidOptions, "color adjustments are out of range")
+	}
+	if opts.TrimFuzz < 0 || opts.TrimFuzz > 100 {
+		return errorf(KindInvalidOptions, "trim fuzz should be in 0-100 range")
+	}
+	if opts.Frame < 0 {
+		return errorf(KindInvalidOptions, "frame cannot be negative")
+	}
+	if opts.DPI < 0 || opts.DPI > 65535 {
+		return errorf(KindInvalidOptions, "dpi should be in 0-65535 range")
+	}
+	if opts.KeepEXIF && opts.Strip {
+		return errorf(KindInvalidOptions, "keep-exif and strip cannot be used together")
+	}
+	if opts.KeepEXIF && opts.Optimize {
+		return errorf(KindInvalidOptions, "keep-exif and optimize cannot be used together")
+	}
+	if err := validGravity(opts.Gravity); err != nil {
+		return &Error{Kind: KindInvalidOptions, Err: err}
+	}
+	if len(opts.Ops) > 0 && (opts.Square || opts.Trim || opts.Rotate != 0 || opts.Flip != "" || opts.Sharpen != nil) {
+		return errorf(KindInvalidOptions, "ops cannot be used with square, trim, rotate, flip or sharpen")
+	}
+	for _, op := range opts.Ops {
+		if _, err := op.compile(*opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Composite returns img with opts.Overlay and opts.Watermark drawn over it
+func (opts Options) Composite(img image.Image) image.Image {
+	if opts.Overlay != nil {
+		img = opts.Overlay.DrawOn(img)
+	}
+	if opts.Watermark != nil {
+		img = opts.Watermark.DrawOn(img)
+	}
+	return img
+}
+
+func (opts Options) warnf(format string, args ...interface{}) {
+	if opts.Warnf != nil {
+		opts.Warnf(format, args...)
+	}
+}
+
+func (opts Options) debugf(format string, args ...interface{}) {
+	if opts.Debugf != nil {
+		opts.Debugf(format, args...)
+	}
+}
+
+// Encode writes img to w in opts.Format format. Non-opaque images are drawn
+// over opts.Background for formats other than png and webp, unless
+// opts.NoFill is set. Webp images are always encoded lossless. Auto format
+// is resolved with AutoFormat.
+func Encode(w io.Writer, img image.Image, opts Options) error {
+	if err := opts.normalize(); err != nil {
+		return err
+	}
+	if opts.Format == "auto" {
+		opts.Format = AutoFormat(img)
+	}
+	if !opts.NoFill && !keepsAlpha(opts.Format) {
+		img = fillBackground(img, opts.Background, opts.bufs)
+	}
+	if opts.Strip {
+		opts.icc, opts.exif = nil, nil
+	}
+	if opts.Optimize {
+		opts.exif = nil
+	}
+	if opts.GrayOutput {
+		switch opts.Format {
+		case "jpeg", "png", "tiff":
+			img = toGray(img, opts.Background, opts.bufs)
+			opts.icc = nil
+		default:
+			opts.warnf("%s output cannot be saved as grayscale image", opts.Format)
+		}
+	}
+	if encode := customEncoder(opts.Format); encode != nil {
+		return encode(w, img, opts)
+	}
+	if dpi := opts.DPI; dpi > 0 || opts.density > 0 {
+		if dpi == 0 {
+			dpi = opts.density
+		}
+		switch opts.Format {
+		case "jpeg", "png", "tiff":
+			opts.DPI, opts.density = 0, 0
+			buf := new(bytes.Buffer)
+			if err := Encode(buf, img, opts); err != nil {
+				return err
+			}
+			data, err := setDensity(opts.Format, buf.Bytes(), dpi)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(data)
+			return err
+		}
+		if opts.DPI > 0 {
+			opts.warnf("density cannot be saved in %s format", opts.Format)
+		}
+	}
+	if len(opts.icc) > 0 || len(opts.exif) > 0 {
+		switch opts.Format {
+		case "jpeg", "png", "webp":
+			icc, exif := opts.icc, opts.exif
+			opts.icc, opts.exif = nil, nil
+			buf := new(bytes.Buffer)
+			if err := Encode(buf, img, opts); err != nil {
+				return err
+			}
+			data, err := embedMetadata(opts.Format, buf.Bytes(), icc, exif)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(data)
+			return err
+		}
+		if len(opts.icc) > 0 {
+			opts.warnf("ICC profile cannot be saved in %s format", opts.Format)
+		}
+		if len(opts.exif) > 0 {
+			opts.warnf("EXIF data cannot be saved in %s format", opts.Format)
+		}
+	}
+	switch opts.Format {
+	case "gif":
+		gifOpts := &gif.Options{NumColors: 256, Quantizer: mean.Quantizer(256)}
+		if opts.GifColors > 0 {
+			gifOpts.NumColors = opts.GifColors
+			gifOpts.Quantizer = mean.Quantizer(opts.GifColors)
+		}
+		if opts.Interlace {
+			b := img.Bounds()
+			pm, ok := img.(*image.Paletted)
+			if !ok || len(pm.Palette) > gifOpts.NumColors {
+				pm = image.NewPaletted(b, gifOpts.Quantizer.Quantize(make(color.Palette, 0, gifOpts.NumColors), img))
+				draw.FloydSteinberg.Draw(pm, b, img, b.Min)
+			}
+			return encodeGIFInterlaced(w, &gif.GIF{Image: []*image.Paletted{pm}, Delay: []int{0}})
+		}
+		return gif.Encode(w, img, gifOpts)
+	case "png":
+		if opts.PngColors > 0 {
+			img = quantize(img, opts.PngColors)
+		}
+		level := pngCompression[opts.PngCompression]
+		if opts.Optimize {
+			return encodePNGOptimized(w, img, opts.Interlace, level)
+		}
+		if opts.Interlace {
+			return encodePNGInterlaced(w, img, level)
+		}
+		enc := png.Encoder{CompressionLevel: level}
+		return enc.Encode(w, img)
+	case "tiff":
+		return encodeTIFF(w, img, opts.TiffCompression)
+	case "bmp":
+		return bmp.Encode(w, img)
+	case "webp":
+		return encodeWebP(w, img)
+	}
+	if opts.Progressive || opts.Subsample != "" || opts.Optimize {
+		return encodeJPEG(w, img, opts.JpegQuality, opts.Subsample, opts.Progressive, opts.Optimize)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: opts.JpegQuality})
+}
+
+// encodeMaxBytes is like Encode, but lowers jpeg quality and, if that's
+// not enough, scales img down until output fits into opts.MaxBytes. It
+// returns the image that was written.
+func encodeMaxBytes(ctx context.Context, w io.Writer, img image.Image, opts Options) (image.Image, error) {
+	buf := new(bytes.Buffer)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var best []byte
+		lo, hi := 1, 1
+		if opts.Format == "jpeg" {
+			hi = opts.JpegQuality
+		}
+		for lo <= hi {
+			q := (lo + hi) / 2
+			o := opts
+			o.JpegQuality = q
+			buf.Reset()
+			if err := Encode(buf, img, o); err != nil {
+				return nil, err
+			}
+			if buf.Len() > opts.MaxBytes {
+				hi = q - 1
+				continue
+			}
+			best = append(best[:0], buf.Bytes()...)
+			lo = q + 1
+			if opts.Format != "jpeg" {
+				break
+			}
+		}
+		if best != nil {
+			_, err := w.Write(best)
+			return img, err
+		}
+		// buf holds the smallest output, scale image down by area ratio
+		// needed to fit, but at least by 10%
+		scale := math.Min(.9, math.Max(.5, math.Sqrt(float64(opts.MaxBytes)/float64(buf.Len()))))
+		b := img.Bounds()
+		width, height := int(float64(b.Dx())*scale), int(float64(b.Dy())*scale)
+		if width < 8 || height < 8 {
+			return nil, fmt.Errorf("cannot fit image into %d bytes", opts.MaxBytes)
+		}
+		var err error
+		if img, err = scaleThreads(img, width, height, opts.Filter, opts.Threads); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// keepsAlpha reports whether transparency is preserved in images of given
+// format
+func keepsAlpha(format string) bool { return format == "png" || format == "webp" }
+
+// fillBackground draws non-opaque images over bg color, white if nil.
+// Translucent bg is itself drawn over white.
+func fillBackground(img image.Image, bg color.Color, bufs *buffers) image.Image {
+	if op, ok := img.(opaquer); !ok || op.Opaque() {
+		return img
+	}
+	newImg := bufs.rgba(img.Bounds())
+	draw.Copy(newImg, newImg.Bounds().Min, image.White, newImg.Bounds(), draw.Src, nil)
+	if bg != nil {
+		draw.Copy(newImg, newImg.Bounds().Min, image.NewUniform(bg), newImg.Bounds(), draw.Over, nil)
+	}
+	draw.Copy(newImg, newImg.Bounds().Min, img, img.Bounds(), draw.Over, nil)
+	return newImg
+}
+
+// toGray returns img converted to grayscale, drawn over bg if it's not
+// opaque
+func toGray(img image.Image, bg color.Color, bufs *buffers) image.Image {
+	if g, ok := img.(*image.Gray); ok {
+		return g
+	}
+	img = fillBackground(img, bg, bufs)
+	b := img.Bounds()
+	g := bufs.gray(b)
+	draw.Draw(g, b, img, b.Min, draw.Src)
+	return g
+}
+
+type transform struct {
+	Width     int
+	Height    int
+	MaxWidth  int
+	MaxHeight int
+	MaxLong   int
+	MaxShort  int
+	Scale     float64
+	Fit       string
+}
+
+// minLimit returns the smaller of a and b, zero meaning no limit
+func minLimit(a, b int) int {
+	if a == 0 || b > 0 && b < a {
+		return b
+	}
+	return a
+}
+
+// limitsOnly reports whether tr only sets max. dimensions, so that image
+// is never upscaled
+func (tr transform) limitsOnly() bool {
+	return tr.MaxWidth > 0 || tr.MaxHeight > 0 || tr.MaxLong > 0 || tr.MaxShort > 0
+}
+
+func (tr transform) newDimensions(origWidth, origHeight int) (width, height int, err error) {
+	if origWidth == 0 || origHeight == 0 {
+		return 0, 0, errorf(KindCorrupt, "invalid source dimensions")
+	}
+	maxWidth, maxHeight := tr.MaxWidth, tr.MaxHeight
+	if tr.MaxLong > 0 || tr.MaxShort > 0 {
+		long, short := &maxWidth, &maxHeight
+		if origHeight > origWidth {
+			long, short = short, long
+		}
+		*long, *short = minLimit(*long, tr.MaxLong), minLimit(*short, tr.MaxShort)
+	}
+	var w, h int
+	switch {
+	case tr.Scale > 0:
+		w = int(math.Max(math.Round(float64(origWidth)*tr.Scale), 1))
+		h = int(math.Max(math.Round(float64(origHeight)*tr.Scale), 1))
+	case maxWidth > 0 || maxHeight > 0:
+		w, h = maxWidth, maxHeight
+		// if only one max dimension specified, calculate another using
+		// original aspect ratio
+		if w == 0 {
+			w = origWidth * h / origHeight
+		}
+		if h == 0 {
+			h = origHeight * w / origWidth
+		}
+		if origWidth <= w && origHeight <= h {
+			return origWidth, origHeight, nil // image already fit
+		}
+		if maxWidth > 0 && maxHeight > 0 {
+			// maxwidth and maxheight form free aspect ratio, need
+			// to adjust w and h to match origin aspect ratio, while
+			// keeping dimensions inside max bounds
+			if float64(origWidth)/float64(origHeight) > float64(w)/float64(h) {
+				h = origHeight * w / origWidth
+			} else {
+				w = origWidth * h / origHeight
+			}
+		}
+	case tr.Width > 0 || tr.Height > 0:
+		// if both width and height specified, free aspect ratio is
+		// applied; if only one is set, original aspect ratio is kept
+		w, h = tr.Width, tr.Height
+		if w == 0 {
+			w = origWidth * h / origHeight
+		}
+		if h == 0 {
+			h = origHeight * w / origWidth
+		}
+		if (tr.Fit == "contain" || tr.Fit == "inside") && tr.Width > 0 && tr.Height > 0 {
+			if origWidth*h > origHeight*w {
+				h = origHeight * w / origWidth
+			} else {
+				w = origWidth * h / origHeight
+			}
+		}
+		if tr.Fit == "outside" && tr.Width > 0 && tr.Height > 0 {
+			if origWidth*h > origHeight*w {
+				w = origWidth * h / origHeight
+			} else {
+				h = origHeight * w / origWidth
+			}
+		}
+	default:
+		return 0, 0, errorf(KindInvalidOptions, "invalid transform %v", tr)
+	}
+	if w*h > PixelLimit || w >= 1<<16 || h >= 1<<16 {
+		return 0, 0, errorf(KindTooLarge, "destination size exceeds limit")
+	}
+	return w, h, nil
+}
+
+func (opts Options) transform() (transform, error) {
+	tr := transform{
+		Width:     opts.Width,
+		Height:    opts.Height,
+		MaxWidth:  opts.MaxWidth,
+		MaxHeight: opts.MaxHeight,
+		MaxLong:   opts.MaxLong,
+		MaxShort:  opts.MaxShort,
+		Scale:     opts.Scale,
+		Fit:       opts.Fit,
+	}
+	if len(opts.Ops) > 0 {
+		if tr != (transform{}) {
+			return transform{}, errorf(KindInvalidOptions, "ops cannot be used with dimensions, scale or fit")
+		}
+		return tr, nil
+	}
+	if tr.Width == 0 || tr.Height == 0 {
+		tr.Fit = "" // only makes sense with both dimensions set
+	}
+	if tr.MaxLong < 0 || tr.MaxShort < 0 {
+		return transform{}, errorf(KindInvalidOptions, "maxlong and maxshort cannot be negative")
+	}
+	if tr.Scale != 0 && (tr.Scale < 0 || tr.Width != 0 || tr.Height != 0 || tr.limitsOnly()) {
+		return transform{}, errorf(KindInvalidOptions, "scale should be positive and cannot be used with other dimensions")
+	}
+	if tr.Width == 0 && tr.Height == 0 && !tr.limitsOnly() && tr.Scale == 0 {
+		return transform{}, errorf(KindInvalidOptions, "no valid dimensions specified")
+	}
+	if tr.Width*tr.Height > PixelLimit || tr.MaxWidth > PixelLimit || tr.MaxHeight > PixelLimit ||
+		tr.MaxLong > PixelLimit || tr.MaxShort > PixelLimit {
+		return transform{}, errorf(KindTooLarge, "destination size exceeds limit")
+	}
+	return tr, nil
+}
+
+// coverSize returns size of the largest part of origWidth×origHeight image
+// having tr.Width×tr.Height aspect ratio if cover fit is used, otherwise
+// original size is returned
+func (tr transform) coverSize(origWidth, origHeight int) (int, int) {
+	if tr.Fit != "cover" {
+		return origWidth, origHeight
+	}
+	if origWidth*tr.Height > origHeight*tr.Width {
+		return clampInt(origHeight*tr.Width/tr.Height, 1, origWidth), origHeight
+	}
+	return origWidth, clampInt(origWidth*tr.Height/tr.Width, 1, origHeight)
+}
+
+// padImage places img in the center of width×height canvas filled with bg
+// color, transparent if bg is nil
+func padImage(img image.Image, width, height int, bg color.Color) image.Image {
+	b := img.Bounds()
+	if b.Dx() >= width && b.Dy() >= height {
+		return img
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	if bg != nil {
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	}
+	off := image.Pt((width-b.Dx())/2, (height-b.Dy())/2)
+	draw.Draw(dst, b.Sub(b.Min).Add(off), img, b.Min, draw.Src)
+	return dst
+}
+
+// SubImager is implemented by images that can return their part sharing
+// pixels with them, like *image.RGBA
+type SubImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+// squareRect returns the largest square centered inside r
+func squareRect(r image.Rectangle) image.Rectangle {
+	minSide := r.Dx()
+	if r.Dy() < minSide {
+		minSide = r.Dy()
+	}
+	x0, y0 := r.Min.X+(r.Dx()-minSide)/2, r.Min.Y+(r.Dy()-minSide)/2
+	return image.Rect(x0, y0, x0+minSide, y0+minSide)
+}
+
+// Scale resizes img to given dimensions, picking the best available
+// implementation for the image type
+func Scale(img image.Image, width, height int) (image.Image, error) {
+	return ScaleFilter(img, width, height, "")
+}
+
+// ScaleFilter is like Scale, but uses given resampling filter: lanczos3
+// (used if empty), lanczos1 to lanczos8, bicubic, bilinear, box or nearest.
+func ScaleFilter(img image.Image, width, height int, filter string) (image.Image, error) {
+	return scaleThreads(img, width, height, filter, 0)
+}
+
+// scaleThreads is like ScaleFilter, but limits the number of goroutines
+// used to threads, if positive
+func scaleThreads(img image.Image, width, height int, filter string, threads int) (image.Image, error) {
+	return scaleBuffers(img, width, height, filter, threads, "", nil)
+}
+
+// scaleBuffers is like scaleThreads, but allocates destination and
+// intermediate images with bufs. YCbCr images are scaled to images with
+// chroma subsampling named like jpegSubsampling keys, 4:2:0 if subsample
+// is empty.
+func scaleBuffers(img image.Image, width, height int, filter string, threads int, subsample string, bufs *buffers) (image.Image, error) {
+	algo, ok := filters[filter]
+	if !ok {
+		return nil, fmt.Errorf("unsupported filter %q", filter)
+	}
+	switch img.(type) {
+	case *image.YCbCr, *image.RGBA, *image.NRGBA, *image.Gray:
+		return resize(img, width, height, algo, threads, subsample, bufs)
+	}
+	if filter == "" {
+		return resizeFallback(img, width, height, threads)
+	}
+	n := bufs.nrgba(img.Bounds())
+	draw.Draw(n, n.Bounds(), img, img.Bounds().Min, draw.Src)
+	return resize(n, width, height, algo, threads, subsample, bufs)
+}
+
+// filters maps names of resampling filters to their implementations, nil
+// stands for nearest neighbor
+var filters = map[string]rez.Filter{
+	"":         rez.NewLanczosFilter(3),
+	"lanczos3": rez.NewLanczosFilter(3),
+	"lanczos2": rez.NewLanczosFilter(2),
+	"bicubic":  rez.NewBicubicFilter(),
+	"bilinear": rez.NewBilinearFilter(),
+	"box":      boxFilter{},
+	"nearest":  nil,
+}
+
+func init() {
+	// lanczos filters with other numbers of taps, fewer are faster
+	for taps := 1; taps <= 8; taps++ {
+		if name := "lanczos" + strconv.Itoa(taps); filters[name] == nil {
+			filters[name] = rez.NewLanczosFilter(taps)
+		}
+	}
+}
+
+// boxFilter averages source pixels covered by destination pixel
+type boxFilter struct{}
+
+func (boxFilter) Taps() int    { return 1 }
+func (boxFilter) Name() string { return "box" }
+func (boxFilter) Get(x float64) float64 {
+	if x <= .5 {
+		return 1
+	}
+	return 0
+}
+
+func resize(inImg image.Image, width, height int, algo rez.Filter, threads int, subsample string, bufs *buffers) (image.Image, error) {
+	var outImg draw.Image
+	rect := image.Rect(0, 0, width, height)
+	switch inImg.(type) {
+	case *image.Gray:
+		outImg = bufs.gray(rect)
+	case *image.RGBA:
+		outImg = bufs.rgba(rect)
+	case *image.NRGBA:
+		outImg = bufs.nrgba(rect)
+	default:
+		if algo == nil {
+			outImg = bufs.rgba(rect)
+			break
+		}
+		ycc := bufs.ycbcr(rect, subsample)
+		if err := convert(ycc, inImg, algo, threads, bufs); err != nil {
+			return nil, err
+		}
+		return ycc, nil
+	}
+	if algo == nil {
+		draw.NearestNeighbor.Scale(outImg, rect, inImg, inImg.Bounds(), draw.Src, nil)
+		return outImg, nil
+	}
+	if err := convert(outImg, inImg, algo, threads, bufs); err != nil {
+		return nil, err
+	}
+	return outImg, nil
+}
+
+func resizeFallback(inImg image.Image, width, height, threads int) (image.Image, error) {
+	return resampleParallel(inImg, width, height, catmullRom, threads), nil
+}
+
+// catmullRom is the filter used by resizeFallback
+var catmullRom = rez.NewCustomBicubicFilter(0, .5)
+
+const (
+	// PixelLimit is the max. number of pixels of source and destination
+	// images
+	PixelLimit = 50 * 1000000
+	// MaxFileSize is the max. number of bytes read from the source
+	MaxFileSize = 50 << 20
+)
+
+type opaquer interface {
+	Opaque() bool
+}
+
+type exifData struct {
+	exif *exif.Exif
+	err  error
+}
+
+// decodeEXIF decodes EXIF data of jpeg image, recovering from decoder
+// panics
+func decodeEXIF(data []byte) (ed exifData) {
+	defer func() {
+		if p := recover(); p != nil {
+			ed = exifData{err: fmt.Errorf("exif decode failed: %v", p)}
+		}
+	}()
+	x, err := exif.Decode(bytes.NewReader(data))
+	return exifData{x, err}
+}
+
+// exifOrientation returns value of EXIF orientation tag, or 0 if it's not
+// available
+func exifOrientation(ed exifData) int {
+	if ed.err != nil || ed.exif == nil {
+		return 0
+	}
+	o, err := ed.exif.Get(exif.Orientation)
+	if err != nil || o == nil || len(o.Val) != 2 {
+		return 0
+	}
+	for _, x := range o.Val {
+		if x != 0 {
+			return int(x)
+		}
+	}
+	return 0
+}
+
+func useExifOrientation(orientation int) (rotatefunc func(image.Image) image.Image, swapWH bool) {
+	switch orientation {
+	case 2: // horizontal flip
+		return flipHorizontal, false
+	case 3: // 180º
+		return rotate180, false
+	case 4: // vertical flip
+		return flipVertical, false
+	case 5: // horizontal flip, then 90ºCCW
+		return transpose, true
+	case 6: // 90ºCCW
+		return rotate90ccw, true
+	case 7: // horizontal flip, then 90ºCW
+		return transverse, true
+	case 8: // 90ºCW
+		return rotate90cw, true
+	}
+	return
+}
+
+// orient returns function applying opts.Rotate and opts.Flip to image, or
+// nil if there's nothing to do; swapWH reports whether it swaps dimensions
+func (opts Options) orient() (orientfunc func(image.Image) image.Image, swapWH bool) {
+	var filters []gift.Filter
+	switch opts.Rotate {
+	case 90:
+		filters = append(filters, gift.Rotate270()) // gift angles are counter-clockwise
+	case 180:
+		filters = append(filters, gift.Rotate180())
+	case 270:
+		filters = append(filters, gift.Rotate90())
+	}
+	switch opts.Flip {
+	case "h":
+		filters = append(filters, gift.FlipHorizontal())
+	case "v":
+		filters = append(filters, gift.FlipVertical())
+	}
+	if len(filters) == 0 {
+		return nil, false
+	}
+	return func(src image.Image) image.Image {
+		for _, f := range filters {
+			src = rotate(src, f)
+		}
+		return src
+	}, opts.Rotate == 90 || opts.Rotate == 270
+}
+
+// adjust returns function applying color adjustments set by opts to image,
+// or nil if there's nothing to do
+func (opts Options) adjust() func(image.Image) image.Image {
+	var filters []gift.Filter
+	if opts.Brightness != 0 {
+		filters = append(filters, gift.Brightness(float32(opts.Brightness)))
+	}
+	if opts.Contrast != 0 {
+		filters = append(filters, gift.Contrast(float32(opts.Contrast)))
+	}
+	if opts.Saturation != 0 {
+		filters = append(filters, gift.Saturation(float32(opts.Saturation)))
+	}
+	if opts.Grayscale {
+		filters = append(filters, gift.Grayscale())
+	}
+	if opts.Sepia != 0 {
+		filters = append(filters, gift.Sepia(float32(opts.Sepia)))
+	}
+	if len(filters) == 0 {
+		return nil
+	}
+	g := gift.New(filters...)
+	return func(src image.Image) image.Image {
+		dst := image.NewNRGBA(g.Bounds(src.Bounds()))
+		g.Draw(dst, src)
+		return dst
+	}
+}
+
+func flipHorizontal(src image.Image) image.Image { return rotate(src, gift.FlipHorizontal()) }
+func flipVertical(src image.Image) image.Image   { return rotate(src, gift.FlipVertical()) }
+func rotate90ccw(src image.Image) image.Image    { return rotate(src, gift.Rotate270()) }
+func rotate90cw(src image.Image) image.Image     { return rotate(src, gift.Rotate90()) }
+func rotate180(src image.Image) image.Image      { return rotate(src, gift.Rotate180()) }
+func transpose(src image.Image) image.Image      { return rotate(src, gift.Transpose()) }
+func transverse(src image.Image) image.Image     { return rotate(src, gift.Transverse()) }
+
+func rotate(src image.Image, filter gift.Filter) image.Image {
+	g := gift.New(filter)
+	var dst draw.Image
+	switch src.(type) {
+	case *image.Gray:
+		dst = image.NewGray(g.Bounds(src.Bounds()))
+	default:
+		dst = image.NewRGBA(g.Bounds(src.Bounds()))
+	}
+	g.Draw(dst, src)
+	return dst
+}
@@ -0,0 +1,79 @@
+package resize
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+func init() {
+	image.RegisterFormat("svg", "<svg", decodeSVG, decodeSVGConfig)
+	image.RegisterFormat("svg", "<?xml", decodeSVG, decodeSVGConfig)
+}
+
+// readSVG parses svg document, failing if it has no dimensions
+func readSVG(r io.Reader) (*oksvg.SvgIcon, error) {
+	icon, err := oksvg.ReadIconStream(r)
+	if err != nil {
+		return nil, err
+	}
+	if w, h := icon.ViewBox.W, icon.ViewBox.H; !(w > 0 && h > 0) || w*h > PixelLimit {
+		return nil, errors.New("svg has no valid dimensions")
+	}
+	return icon, nil
+}
+
+func decodeSVGConfig(r io.Reader) (image.Config, error) {
+	icon, err := readSVG(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{
+		ColorModel: color.RGBAModel,
+		Width:      int(math.Ceil(icon.ViewBox.W)),
+		Height:     int(math.Ceil(icon.ViewBox.H)),
+	}, nil
+}
+
+func decodeSVG(r io.Reader) (image.Image, error) {
+	icon, err := readSVG(r)
+	if err != nil {
+		return nil, err
+	}
+	return rasterizeSVG(icon, 1), nil
+}
+
+// rasterizeSVG draws svg icon scaled by given factor
+func rasterizeSVG(icon *oksvg.SvgIcon, scale float64) image.Image {
+	w := int(math.Max(math.Ceil(icon.ViewBox.W*scale), 1))
+	h := int(math.Max(math.Ceil(icon.ViewBox.H*scale), 1))
+	icon.SetTarget(0, 0, float64(w), float64(h))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	scanner := rasterx.NewScannerGV(w, h, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+	return img
+}
+
+// decodeSVGSized rasterizes svg document read from r so that the shorter
+// side of the result is side pixels long, keeping it within PixelLimit. If
+// side is not positive, document is rasterized at its own size.
+func decodeSVGSized(r io.Reader, side int) (image.Image, error) {
+	icon, err := readSVG(r)
+	if err != nil {
+		return nil, err
+	}
+	w, h := icon.ViewBox.W, icon.ViewBox.H
+	scale := 1.0
+	if side > 0 {
+		scale = float64(side) / math.Min(w, h)
+	}
+	if limit := math.Sqrt(PixelLimit / (w * h)); scale > limit {
+		scale = limit
+	}
+	return rasterizeSVG(icon, scale), nil
+}
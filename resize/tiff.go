@@ -0,0 +1,129 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+
+	"golang.org/x/image/tiff"
+)
+
+// tiffCompression lists supported Options.TiffCompression values
+var tiffCompression = map[string]bool{"": true, "deflate": true, "lzw": true, "none": true}
+
+// encodeTIFF writes img to w as tiff with given compression, deflate if
+// compression is empty
+func encodeTIFF(w io.Writer, img image.Image, compression string) error {
+	switch compression {
+	case "", "deflate":
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate})
+	case "none":
+		return tiff.Encode(w, img, nil)
+	}
+	// tiff package cannot write lzw, so its uncompressed output is
+	// rewritten with pixel data compressed
+	buf := new(bytes.Buffer)
+	if err := tiff.Encode(buf, img, nil); err != nil {
+		return err
+	}
+	data, err := compressTIFFStrip(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// compressTIFFStrip takes uncompressed tiff as written by tiff.Encode, with
+// pixel data stored in a single strip right after the header and followed by
+// the only IFD, and returns it with pixel data compressed with lzw
+func compressTIFFStrip(data []byte) ([]byte, error) {
+	bo := tiffByteOrder(data)
+	if bo == nil {
+		return nil, errors.New("invalid tiff data")
+	}
+	ifd := int(bo.Uint32(data[4:]))
+	if ifd < 8 || ifd > len(data) {
+		return nil, errors.New("invalid tiff data")
+	}
+	strip := tiffLZW(data[8:ifd])
+	delta := len(strip) - (ifd - 8)
+	out := make([]byte, 0, len(data)+delta)
+	out = append(out, data[:8]...)
+	bo.PutUint32(out[4:], uint32(ifd+delta))
+	out = append(out, strip...)
+	out = append(out, data[ifd:]...)
+	tiffEntries(out, func(bo binary.ByteOrder, e int) {
+		tag, typ := bo.Uint16(out[e:]), bo.Uint16(out[e+2:])
+		switch tag {
+		case 0x0103: // Compression
+			bo.PutUint16(out[e+8:], 5)
+			return
+		case 0x0117: // StripByteCounts
+			bo.PutUint32(out[e+8:], uint32(len(strip)))
+			return
+		}
+		if tiffTypeSizes[typ]*int(bo.Uint32(out[e+4:])) > 4 {
+			bo.PutUint32(out[e+8:], uint32(int(bo.Uint32(out[e+8:]))+delta))
+		}
+	})
+	return out, nil
+}
+
+// tiffLZW returns data compressed with lzw variant used by tiff: codes are
+// packed most significant bit first and their width grows one code earlier
+// than in compress/lzw
+func tiffLZW(data []byte) []byte {
+	const (
+		clearCode = 256
+		eoiCode   = 257
+		maxCode   = 4094
+	)
+	out := make([]byte, 0, len(data)/2)
+	var acc uint32
+	var nbits, width uint
+	put := func(code int) {
+		acc = acc<<width | uint32(code)
+		for nbits += width; nbits >= 8; nbits -= 8 {
+			out = append(out, byte(acc>>(nbits-8)))
+		}
+	}
+	var table map[uint32]int
+	var next int
+	reset := func() {
+		put(clearCode)
+		table, next, width = make(map[uint32]int), eoiCode+1, 9
+	}
+	width = 9
+	reset()
+	prefix := -1
+	for _, c := range data {
+		if prefix < 0 {
+			prefix = int(c)
+			continue
+		}
+		key := uint32(prefix)<<8 | uint32(c)
+		if code, ok := table[key]; ok {
+			prefix = code
+			continue
+		}
+		put(prefix)
+		prefix = int(c)
+		table[key] = next
+		if next++; next == maxCode {
+			reset()
+		} else if next == 1<<width {
+			width++
+		}
+	}
+	if prefix >= 0 {
+		put(prefix)
+	}
+	put(eoiCode)
+	if nbits > 0 {
+		out = append(out, byte(acc<<(8-nbits)))
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+package resize
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+)
+
+// trimRect returns bounds of img with borders of the same color as its
+// top-left pixel removed. Colors differing from it by at most fuzz percents
+// per channel are considered the same; all fully transparent pixels are
+// considered the same regardless of their color. If the whole image is of
+// border color, its bounds are returned as is.
+func trimRect(img image.Image, fuzz float64) image.Rectangle {
+	b := img.Bounds()
+	if b.Empty() {
+		return b
+	}
+	ref := color.NRGBAModel.Convert(img.At(b.Min.X, b.Min.Y)).(color.NRGBA)
+	tolerance := int(fuzz * 255 / 100)
+	border := func(x, y int) bool {
+		c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+		if c.A == 0 && ref.A == 0 {
+			return true
+		}
+		return abs(int(c.R)-int(ref.R)) <= tolerance && abs(int(c.G)-int(ref.G)) <= tolerance &&
+			abs(int(c.B)-int(ref.B)) <= tolerance && abs(int(c.A)-int(ref.A)) <= tolerance
+	}
+	row := func(y, x0, x1 int) bool {
+		for x := x0; x < x1; x++ {
+			if !border(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	col := func(x, y0, y1 int) bool {
+		for y := y0; y < y1; y++ {
+			if !border(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	r := b
+	for r.Min.Y < r.Max.Y && row(r.Min.Y, r.Min.X, r.Max.X) {
+		r.Min.Y++
+	}
+	if r.Empty() {
+		return b
+	}
+	for row(r.Max.Y-1, r.Min.X, r.Max.X) {
+		r.Max.Y--
+	}
+	for col(r.Min.X, r.Min.Y, r.Max.Y) {
+		r.Min.X++
+	}
+	for col(r.Max.X-1, r.Min.Y, r.Max.Y) {
+		r.Max.X--
+	}
+	return r
+}
+
+// animationTrimRect returns union of trimRect results for every frame of
+// animated gif composed over previous frames
+func animationTrimRect(a *animation, fuzz float64) image.Rectangle {
+	canvas := image.NewRGBA(a.bounds)
+	var area image.Rectangle
+	for i, frame := range a.frames {
+		disposal := a.disposal[i]
+		var prev *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			prev = cloneRGBA(canvas)
+		}
+		a.drawFrame(canvas, i)
+		area = area.Union(trimRect(canvas, fuzz))
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = prev
+		}
+	}
+	return area
+}
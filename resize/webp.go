@@ -0,0 +1,812 @@
+package resize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"golang.org/x/image/vp8"
+	"golang.org/x/image/vp8l"
+)
+
+// This file implements WebP decoder wrapping golang.org/x/image/vp8 and
+// golang.org/x/image/vp8l packages, and lossless WebP (VP8L) encoder, see
+// https://developers.google.com/speed/webp/docs/riff_container and
+// https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+//
+// Unlike golang.org/x/image/webp, decoder supports extended format files
+// carrying ICC profile or metadata.
+//
+// Encoder applies subtract green and predictor transforms, then writes pixels
+// using LZ77 backward references and a single set of prefix codes for the
+// whole image.
+
+func init() {
+	image.RegisterFormat("webp", "RIFF????WEBPVP8", decodeWebP, decodeWebPConfig)
+}
+
+var errInvalidWebP = errors.New("webp: invalid format")
+
+func decodeWebPConfig(r io.Reader) (image.Config, error) {
+	var b [30]byte
+	if n, err := io.ReadFull(r, b[:]); err != nil && (err != io.ErrUnexpectedEOF || n < 25) {
+		return image.Config{}, err
+	}
+	if string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return image.Config{}, errInvalidWebP
+	}
+	p := b[20:]
+	switch string(b[12:16]) {
+	case "VP8X":
+		return image.Config{
+			ColorModel: color.NRGBAModel,
+			Width:      1 + (int(p[4]) | int(p[5])<<8 | int(p[6])<<16),
+			Height:     1 + (int(p[7]) | int(p[8])<<8 | int(p[9])<<16),
+		}, nil
+	case "VP8L":
+		return vp8l.DecodeConfig(bytes.NewReader(p))
+	case "VP8 ":
+		if p[3] != 0x9d || p[4] != 0x01 || p[5] != 0x2a {
+			return image.Config{}, errInvalidWebP
+		}
+		return image.Config{
+			ColorModel: color.YCbCrModel,
+			Width:      int(binary.LittleEndian.Uint16(p[6:]) & 0x3fff),
+			Height:     int(binary.LittleEndian.Uint16(p[8:]) & 0x3fff),
+		}, nil
+	}
+	return image.Config{}, errInvalidWebP
+}
+
+func decodeWebP(r io.Reader) (image.Image, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxFileSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errInvalidWebP
+	}
+	var alpha []byte
+	var width, height int
+	for i := 12; i+8 <= len(data); {
+		n := int(binary.LittleEndian.Uint32(data[i+4:]))
+		if n < 0 || i+8+n > len(data) {
+			return nil, errInvalidWebP
+		}
+		p := data[i+8 : i+8+n]
+		switch string(data[i : i+4]) {
+		case "VP8X":
+			if n < 10 {
+				return nil, errInvalidWebP
+			}
+			if p[0]&0x02 != 0 {
+				return nil, errors.New("webp: animation is not supported")
+			}
+			width = 1 + (int(p[4]) | int(p[5])<<8 | int(p[6])<<16)
+			height = 1 + (int(p[7]) | int(p[8])<<8 | int(p[9])<<16)
+		case "ALPH":
+			if alpha, err = decodeWebPAlpha(p, width, height); err != nil {
+				return nil, err
+			}
+		case "VP8L":
+			return vp8l.Decode(bytes.NewReader(p))
+		case "VP8 ":
+			d := vp8.NewDecoder()
+			d.Init(bytes.NewReader(p), n)
+			if _, err := d.DecodeFrameHeader(); err != nil {
+				return nil, err
+			}
+			m, err := d.DecodeFrame()
+			if err != nil {
+				return nil, err
+			}
+			if alpha == nil {
+				return m, nil
+			}
+			if m.Rect.Dx() != width || m.Rect.Dy() != height {
+				return nil, errInvalidWebP
+			}
+			return &image.NYCbCrA{YCbCr: *m, A: alpha, AStride: width}, nil
+		}
+		i += 8 + n + n&1
+	}
+	return nil, errInvalidWebP
+}
+
+// decodeWebPAlpha decodes ALPH chunk payload
+func decodeWebPAlpha(p []byte, width, height int) ([]byte, error) {
+	if len(p) < 1 || width < 1 || height < 1 {
+		return nil, errInvalidWebP
+	}
+	var alpha []byte
+	switch p[0] & 0x03 {
+	case 0:
+		if len(p) < 1+width*height {
+			return nil, errInvalidWebP
+		}
+		alpha = append([]byte(nil), p[1:1+width*height]...)
+	case 1:
+		// alpha is stored as green channel of headerless VP8L image
+		hdr := []byte{0x2f, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(hdr[1:], uint32(width-1)|uint32(height-1)<<14)
+		img, err := vp8l.Decode(io.MultiReader(bytes.NewReader(hdr), bytes.NewReader(p[1:])))
+		if err != nil {
+			return nil, err
+		}
+		pix := img.(*image.NRGBA).Pix
+		alpha = make([]byte, width*height)
+		for i := range alpha {
+			alpha[i] = pix[4*i+1]
+		}
+	default:
+		return nil, errInvalidWebP
+	}
+	filter := p[0] >> 2 & 0x03
+	if filter == 0 {
+		return alpha, nil
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			var pred byte
+			switch {
+			case x == 0 && y == 0:
+				continue
+			case y == 0:
+				pred = alpha[i-1]
+			case x == 0:
+				pred = alpha[i-width]
+			case filter == 1:
+				pred = alpha[i-1]
+			case filter == 2:
+				pred = alpha[i-width]
+			default:
+				pred = clamp255(int(alpha[i-1]) + int(alpha[i-width]) - int(alpha[i-width-1]))
+			}
+			alpha[i] += pred
+		}
+	}
+	return alpha, nil
+}
+
+// encodeWebP writes img to w as lossless WebP image
+func encodeWebP(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > 1<<14 || height > 1<<14 {
+		return errors.New("webp: image dimensions are out of supported range")
+	}
+	src := ToNRGBA(img)
+	pix := make([]byte, 0, 4*width*height)
+	alpha := false
+	for y := 0; y < height; y++ {
+		i := src.PixOffset(b.Min.X, b.Min.Y+y)
+		row := src.Pix[i : i+4*width]
+		for x := 3; x < len(row) && !alpha; x += 4 {
+			alpha = row[x] != 0xff
+		}
+		pix = append(pix, row...)
+	}
+
+	bw := &bitWriter{}
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if alpha {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3) // version
+
+	// subtract green transform
+	bw.write(1, 1)
+	bw.write(2, 2)
+	for i := 0; i < len(pix); i += 4 {
+		pix[i] -= pix[i+1]
+		pix[i+2] -= pix[i+1]
+	}
+	// predictor transform
+	bw.write(1, 1)
+	bw.write(0, 2)
+	bw.write(vp8lTileBits-2, 3)
+	modes, tw, th := predictorModes(pix, width, height)
+	writeEntropyImage(bw, modes, tw, th, false)
+	pix = predictorResiduals(pix, width, height, modes)
+	bw.write(0, 1) // no more transforms
+
+	writeEntropyImage(bw, pix, width, height, true)
+	data := bw.bytes()
+
+	hdr := make([]byte, 20)
+	copy(hdr, "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(4+8+len(data)+len(data)&1))
+	copy(hdr[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(len(data)))
+	if len(data)&1 == 1 {
+		data = append(data, 0)
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// vp8lTileBits is log-2 size of predictor transform tiles
+const vp8lTileBits = 4
+
+// predictorModes selects predictor mode for each tile of RGBA pixels,
+// picking the one giving smallest residuals. Modes are returned as RGBA
+// image of tw×th size with mode stored in green channel.
+func predictorModes(pix []byte, width, height int) (modes []byte, tw, th int) {
+	tw = (width + 1<<vp8lTileBits - 1) >> vp8lTileBits
+	th = (height + 1<<vp8lTileBits - 1) >> vp8lTileBits
+	modes = make([]byte, 4*tw*th)
+	for ty := 0; ty < th; ty++ {
+		for tx := 0; tx < tw; tx++ {
+			best, bestCost := 0, -1
+			for mode := 0; mode < 14; mode++ {
+				cost := 0
+				for y := ty << vp8lTileBits; y < height && y < (ty+1)<<vp8lTileBits; y++ {
+					if y == 0 {
+						continue
+					}
+					for x := tx << vp8lTileBits; x < width && x < (tx+1)<<vp8lTileBits; x++ {
+						if x == 0 {
+							continue
+						}
+						p := 4 * (y*width + x)
+						pred := predict(uint8(mode), pix, p, p-4*width)
+						for c := 0; c < 4; c++ {
+							cost += abs(int(int8(pix[p+c] - pred[c])))
+						}
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[4*(ty*tw+tx)+1] = uint8(best)
+		}
+	}
+	return modes, tw, th
+}
+
+// predictorResiduals returns differences between RGBA pixels and their
+// predicted values
+func predictorResiduals(pix []byte, width, height int, modes []byte) []byte {
+	out := make([]byte, len(pix))
+	tw := (width + 1<<vp8lTileBits - 1) >> vp8lTileBits
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := 4 * (y*width + x)
+			var pred [4]byte
+			switch {
+			case x == 0 && y == 0:
+				pred = [4]byte{0, 0, 0, 0xff}
+			case y == 0:
+				copy(pred[:], pix[p-4:p])
+			case x == 0:
+				copy(pred[:], pix[p-4*width:p-4*width+4])
+			default:
+				mode := modes[4*((y>>vp8lTileBits)*tw+x>>vp8lTileBits)+1]
+				pred = predict(mode, pix, p, p-4*width)
+			}
+			for c := 0; c < 4; c++ {
+				out[p+c] = pix[p+c] - pred[c]
+			}
+		}
+	}
+	return out
+}
+
+// predict returns prediction of pixel at offset p in RGBA pix using given
+// predictor mode; top is offset of pixel above p
+func predict(mode uint8, pix []byte, p, top int) [4]byte {
+	var out [4]byte
+	l, t, tl, tr := pix[p-4:p], pix[top:top+4], pix[top-4:top], pix[top+4:top+8]
+	if mode == 11 { // Select(L, T, TL)
+		var pl, pt int
+		for c := 0; c < 4; c++ {
+			pl += abs(int(tl[c]) - int(t[c]))
+			pt += abs(int(tl[c]) - int(l[c]))
+		}
+		if pl < pt {
+			copy(out[:], l)
+		} else {
+			copy(out[:], t)
+		}
+		return out
+	}
+	for c := 0; c < 4; c++ {
+		switch mode {
+		case 0:
+			if c == 3 {
+				out[c] = 0xff
+			}
+		case 1:
+			out[c] = l[c]
+		case 2:
+			out[c] = t[c]
+		case 3:
+			out[c] = tr[c]
+		case 4:
+			out[c] = tl[c]
+		case 5:
+			out[c] = avg2(avg2(l[c], tr[c]), t[c])
+		case 6:
+			out[c] = avg2(l[c], tl[c])
+		case 7:
+			out[c] = avg2(l[c], t[c])
+		case 8:
+			out[c] = avg2(tl[c], t[c])
+		case 9:
+			out[c] = avg2(t[c], tr[c])
+		case 10:
+			out[c] = avg2(avg2(l[c], tl[c]), avg2(t[c], tr[c]))
+		case 12:
+			out[c] = clamp255(int(l[c]) + int(t[c]) - int(tl[c]))
+		case 13:
+			a := int(avg2(l[c], t[c]))
+			out[c] = clamp255(a + (a-int(tl[c]))/2)
+		}
+	}
+	return out
+}
+
+func avg2(a, b uint8) uint8 { return uint8((uint16(a) + uint16(b)) / 2) }
+
+func clamp255(v int) uint8 {
+	switch {
+	case v < 0:
+		return 0
+	case v > 255:
+		return 255
+	}
+	return uint8(v)
+}
+
+const (
+	vp8lLiterals     = 256
+	vp8lLengthCodes  = 24
+	vp8lDistCodes    = 40
+	vp8lMaxLength    = 4096
+	vp8lMinLength    = 3
+	vp8lMaxChain     = 32
+	vp8lDistOffset   = 120
+	vp8lMaxDistance  = 1<<20 - vp8lDistOffset
+	vp8lHashBits     = 16
+	vp8lMaxCodeBits  = 15
+	vp8lMaxCLCodeLen = 7
+)
+
+// vp8lToken is either a literal pixel (length is 0), or a backward
+// reference
+type vp8lToken struct {
+	pos      int // literal pixel index
+	length   int
+	distCode int
+}
+
+// writeEntropyImage writes RGBA pixels of width×height image as
+// entropy-coded image without color cache
+func writeEntropyImage(bw *bitWriter, pix []byte, width, height int, topLevel bool) {
+	bw.write(0, 1) // no color cache
+	if topLevel {
+		bw.write(0, 1) // no meta prefix codes
+	}
+	tokens := lz77(pix, width)
+	var hist [5][]int
+	hist[0] = make([]int, vp8lLiterals+vp8lLengthCodes)
+	hist[1] = make([]int, vp8lLiterals)
+	hist[2] = make([]int, vp8lLiterals)
+	hist[3] = make([]int, vp8lLiterals)
+	hist[4] = make([]int, vp8lDistCodes)
+	for _, t := range tokens {
+		if t.length == 0 {
+			p := 4 * t.pos
+			hist[0][pix[p+1]]++
+			hist[1][pix[p]]++
+			hist[2][pix[p+2]]++
+			hist[3][pix[p+3]]++
+			continue
+		}
+		sym, _, _ := prefixEncode(t.length)
+		hist[0][vp8lLiterals+sym]++
+		sym, _, _ = prefixEncode(t.distCode)
+		hist[4][sym]++
+	}
+	var codes [5]*prefixCode
+	for i := range codes {
+		codes[i] = newPrefixCode(hist[i], vp8lMaxCodeBits)
+		codes[i].writeTo(bw)
+	}
+	for _, t := range tokens {
+		if t.length == 0 {
+			p := 4 * t.pos
+			codes[0].put(bw, int(pix[p+1]))
+			codes[1].put(bw, int(pix[p]))
+			codes[2].put(bw, int(pix[p+2]))
+			codes[3].put(bw, int(pix[p+3]))
+			continue
+		}
+		sym, n, extra := prefixEncode(t.length)
+		codes[0].put(bw, vp8lLiterals+sym)
+		bw.write(extra, n)
+		sym, n, extra = prefixEncode(t.distCode)
+		codes[4].put(bw, sym)
+		bw.write(extra, n)
+	}
+}
+
+// lz77 splits RGBA pixels into literals and backward references using greedy
+// hash chain matching
+func lz77(pix []byte, width int) []vp8lToken {
+	n := len(pix) / 4
+	argb := make([]uint32, n)
+	for i := range argb {
+		argb[i] = binary.LittleEndian.Uint32(pix[4*i:])
+	}
+	distCodes := make(map[int]int, vp8lDistOffset)
+	for code := vp8lDistOffset; code > 0; code-- {
+		distCodes[planeDistance(width, code)] = code
+	}
+	hash := func(i int) int {
+		return int(((argb[i]*0x1e35a7bd)^(argb[i+1]*0x9e3779b1))>>(32-vp8lHashBits)) & (1<<vp8lHashBits - 1)
+	}
+	head := make([]int32, 1<<vp8lHashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, n)
+	insert := func(i int) {
+		if i+1 >= n {
+			return
+		}
+		h := hash(i)
+		prev[i] = head[h]
+		head[h] = int32(i)
+	}
+	matchLen := func(i, j int) int {
+		l := 0
+		for i+l < n && l < vp8lMaxLength && argb[i+l] == argb[j+l] {
+			l++
+		}
+		return l
+	}
+	tokens := make([]vp8lToken, 0, n/2)
+	for i := 0; i < n; {
+		bestLen, bestDist := 0, 0
+		for _, d := range [...]int{1, width} {
+			if d <= i {
+				if l := matchLen(i, i-d); l > bestLen {
+					bestLen, bestDist = l, d
+				}
+			}
+		}
+		if i+1 < n {
+			for j, k := int(head[hash(i)]), 0; j >= 0 && k < vp8lMaxChain && i-j <= vp8lMaxDistance; j, k = int(prev[j]), k+1 {
+				if l := matchLen(i, j); l > bestLen {
+					bestLen, bestDist = l, i-j
+				}
+			}
+		}
+		if bestLen < vp8lMinLength {
+			tokens = append(tokens, vp8lToken{pos: i})
+			insert(i)
+			i++
+			continue
+		}
+		code, ok := distCodes[bestDist]
+		if !ok {
+			code = bestDist + vp8lDistOffset
+		}
+		tokens = append(tokens, vp8lToken{length: bestLen, distCode: code})
+		for k := 0; k < bestLen; k++ {
+			insert(i + k)
+		}
+		i += bestLen
+	}
+	return tokens
+}
+
+// planeDistance returns linear distance matching distance code 1-120, see
+// section 4.2.2 of specification
+func planeDistance(width, code int) int {
+	dy, dx := vp8lDistanceMap[code-1]>>4, 8-int(vp8lDistanceMap[code-1]&0xf)
+	if d := int(dy)*width + dx; d >= 1 {
+		return d
+	}
+	return 1
+}
+
+var vp8lDistanceMap = [vp8lDistOffset]uint8{
+	0x18, 0x07, 0x17, 0x19, 0x28, 0x06, 0x27, 0x29, 0x16, 0x1a,
+	0x26, 0x2a, 0x38, 0x05, 0x37, 0x39, 0x15, 0x1b, 0x36, 0x3a,
+	0x25, 0x2b, 0x48, 0x04, 0x47, 0x49, 0x14, 0x1c, 0x35, 0x3b,
+	0x46, 0x4a, 0x24, 0x2c, 0x58, 0x45, 0x4b, 0x34, 0x3c, 0x03,
+	0x57, 0x59, 0x13, 0x1d, 0x56, 0x5a, 0x23, 0x2d, 0x44, 0x4c,
+	0x55, 0x5b, 0x33, 0x3d, 0x68, 0x02, 0x67, 0x69, 0x12, 0x1e,
+	0x66, 0x6a, 0x22, 0x2e, 0x54, 0x5c, 0x43, 0x4d, 0x65, 0x6b,
+	0x32, 0x3e, 0x78, 0x01, 0x77, 0x79, 0x53, 0x5d, 0x11, 0x1f,
+	0x64, 0x6c, 0x42, 0x4e, 0x76, 0x7a, 0x21, 0x2f, 0x75, 0x7b,
+	0x31, 0x3f, 0x63, 0x6d, 0x52, 0x5e, 0x00, 0x74, 0x7c, 0x41,
+	0x4f, 0x10, 0x20, 0x62, 0x6e, 0x30, 0x73, 0x7d, 0x51, 0x5f,
+	0x40, 0x72, 0x7e, 0x61, 0x6f, 0x50, 0x71, 0x7f, 0x60, 0x70,
+}
+
+// prefixEncode returns prefix symbol, number of extra bits and extra bits
+// value for LZ77 length or distance code v (v >= 1)
+func prefixEncode(v int) (sym int, nbits uint, extra uint32) {
+	v--
+	if v < 4 {
+		return v, 0, 0
+	}
+	hb := uint(0)
+	for x := v; x > 1; x >>= 1 {
+		hb++
+	}
+	second := (v >> (hb - 1)) & 1
+	nbits = hb - 1
+	return int(2*hb) + second, nbits, uint32(v) & (1<<nbits - 1)
+}
+
+// prefixCode is a canonical Huffman code
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint32 // bit-reversed, ready to be written LSB first
+	used    []int    // symbols with non-zero frequency
+}
+
+// newPrefixCode builds prefix code for given symbol frequencies with code
+// lengths not exceeding maxBits
+func newPrefixCode(freq []int, maxBits uint8) *prefixCode {
+	pc := &prefixCode{lengths: huffmanLengths(freq, maxBits)}
+	for sym, f := range freq {
+		if f > 0 {
+			pc.used = append(pc.used, sym)
+		}
+	}
+	if len(pc.used) < 2 {
+		// single symbol codes take zero bits
+		return pc
+	}
+	pc.codes = canonicalCodes(pc.lengths)
+	return pc
+}
+
+// put writes code of symbol sym
+func (pc *prefixCode) put(bw *bitWriter, sym int) {
+	if pc.codes == nil {
+		return
+	}
+	bw.write(pc.codes[sym], uint(pc.lengths[sym]))
+}
+
+// writeTo writes code definition, see section 5.2.2 of specification
+func (pc *prefixCode) writeTo(bw *bitWriter) {
+	if len(pc.used) <= 2 && (len(pc.used) == 0 || pc.used[len(pc.used)-1] < 256) {
+		// simple code length code
+		syms := pc.used
+		if len(syms) == 0 {
+			syms = []int{0}
+		}
+		bw.write(1, 1)
+		bw.write(uint32(len(syms)-1), 1)
+		if syms[0] < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(syms[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(syms[0]), 8)
+		}
+		if len(syms) == 2 {
+			bw.write(uint32(syms[1]), 8)
+		}
+		return
+	}
+	lengths := pc.lengths
+	if len(pc.used) == 1 {
+		lengths = make([]uint8, len(pc.lengths))
+		lengths[pc.used[0]] = 1
+	}
+	// run-length encode code lengths with symbols 0-15 (literal lengths),
+	// 16 (repeat previous 3-6 times), 17 (3-10 zeros), 18 (11-138 zeros)
+	type clToken struct {
+		sym   int
+		extra uint32
+	}
+	var tokens []clToken
+	var clFreq [19]int
+	for i := 0; i < len(lengths); {
+		v := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == v {
+			run++
+		}
+		switch {
+		case v == 0 && run >= 11:
+			if run > 138 {
+				run = 138
+			}
+			tokens = append(tokens, clToken{18, uint32(run - 11)})
+		case v == 0 && run >= 3:
+			if run > 10 {
+				run = 10
+			}
+			tokens = append(tokens, clToken{17, uint32(run - 3)})
+		case v != 0 && i > 0 && lengths[i-1] == v && run >= 3:
+			if run > 6 {
+				run = 6
+			}
+			tokens = append(tokens, clToken{16, uint32(run - 3)})
+		default:
+			run = 1
+			tokens = append(tokens, clToken{int(v), 0})
+		}
+		clFreq[tokens[len(tokens)-1].sym]++
+		i += run
+	}
+	clCode := newPrefixCode(clFreq[:], vp8lMaxCLCodeLen)
+	clLengths := clCode.lengths
+	if len(clCode.used) == 1 {
+		clLengths = make([]uint8, len(clFreq))
+		clLengths[clCode.used[0]] = 1
+	}
+	n := len(codeLengthCodeOrder)
+	for n > 4 && clLengths[codeLengthCodeOrder[n-1]] == 0 {
+		n--
+	}
+	bw.write(0, 1) // normal code
+	bw.write(uint32(n-4), 4)
+	for _, sym := range codeLengthCodeOrder[:n] {
+		bw.write(uint32(clLengths[sym]), 3)
+	}
+	bw.write(0, 1) // max_symbol is alphabet size
+	for _, t := range tokens {
+		clCode.put(bw, t.sym)
+		switch t.sym {
+		case 16:
+			bw.write(t.extra, 2)
+		case 17:
+			bw.write(t.extra, 3)
+		case 18:
+			bw.write(t.extra, 7)
+		}
+	}
+}
+
+var codeLengthCodeOrder = [19]uint8{
+	17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// huffmanLengths returns Huffman code lengths for given symbol frequencies
+// limited to maxBits. If lengths exceed the limit, frequencies are halved
+// and code is rebuilt.
+func huffmanLengths(freq []int, maxBits uint8) []uint8 {
+	type node struct {
+		freq   int
+		parent int
+	}
+	lengths := make([]uint8, len(freq))
+	f := append([]int(nil), freq...)
+	for {
+		var syms []int
+		for sym, v := range f {
+			if v > 0 {
+				syms = append(syms, sym)
+			}
+		}
+		if len(syms) < 2 {
+			for _, sym := range syms {
+				lengths[sym] = 1
+			}
+			return lengths
+		}
+		sort.SliceStable(syms, func(i, j int) bool { return f[syms[i]] < f[syms[j]] })
+		// two-queue Huffman construction: leaves are sorted by frequency,
+		// internal nodes are created in non-decreasing frequency order
+		nodes := make([]node, 0, 2*len(syms)-1)
+		for _, sym := range syms {
+			nodes = append(nodes, node{freq: f[sym], parent: -1})
+		}
+		leaf, inner := 0, len(syms)
+		pick := func() int {
+			if leaf < len(syms) && (inner >= len(nodes) || nodes[leaf].freq <= nodes[inner].freq) {
+				leaf++
+				return leaf - 1
+			}
+			inner++
+			return inner - 1
+		}
+		for len(nodes) < 2*len(syms)-1 {
+			a, b := pick(), pick()
+			nodes = append(nodes, node{freq: nodes[a].freq + nodes[b].freq, parent: -1})
+			nodes[a].parent = len(nodes) - 1
+			nodes[b].parent = len(nodes) - 1
+		}
+		depth := make([]uint8, len(nodes))
+		for i := len(nodes) - 2; i >= 0; i-- {
+			depth[i] = depth[nodes[i].parent] + 1
+		}
+		ok := true
+		for i, sym := range syms {
+			if depth[i] > maxBits {
+				ok = false
+				break
+			}
+			lengths[sym] = depth[i]
+		}
+		if ok {
+			return lengths
+		}
+		for sym, v := range f {
+			if v > 0 {
+				f[sym] = (v + 1) / 2
+			}
+		}
+	}
+}
+
+// canonicalCodes returns bit-reversed canonical Huffman codes for given code
+// lengths
+func canonicalCodes(lengths []uint8) []uint32 {
+	var count [vp8lMaxCodeBits + 1]uint32
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [vp8lMaxCodeBits + 1]uint32
+	code := uint32(0)
+	for l := 1; l <= vp8lMaxCodeBits; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	codes := make([]uint32, len(lengths))
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		var rev uint32
+		for i := uint8(0); i < l; i++ {
+			rev = rev<<1 | c&1
+			c >>= 1
+		}
+		codes[sym] = rev
+	}
+	return codes
+}
+
+// bitWriter accumulates bits LSB first
+type bitWriter struct {
+	buf   bytes.Buffer
+	bits  uint64
+	nbits uint
+}
+
+func (bw *bitWriter) write(v uint32, n uint) {
+	bw.bits |= uint64(v) << bw.nbits
+	bw.nbits += n
+	for bw.nbits >= 8 {
+		bw.buf.WriteByte(byte(bw.bits))
+		bw.bits >>= 8
+		bw.nbits -= 8
+	}
+}
+
+// bytes flushes pending bits and returns written data
+func (bw *bitWriter) bytes() []byte {
+	if bw.nbits > 0 {
+		bw.buf.WriteByte(byte(bw.bits))
+		bw.bits, bw.nbits = 0, 0
+	}
+	return bw.buf.Bytes()
+}
@@ -0,0 +1,60 @@
+package resize
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestEncodeWebP(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, size := range []image.Point{{1, 1}, {7, 3}, {3, 7}, {64, 64}, {333, 217}} {
+		for _, alpha := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%dx%d/alpha=%v", size.X, size.Y, alpha), func(t *testing.T) {
+				img := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+				for y := 0; y < size.Y; y++ {
+					for x := 0; x < size.X; x++ {
+						// gradients for predictors, repeated tiles for
+						// backward references, noise for the rest
+						c := color.NRGBA{uint8(x), uint8(y), uint8(x/8*8 + y/8*8), 255}
+						if x > size.X/2 {
+							c.B = uint8(rnd.Intn(256))
+						}
+						if alpha {
+							c.A = uint8(x * y)
+						}
+						img.SetNRGBA(x, y, c)
+					}
+				}
+				buf := new(bytes.Buffer)
+				if err := encodeWebP(buf, img); err != nil {
+					t.Fatal(err)
+				}
+				out, err := webp.Decode(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if out.Bounds() != img.Bounds() {
+					t.Fatalf("got %v bounds, want %v", out.Bounds(), img.Bounds())
+				}
+				for y := 0; y < size.Y; y++ {
+					for x := 0; x < size.X; x++ {
+						want := img.NRGBAAt(x, y)
+						got := color.NRGBAModel.Convert(out.At(x, y)).(color.NRGBA)
+						if want.A == 0 {
+							want, got = color.NRGBA{}, color.NRGBA{A: got.A}
+						}
+						if got != want {
+							t.Fatalf("pixel at %d,%d is %v, want %v", x, y, got, want)
+						}
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,5 @@
+// Package resizepb holds gRPC Resizer service and messages generated from
+// resize.proto.
+package resizepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative resize.proto
@@ -0,0 +1,180 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package resizepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ResizerClient is the client API for Resizer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ResizerClient interface {
+	// Resize transforms a single image; it is limited by the max. message
+	// size, use ResizeStream for large images
+	Resize(ctx context.Context, in *ResizeRequest, opts ...grpc.CallOption) (*ResizeResponse, error)
+	// ResizeStream takes image split into data of several messages, options
+	// are taken from the first one. The resulting image is sent back in
+	// chunks, only the first response message has format and dimensions set.
+	ResizeStream(ctx context.Context, opts ...grpc.CallOption) (Resizer_ResizeStreamClient, error)
+}
+
+type resizerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewResizerClient(cc grpc.ClientConnInterface) ResizerClient {
+	return &resizerClient{cc}
+}
+
+func (c *resizerClient) Resize(ctx context.Context, in *ResizeRequest, opts ...grpc.CallOption) (*ResizeResponse, error) {
+	out := new(ResizeResponse)
+	err := c.cc.Invoke(ctx, "/imageresize.Resizer/Resize", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *resizerClient) ResizeStream(ctx context.Context, opts ...grpc.CallOption) (Resizer_ResizeStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Resizer_ServiceDesc.Streams[0], "/imageresize.Resizer/ResizeStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &resizerResizeStreamClient{stream}
+	return x, nil
+}
+
+type Resizer_ResizeStreamClient interface {
+	Send(*ResizeRequest) error
+	Recv() (*ResizeResponse, error)
+	grpc.ClientStream
+}
+
+type resizerResizeStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *resizerResizeStreamClient) Send(m *ResizeRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *resizerResizeStreamClient) Recv() (*ResizeResponse, error) {
+	m := new(ResizeResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ResizerServer is the server API for Resizer service.
+// All implementations must embed UnimplementedResizerServer
+// for forward compatibility
+type ResizerServer interface {
+	// Resize transforms a single image; it is limited by the max. message
+	// size, use ResizeStream for large images
+	Resize(context.Context, *ResizeRequest) (*ResizeResponse, error)
+	// ResizeStream takes image split into data of several messages, options
+	// are taken from the first one. The resulting image is sent back in
+	// chunks, only the first response message has format and dimensions set.
+	ResizeStream(Resizer_ResizeStreamServer) error
+	mustEmbedUnimplementedResizerServer()
+}
+
+// UnimplementedResizerServer must be embedded to have forward compatible implementations.
+type UnimplementedResizerServer struct {
+}
+
+func (UnimplementedResizerServer) Resize(context.Context, *ResizeRequest) (*ResizeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Resize not implemented")
+}
+func (UnimplementedResizerServer) ResizeStream(Resizer_ResizeStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method ResizeStream not implemented")
+}
+func (UnimplementedResizerServer) mustEmbedUnimplementedResizerServer() {}
+
+// UnsafeResizerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ResizerServer will
+// result in compilation errors.
+type UnsafeResizerServer interface {
+	mustEmbedUnimplementedResizerServer()
+}
+
+func RegisterResizerServer(s grpc.ServiceRegistrar, srv ResizerServer) {
+	s.RegisterService(&Resizer_ServiceDesc, srv)
+}
+
+func _Resizer_Resize_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResizeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ResizerServer).Resize(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/imageresize.Resizer/Resize",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ResizerServer).Resize(ctx, req.(*ResizeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Resizer_ResizeStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ResizerServer).ResizeStream(&resizerResizeStreamServer{stream})
+}
+
+type Resizer_ResizeStreamServer interface {
+	Send(*ResizeResponse) error
+	Recv() (*ResizeRequest, error)
+	grpc.ServerStream
+}
+
+type resizerResizeStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *resizerResizeStreamServer) Send(m *ResizeResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *resizerResizeStreamServer) Recv() (*ResizeRequest, error) {
+	m := new(ResizeRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Resizer_ServiceDesc is the grpc.ServiceDesc for Resizer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Resizer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "imageresize.Resizer",
+	HandlerType: (*ResizerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Resize",
+			Handler:    _Resizer_Resize_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ResizeStream",
+			Handler:       _Resizer_ResizeStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "resize.proto",
+}
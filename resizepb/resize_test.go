@@ -0,0 +1,82 @@
+package resizepb
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, m := range []proto.Message{
+		&ResizeRequest{Data: []byte{1, 2, 3}, Options: &TransformOptions{
+			Width: 1, Height: 2, MaxWidth: 3, MaxHeight: 4, Format: "png",
+			Quality: 5, Fit: "cover", Gravity: "north",
+		}},
+		&ResizeResponse{Data: []byte{4, 5}, Format: "jpeg", Width: 6, Height: 7},
+	} {
+		b, err := proto.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := m.ProtoReflect().New().Interface()
+		if err := proto.Unmarshal(b, got); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(m, got) {
+			t.Errorf("got %v after round trip, want %v", got, m)
+		}
+	}
+}
+
+// TestMatchesProto checks that generated code is in sync with resize.proto,
+// comparing message fields with ones declared there
+func TestMatchesProto(t *testing.T) {
+	src, err := ioutil.ReadFile("resize.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgRe := regexp.MustCompile(`(?s)message (\w+) \{(.*?)\}`)
+	fieldRe := regexp.MustCompile(`(\w+) (\w+) = (\d+);`)
+	messages := map[string]protoreflect.MessageDescriptor{
+		"TransformOptions": (&TransformOptions{}).ProtoReflect().Descriptor(),
+		"ResizeRequest":    (&ResizeRequest{}).ProtoReflect().Descriptor(),
+		"ResizeResponse":   (&ResizeResponse{}).ProtoReflect().Descriptor(),
+	}
+	for _, m := range msgRe.FindAllSubmatch(src, -1) {
+		name := string(m[1])
+		md, ok := messages[name]
+		if !ok {
+			t.Errorf("message %s has no generated type", name)
+			continue
+		}
+		delete(messages, name)
+		fields := fieldRe.FindAllSubmatch(m[2], -1)
+		if len(fields) != md.Fields().Len() {
+			t.Errorf("%s: %d fields in resize.proto, %d generated", name, len(fields), md.Fields().Len())
+		}
+		for _, f := range fields {
+			fd := md.Fields().ByName(protoreflect.Name(f[2]))
+			if fd == nil {
+				t.Errorf("%s.%s is not generated", name, f[2])
+				continue
+			}
+			if n, _ := strconv.Atoi(string(f[3])); int(fd.Number()) != n {
+				t.Errorf("%s.%s: number %d in resize.proto, %d generated", name, f[2], n, fd.Number())
+			}
+			typ := fd.Kind().String()
+			if fd.Kind() == protoreflect.MessageKind {
+				typ = string(fd.Message().Name())
+			}
+			if typ != string(f[1]) {
+				t.Errorf("%s.%s: type %s in resize.proto, %s generated", name, f[2], f[1], typ)
+			}
+		}
+	}
+	for name := range messages {
+		t.Errorf("message %s is not declared in resize.proto", name)
+	}
+}
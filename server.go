@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artyom/image-resize/resize"
+)
+
+// serve runs HTTP server on par.Listen address, resizing uploaded or fetched
+// images on the fly. Options set by par are used as defaults that requests
+// can override with query parameters.
+func serve(par params) error {
+	opts, err := par.options()
+	if err != nil {
+		return err
+	}
+	if par.Format == "" {
+		opts.Format = "jpeg"
+	}
+	sizes, err := parseSizes(par.AllowSizes)
+	if err != nil {
+		return &resize.Error{Kind: resize.KindInvalidOptions, Err: err}
+	}
+	m, err := startMetrics(par)
+	if err != nil {
+		return err
+	}
+	h := &resizeHandler{opts: opts, client: publicClient(par.HTTPTimeout), timeout: par.Timeout,
+		metrics: m, key: []byte(os.Getenv(signingKeyEnv)), sizes: sizes, cacheControl: par.CacheControl}
+	if par.ServerCache != "" && par.ServerCacheSize <= 0 {
+		return &resize.Error{Kind: resize.KindInvalidOptions, Err: errors.New("server-cache requires positive server-cache-size")}
+	}
+	if par.ServerCache != "" || par.ServerCacheSize > 0 {
+		if h.cache, err = newResponseCache(int64(par.ServerCacheSize)<<20, par.ServerCache); err != nil {
+			return err
+		}
+	}
+	srv := &http.Server{
+		Addr:        par.Listen,
+		Handler:     h,
+		ReadTimeout: time.Minute,
+	}
+	return srv.ListenAndServe()
+}
+
+// resizeHandler resizes image either sent as request body (POST or PUT,
+// either raw or as "file" field of multipart form), or fetched from url
+// given as "url" query parameter, which may only point to public addresses
+// (see publicClient). Query parameters w, h, maxw, maxh, q and fmt override
+// default width, height, max. width, max. height, jpeg quality and output
+// format. If key is set, requests must be signed with it, see
+// requestSignature.
+type resizeHandler struct {
+	opts    resize.Options
+	client  *http.Client
+	timeout time.Duration // max. time to process single image, if positive
+	metrics *serverMetrics
+	key     []byte   // secret key to check request signatures with
+	sizes   sizeList // allowed dimensions, if not nil
+
+	cache        *responseCache // optional
+	cacheControl string         // Cache-Control header value
+
+	proc resize.Processor
+}
+
+func (h *resizeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(h.key) > 0 && !validSignature(h.key, r.URL.EscapedPath(), r.URL.Query()) {
+		h.metrics.fail(&resize.Error{Kind: resize.KindInvalidOptions, Err: errors.New("invalid signature")})
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+	opts, err := queryOptions(h.opts, r.URL.Query())
+	if err == nil {
+		err = h.sizes.check(r.URL.Query())
+	}
+	if err != nil {
+		h.metrics.fail(&resize.Error{Kind: resize.KindInvalidOptions, Err: err})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var src io.Reader
+	switch {
+	case r.Method == http.MethodPost || r.Method == http.MethodPut:
+		limit := int64(resize.MaxFileSize)
+		multipart := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+		if multipart {
+			limit += 1 << 20 // form encoding overhead
+		}
+		if r.ContentLength > limit {
+			err := &resize.Error{Kind: resize.KindTooLarge, Err: errors.New("image size exceeds limit")}
+			h.metrics.fail(err)
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		// one byte more so that sourceReader reports too large image
+		r.Body = http.MaxBytesReader(w, r.Body, limit+1)
+		src = r.Body
+		if multipart {
+			f, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer f.Close()
+			src = f
+		}
+	case r.Method == http.MethodGet && r.URL.Query().Get("url") != "":
+		body, err := fetchURL(r.Context(), h.client, r.URL.Query().Get("url"), nil)
+		if err != nil {
+			h.metrics.fail(err)
+			code := http.StatusBadGateway
+			if resize.KindOf(err) == resize.KindTooLarge {
+				code = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		defer body.Close()
+		src = body
+	default:
+		http.Error(w, "image should be uploaded or its url given as url parameter", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	src = &sourceReader{r: src, n: resize.MaxFileSize}
+	var key string
+	if h.cache != nil {
+		data, err := ioutil.ReadAll(src)
+		if err != nil {
+			h.metrics.fail(err)
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		sum := sha256.Sum256(data)
+		key = responseKey(sum[:], r.URL.Query())
+		if format, out, ok := h.cache.get(key); ok {
+			h.reply(w, r, format, out, key)
+			return
+		}
+		src = bytes.NewReader(data)
+	}
+	buf := new(bytes.Buffer)
+	res, err := h.proc.Process(ctx, src, buf, opts)
+	if err != nil {
+		h.metrics.fail(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	h.metrics.observe(res, buf.Len())
+	if h.cache != nil {
+		h.cache.put(key, res.Format, buf.Bytes())
+	}
+	h.reply(w, r, res.Format, buf.Bytes(), key)
+}
+
+// errorStatus returns HTTP status code of error reading or processing image
+func errorStatus(err error) int {
+	var se sourceError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case resize.KindOf(err) == resize.KindTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case resize.KindOf(err) == resize.KindInvalidOptions, errors.As(err, &se):
+		return http.StatusBadRequest
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// sourceReader reads image of at most n bytes, failing with KindTooLarge
+// error if it's larger. Other read errors are returned as sourceError, so
+// that they're told from processing ones.
+type sourceReader struct {
+	r io.Reader
+	n int64 // bytes left
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > s.n+1 {
+		p = p[:s.n+1]
+	}
+	n, err := s.r.Read(p)
+	if s.n -= int64(n); s.n < 0 {
+		return n, &resize.Error{Kind: resize.KindTooLarge, Err: errors.New("image size exceeds limit")}
+	}
+	if err != nil && err != io.EOF {
+		err = sourceError{err}
+	}
+	return n, err
+}
+
+// sourceError is an error reading image source
+type sourceError struct{ err error }
+
+func (e sourceError) Error() string { return e.err.Error() }
+func (e sourceError) Unwrap() error { return e.err }
+
+// reply writes image of given format to w. If key is not empty, it is used
+// as ETag, so that conditional requests are handled.
+func (h *resizeHandler) reply(w http.ResponseWriter, r *http.Request, format string, data []byte, key string) {
+	w.Header().Set("Content-Type", "image/"+format)
+	if h.cacheControl != "" {
+		w.Header().Set("Cache-Control", h.cacheControl)
+	}
+	if key == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+		return
+	}
+	w.Header().Set("ETag", `"`+key[:32]+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// queryOptions returns copy of opts with values overridden by query
+// parameters
+func queryOptions(opts resize.Options, q url.Values) (resize.Options, error) {
+	for _, p := range [...]struct {
+		name string
+		dst  *int
+	}{
+		{"w", &opts.Width},
+		{"h", &opts.Height},
+		{"maxw", &opts.MaxWidth},
+		{"maxh", &opts.MaxHeight},
+		{"q", &opts.JpegQuality},
+	} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid %s parameter value %q", p.name, v)
+		}
+		*p.dst = n
+	}
+	switch f := strings.ToLower(q.Get("fmt")); f {
+	case "":
+	case "jpg":
+		opts.Format = "jpeg"
+	default:
+		opts.Format = f
+	}
+	return opts, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responseCache keeps images produced by HTTP server in memory, evicting
+// least recently used ones once their total size exceeds the limit, and
+// optionally in a directory, evicting least recently used files there the
+// same way.
+type responseCache struct {
+	maxBytes int64 // limit of each cache size; no memory cache if not positive
+	dir      string
+
+	mu      sync.Mutex // guards memory cache
+	lru     *list.List // of *cachedResponse, most recently used first
+	entries map[string]*list.Element
+	size    int64
+
+	dirMu   sync.Mutex // guards files in dir, so that memory cache doesn't wait for disk
+	dirSize int64
+}
+
+type cachedResponse struct {
+	key    string
+	format string
+	data   []byte
+}
+
+// newResponseCache returns cache limited to maxBytes. If dir is not empty,
+// it is used to persist cached images, maxBytes must be positive then.
+func newResponseCache(maxBytes int64, dir string) (*responseCache, error) {
+	c := &responseCache{maxBytes: maxBytes, dir: dir, lru: list.New(), entries: make(map[string]*list.Element)}
+	if dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			c.dirSize += fi.Size()
+		}
+	}
+	c.dirMu.Lock()
+	defer c.dirMu.Unlock()
+	c.evictFiles()
+	return c, nil
+}
+
+// responseKey returns cache key of image produced from input with digest
+// sum according to query parameters q
+func responseKey(sum []byte, q url.Values) string {
+	h := sha256.New()
+	h.Write(sum)
+	for _, k := range [...]string{"w", "h", "maxw", "maxh", "q", "fmt"} {
+		io.WriteString(h, k+"="+q.Get(k)+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns cached image format and data
+func (c *responseCache) get(key string) (format string, data []byte, ok bool) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		e := el.Value.(*cachedResponse)
+		c.mu.Unlock()
+		return e.format, e.data, true
+	}
+	c.mu.Unlock()
+	if c.dir == "" {
+		return "", nil, false
+	}
+	names, _ := filepath.Glob(filepath.Join(c.dir, key+".*"))
+	if len(names) == 0 {
+		return "", nil, false
+	}
+	data, err := ioutil.ReadFile(names[0])
+	if err != nil {
+		return "", nil, false
+	}
+	now := time.Now()
+	os.Chtimes(names[0], now, now)
+	format = strings.TrimPrefix(filepath.Ext(names[0]), ".")
+	c.mu.Lock()
+	c.addMem(key, format, data)
+	c.mu.Unlock()
+	return format, data, true
+}
+
+// put saves image of given format under key
+func (c *responseCache) put(key, format string, data []byte) {
+	c.mu.Lock()
+	_, ok := c.entries[key]
+	if !ok {
+		c.addMem(key, format, data)
+	}
+	c.mu.Unlock()
+	if ok || c.dir == "" {
+		return
+	}
+	c.dirMu.Lock()
+	defer c.dirMu.Unlock()
+	name := filepath.Join(c.dir, key+"."+format)
+	if _, err := os.Stat(name); err == nil {
+		return // already counted in dirSize
+	}
+	if err := writeFile(name, data, false); err != nil {
+		return
+	}
+	c.dirSize += int64(len(data))
+	c.evictFiles()
+}
+
+// addMem adds image to memory cache unless it's there already, must be
+// called with c.mu held
+func (c *responseCache) addMem(key, format string, data []byte) {
+	if _, ok := c.entries[key]; ok || int64(len(data)) > c.maxBytes {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cachedResponse{key: key, format: format, data: data})
+	c.size += int64(len(data))
+	for c.size > c.maxBytes {
+		e := c.lru.Remove(c.lru.Back()).(*cachedResponse)
+		delete(c.entries, e.key)
+		c.size -= int64(len(e.data))
+	}
+}
+
+// evictFiles removes least recently used files from cache directory until
+// its size is within limit, must be called with c.dirMu held
+func (c *responseCache) evictFiles() {
+	if c.dirSize <= c.maxBytes {
+		return
+	}
+	fis, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].ModTime().Before(fis[j].ModTime()) })
+	for _, fi := range fis {
+		if c.dirSize <= c.maxBytes {
+			break
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if os.Remove(filepath.Join(c.dir, fi.Name())) == nil {
+			c.dirSize -= fi.Size()
+		}
+	}
+}
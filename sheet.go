@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/artyom/image-resize/resize"
+	"golang.org/x/image/draw"
+)
+
+// makeSheet composes contact sheet of images found in par.Sheet directory
+// (or matching par.Sheet glob pattern) and listed in par.frames, and saves
+// it to par.Output. Images are scaled to fit par.SheetThumb sized square
+// cells, placed in par.SheetCols columns separated by par.SheetPad pixels
+// and optionally labeled with their file names.
+func makeSheet(par params, opts resize.Options) error {
+	names, err := sheetFiles(par.Sheet)
+	if err != nil {
+		return err
+	}
+	names = append(names, par.frames...)
+	if len(names) == 0 {
+		return errors.New("no images for contact sheet")
+	}
+	thumb, cols, pad := par.SheetThumb, par.SheetCols, par.SheetPad
+	if thumb <= 0 || cols <= 0 || pad < 0 {
+		return errors.New("contact sheet thumbnail size and columns should be positive, padding cannot be negative")
+	}
+	if cols > len(names) {
+		cols = len(names)
+	}
+	rows := (len(names) + cols - 1) / cols
+	var labelHeight int
+	if par.SheetLabels {
+		if labelHeight = thumb / 8; labelHeight < 12 {
+			labelHeight = 12
+		}
+	}
+	cellHeight := thumb + labelHeight
+	width, height := cols*thumb+(cols+1)*pad, rows*cellHeight+(rows+1)*pad
+	if width*height > resize.PixelLimit || width >= 1<<16 || height >= 1<<16 {
+		return errors.New("contact sheet size exceeds limit")
+	}
+	thumbs, err := sheetThumbs(par, opts, names)
+	if err != nil {
+		return err
+	}
+	var bg color.Color = color.White
+	switch {
+	case opts.NoFill:
+		bg = color.Transparent
+	case opts.Background != nil:
+		bg = opts.Background
+	}
+	sheet := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	var textColor color.Color
+	if par.SheetLabels {
+		if textColor, err = parseColor(par.TextColor); err != nil {
+			return err
+		}
+	}
+	for i, img := range thumbs {
+		x := pad + i%cols*(thumb+pad)
+		y := pad + i/cols*(cellHeight+pad)
+		b := img.Bounds()
+		pt := image.Pt(x+(thumb-b.Dx())/2, y+(thumb-b.Dy())/2)
+		draw.Draw(sheet, b.Sub(b.Min).Add(pt), img, b.Min, draw.Over)
+		if !par.SheetLabels {
+			continue
+		}
+		label := filepath.Base(names[i])
+		size, err := textSize(label, thumb, 3*labelHeight)
+		if err != nil {
+			return err
+		}
+		cell := sheet.SubImage(image.Rect(x, y+thumb, x+thumb, y+cellHeight)).(*image.NRGBA)
+		center := image.Pt(x+thumb/2, y+thumb+labelHeight/2)
+		if err := drawText(cell, label, center, size, textColor); err != nil {
+			return err
+		}
+	}
+	return writeImage(par, opts, opts.Composite(sheet))
+}
+
+// sheetFiles returns sorted names of image files in dir, or names matching
+// glob pattern if dir is not a directory
+func sheetFiles(dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		names, err := filepath.Glob(dir)
+		sort.Strings(names)
+		return names, err
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && isImageFile(fi.Name()) {
+			names = append(names, filepath.Join(dir, fi.Name()))
+		}
+	}
+	return names, nil
+}
+
+// sheetThumbs scales named images to fit par.SheetThumb square with
+// par.Workers concurrent workers, returning them in the same order
+func sheetThumbs(par params, opts resize.Options, names []string) ([]image.Image, error) {
+	opts.Width, opts.Height = 0, 0
+	opts.MaxWidth, opts.MaxHeight = par.SheetThumb, par.SheetThumb
+	opts.Format, opts.PngColors, opts.MaxBytes = "png", 0, 0
+	opts.NoFill, opts.Strip, opts.KeepEXIF = true, true, false
+	opts.Overlay, opts.Watermark = nil, nil
+	workers := par.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	thumbs := make([]image.Image, len(names))
+	errs := make([]error, len(names))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				thumbs[i], errs[i] = sheetThumb(par, opts, names[i])
+			}
+		}()
+	}
+	for i := range names {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", names[i], err)
+		}
+	}
+	return thumbs, nil
+}
+
+func sheetThumb(par params, opts resize.Options, name string) (image.Image, error) {
+	ctx, cancel := par.context()
+	defer cancel()
+	f, err := par.openInput(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := new(bytes.Buffer)
+	if _, err := resize.ProcessContext(ctx, f, buf, opts); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(buf)
+	return img, err
+}
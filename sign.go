@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// signingKeyEnv is the environment variable with the secret key requests
+// to HTTP server must be signed with
+const signingKeyEnv = "IMAGE_RESIZE_KEY"
+
+// requestSignature returns signature of request to path with query q:
+// base64url-encoded HMAC-SHA256 of path followed by "?" and sorted query
+// parameters except sig
+func requestSignature(key []byte, path string, q url.Values) string {
+	q2 := make(url.Values, len(q))
+	for k, v := range q {
+		if k != "sig" {
+			q2[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path + "?" + q2.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validSignature reports whether sig parameter of q matches the signature
+// of request to path
+func validSignature(key []byte, path string, q url.Values) bool {
+	return hmac.Equal([]byte(q.Get("sig")), []byte(requestSignature(key, path, q)))
+}
+
+// printSigned prints s, which is path with optional query, with sig
+// parameter added, using key from signingKeyEnv
+func printSigned(s string) error {
+	key := os.Getenv(signingKeyEnv)
+	if key == "" {
+		return fmt.Errorf("%s environment variable is not set", signingKeyEnv)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("sig", requestSignature([]byte(key), u.EscapedPath(), q))
+	u.RawQuery = q.Encode()
+	fmt.Println(u)
+	return nil
+}
+
+// sizeList is a set of width×height pairs, zero meaning unset dimension
+type sizeList map[[2]int]bool
+
+// parseSizes parses comma separated list of sizes like "100x100,800x0"
+func parseSizes(s string) (sizeList, error) {
+	if s == "" {
+		return nil, nil
+	}
+	l := make(sizeList)
+	for _, f := range strings.Split(s, ",") {
+		i := strings.IndexByte(f, 'x')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid size %q, should be WxH", f)
+		}
+		w, err1 := strconv.Atoi(f[:i])
+		h, err2 := strconv.Atoi(f[i+1:])
+		if err1 != nil || err2 != nil || w < 0 || h < 0 {
+			return nil, fmt.Errorf("invalid size %q, should be WxH", f)
+		}
+		l[[2]int{w, h}] = true
+	}
+	return l, nil
+}
+
+// check returns an error if query q sets width and height or max. width and
+// max. height to a pair not in l
+func (l sizeList) check(q url.Values) error {
+	if l == nil {
+		return nil
+	}
+	for _, p := range [...][2]string{{"w", "h"}, {"maxw", "maxh"}} {
+		if q.Get(p[0]) == "" && q.Get(p[1]) == "" {
+			continue
+		}
+		w, _ := strconv.Atoi(q.Get(p[0]))
+		h, _ := strconv.Atoi(q.Get(p[1]))
+		if !l[[2]int{w, h}] {
+			return errors.New("requested dimensions are not allowed")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/artyom/image-resize/resize"
+)
+
+// skipFile reports whether processing of par.Input can be skipped because
+// its output is not older than it and par.NewerThan is set, or because it's
+// already within output bounds and par.SkipSmaller is set and no other
+// transformations are requested; in the latter case input is linked or
+// copied to par.Output instead.
+func skipFile(par params) (bool, error) {
+	if par.NewerThan {
+		in, err := os.Stat(par.Input)
+		if err != nil {
+			return false, err
+		}
+		if out, err := os.Stat(par.Output); err == nil && !out.ModTime().Before(in.ModTime()) {
+			return true, nil
+		}
+	}
+	if !par.SkipSmaller {
+		return false, nil
+	}
+	opts, err := par.options()
+	if err != nil {
+		return false, err
+	}
+	if !pureResize(opts) {
+		return false, nil
+	}
+	f, err := os.Open(par.Input)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := resize.Probe(f, opts)
+	if err != nil {
+		return false, err
+	}
+	w, h := info.OutputWidth, info.OutputHeight
+	if info.Format != opts.Format || !(w == info.Width && h == info.Height || w == info.Height && h == info.Width) {
+		return false, nil
+	}
+	return true, linkFile(par.Input, par.Output)
+}
+
+// pureResize reports whether opts only change image size and format, so
+// that input already of output size and format can be used as output;
+// default jpeg quality is not considered a change
+func pureResize(opts resize.Options) bool {
+	return !opts.Square && opts.Background == nil && opts.Rotate == 0 && opts.Flip == "" &&
+		(opts.JpegQuality == 0 || opts.JpegQuality == jpeg.DefaultQuality) && !opts.Progressive && opts.MaxBytes == 0 && opts.Subsample == "" &&
+		!opts.Optimize && !opts.Interlace && opts.GifColors == 0 && opts.PngColors == 0 &&
+		opts.PngCompression == "" && opts.TiffCompression == "" &&
+		opts.Loop == nil && opts.FPS == 0 && opts.DropFrames == 0 &&
+		opts.Sharpen == nil && opts.Overlay == nil && opts.Watermark == nil &&
+		!opts.Grayscale && opts.Sepia == 0 && opts.Brightness == 0 && opts.Contrast == 0 && opts.Saturation == 0 &&
+		!opts.GrayOutput && !opts.SRGB && !opts.Strip && !opts.StripGPS && opts.DPI == 0 &&
+		!opts.Hash && opts.Placeholder == "" && !opts.Metrics && !opts.Trim && len(opts.Ops) == 0 &&
+		opts.Frame == 0 && !opts.FirstFrame && !opts.UseEXIFThumb
+}
+
+// linkFile replaces dst with hard link to src, or with a copy of src if
+// linking is not possible
+func linkFile(src, dst string) error {
+	s, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if d, err := os.Stat(dst); err == nil && os.SameFile(s, d) {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".image-resize-")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	os.Remove(tmp.Name())
+	defer os.Remove(tmp.Name())
+	if err := os.Link(src, tmp.Name()); err == nil {
+		return os.Rename(tmp.Name(), dst)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out, err := os.OpenFile(tmp.Name(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, f); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/artyom/image-resize/resize"
+)
+
+// sliceImage resizes image read from r and cuts the result into a grid of
+// par.Slice columns and rows or into tiles of par.Tile size, saving them to
+// files named after par.Output with tile number appended, like
+// name-0001.png, row by row
+func sliceImage(ctx context.Context, r io.Reader, par params, opts resize.Options) error {
+	if par.Slice != "" && par.Tile != "" {
+		return errors.New("slice and tile cannot be used together")
+	}
+	if par.Output == "" || par.Output == stdio {
+		return errors.New("slice and tile require output file")
+	}
+	var cols, rows, tw, th int
+	var err error
+	if par.Slice != "" {
+		if cols, rows, err = parsePair(par.Slice); err != nil {
+			return fmt.Errorf("invalid slice value: %w", err)
+		}
+	} else if tw, th, err = parsePair(par.Tile); err != nil {
+		return fmt.Errorf("invalid tile value: %w", err)
+	}
+	img, err := processedImage(ctx, r, opts)
+	if err != nil {
+		return err
+	}
+	if opts.Format == "auto" {
+		opts.Format = resize.AutoFormat(img)
+	}
+	b := img.Bounds()
+	if par.Tile != "" {
+		cols, rows = (b.Dx()+tw-1)/tw, (b.Dy()+th-1)/th
+	} else if cols > b.Dx() || rows > b.Dy() {
+		return fmt.Errorf("%d×%d image cannot be sliced into %d×%d grid", b.Dx(), b.Dy(), cols, rows)
+	}
+	sub := img.(resize.SubImager)
+	ext := filepath.Ext(par.Output)
+	base := strings.TrimSuffix(par.Output, ext)
+	opts.Width, opts.Height, opts.MaxWidth, opts.MaxHeight = 0, 0, 0, 0
+	opts.MaxLong, opts.MaxShort = 0, 0
+	var n int
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var rect image.Rectangle
+			if par.Tile != "" {
+				rect = image.Rect(col*tw, row*th, (col+1)*tw, (row+1)*th).Add(b.Min).Intersect(b)
+			} else {
+				rect = image.Rect(col*b.Dx()/cols, row*b.Dy()/rows, (col+1)*b.Dx()/cols, (row+1)*b.Dy()/rows).Add(b.Min)
+			}
+			n++
+			p := par
+			p.Output = fmt.Sprintf("%s-%04d%s", base, n, ext)
+			if err := writeImage(p, opts, sub.SubImage(rect)); err != nil {
+				return fmt.Errorf("tile %d: %w", n, err)
+			}
+		}
+	}
+	return nil
+}
+
+// processedImage returns image read from r transformed according to opts,
+// with its transparency kept. The result implements resize.SubImager and is
+// never *image.YCbCr, as subsampled chroma of the latter cannot be scaled
+// down to the smallest pyramid levels.
+func processedImage(ctx context.Context, r io.Reader, opts resize.Options) (image.Image, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, resize.MaxFileSize))
+	if err != nil {
+		return nil, err
+	}
+	info, err := resize.Probe(bytes.NewReader(data), resize.Options{})
+	if err != nil {
+		return nil, err
+	}
+	if info.Width*info.Height > resize.PixelLimit {
+		return nil, fmt.Errorf("image dimensions %d×%d exceeds limit", info.Width, info.Height)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	opts.Format = ""
+	if img, err = resize.Image(resize.Orient(img, info.Orientation), opts); err != nil {
+		return nil, err
+	}
+	switch img.(type) {
+	case *image.YCbCr:
+	case resize.SubImager:
+		return img, nil
+	}
+	return resize.ToNRGBA(img), nil
+}
+
+// parsePair parses positive numbers pair like 4x3
+func parsePair(s string) (int, int, error) {
+	i := strings.IndexByte(s, 'x')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("%q should be NxM", s)
+	}
+	a, err1 := strconv.Atoi(s[:i])
+	b, err2 := strconv.Atoi(s[i+1:])
+	if err1 != nil || err2 != nil || a <= 0 || b <= 0 {
+		return 0, 0, fmt.Errorf("%q should be NxM with positive numbers", s)
+	}
+	return a, b, nil
+}
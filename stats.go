@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// runStats accumulates statistics over processed files
+type runStats struct {
+	mu    sync.Mutex
+	start time.Time
+
+	Processed   int   `json:"processed"`
+	Skipped     int   `json:"skipped"`
+	Failed      int   `json:"failed"`
+	InputBytes  int64 `json:"inputBytes"`
+	OutputBytes int64 `json:"outputBytes"`
+	// CompressionRatio is the ratio of input to output bytes over
+	// processed files
+	CompressionRatio float64 `json:"compressionRatio,omitempty"`
+	WallTime         float64 `json:"wallTimeSeconds"`
+	FilesPerSecond   float64 `json:"filesPerSecond"`
+	BytesPerSecond   float64 `json:"bytesPerSecond"`
+
+	// Duplicates is the number of inputs not processed in dedupe mode as
+	// they are identical to processed ones, LinkedOutputs is the number of
+	// outputs of different inputs replaced with hard links to identical
+	// ones, SavedBytes is the disk space saved by hard links
+	Duplicates    int   `json:"duplicates,omitempty"`
+	LinkedOutputs int   `json:"linkedOutputs,omitempty"`
+	SavedBytes    int64 `json:"savedBytes,omitempty"`
+}
+
+func newRunStats() *runStats { return &runStats{start: time.Now()} }
+
+// record registers outcome of processing file described by par; sizes of
+// outputs are taken from par.saved if set, as names of outputs may differ
+// from par.Output
+func (st *runStats) record(par params, skipped bool, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	switch {
+	case err != nil:
+		st.Failed++
+		return
+	case skipped:
+		st.Skipped++
+		return
+	}
+	st.Processed++
+	if fi, err := os.Stat(par.Input); err == nil && fi.Mode().IsRegular() {
+		st.InputBytes += fi.Size()
+	}
+	outputs := []string{par.Output}
+	if par.saved != nil {
+		outputs = *par.saved
+	}
+	for _, name := range outputs {
+		if fi, err := os.Stat(name); err == nil && fi.Mode().IsRegular() {
+			st.OutputBytes += fi.Size()
+		}
+	}
+}
+
+// recordDuplicate registers output of duplicate input saved as a copy of
+// another output, or a hard link to it, saving given number of bytes
+func (st *runStats) recordDuplicate(saved int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.Duplicates++
+	st.SavedBytes += saved
+}
+
+// recordLinked registers output replaced with hard link to identical one,
+// saving given number of bytes
+func (st *runStats) recordLinked(saved int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.LinkedOutputs++
+	st.SavedBytes += saved
+}
+
+// finish calculates summary values
+func (st *runStats) finish() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.WallTime = time.Since(st.start).Seconds()
+	if st.OutputBytes > 0 {
+		st.CompressionRatio = float64(st.InputBytes) / float64(st.OutputBytes)
+	}
+	if secs := st.WallTime; secs > 0 {
+		st.FilesPerSecond = float64(st.Processed) / secs
+		st.BytesPerSecond = float64(st.InputBytes) / secs
+	}
+}
+
+// report prints statistics to stderr and/or saves them as JSON according to
+// par settings
+func (st *runStats) report(par params) error {
+	if !par.Stats && par.Report == "" {
+		return nil
+	}
+	st.finish()
+	if par.Stats {
+		fmt.Fprintf(os.Stderr, "processed: %d, skipped: %d, failed: %d\n",
+			st.Processed, st.Skipped, st.Failed)
+		fmt.Fprintf(os.Stderr, "input: %d bytes, output: %d bytes, compression ratio: %.2f\n",
+			st.InputBytes, st.OutputBytes, st.CompressionRatio)
+		fmt.Fprintf(os.Stderr, "wall time: %.3fs, %.2f files/s, %.2f MB/s\n",
+			st.WallTime, st.FilesPerSecond, st.BytesPerSecond/(1<<20))
+	}
+	if par.Report == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(par.Report, append(b, '\n'), 0666)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"image"
+	"image/color"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// drawText draws single line of text with Go Regular font of given pixel
+// size on dst, placing text bounding box center at center point
+func drawText(dst draw.Image, text string, center image.Point, size float64, c color.Color) error {
+	f, err := sfnt.Parse(goregular.TTF)
+	if err != nil {
+		return err
+	}
+	var buf sfnt.Buffer
+	ppem := fixed.Int26_6(size * 64)
+	metrics, err := f.Metrics(&buf, ppem, font.HintingNone)
+	if err != nil {
+		return err
+	}
+	width, err := textWidth(f, &buf, text, ppem)
+	if err != nil {
+		return err
+	}
+	b := dst.Bounds()
+	originX := float32(center.X-b.Min.X) - float32(width)/128
+	originY := float32(center.Y-b.Min.Y) + float32(metrics.Ascent-metrics.Descent)/128
+	r := vector.NewRasterizer(b.Dx(), b.Dy())
+	var prev sfnt.GlyphIndex
+	for i, ch := range []rune(text) {
+		x, err := f.GlyphIndex(&buf, ch)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			if k, err := f.Kern(&buf, prev, x, ppem, font.HintingNone); err == nil {
+				originX += float32(k) / 64
+			}
+		}
+		segments, err := f.LoadGlyph(&buf, x, ppem, nil)
+		if err != nil {
+			return err
+		}
+		pt := func(p fixed.Point26_6) (float32, float32) {
+			return originX + float32(p.X)/64, originY + float32(p.Y)/64
+		}
+		for _, seg := range segments {
+			x0, y0 := pt(seg.Args[0])
+			switch seg.Op {
+			case sfnt.SegmentOpMoveTo:
+				r.MoveTo(x0, y0)
+			case sfnt.SegmentOpLineTo:
+				r.LineTo(x0, y0)
+			case sfnt.SegmentOpQuadTo:
+				x1, y1 := pt(seg.Args[1])
+				r.QuadTo(x0, y0, x1, y1)
+			case sfnt.SegmentOpCubeTo:
+				x1, y1 := pt(seg.Args[1])
+				x2, y2 := pt(seg.Args[2])
+				r.CubeTo(x0, y0, x1, y1, x2, y2)
+			}
+		}
+		adv, err := f.GlyphAdvance(&buf, x, ppem, font.HintingNone)
+		if err != nil {
+			return err
+		}
+		originX += float32(adv) / 64
+		prev = x
+	}
+	r.Draw(dst, b, image.NewUniform(c), image.Point{})
+	return nil
+}
+
+// textSize returns size of font to use so that text fits inside width×height
+// box with some margin
+func textSize(text string, width, height int) (float64, error) {
+	f, err := sfnt.Parse(goregular.TTF)
+	if err != nil {
+		return 0, err
+	}
+	var buf sfnt.Buffer
+	const refSize = 100
+	w, err := textWidth(f, &buf, text, fixed.I(refSize))
+	if err != nil {
+		return 0, err
+	}
+	size := float64(height) / 4
+	if w > 0 {
+		if s := float64(width) * 0.8 * refSize / (float64(w) / 64); s < size {
+			size = s
+		}
+	}
+	return size, nil
+}
+
+// textWidth returns width of rendered text in 26.6 fixed point format
+func textWidth(f *sfnt.Font, buf *sfnt.Buffer, text string, ppem fixed.Int26_6) (fixed.Int26_6, error) {
+	var width fixed.Int26_6
+	var prev sfnt.GlyphIndex
+	for i, ch := range []rune(text) {
+		x, err := f.GlyphIndex(buf, ch)
+		if err != nil {
+			return 0, err
+		}
+		if i > 0 {
+			if k, err := f.Kern(buf, prev, x, ppem, font.HintingNone); err == nil {
+				width += k
+			}
+		}
+		adv, err := f.GlyphAdvance(buf, x, ppem, font.HintingNone)
+		if err != nil {
+			return 0, err
+		}
+		width += adv
+		prev = x
+	}
+	return width, nil
+}
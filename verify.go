@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"os"
+
+	"github.com/artyom/image-resize/resize"
+)
+
+// verifyOutput re-decodes image file written to name and checks that it is
+// complete and matches expected format, dimensions and number of frames
+func verifyOutput(name string, want *resize.Result) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return verifyImage(name, f, want)
+}
+
+// verifyImage is like verifyOutput, but decodes image from r; name is only
+// used in error messages
+func verifyImage(name string, f io.Reader, want *resize.Result) error {
+	var img image.Image
+	var err error
+	var kind string
+	if want.Frames > 0 && want.Format == "gif" {
+		g, err := gif.DecodeAll(f)
+		if err != nil {
+			return fmt.Errorf("verification of %s failed: %v", name, err)
+		}
+		if len(g.Image) != want.Frames {
+			return fmt.Errorf("verification of %s failed: got %d frames, want %d",
+				name, len(g.Image), want.Frames)
+		}
+		img, kind = g.Image[0], "gif"
+	} else if img, kind, err = image.Decode(f); err != nil {
+		return fmt.Errorf("verification of %s failed: %v", name, err)
+	}
+	if kind != want.Format {
+		return fmt.Errorf("verification of %s failed: got %s format, want %s", name, kind, want.Format)
+	}
+	if got := img.Bounds().Size(); got.X != want.Width || got.Y != want.Height {
+		return fmt.Errorf("verification of %s failed: got %d×%d image, want %d×%d",
+			name, got.X, got.Y, want.Width, want.Height)
+	}
+	return nil
+}
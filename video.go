@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// videoFrame extracts a single frame of video file at given position
+// (ffmpeg time duration syntax, like "00:00:03" or "3.5") using ffmpeg and
+// returns it as png-encoded image. If position is empty, the first frame is
+// extracted. Cancelling ctx kills ffmpeg.
+func videoFrame(ctx context.Context, name, position string) ([]byte, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, errors.New("ffmpeg is required to process video files")
+	}
+	args := []string{"-nostdin", "-v", "error"}
+	if position != "" {
+		args = append(args, "-ss", position)
+	}
+	if !isURL(name) && !filepath.IsAbs(name) {
+		name = "./" + name // so that names starting with - are not options
+	}
+	args = append(args, "-i", name, "-frames:v", "1", "-f", "image2pipe", "-vcodec", "png", "-")
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("ffmpeg: %s", msg)
+		}
+		return nil, fmt.Errorf("ffmpeg: %v", err)
+	}
+	if stdout.Len() == 0 {
+		return nil, errors.New("ffmpeg: no frame extracted, position may be past the end of video")
+	}
+	return stdout.Bytes(), nil
+}
+
+// isVideo reports whether file name has one of the well-known video file
+// extensions
+func isVideo(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp4", ".m4v", ".mov", ".webm", ".mkv", ".avi", ".mpg", ".mpeg", ".3gp", ".ogv":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long a file should stay unchanged before it's
+// processed, so that files still being written are not picked up
+const watchDebounce = time.Second
+
+// watchDir monitors par.Watch tree and processes supported images created
+// or changed there like processDir does, with up to par.Workers of them
+// processed concurrently. It runs until watching fails. Errors are reported
+// per file and don't stop watching.
+func watchDir(par params, c *resultCache, st *runStats) error {
+	if par.Outdir == "" {
+		return errors.New("watch requires output directory")
+	}
+	if par.Input != "" || par.Output != "" || len(par.Outputs) > 0 || par.Indir != "" {
+		return errors.New("input and output files or indir cannot be used with watch")
+	}
+	if filepath.Clean(par.Outdir) == filepath.Clean(par.Watch) {
+		return errors.New("output directory should differ from watched one")
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	par.Indir = par.Watch
+	isOutdir := func(path string) bool { return filepath.Clean(path) == filepath.Clean(par.Outdir) }
+	timers := make(map[string]*time.Timer)
+	ready := make(chan string)
+	schedule := func(path string) {
+		if t, ok := timers[path]; ok {
+			t.Reset(watchDebounce)
+			return
+		}
+		timers[path] = time.AfterFunc(watchDebounce, func() { ready <- path })
+	}
+	// fsnotify doesn't watch subdirectories, so they're added one by one,
+	// including ones created later; files already in those are processed
+	addTree := func(root string, existing bool) error {
+		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if isOutdir(path) {
+					return filepath.SkipDir
+				}
+				return w.Add(path)
+			}
+			if existing && info.Mode().IsRegular() && isImageFile(path) {
+				schedule(path)
+			}
+			return nil
+		})
+	}
+	if err := addTree(par.Watch, false); err != nil {
+		return err
+	}
+	workers := par.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+			info, err := os.Stat(ev.Name)
+			if err != nil {
+				continue
+			}
+			switch {
+			case info.IsDir():
+				if ev.Op&fsnotify.Create != 0 {
+					if err := addTree(ev.Name, true); err != nil {
+						printError(ev.Name, err, par.JSONErrors)
+					}
+				}
+			case info.Mode().IsRegular() && isImageFile(ev.Name):
+				schedule(ev.Name)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		case path := <-ready:
+			delete(timers, path)
+			rel, err := filepath.Rel(par.Watch, path)
+			if err != nil {
+				printError(path, err, par.JSONErrors)
+				continue
+			}
+			sem <- struct{}{}
+			go func() {
+				defer func() { <-sem }()
+				if err := processDirFile(par, rel, c, st); err != nil {
+					printError(path, err, par.JSONErrors)
+				}
+			}()
+		}
+	}
+}